@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+)
+
+// AnalyzeOptions はanalyzeコマンドのオプションです
+type AnalyzeOptions struct {
+	ReportOptions
+	Format   string
+	Filter   *EntryFilter
+	Redactor *Redactor
+
+	// Output と RowGroupSize は Format が parquet の場合の出力先のディレクトリと行グループの行数です
+	Output       string
+	RowGroupSize int64
+}
+
+// LogOpener はログファイルを全てメモリに読み込まずに開けるクライアントです
+type LogOpener interface {
+	OpenSlowQueryLog(instance string, logFile string) (io.ReadCloser, error)
+}
+
+// ReadRecords はインスタンスのログを読み込み、エントリごとに fn を呼び出します
+// クライアントが LogOpener を実装している場合は、ログファイルを少しずつ読み込みます
+func ReadRecords(client AWSClientInterface, instances []string, fn func(Record) error) error {
+	for _, instance := range instances {
+		logList, err := GetSlowQueryList(client, instance)
+		if err != nil {
+			return err
+		}
+
+		for _, logFile := range logList {
+			r, err := openLog(client, instance, logFile)
+			if err != nil {
+				return err
+			}
+			if r == nil {
+				continue
+			}
+
+			err = scanRecords(r, Record{Instance: instance, Source: logFile}, fn)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// openLog はログファイルを読み込み用に開きます。ログがない場合はnilを返します
+func openLog(client AWSClientInterface, instance string, logFile string) (io.ReadCloser, error) {
+	if opener, ok := client.(LogOpener); ok {
+		return opener.OpenSlowQueryLog(instance, logFile)
+	}
+
+	data, err := client.DownloadSlowQueryLog(instance, logFile)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(*data)), nil
+}
+
+func scanRecords(r io.Reader, base Record, fn func(Record) error) error {
+	scanner := parser.NewScanner(r)
+	for scanner.Scan() {
+		record := base
+		record.Entry = scanner.Entry()
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", base.Source, err)
+	}
+	return nil
+}
+
+// Analyze はローカルのスロークエリログを集計してレポートを書き出します
+// Format が slowlog、jsonl、csv の場合は集計せずに、条件に合うエントリをその形式で書き出します
+func Analyze(w io.Writer, logger *slog.Logger, paths []string, opts AnalyzeOptions) error {
+	if opts.Format != "" && opts.Format != "text" && opts.Format != "json" && opts.Format != "html" && !isExportFormat(opts.Format) {
+		return fmt.Errorf("Unsupported format: %s. Use 'text', 'json', 'html', 'slowlog', 'jsonl', 'csv' or 'parquet'", opts.Format)
+	}
+
+	client, err := NewLocalClient(logger, strings.Join(paths, ","))
+	if err != nil {
+		return err
+	}
+
+	if isExportFormat(opts.Format) {
+		return exportRecords(w, client, opts)
+	}
+
+	digest := NewDigest()
+	var profile *LoadProfile
+	if opts.Format == "html" {
+		profile = NewLoadProfile()
+	}
+	err = ReadRecords(client, client.GetInstanceList(), func(r Record) error {
+		if opts.Filter.Match(r.Entry) {
+			r.Entry = opts.Redactor.Redact(r.Entry)
+			digest.Add(r)
+			profile.Add(r)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	opts.Filter.WarnErrors(logger)
+
+	switch opts.Format {
+	case "", "text":
+		return WriteTextReport(w, digest, opts.ReportOptions)
+	case "json":
+		return WriteJSONReport(w, digest, opts.ReportOptions)
+	case "html":
+		return WriteHTMLReport(w, digest, profile, opts.ReportOptions)
+	default:
+		return fmt.Errorf("Unsupported format: %s. Use 'text', 'json', 'html', 'slowlog', 'jsonl', 'csv' or 'parquet'", opts.Format)
+	}
+}
+
+// exportRecords はローカルのスロークエリログのエントリを集計せずに書き出します
+func exportRecords(w io.Writer, client LocalClient, opts AnalyzeOptions) error {
+	var rw RecordWriter
+	var err error
+	if opts.Format == "parquet" {
+		rw, err = NewParquetWriter(opts.Output, opts.RowGroupSize)
+	} else {
+		rw, err = NewRecordWriter(w, opts.Format, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = ReadRecords(client, client.GetInstanceList(), func(r Record) error {
+		if !opts.Filter.Match(r.Entry) {
+			return nil
+		}
+		r.Entry = opts.Redactor.Redact(r.Entry)
+		r.Provider = "local"
+		return rw.Write(r)
+	})
+	if err != nil {
+		return err
+	}
+	return rw.Flush()
+}
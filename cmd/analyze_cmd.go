@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// analyzeCmd はダウンロード済みのスロークエリログをフィンガープリントごとに集計するコマンドです
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze [flags] <path>...",
+	Short: "Summarize slow query logs by query fingerprint",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, _ := cmd.Flags().GetBool("debug")
+		logger := NewLogger("info")
+		if debug {
+			logger = NewLogger("debug")
+		}
+
+		top, _ := cmd.Flags().GetInt("top")
+		orderBy, _ := cmd.Flags().GetString("order-by")
+		format, _ := cmd.Flags().GetString("format")
+		output, _ := cmd.Flags().GetString("output")
+		rowGroupSize, _ := cmd.Flags().GetInt64("row-group-size")
+
+		filter, err := NewEntryFilter(mergeFilterOptions(FilterOptions{}, cmd.Flags()))
+		if err != nil {
+			return err
+		}
+
+		redactor, err := NewRedactor(mergeRedactOptions(RedactOptions{}, cmd.Flags()))
+		if err != nil {
+			return err
+		}
+
+		return Analyze(cmd.OutOrStdout(), logger, args, AnalyzeOptions{
+			ReportOptions: ReportOptions{Top: top, OrderBy: orderBy},
+			Format:        format,
+			Filter:        filter,
+			Redactor:      redactor,
+			Output:        output,
+			RowGroupSize:  rowGroupSize,
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(analyzeCmd)
+	analyzeCmd.Flags().BoolP("debug", "d", false, "debug mode")
+	analyzeCmd.Flags().Int("top", 20, "number of query fingerprints to report (0 for all)")
+	analyzeCmd.Flags().String("format", "text", "report format (text, json or html), or slowlog, jsonl, csv or parquet to export the entries")
+	analyzeCmd.Flags().StringP("output", "o", "", "output directory for --format parquet")
+	analyzeCmd.Flags().Int64("row-group-size", DefaultRowGroupSize, "rows per row group of parquet files")
+	analyzeCmd.Flags().String("order-by", "total", "rank fingerprints by total, count, avg, max, lock or rows")
+	addEntryFilterFlags(analyzeCmd.Flags())
+	addRedactFlags(analyzeCmd.Flags())
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	dir := t.TempDir()
+	if err := GenerateTestLogs(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err := Analyze(&buf, NewLogger("error"), []string{dir}, AnalyzeOptions{
+		ReportOptions: ReportOptions{Top: 3, OrderBy: "total"},
+	})
+	if err != nil {
+		t.Fatalf("Analyze() returned error: %v", err)
+	}
+
+	report := buf.String()
+	// 各クエリはAWSスタイル、GCPスタイル、インスタンスごとのファイルにそれぞれ1回ずつ書き込まれる
+	for _, want := range []string{
+		"# Overall: 24 queries, 8 unique",
+		"# Fingerprint: delete from logs where created_at < now() - interval ? day",
+		"# Count: 3 ",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Analyze() report does not contain %q:\n%s", want, report)
+		}
+	}
+
+	filter, err := NewEntryFilter(FilterOptions{DBs: []string{"finance"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := Analyze(&buf, NewLogger("error"), []string{dir}, AnalyzeOptions{Filter: filter}); err != nil {
+		t.Fatalf("Analyze() with filter returned error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "# Overall: 3 queries, 1 unique") {
+		t.Errorf("Analyze() with filter report:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := Analyze(&buf, NewLogger("error"), []string{dir}, AnalyzeOptions{Format: "html"}); err != nil {
+		t.Fatalf("Analyze() with html format returned error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "<div><b>24</b>queries</div>") || !strings.Contains(buf.String(), "<polyline") {
+		t.Errorf("Analyze() html report:\n%s", buf.String())
+	}
+
+	if err := Analyze(&buf, NewLogger("error"), []string{dir + "/*.txt"}, AnalyzeOptions{}); err == nil {
+		t.Error("Analyze() without log files should return error")
+	}
+}
@@ -0,0 +1,624 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API サーバーのデフォルト値です
+const (
+	defaultAPIConcurrency = 2
+	defaultAPIMaxQueued   = 100
+	defaultAPIJobTTL      = 24 * time.Hour
+)
+
+// ジョブの状態です
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// apiOutputTypes はジョブの出力形式ごとの Content-Type です
+// parquet はディレクトリに書き出すため、ジョブの出力形式には使えません
+var apiOutputTypes = map[string]string{
+	"slowlog": "text/plain; charset=utf-8",
+	"jsonl":   "application/x-ndjson",
+	"csv":     "text/csv; charset=utf-8",
+}
+
+// APIOptions は API サーバーの設定です
+type APIOptions struct {
+	// Token は Authorization: Bearer で受け付けるトークンです。空の場合は認証しません
+	Token string
+	// Concurrency は同時に実行するジョブの数です
+	Concurrency int
+	// MaxQueued は実行を待てるジョブの数です。超えた場合は新しいジョブを断ります
+	MaxQueued int
+	// DataDir はジョブの出力を書き出すディレクトリです
+	DataDir string
+	// JobTTL は終わったジョブと出力を残しておく時間です
+	JobTTL time.Duration
+}
+
+// APIJobRequest はダウンロードジョブの依頼です
+type APIJobRequest struct {
+	Target string `json:"target"`
+	// Instances はインスタンス名の前方一致です。省略した場合はターゲットのインスタンスです
+	Instances []string `json:"instances,omitempty"`
+	// Filter はログファイル名に含まれる文字列です。省略した場合はターゲットの filter です
+	Filter string `json:"filter,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+// APIJob はダウンロードジョブの状態です
+type APIJob struct {
+	ID         string     `json:"id"`
+	Target     string     `json:"target"`
+	Instances  []string   `json:"instances"`
+	Filter     string     `json:"filter,omitempty"`
+	Format     string     `json:"format"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	LogFiles   int        `json:"log_files"`
+	Entries    int64      `json:"entries"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	output  string
+	digest  *Digest
+	profile *LoadProfile
+}
+
+// finished はジョブが終わっているかどうかを返します
+func (j *APIJob) finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
+
+// APIServer は設定ファイルのターゲットのログをダウンロードする HTTP API です
+// 利用者はクラウドの認証情報を持たずに、サーバーの認証情報でダウンロードできます
+type APIServer struct {
+	logger  *slog.Logger
+	targets map[string]Target
+	opts    APIOptions
+	// newClient はターゲットのクライアントを生成します。テストでは偽のクライアントに差し替えます
+	newClient func(*slog.Logger, Target) (AWSClientInterface, error)
+
+	sem     chan struct{}
+	mu      sync.Mutex
+	jobs    map[string]*APIJob
+	pending int
+	wg      sync.WaitGroup
+}
+
+// NewAPIServer は API サーバーを生成します
+func NewAPIServer(logger *slog.Logger, targets map[string]Target, opts APIOptions) (*APIServer, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets to serve")
+	}
+	if opts.DataDir == "" {
+		return nil, fmt.Errorf("data directory is required")
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultAPIConcurrency
+	}
+	if opts.MaxQueued <= 0 {
+		opts.MaxQueued = defaultAPIMaxQueued
+	}
+	if opts.JobTTL <= 0 {
+		opts.JobTTL = defaultAPIJobTTL
+	}
+
+	return &APIServer{
+		logger:    logger,
+		targets:   targets,
+		opts:      opts,
+		newClient: NewClient,
+		sem:       make(chan struct{}, opts.Concurrency),
+		jobs:      map[string]*APIJob{},
+	}, nil
+}
+
+// Handler は API のハンドラーを返します
+func (s *APIServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/targets", s.handleTargets)
+	mux.HandleFunc("GET /api/v1/targets/{target}/instances", s.handleInstances)
+	mux.HandleFunc("GET /api/v1/targets/{target}/instances/{instance}/logs", s.handleLogs)
+	mux.HandleFunc("GET /api/v1/jobs", s.handleJobs)
+	mux.HandleFunc("POST /api/v1/jobs", s.handleCreateJob)
+	mux.HandleFunc("GET /api/v1/jobs/{id}", s.handleJob)
+	mux.HandleFunc("GET /api/v1/jobs/{id}/output", s.handleOutput)
+	mux.HandleFunc("GET /api/v1/jobs/{id}/report", s.handleReport)
+	return s.authenticate(mux)
+}
+
+// authenticate は Authorization: Bearer のトークンを確認します
+func (s *APIServer) authenticate(next http.Handler) http.Handler {
+	if s.opts.Token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mysql-slowquery-downloder"`)
+			writeAPIError(w, http.StatusUnauthorized, fmt.Errorf("invalid or missing token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeAPIJSON は値をJSONで返します
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// writeAPIError はエラーを {"error": "..."} で返します
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// target はパスのターゲットを返します。見つからない場合は404を返します
+func (s *APIServer) target(w http.ResponseWriter, name string) (Target, bool) {
+	target, ok := s.targets[name]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("target %q not found", name))
+	}
+	return target, ok
+}
+
+// client はターゲットのクライアントを生成します。失敗した場合は502を返します
+func (s *APIServer) client(w http.ResponseWriter, target Target) (AWSClientInterface, bool) {
+	client, err := s.newClient(s.logger, target)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err)
+		return nil, false
+	}
+	return client, true
+}
+
+func (s *APIServer) handleTargets(w http.ResponseWriter, r *http.Request) {
+	type apiTarget struct {
+		Name     string `json:"name"`
+		Provider string `json:"provider"`
+	}
+	targets := []apiTarget{}
+	for name, t := range s.targets {
+		targets = append(targets, apiTarget{Name: name, Provider: t.Provider})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	writeAPIJSON(w, http.StatusOK, map[string]any{"targets": targets})
+}
+
+func (s *APIServer) handleInstances(w http.ResponseWriter, r *http.Request) {
+	target, ok := s.target(w, r.PathValue("target"))
+	if !ok {
+		return
+	}
+	client, ok := s.client(w, target)
+	if !ok {
+		return
+	}
+	defer closeClient(client)
+
+	instances, err := selectInstances(client, target.Instances)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err)
+		return
+	}
+	if instances == nil {
+		instances = []string{}
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]any{"instances": instances})
+}
+
+func (s *APIServer) handleLogs(w http.ResponseWriter, r *http.Request) {
+	target, ok := s.target(w, r.PathValue("target"))
+	if !ok {
+		return
+	}
+	client, ok := s.client(w, target)
+	if !ok {
+		return
+	}
+	defer closeClient(client)
+
+	instance := r.PathValue("instance")
+	if !s.allowedInstance(client, target, instance) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("instance %q not found in target %q", instance, target.Name))
+		return
+	}
+
+	logs, err := GetSlowQueryList(client, instance)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err)
+		return
+	}
+	if logs == nil {
+		logs = []string{}
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]any{"instance": instance, "logs": logs})
+}
+
+// allowedInstance はインスタンスがターゲットの対象かどうかを返します
+func (s *APIServer) allowedInstance(client AWSClientInterface, target Target, instance string) bool {
+	instances, err := selectInstances(client, target.Instances)
+	return err == nil && contains(instances, instance)
+}
+
+func (s *APIServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	jobs := []APIJob{}
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+	writeAPIJSON(w, http.StatusOK, map[string]any{"jobs": jobs})
+}
+
+func (s *APIServer) handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	var req APIJobRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	target, ok := s.target(w, req.Target)
+	if !ok {
+		return
+	}
+	if req.Format == "" {
+		req.Format = "slowlog"
+	}
+	if _, ok := apiOutputTypes[req.Format]; !ok {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("Unsupported format: %s. Use 'slowlog', 'jsonl' or 'csv'", req.Format))
+		return
+	}
+	if req.Filter == "" {
+		req.Filter = target.Filter
+	}
+
+	job, err := s.enqueue(target, req)
+	if err != nil {
+		writeAPIError(w, http.StatusTooManyRequests, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	writeAPIJSON(w, http.StatusAccepted, job)
+}
+
+// job はパスのジョブの写しを返します。見つからない場合は404を返します
+func (s *APIServer) job(w http.ResponseWriter, id string) (APIJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("job %q not found", id))
+		return APIJob{}, false
+	}
+	return *job, true
+}
+
+// succeededJob は成功したジョブを返します。終わっていない場合や失敗した場合は409を返します
+func (s *APIServer) succeededJob(w http.ResponseWriter, id string) (APIJob, bool) {
+	job, ok := s.job(w, id)
+	if !ok {
+		return job, false
+	}
+	if job.Status != JobSucceeded {
+		writeAPIError(w, http.StatusConflict, fmt.Errorf("job %s is %s", job.ID, job.Status))
+		return job, false
+	}
+	return job, true
+}
+
+func (s *APIServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	if job, ok := s.job(w, r.PathValue("id")); ok {
+		writeAPIJSON(w, http.StatusOK, job)
+	}
+}
+
+func (s *APIServer) handleOutput(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.succeededJob(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	file, err := os.Open(job.output)
+	if errors.Is(err, os.ErrNotExist) {
+		// 条件に合うエントリがない場合は出力ファイルが作られない
+		w.Header().Set("Content-Type", apiOutputTypes[job.Format])
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", apiOutputTypes[job.Format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filepath.Base(job.output)))
+	http.ServeContent(w, r, filepath.Base(job.output), time.Time{}, file)
+}
+
+func (s *APIServer) handleReport(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.succeededJob(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	opts := ReportOptions{OrderBy: r.URL.Query().Get("order_by")}
+	if opts.OrderBy == "" {
+		opts.OrderBy = "total"
+	}
+	if top := r.URL.Query().Get("top"); top != "" {
+		n, err := strconv.Atoi(top)
+		if err != nil || n < 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid top: %s", top))
+			return
+		}
+		opts.Top = n
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		WriteJSONReport(w, job.digest, opts)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		WriteHTMLReport(w, job.digest, job.profile, opts)
+	default:
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("Unsupported format: %s. Use 'json' or 'html'", format))
+	}
+}
+
+// newJobID はジョブのIDを生成します
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// enqueue はジョブを登録し、空きができたら実行します
+func (s *APIServer) enqueue(target Target, req APIJobRequest) (*APIJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(time.Now())
+	if s.pending >= s.opts.MaxQueued {
+		return nil, fmt.Errorf("too many jobs are waiting (%d); retry later", s.pending)
+	}
+
+	id := newJobID()
+	job := &APIJob{
+		ID:        id,
+		Target:    target.Name,
+		Instances: req.Instances,
+		Filter:    req.Filter,
+		Format:    req.Format,
+		Status:    JobQueued,
+		CreatedAt: time.Now().UTC(),
+		output:    filepath.Join(s.opts.DataDir, id, "output."+strings.TrimPrefix(req.Format, "slow")),
+	}
+	if job.Instances == nil {
+		job.Instances = []string{}
+	}
+	s.jobs[id] = job
+	s.pending++
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.sem <- struct{}{}
+		defer func() { <-s.sem }()
+		s.run(job, target)
+	}()
+
+	snapshot := *job
+	return &snapshot, nil
+}
+
+// expire は JobTTL より前に終わったジョブと出力を削除します。s.mu を持った状態で呼び出します
+func (s *APIServer) expire(now time.Time) {
+	for id, job := range s.jobs {
+		if job.finished() && now.Sub(*job.FinishedAt) > s.opts.JobTTL {
+			os.RemoveAll(filepath.Dir(job.output))
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// expireJobs は ctx が終わるまで JobTTL の10分の1ごとに終わったジョブと出力を削除します
+// ジョブが登録されない間も JobTTL を過ぎたジョブを残さないように使います
+func (s *APIServer) expireJobs(ctx context.Context) {
+	ticker := time.NewTicker(max(s.opts.JobTTL/10, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			s.expire(now)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// update はジョブの状態を s.mu を持った状態で更新します
+func (s *APIServer) update(job *APIJob, fn func(*APIJob)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(job)
+}
+
+// run はジョブのログをダウンロードし、出力ファイルと集計結果を作ります
+func (s *APIServer) run(job *APIJob, target Target) {
+	started := time.Now().UTC()
+	s.update(job, func(j *APIJob) {
+		j.Status = JobRunning
+		j.StartedAt = &started
+		s.pending--
+	})
+	s.logger.Info("Job started", "job", job.ID, "target", job.Target)
+
+	digest, profile, logFiles, err := s.download(job, target)
+
+	finished := time.Now().UTC()
+	s.update(job, func(j *APIJob) {
+		j.FinishedAt = &finished
+		j.LogFiles = logFiles
+		if err != nil {
+			j.Status = JobFailed
+			j.Error = err.Error()
+			return
+		}
+		j.Status = JobSucceeded
+		j.Entries = digest.QueryTime.Count
+		j.digest = digest
+		j.profile = profile
+	})
+	if err != nil {
+		s.logger.Error("Job failed", "job", job.ID, "error", err)
+		return
+	}
+	s.logger.Info("Job succeeded", "job", job.ID, "entries", digest.QueryTime.Count)
+}
+
+// download はジョブのインスタンスのログを出力ファイルに書き出しながら集計します
+func (s *APIServer) download(job *APIJob, target Target) (*Digest, *LoadProfile, int, error) {
+	entryFilter, err := NewEntryFilter(target.Entries)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	redactor, err := NewRedactor(target.Redact)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	client, err := s.newClient(s.logger, target)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer closeClient(client)
+
+	// 依頼されたインスタンスもターゲットのインスタンスの中から選ぶ
+	instances, err := selectInstances(client, target.Instances)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if len(job.Instances) > 0 {
+		var selected []string
+		for _, prefix := range job.Instances {
+			instance := FilterInstance(staticInstances(instances), prefix)
+			if instance == "" {
+				return nil, nil, 0, fmt.Errorf("No matching instance found: %s", prefix)
+			}
+			selected = append(selected, instance)
+		}
+		instances = selected
+	}
+
+	digest := NewDigest()
+	profile := NewLoadProfile()
+	logFiles := 0
+	headers := map[string]bool{}
+	for _, instance := range instances {
+		logList, err := GetSlowQueryList(client, instance)
+		if err != nil {
+			return nil, nil, logFiles, err
+		}
+		for _, log := range logList {
+			if job.Filter == "" || strings.Contains(log, job.Filter) {
+				logFiles++
+			}
+		}
+
+		err = DownloadSlowQueryLog(client, instance, logList, DownloadOptions{
+			Target:      target.Name,
+			Provider:    target.Provider,
+			Filter:      job.Filter,
+			Output:      job.output,
+			Format:      job.Format,
+			EntryFilter: entryFilter,
+			Redactor:    redactor,
+			Collect: func(r Record) error {
+				digest.Add(r)
+				profile.Add(r)
+				return nil
+			},
+			headers: headers,
+		})
+		if err != nil {
+			return nil, nil, logFiles, err
+		}
+	}
+	entryFilter.WarnErrors(s.logger, "job", job.ID)
+	return digest, profile, logFiles, nil
+}
+
+// staticInstances はインスタンスの一覧だけを返すクライアントです。FilterInstance で一覧から選ぶために使います
+type staticInstances []string
+
+func (s staticInstances) GetInstanceList() []string { return s }
+
+func (s staticInstances) GetSlowQueryList(string) ([]string, error) { return nil, nil }
+
+func (s staticInstances) DownloadSlowQueryLog(string, string) (*string, error) { return nil, nil }
+
+// Wait は実行中と待機中のジョブが終わるまで待ちます
+func (s *APIServer) Wait() {
+	s.wg.Wait()
+}
+
+// ListenAndServe は ctx が終わるまで API を公開します
+func (s *APIServer) ListenAndServe(ctx context.Context, addr string) error {
+	server := &http.Server{Addr: addr, Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.expireJobs(ctx)
+
+	errCh := make(chan error, 1)
+	go func() {
+		s.logger.Info("Serving API", "addr", addr, "targets", len(s.targets), "concurrency", s.opts.Concurrency)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdown)
+	}
+}
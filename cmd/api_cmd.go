@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// apiTokenEnv は --token を省略したときにトークンを読む環境変数です
+const apiTokenEnv = "SLOWQUERY_API_TOKEN"
+
+// apiCmd は設定ファイルのターゲットのログをHTTPでダウンロードできるようにするコマンドです
+var apiCmd = &cobra.Command{
+	Use:   "api",
+	Short: "Serve an HTTP API for downloads and reports of the targets",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, _ := cmd.Flags().GetBool("debug")
+		logger := NewLogger("info")
+		if debug {
+			logger = NewLogger("debug")
+		}
+
+		addr, _ := cmd.Flags().GetString("addr")
+		token, _ := cmd.Flags().GetString("token")
+		noAuth, _ := cmd.Flags().GetBool("no-auth")
+		concurrency, _ := cmd.Flags().GetInt("concurrency")
+		maxQueued, _ := cmd.Flags().GetInt("max-queued")
+		dataDir, _ := cmd.Flags().GetString("data-dir")
+		jobTTL, _ := cmd.Flags().GetDuration("job-ttl")
+
+		if token == "" {
+			token = os.Getenv(apiTokenEnv)
+		}
+		if token == "" && !noAuth {
+			return fmt.Errorf("API token is required. Set --token or %s, or use --no-auth", apiTokenEnv)
+		}
+		if noAuth {
+			token = ""
+		}
+
+		targets, err := resolveTargets(cmd)
+		if err != nil {
+			return err
+		}
+
+		if dataDir == "" {
+			dataDir, err = os.MkdirTemp("", "mysql-slowquery-downloder-api-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dataDir)
+		}
+
+		server, err := NewAPIServer(logger, targets, APIOptions{
+			Token:       token,
+			Concurrency: concurrency,
+			MaxQueued:   maxQueued,
+			DataDir:     dataDir,
+			JobTTL:      jobTTL,
+		})
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return server.ListenAndServe(ctx, addr)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(apiCmd)
+	addTargetFlags(apiCmd.Flags())
+	apiCmd.Flags().String("addr", ":8080", "address to serve the API on")
+	apiCmd.Flags().String("token", "", "bearer token required by the API (default $"+apiTokenEnv+")")
+	apiCmd.Flags().Bool("no-auth", false, "serve the API without a token")
+	apiCmd.Flags().Int("concurrency", defaultAPIConcurrency, "download jobs to run at the same time")
+	apiCmd.Flags().Int("max-queued", defaultAPIMaxQueued, "download jobs allowed to wait before new ones are rejected")
+	apiCmd.Flags().String("data-dir", "", "directory to keep the job outputs in (default a temporary directory removed at exit)")
+	apiCmd.Flags().Duration("job-ttl", defaultAPIJobTTL, "how long finished jobs and their outputs are kept")
+}
@@ -0,0 +1,349 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAPIToken = "test-token"
+
+// blockingClientMock はダウンロードを release が閉じられるまで止めるクライアントのモック実装
+type blockingClientMock struct {
+	release chan struct{}
+}
+
+func (m blockingClientMock) GetInstanceList() []string {
+	return []string{"db-1"}
+}
+
+func (m blockingClientMock) GetSlowQueryList(instance string) ([]string, error) {
+	return []string{"slow.log"}, nil
+}
+
+func (m blockingClientMock) DownloadSlowQueryLog(instance string, logFile string) (*string, error) {
+	<-m.release
+	data := slowLogEntry(0, "SELECT 1", 1)
+	return &data, nil
+}
+
+// newTestAPIServer はテスト用のログを local ターゲットとして公開するサーバーを生成します
+func newTestAPIServer(t *testing.T, opts APIOptions) (*APIServer, *httptest.Server) {
+	t.Helper()
+
+	logs := t.TempDir()
+	if err := GenerateTestLogs(logs); err != nil {
+		t.Fatal(err)
+	}
+	if opts.DataDir == "" {
+		opts.DataDir = t.TempDir()
+	}
+	if opts.Token == "" {
+		opts.Token = testAPIToken
+	}
+
+	targets := map[string]Target{
+		"local":  {Name: "local", Provider: "local", Path: logs, Instances: []string{"mysql-instance"}},
+		"all":    {Name: "all", Provider: "local", Path: logs, Redact: RedactOptions{Literals: true}},
+		"broken": {Name: "broken", Provider: "broken"},
+	}
+	s, err := NewAPIServer(NewLogger("error"), targets, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.newClient = func(logger *slog.Logger, target Target) (AWSClientInterface, error) {
+		if target.Provider == "broken" {
+			return nil, errors.New("no credentials")
+		}
+		return NewClient(logger, target)
+	}
+
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		s.Wait()
+	})
+	return s, srv
+}
+
+// apiRequest は API を呼び出し、ステータスコードと本文を返します
+func apiRequest(t *testing.T, srv *httptest.Server, method, path, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAPIToken)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+// createTestJob はジョブを作り、終わるまで待ってから状態を返します
+func createTestJob(t *testing.T, s *APIServer, srv *httptest.Server, body string) APIJob {
+	t.Helper()
+
+	status, resp := apiRequest(t, srv, http.MethodPost, "/api/v1/jobs", body)
+	if status != http.StatusAccepted {
+		t.Fatalf("POST /api/v1/jobs = %d %s, want 202", status, resp)
+	}
+	var job APIJob
+	if err := json.Unmarshal([]byte(resp), &job); err != nil {
+		t.Fatal(err)
+	}
+	s.Wait()
+
+	status, resp = apiRequest(t, srv, http.MethodGet, "/api/v1/jobs/"+job.ID, "")
+	if status != http.StatusOK {
+		t.Fatalf("GET /api/v1/jobs/%s = %d %s", job.ID, status, resp)
+	}
+	if err := json.Unmarshal([]byte(resp), &job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestAPIServerAuth(t *testing.T) {
+	_, srv := newTestAPIServer(t, APIOptions{})
+
+	testCases := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{name: "トークンなし", want: http.StatusUnauthorized},
+		{name: "不正なトークン", header: "Bearer wrong", want: http.StatusUnauthorized},
+		{name: "Bearer でない", header: testAPIToken, want: http.StatusUnauthorized},
+		{name: "正しいトークン", header: "Bearer " + testAPIToken, want: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/targets", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.want)
+			}
+		})
+	}
+}
+
+func TestAPIServerListing(t *testing.T) {
+	_, srv := newTestAPIServer(t, APIOptions{})
+
+	testCases := []struct {
+		name       string
+		path       string
+		wantStatus int
+		want       string
+	}{
+		{name: "ターゲット一覧", path: "/api/v1/targets", wantStatus: http.StatusOK, want: `"name": "local"`},
+		{name: "インスタンス一覧", path: "/api/v1/targets/local/instances", wantStatus: http.StatusOK, want: `"instances": [
+    "mysql-instance-1"
+  ]`},
+		{name: "ログファイル一覧", path: "/api/v1/targets/all/instances/gcp-mysql-prod/logs", wantStatus: http.StatusOK, want: "slowquery.gcp-mysql-prod.log"},
+		{name: "ターゲットにないインスタンス", path: "/api/v1/targets/local/instances/gcp-mysql-prod/logs", wantStatus: http.StatusNotFound},
+		{name: "存在しないターゲット", path: "/api/v1/targets/unknown/instances", wantStatus: http.StatusNotFound},
+		{name: "クライアントの生成に失敗", path: "/api/v1/targets/broken/instances", wantStatus: http.StatusBadGateway, want: "no credentials"},
+		{name: "存在しないジョブ", path: "/api/v1/jobs/unknown", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			status, body := apiRequest(t, srv, http.MethodGet, tc.path, "")
+			if status != tc.wantStatus {
+				t.Errorf("GET %s = %d, want %d\n%s", tc.path, status, tc.wantStatus, body)
+			}
+			if !strings.Contains(body, tc.want) {
+				t.Errorf("GET %s does not contain %q:\n%s", tc.path, tc.want, body)
+			}
+		})
+	}
+}
+
+func TestAPIServerJob(t *testing.T) {
+	s, srv := newTestAPIServer(t, APIOptions{})
+
+	job := createTestJob(t, s, srv, `{"target": "all", "instances": ["gcp-mysql"], "format": "jsonl"}`)
+	if job.Status != JobSucceeded || job.Instances[0] != "gcp-mysql" || job.LogFiles != 1 || job.Entries == 0 {
+		t.Fatalf("job = %+v", job)
+	}
+
+	status, body := apiRequest(t, srv, http.MethodGet, "/api/v1/jobs/"+job.ID+"/output", "")
+	if status != http.StatusOK {
+		t.Fatalf("GET output = %d %s", status, body)
+	}
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if int64(len(lines)) != job.Entries {
+		t.Errorf("output has %d lines, want %d", len(lines), job.Entries)
+	}
+	// ターゲットの redact が出力にも適用される
+	if strings.Contains(body, "2023-01-01") {
+		t.Errorf("output contains a literal:\n%s", body)
+	}
+
+	status, body = apiRequest(t, srv, http.MethodGet, "/api/v1/jobs/"+job.ID+"/report?top=1", "")
+	var report JSONReport
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &report) != nil {
+		t.Fatalf("GET report = %d %s", status, body)
+	}
+	if report.Overall.Queries != job.Entries || len(report.Classes) != 1 {
+		t.Errorf("report = %d queries, %d classes, want %d queries, 1 class", report.Overall.Queries, len(report.Classes), job.Entries)
+	}
+
+	status, body = apiRequest(t, srv, http.MethodGet, "/api/v1/jobs/"+job.ID+"/report?format=html", "")
+	if status != http.StatusOK || !strings.Contains(body, "<html") {
+		t.Errorf("GET report?format=html = %d", status)
+	}
+
+	status, body = apiRequest(t, srv, http.MethodGet, "/api/v1/jobs", "")
+	if status != http.StatusOK || !strings.Contains(body, job.ID) {
+		t.Errorf("GET /api/v1/jobs = %d %s", status, body)
+	}
+}
+
+func TestAPIServerJobErrors(t *testing.T) {
+	s, srv := newTestAPIServer(t, APIOptions{})
+
+	testCases := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "不正なJSON", body: `{"target": `, want: http.StatusBadRequest},
+		{name: "未知のキー", body: `{"target": "local", "output": "/etc/passwd"}`, want: http.StatusBadRequest},
+		{name: "存在しないターゲット", body: `{"target": "unknown"}`, want: http.StatusNotFound},
+		{name: "parquet", body: `{"target": "local", "format": "parquet"}`, want: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if status, body := apiRequest(t, srv, http.MethodPost, "/api/v1/jobs", tc.body); status != tc.want {
+				t.Errorf("POST /api/v1/jobs = %d, want %d\n%s", status, tc.want, body)
+			}
+		})
+	}
+
+	// ターゲットの外のインスタンスは選べない
+	job := createTestJob(t, s, srv, `{"target": "local", "instances": ["gcp-mysql-prod"]}`)
+	if job.Status != JobFailed || !strings.Contains(job.Error, "gcp-mysql-prod") {
+		t.Errorf("job = %+v, want failed", job)
+	}
+	if status, _ := apiRequest(t, srv, http.MethodGet, "/api/v1/jobs/"+job.ID+"/output", ""); status != http.StatusConflict {
+		t.Errorf("GET output of failed job = %d, want 409", status)
+	}
+
+	job = createTestJob(t, s, srv, `{"target": "broken"}`)
+	if job.Status != JobFailed || job.Error != "no credentials" {
+		t.Errorf("job = %+v, want failed", job)
+	}
+}
+
+func TestAPIServerConcurrency(t *testing.T) {
+	s, srv := newTestAPIServer(t, APIOptions{Concurrency: 1, MaxQueued: 1})
+	mock := blockingClientMock{release: make(chan struct{})}
+	s.newClient = func(*slog.Logger, Target) (AWSClientInterface, error) { return mock, nil }
+
+	waitStatus := func(id, want string) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			_, body := apiRequest(t, srv, http.MethodGet, "/api/v1/jobs/"+id, "")
+			if strings.Contains(body, `"status": "`+want+`"`) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("job %s did not become %s", id, want)
+	}
+
+	var ids []string
+	for i, want := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests} {
+		status, body := apiRequest(t, srv, http.MethodPost, "/api/v1/jobs", `{"target": "all"}`)
+		if status != want {
+			t.Fatalf("job %d: POST /api/v1/jobs = %d, want %d\n%s", i+1, status, want, body)
+		}
+		var job APIJob
+		json.Unmarshal([]byte(body), &job)
+		ids = append(ids, job.ID)
+		if i == 0 {
+			// 1つ目が実行中になってから次のジョブを登録する
+			waitStatus(job.ID, JobRunning)
+		}
+	}
+	waitStatus(ids[1], JobQueued)
+
+	close(mock.release)
+	s.Wait()
+	waitStatus(ids[0], JobSucceeded)
+	waitStatus(ids[1], JobSucceeded)
+}
+
+func TestAPIServerExpire(t *testing.T) {
+	s, srv := newTestAPIServer(t, APIOptions{JobTTL: time.Hour})
+	job := createTestJob(t, s, srv, `{"target": "local"}`)
+
+	dir := s.opts.DataDir + "/" + job.ID
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("job output directory: %v", err)
+	}
+
+	s.mu.Lock()
+	s.expire(time.Now().Add(2 * time.Hour))
+	s.mu.Unlock()
+
+	if status, _ := apiRequest(t, srv, http.MethodGet, "/api/v1/jobs/"+job.ID, ""); status != http.StatusNotFound {
+		t.Errorf("GET expired job = %d, want 404", status)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("job output directory was not removed: %v", err)
+	}
+
+	// 新しいジョブが登録されなくても、JobTTL を過ぎたジョブは削除する
+	job = createTestJob(t, s, srv, `{"target": "local"}`)
+	dir = s.opts.DataDir + "/" + job.ID
+	s.opts.JobTTL = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.expireJobs(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, _ := apiRequest(t, srv, http.MethodGet, "/api/v1/jobs/"+job.ID, "")
+		if _, err := os.Stat(dir); status == http.StatusNotFound && os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job was not expired without a new job")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewAPIServer(t *testing.T) {
+	if _, err := NewAPIServer(NewLogger("error"), nil, APIOptions{DataDir: t.TempDir()}); err == nil {
+		t.Error("NewAPIServer() without targets should return error")
+	}
+	if _, err := NewAPIServer(NewLogger("error"), map[string]Target{"a": {}}, APIOptions{}); err == nil {
+		t.Error("NewAPIServer() without data directory should return error")
+	}
+}
@@ -3,9 +3,12 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -16,6 +19,7 @@ type AWSClient struct {
 	cfg       aws.Config
 	rdsClient *rds.Client
 	logger    *slog.Logger
+	logType   string
 }
 
 type AWSClientInterface interface {
@@ -24,8 +28,19 @@ type AWSClientInterface interface {
 	DownloadSlowQueryLog(instance string, logFile string) (*string, error)
 }
 
-func NewAWSClient(logger *slog.Logger) (AWSClient, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+func NewAWSClient(logger *slog.Logger, profile, region, logType string) (AWSClient, error) {
+	var opts []func(*config.LoadOptions) error
+	if profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	if logType == "" {
+		logType = "slowquery"
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
 	if err != nil {
 		logger.Error(err.Error())
 		return AWSClient{}, err
@@ -37,6 +52,7 @@ func NewAWSClient(logger *slog.Logger) (AWSClient, error) {
 		cfg:       cfg,
 		logger:    logger,
 		rdsClient: rdsClient,
+		logType:   logType,
 	}, nil
 }
 
@@ -74,7 +90,7 @@ func (a AWSClient) GetInstanceList() []string {
 		a.logger.Debug("No DB instances found.")
 	} else {
 		for _, instance := range output.DBInstances {
-			a.logger.Error(fmt.Sprintf("DB instance %v", *instance.DBInstanceIdentifier))
+			a.logger.Debug(fmt.Sprintf("DB instance %v", *instance.DBInstanceIdentifier))
 			instanceList = append(instanceList, *instance.DBInstanceIdentifier)
 		}
 	}
@@ -85,7 +101,7 @@ func (a AWSClient) GetInstanceList() []string {
 func (a AWSClient) GetSlowQueryList(instance string) ([]string, error) {
 	var slowQueryList []string
 
-	fmt.Println(instance)
+	a.logger.Debug(fmt.Sprintf("instance: %s", instance))
 	req, err := a.rdsClient.DescribeDBInstances(context.Background(), &rds.DescribeDBInstancesInput{})
 	if err != nil {
 		a.logger.Error(fmt.Sprintf("Couldn't list DB instances: %v", err))
@@ -102,7 +118,7 @@ func (a AWSClient) GetSlowQueryList(instance string) ([]string, error) {
 
 		slowQueryReq, _ := a.rdsClient.DescribeDBLogFiles(context.Background(), &rds.DescribeDBLogFilesInput{
 			DBInstanceIdentifier: dbInstance.DBInstanceIdentifier,
-			FilenameContains:     aws.String("slowquery/mysql-slowquery"),
+			FilenameContains:     aws.String(fmt.Sprintf("%s/mysql-%s", a.logType, a.logType)),
 		})
 
 		for _, logFile := range slowQueryReq.DescribeDBLogFiles {
@@ -112,47 +128,131 @@ func (a AWSClient) GetSlowQueryList(instance string) ([]string, error) {
 	return slowQueryList, nil
 }
 
-func DownloadSlowQueryLog(a AWSClientInterface, instance, filter string, logFile []string) (*string, error) {
-	var str *string
+// DownloadOptions はダウンロードしたログの扱いを指定します
+type DownloadOptions struct {
+	Target      string
+	Provider    string
+	Filter      string
+	Output      string
+	Format      string
+	EntryFilter *EntryFilter
+	Redactor    *Redactor
+
+	// RowGroupSize は Format が parquet の場合の行グループの行数です
+	RowGroupSize int64
+
+	// Collect はダウンロードしたログのうち EntryFilter に合うエントリごとに呼び出されます
+	// エラーを返した場合はダウンロードを中止します
+	Collect func(Record) error
+
+	// headers はcsvのヘッダーを書き出し済みの出力先です
+	headers map[string]bool
+}
+
+func (o DownloadOptions) convertOptions(header bool) ConvertOptions {
+	return ConvertOptions{
+		Format:       o.Format,
+		Header:       header,
+		RowGroupSize: o.RowGroupSize,
+		Filter:       o.EntryFilter,
+		Redactor:     o.Redactor,
+		Collect:      o.Collect,
+	}
+}
+
+// needsHeader は出力先にcsvのヘッダーを書き出す必要があるかどうかを返します
+// 既に中身のあるファイルに追記する場合は書き出しません
+func (o DownloadOptions) needsHeader(path string) bool {
+	if o.headers[path] {
+		return false
+	}
+	if o.headers != nil {
+		o.headers[path] = true
+	}
+	if !isStdout(path) {
+		if fi, err := os.Stat(path); err == nil && fi.Size() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// collect はログのエントリを解析して、条件に合うエントリを伏せてから Collect に渡します
+func (o DownloadOptions) collect(r io.Reader, base Record) error {
+	return scanRecords(r, base, func(r Record) error {
+		if o.EntryFilter.Match(r.Entry) {
+			r.Entry = o.Redactor.Redact(r.Entry)
+			return o.Collect(r)
+		}
+		return nil
+	})
+}
+
+// DownloadSlowQueryLog はインスタンスのログファイルを出力先に書き出します
+// クライアントが LogOpener を実装している場合は、ログファイルを全てメモリに読み込まずに書き出します
+func DownloadSlowQueryLog(a AWSClientInterface, instance string, logFile []string, opts DownloadOptions) error {
 	for _, log := range logFile {
 		// フィルタの文字列が含まれていない場合はスキップ
-		if filter != "" && !strings.Contains(log, filter) {
+		if opts.Filter != "" && !strings.Contains(log, opts.Filter) {
 			continue
 		}
 
-		str, err := a.DownloadSlowQueryLog(instance, log)
+		path, err := OutputPath(opts.Output, OutputData{
+			Target:   opts.Target,
+			Provider: opts.Provider,
+			Instance: instance,
+			LogFile:  filepath.Base(log),
+			Date:     time.Now().Format("2006-01-02"),
+		})
 		if err != nil {
-			return str, err
+			return err
 		}
 
-		// logDataをファイルに書き出す
-		err = WriteLogData("a.log", str)
+		r, err := openLog(a, instance, log)
 		if err != nil {
-			return str, err
+			return err
+		}
+		if r == nil {
+			continue
+		}
+
+		err = opts.write(r, Record{Instance: instance, Provider: opts.Provider, Source: log}, path)
+		r.Close()
+		if err != nil {
+			return err
 		}
 	}
 
-	return str, nil
+	return nil
 }
 
-func WriteLogData(path string, logData *string) error {
-	if logData == nil {
-		return nil
+// write はログを出力先に書き出します。Collect が指定されている場合は書き出しながらエントリを渡します
+func (o DownloadOptions) write(r io.Reader, base Record, path string) error {
+	// parquetは出力先をディレクトリとしてパーティションごとに書き出す
+	if o.Format == "parquet" {
+		return WriteParquetData(r, base, path, o.convertOptions(false))
 	}
 
-	// 追記モードでファイルを開く
-	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	w, err := openOutput(path)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	_, err = file.WriteString(*logData)
-	if err != nil {
-		return err
+	switch {
+	// エントリ単位のフィルタ、出力形式、伏せる設定のいずれかが指定されている場合はエントリを解析して書き出す
+	// 伏せる前のデータはメモリ上にだけあり、ファイルには書き出されない
+	case o.EntryFilter != nil || o.Redactor != nil || (o.Format != "" && o.Format != "slowlog"):
+		err = ConvertLogData(w, r, base, o.convertOptions(o.Format == "csv" && o.needsHeader(path)))
+	case o.Collect != nil:
+		err = o.collect(io.TeeReader(r, w), base)
+	default:
+		_, err = io.Copy(w, r)
 	}
 
-	return nil
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (a AWSClient) DownloadSlowQueryLog(instance string, logFile string) (*string, error) {
@@ -168,3 +268,30 @@ func (a AWSClient) DownloadSlowQueryLog(instance string, logFile string) (*strin
 	}
 	return req.LogFileData, nil
 }
+
+// TailSlowQueryLog は DownloadDBLogFilePortion の marker を使って、前回の続きからログファイルの終わりまでを返します
+func (a AWSClient) TailSlowQueryLog(instance string, logFile string, marker string) (string, string, error) {
+	if marker == "" {
+		marker = "0"
+	}
+
+	var b strings.Builder
+	for {
+		req, err := a.rdsClient.DownloadDBLogFilePortion(context.Background(), &rds.DownloadDBLogFilePortionInput{
+			DBInstanceIdentifier: aws.String(instance),
+			LogFileName:          aws.String(logFile),
+			Marker:               aws.String(marker),
+		})
+		if err != nil {
+			return "", "", err
+		}
+
+		b.WriteString(aws.ToString(req.LogFileData))
+		if req.Marker != nil {
+			marker = *req.Marker
+		}
+		if !aws.ToBool(req.AdditionalDataPending) {
+			return b.String(), marker, nil
+		}
+	}
+}
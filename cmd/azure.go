@@ -0,0 +1,373 @@
+package cmd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAzureEndpoint  = "https://management.azure.com"
+	defaultAzureAuthority = "https://login.microsoftonline.com"
+	azureMySQLAPIVersion  = "2023-12-30"
+
+	// azureRequestTimeout はARMとトークンのリクエストごとのタイムアウトです
+	azureRequestTimeout = time.Minute
+	// azureResponseHeaderTimeout はログファイルのダウンロードでレスポンスヘッダーを待つ時間です
+	// 本文を読み込む時間は大きなログでも途中で切れないように制限しません
+	azureResponseHeaderTimeout = time.Minute
+)
+
+// AzureConfig はAzure Database for MySQL Flexible Serverプロバイダーの設定です
+// クライアントシークレットは環境変数 AZURE_CLIENT_SECRET から読み込みます
+type AzureConfig struct {
+	Subscription  string `yaml:"subscription"`
+	ResourceGroup string `yaml:"resource_group"`
+	TenantID      string `yaml:"tenant_id"`
+	ClientID      string `yaml:"client_id"`
+	Endpoint      string `yaml:"endpoint"`
+	Authority     string `yaml:"authority"`
+}
+
+// AzureClient はServer Logs REST APIからスロークエリログを取得するクライアントです
+type AzureClient struct {
+	logger     *slog.Logger
+	config     AzureConfig
+	httpClient *http.Client
+	token      *azureToken
+
+	mu      *sync.Mutex
+	servers map[string]string
+	logURLs map[string]string
+}
+
+// azureToken はARMのアクセストークンを保持します
+// static は AZURE_ACCESS_TOKEN から読み込んだ更新できないトークンであることを表します
+type azureToken struct {
+	mu           sync.Mutex
+	accessToken  string
+	expiresAt    time.Time
+	clientSecret string
+	static       bool
+}
+
+// errAzureTokenExpired は AZURE_ACCESS_TOKEN の期限切れや拒否を表すエラーです
+var errAzureTokenExpired = fmt.Errorf("Azure access token expired, refresh AZURE_ACCESS_TOKEN")
+
+// jwtExpiry はJWTのペイロードの exp クレームを返します。JWTでない場合はゼロ値を返します
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+// azureLogFile はServer Logs APIが返すログファイルです
+type azureLogFile struct {
+	Name       string `json:"name"`
+	Properties struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	} `json:"properties"`
+}
+
+// NewAzureClient はサービスプリンシパルまたは AZURE_ACCESS_TOKEN で認証するクライアントを生成します
+func NewAzureClient(logger *slog.Logger, config AzureConfig) (AzureClient, error) {
+	if config.Subscription == "" {
+		config.Subscription = os.Getenv("AZURE_SUBSCRIPTION_ID")
+	}
+	if config.TenantID == "" {
+		config.TenantID = os.Getenv("AZURE_TENANT_ID")
+	}
+	if config.ClientID == "" {
+		config.ClientID = os.Getenv("AZURE_CLIENT_ID")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = defaultAzureEndpoint
+	}
+	if config.Authority == "" {
+		config.Authority = defaultAzureAuthority
+	}
+
+	if config.Subscription == "" {
+		return AzureClient{}, fmt.Errorf("Azure subscription ID is required")
+	}
+
+	token := &azureToken{
+		accessToken:  os.Getenv("AZURE_ACCESS_TOKEN"),
+		clientSecret: os.Getenv("AZURE_CLIENT_SECRET"),
+	}
+	if token.accessToken != "" {
+		token.static = true
+		token.expiresAt = jwtExpiry(token.accessToken)
+	} else if config.TenantID == "" || config.ClientID == "" || token.clientSecret == "" {
+		return AzureClient{}, fmt.Errorf("Azure credentials are required: set AZURE_ACCESS_TOKEN or AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET")
+	}
+
+	return AzureClient{
+		logger: logger,
+		config: config,
+		httpClient: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: azureResponseHeaderTimeout,
+		}},
+		token:   token,
+		mu:      &sync.Mutex{},
+		servers: map[string]string{},
+		logURLs: map[string]string{},
+	}, nil
+}
+
+// accessToken はクライアントクレデンシャルフローでARMのアクセストークンを取得します
+func (a AzureClient) accessToken() (string, error) {
+	a.token.mu.Lock()
+	defer a.token.mu.Unlock()
+
+	if a.token.static {
+		// 期限の分からないトークンはそのまま使い、拒否されたときに getPage で報告する
+		if !a.token.expiresAt.IsZero() && !time.Now().Before(a.token.expiresAt) {
+			return "", fmt.Errorf("%w (expired at %s)", errAzureTokenExpired, a.token.expiresAt.UTC().Format(time.RFC3339))
+		}
+		return a.token.accessToken, nil
+	}
+	if a.token.accessToken != "" && time.Now().Before(a.token.expiresAt) {
+		return a.token.accessToken, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {a.config.ClientID},
+		"client_secret": {a.token.clientSecret},
+		"scope":         {strings.TrimSuffix(a.config.Endpoint, "/") + "/.default"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), azureRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s/oauth2/v2.0/token", a.config.Authority, a.config.TenantID), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("failed to get Azure access token: %s: %s", resp.Status, body)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	a.token.accessToken = token.AccessToken
+	a.token.expiresAt = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return a.token.accessToken, nil
+}
+
+// azurePage はARMのリスト系APIの1ページです
+type azurePage struct {
+	Value    []json.RawMessage `json:"value"`
+	NextLink string            `json:"nextLink"`
+}
+
+// list はARMのリスト系APIを nextLink をたどりながら呼び出します
+func (a AzureClient) list(u string, fn func(json.RawMessage) error) error {
+	for u != "" {
+		page, err := a.getPage(u)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range page.Value {
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+		u = page.NextLink
+	}
+	return nil
+}
+
+// getPage はARMのリスト系APIの1ページを azureRequestTimeout 以内に取得します
+func (a AzureClient) getPage(u string) (azurePage, error) {
+	var page azurePage
+	token, err := a.accessToken()
+	if err != nil {
+		return page, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), azureRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return page, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return page, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized && a.token.static {
+		return page, fmt.Errorf("GET %s: %s: %w", u, resp.Status, errAzureTokenExpired)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return page, fmt.Errorf("GET %s: %s: %s", u, resp.Status, body)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	return page, err
+}
+
+func (a AzureClient) GetInstanceList() []string {
+	instanceList, err := a.listServers()
+	if err != nil {
+		a.logger.Error(fmt.Sprintf("Couldn't list flexible servers: %v", err))
+	}
+	return instanceList
+}
+
+// listServers はフレキシブルサーバーを一覧し、名前とリソースIDを記録します
+func (a AzureClient) listServers() ([]string, error) {
+	var instanceList []string
+
+	path := fmt.Sprintf("/subscriptions/%s", a.config.Subscription)
+	if a.config.ResourceGroup != "" {
+		path += fmt.Sprintf("/resourceGroups/%s", a.config.ResourceGroup)
+	}
+	u := fmt.Sprintf("%s%s/providers/Microsoft.DBforMySQL/flexibleServers?api-version=%s", a.config.Endpoint, path, azureMySQLAPIVersion)
+
+	err := a.list(u, func(v json.RawMessage) error {
+		var server struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(v, &server); err != nil {
+			return err
+		}
+
+		a.mu.Lock()
+		a.servers[server.Name] = server.ID
+		a.mu.Unlock()
+		instanceList = append(instanceList, server.Name)
+		return nil
+	})
+	return instanceList, err
+}
+
+func (a AzureClient) GetSlowQueryList(instance string) ([]string, error) {
+	var slowQueryList []string
+
+	a.mu.Lock()
+	id, ok := a.servers[instance]
+	a.mu.Unlock()
+	if !ok {
+		if _, err := a.listServers(); err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		id, ok = a.servers[instance]
+		a.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("flexible server not found: %s", instance)
+		}
+	}
+
+	u := fmt.Sprintf("%s%s/logFiles?api-version=%s", a.config.Endpoint, id, azureMySQLAPIVersion)
+	err := a.list(u, func(v json.RawMessage) error {
+		var logFile azureLogFile
+		if err := json.Unmarshal(v, &logFile); err != nil {
+			return err
+		}
+		if logFile.Properties.Type != "slowlog" {
+			return nil
+		}
+
+		a.mu.Lock()
+		a.logURLs[instance+"/"+logFile.Name] = logFile.Properties.URL
+		a.mu.Unlock()
+		slowQueryList = append(slowQueryList, logFile.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return slowQueryList, nil
+}
+
+func (a AzureClient) DownloadSlowQueryLog(instance string, logFile string) (*string, error) {
+	r, err := a.OpenSlowQueryLog(instance, logFile)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var b strings.Builder
+	if _, err := io.Copy(&b, r); err != nil {
+		return nil, err
+	}
+
+	str := b.String()
+	return &str, nil
+}
+
+// OpenSlowQueryLog はログファイルのSAS URLへのレスポンスを読み込み用に返します
+func (a AzureClient) OpenSlowQueryLog(instance string, logFile string) (io.ReadCloser, error) {
+	a.mu.Lock()
+	u, ok := a.logURLs[instance+"/"+logFile]
+	a.mu.Unlock()
+	if !ok {
+		if _, err := a.GetSlowQueryList(instance); err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		u, ok = a.logURLs[instance+"/"+logFile]
+		a.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("log file not found: %s", logFile)
+		}
+	}
+
+	// SAS URLには認証情報が含まれるため、Authorizationヘッダーは付けない
+	resp, err := a.httpClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s: %s", logFile, resp.Status)
+	}
+	return resp.Body, nil
+}
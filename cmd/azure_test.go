@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const azureTestSlowLog = "# Time: 2023-05-10T12:30:15.000000Z\n# Query_time: 2.500000  Lock_time: 0.010000 Rows_sent: 100  Rows_examined: 1000000\nSELECT 1;\n"
+
+// newAzureStandIn はARMとSAS URLを模したテスト用のHTTPサーバーを起動します
+func newAzureStandIn(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	var server *httptest.Server
+
+	mux.HandleFunc("POST /tenant/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_secret") != "secret" || r.FormValue("grant_type") != "client_credentials" {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"token-1","expires_in":3600}`)
+	})
+
+	authorized := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token-1" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+		}
+	}
+
+	const servers = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.DBforMySQL/flexibleServers"
+	mux.HandleFunc("GET "+servers, authorized(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprintf(w, `{"value":[{"id":"%s/mysql-prod-2","name":"mysql-prod-2"}]}`, servers)
+			return
+		}
+		fmt.Fprintf(w, `{"value":[{"id":"%s/mysql-prod-1","name":"mysql-prod-1"}],"nextLink":"%s%s?api-version=%s&page=2"}`,
+			servers, server.URL, servers, azureMySQLAPIVersion)
+	}))
+	mux.HandleFunc("GET "+servers+"/mysql-prod-1/logFiles", authorized(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"value":[
+			{"name":"mysql-slow-mysql-prod-1-2023051012.log","properties":{"type":"slowlog","url":"%[1]s/sas/slow-1.log?sig=abc"}},
+			{"name":"mysql-error-mysql-prod-1-2023051012.log","properties":{"type":"errorlog","url":"%[1]s/sas/error-1.log?sig=abc"}}
+		]}`, server.URL)
+	}))
+	mux.HandleFunc("GET /sas/slow-1.log", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") != "abc" || r.Header.Get("Authorization") != "" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, azureTestSlowLog)
+	})
+
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAzureClient(t *testing.T) {
+	server := newAzureStandIn(t)
+	t.Setenv("AZURE_ACCESS_TOKEN", "")
+	t.Setenv("AZURE_CLIENT_SECRET", "secret")
+
+	client, err := NewAzureClient(NewLogger("error"), AzureConfig{
+		Subscription:  "sub",
+		ResourceGroup: "rg",
+		TenantID:      "tenant",
+		ClientID:      "client",
+		Endpoint:      server.URL,
+		Authority:     server.URL,
+	})
+	if err != nil {
+		t.Fatalf("NewAzureClient() returned error: %v", err)
+	}
+
+	if got := client.GetInstanceList(); !reflect.DeepEqual(got, []string{"mysql-prod-1", "mysql-prod-2"}) {
+		t.Errorf("GetInstanceList() = %v", got)
+	}
+
+	instance := FilterInstance(client, "mysql-prod-1")
+	logList, err := GetSlowQueryList(client, instance)
+	if err != nil {
+		t.Fatalf("GetSlowQueryList() returned error: %v", err)
+	}
+	if !reflect.DeepEqual(logList, []string{"mysql-slow-mysql-prod-1-2023051012.log"}) {
+		t.Errorf("GetSlowQueryList() = %v", logList)
+	}
+
+	output := filepath.Join(t.TempDir(), "slow.log")
+	if err := DownloadSlowQueryLog(client, instance, logList, DownloadOptions{Provider: "azure", Output: output}); err != nil {
+		t.Fatalf("DownloadSlowQueryLog() returned error: %v", err)
+	}
+	if got, err := os.ReadFile(output); err != nil || string(got) != azureTestSlowLog {
+		t.Errorf("DownloadSlowQueryLog() wrote %q, want %q (error: %v)", got, azureTestSlowLog, err)
+	}
+
+	if _, err := GetSlowQueryList(client, "unknown"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("GetSlowQueryList() with unknown server error = %v", err)
+	}
+}
+
+func TestNewAzureClient(t *testing.T) {
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "")
+	t.Setenv("AZURE_TENANT_ID", "")
+	t.Setenv("AZURE_CLIENT_ID", "")
+	t.Setenv("AZURE_CLIENT_SECRET", "")
+	t.Setenv("AZURE_ACCESS_TOKEN", "")
+
+	testCases := []struct {
+		name    string
+		config  AzureConfig
+		token   string
+		wantErr bool
+	}{
+		{
+			name:    "サブスクリプションなし",
+			config:  AzureConfig{},
+			token:   "token",
+			wantErr: true,
+		},
+		{
+			name:    "認証情報なし",
+			config:  AzureConfig{Subscription: "sub"},
+			wantErr: true,
+		},
+		{
+			name:   "アクセストークン",
+			config: AzureConfig{Subscription: "sub"},
+			token:  "token",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("AZURE_ACCESS_TOKEN", tc.token)
+
+			_, err := NewAzureClient(NewLogger("error"), tc.config)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("NewAzureClient() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// testJWT は exp クレームだけを持つテスト用のJWTを返します
+func testJWT(exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+	return "eyJhbGciOiJub25lIn0." + payload + ".sig"
+}
+
+func TestAzureClientAccessToken(t *testing.T) {
+	server := newAzureStandIn(t)
+	t.Setenv("AZURE_CLIENT_SECRET", "")
+
+	testCases := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "JWTでないトークン", token: "token-1"},
+		{name: "期限切れのトークン", token: testJWT(time.Now().Add(-time.Minute)), wantErr: true},
+		{name: "拒否されたトークン", token: testJWT(time.Now().Add(time.Hour)), wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("AZURE_ACCESS_TOKEN", tc.token)
+			client, err := NewAzureClient(NewLogger("error"), AzureConfig{
+				Subscription:  "sub",
+				ResourceGroup: "rg",
+				Endpoint:      server.URL,
+			})
+			if err != nil {
+				t.Fatalf("NewAzureClient() returned error: %v", err)
+			}
+
+			_, err = client.GetSlowQueryList("mysql-prod-1")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("GetSlowQueryList() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil && !errors.Is(err, errAzureTokenExpired) {
+				t.Errorf("GetSlowQueryList() error = %v, want %v", err, errAzureTokenExpired)
+			}
+		})
+	}
+
+	if got := jwtExpiry(testJWT(time.Unix(1683721815, 0))); !got.Equal(time.Unix(1683721815, 0)) {
+		t.Errorf("jwtExpiry() = %v, want %v", got, time.Unix(1683721815, 0))
+	}
+}
@@ -0,0 +1,465 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// checkGroupBys と checkMetrics はルールに指定できる集計の単位と値です
+var (
+	checkGroupBys = []string{"fingerprint", "instance", "user", "db", "host"}
+	checkMetrics  = []string{"count", "query_time", "lock_time", "rows_sent", "rows_examined"}
+)
+
+// CheckRule はスロークエリログが満たすべき条件です
+// 条件に合うエントリの metric の合計が、group_by と per で分けた集計ごとに max を超えると違反になります
+type CheckRule struct {
+	Name string `yaml:"name"`
+	// FilterOptions はルールの対象にするエントリの条件です
+	FilterOptions `yaml:",inline"`
+	GroupBy       string  `yaml:"group_by"`
+	Per           string  `yaml:"per"`
+	Metric        string  `yaml:"metric"`
+	Max           float64 `yaml:"max"`
+}
+
+// CheckRules はルールファイルの内容です
+type CheckRules struct {
+	Rules []CheckRule `yaml:"rules"`
+}
+
+// LoadCheckRules はルールファイルを読み込みます
+// ルールの書き間違いに気付けるように、未知のキーはエラーにします
+func LoadCheckRules(path string) ([]CheckRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules CheckRules
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&rules); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to parse rules %s: %w", path, err)
+	}
+	if len(rules.Rules) == 0 {
+		return nil, fmt.Errorf("no rules in %s", path)
+	}
+	return rules.Rules, nil
+}
+
+// Checker はエントリをルールごとに集計して違反を見つけます
+type Checker struct {
+	rules []*checkRule
+}
+
+type checkRule struct {
+	CheckRule
+	filter *EntryFilter
+	per    time.Duration
+	// entries はルールの対象になったエントリの数です
+	entries int64
+	values  map[checkKey]*checkValue
+}
+
+type checkKey struct {
+	group  string
+	window int64
+}
+
+type checkValue struct {
+	value float64
+	count int64
+	label string
+}
+
+// NewChecker はルールを検証してCheckerを生成します
+func NewChecker(rules []CheckRule) (*Checker, error) {
+	c := &Checker{}
+	names := map[string]bool{}
+
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d: name is required", i+1)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %q: duplicate name", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if rule.GroupBy != "" && !contains(checkGroupBys, rule.GroupBy) {
+			return nil, fmt.Errorf("rule %q: unsupported group_by %q. Use %s", rule.Name, rule.GroupBy, strings.Join(checkGroupBys, ", "))
+		}
+		if rule.Metric == "" {
+			rule.Metric = "count"
+		}
+		if !contains(checkMetrics, rule.Metric) {
+			return nil, fmt.Errorf("rule %q: unsupported metric %q. Use %s", rule.Name, rule.Metric, strings.Join(checkMetrics, ", "))
+		}
+
+		filter, err := NewEntryFilter(rule.FilterOptions)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+
+		r := &checkRule{CheckRule: rule, filter: filter, values: map[checkKey]*checkValue{}}
+		if rule.Per != "" {
+			if r.per, err = ParseBucket(rule.Per); err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+			}
+		}
+		c.rules = append(c.rules, r)
+	}
+
+	return c, nil
+}
+
+// WarnErrors はルールの --where の式の評価に失敗したエントリがあれば、ルールごとに警告として出力します
+func (c *Checker) WarnErrors(logger *slog.Logger) {
+	if c == nil {
+		return
+	}
+	for _, rule := range c.rules {
+		rule.filter.WarnErrors(logger, "rule", rule.Name)
+	}
+}
+
+// Add はエントリを全てのルールの集計に加えます
+// per を指定したルールでは、時刻のないエントリは集計しません
+func (c *Checker) Add(r Record) {
+	for _, rule := range c.rules {
+		if !rule.filter.Match(r.Entry) {
+			continue
+		}
+
+		var key checkKey
+		if rule.per > 0 {
+			t := r.StartTime()
+			if t.IsZero() {
+				continue
+			}
+			key.window = t.UnixNano() / int64(rule.per)
+		}
+
+		label := ""
+		switch rule.GroupBy {
+		case "fingerprint":
+			label = Fingerprint(r.Statement)
+			key.group = FingerprintID(label)
+		case "instance":
+			key.group = r.Instance
+		case "user":
+			key.group = r.User
+		case "db":
+			key.group = r.DB
+		case "host":
+			key.group = r.Host
+			if key.group == "" {
+				key.group = r.IP
+			}
+		}
+
+		rule.entries++
+		v, ok := rule.values[key]
+		if !ok {
+			v = &checkValue{label: label}
+			rule.values[key] = v
+		}
+		v.count++
+		v.value += checkMetric(r, rule.Metric)
+	}
+}
+
+func checkMetric(r Record, metric string) float64 {
+	switch metric {
+	case "query_time":
+		return r.QueryTime
+	case "lock_time":
+		return r.LockTime
+	case "rows_sent":
+		return float64(r.RowsSent)
+	case "rows_examined":
+		return float64(r.RowsExamined)
+	default:
+		return 1
+	}
+}
+
+// CheckViolation はルールの違反です
+type CheckViolation struct {
+	// Group は group_by の値です。フィンガープリントの場合はクエリIDです
+	Group       string
+	Fingerprint string
+	// Window は per を指定したルールの時間帯の開始時刻です
+	Window time.Time
+	Value  float64
+	Count  int64
+}
+
+// CheckRuleResult はルールごとの結果です
+type CheckRuleResult struct {
+	Rule       CheckRule
+	Entries    int64
+	Violations []CheckViolation
+}
+
+// CheckResult は全てのルールの結果です
+type CheckResult struct {
+	Rules []CheckRuleResult
+}
+
+// Failed は違反のあったルールの数を返します
+func (r CheckResult) Failed() int {
+	n := 0
+	for _, rule := range r.Rules {
+		if len(rule.Violations) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Result はルールごとの違反を値の大きい順に返します
+func (c *Checker) Result() CheckResult {
+	var result CheckResult
+	for _, rule := range c.rules {
+		r := CheckRuleResult{Rule: rule.CheckRule, Entries: rule.entries}
+
+		for key, v := range rule.values {
+			if v.value <= rule.Max {
+				continue
+			}
+			violation := CheckViolation{Group: key.group, Fingerprint: v.label, Value: v.value, Count: v.count}
+			if rule.per > 0 {
+				violation.Window = time.Unix(0, key.window*int64(rule.per)).UTC()
+			}
+			r.Violations = append(r.Violations, violation)
+		}
+		sort.Slice(r.Violations, func(i, j int) bool {
+			a, b := r.Violations[i], r.Violations[j]
+			if a.Value != b.Value {
+				return a.Value > b.Value
+			}
+			if !a.Window.Equal(b.Window) {
+				return a.Window.Before(b.Window)
+			}
+			return a.Group < b.Group
+		})
+
+		result.Rules = append(result.Rules, r)
+	}
+	return result
+}
+
+// CheckOptions はcheckコマンドのオプションです
+type CheckOptions struct {
+	Filter *EntryFilter
+	// JUnit はJUnit XML形式の結果を書き出すファイルです
+	JUnit string
+}
+
+// Check はローカルのスロークエリログをルールで検査して、違反を書き出します
+func Check(w io.Writer, logger *slog.Logger, paths []string, rules []CheckRule, opts CheckOptions) (CheckResult, error) {
+	checker, err := NewChecker(rules)
+	if err != nil {
+		return CheckResult{}, err
+	}
+
+	client, err := NewLocalClient(logger, strings.Join(paths, ","))
+	if err != nil {
+		return CheckResult{}, err
+	}
+
+	err = ReadRecords(client, client.GetInstanceList(), func(r Record) error {
+		if opts.Filter.Match(r.Entry) {
+			checker.Add(r)
+		}
+		return nil
+	})
+	if err != nil {
+		return CheckResult{}, err
+	}
+	opts.Filter.WarnErrors(logger)
+	checker.WarnErrors(logger)
+
+	result := checker.Result()
+	if err := WriteCheckText(w, result); err != nil {
+		return result, err
+	}
+
+	if opts.JUnit != "" {
+		f, err := os.Create(opts.JUnit)
+		if err != nil {
+			return result, err
+		}
+		if err := WriteCheckJUnit(f, result); err != nil {
+			f.Close()
+			return result, err
+		}
+		if err := f.Close(); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// checkMaxViolations はテキスト形式でルールごとに表示する違反の数です
+const checkMaxViolations = 10
+
+// WriteCheckText はルールごとの結果と違反を書き出します
+func WriteCheckText(w io.Writer, result CheckResult) error {
+	var b strings.Builder
+
+	for _, r := range result.Rules {
+		if len(r.Violations) == 0 {
+			fmt.Fprintf(&b, "PASS  %s (%d entries)\n", r.Rule.Name, r.Entries)
+			continue
+		}
+
+		fmt.Fprintf(&b, "FAIL  %s: %d violations (%s)\n", r.Rule.Name, len(r.Violations), describeCheckRule(r.Rule))
+		for i, v := range r.Violations {
+			if i == checkMaxViolations {
+				fmt.Fprintf(&b, "      ... and %d more\n", len(r.Violations)-checkMaxViolations)
+				break
+			}
+			fmt.Fprintf(&b, "      %s\n", describeCheckViolation(r.Rule, v, 60))
+		}
+	}
+
+	fmt.Fprintf(&b, "\n# %d rules, %d failed\n", len(result.Rules), result.Failed())
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// describeCheckRule は集計の内容を "sum of query_time per 1h by fingerprint > 300" のように返します
+func describeCheckRule(rule CheckRule) string {
+	var b strings.Builder
+	if rule.Metric == "" || rule.Metric == "count" {
+		b.WriteString("count")
+	} else {
+		b.WriteString("sum of " + rule.Metric)
+	}
+	if rule.Per != "" {
+		b.WriteString(" per " + rule.Per)
+	}
+	if rule.GroupBy != "" {
+		b.WriteString(" by " + rule.GroupBy)
+	}
+	b.WriteString(" > " + strconv.FormatFloat(rule.Max, 'f', -1, 64))
+	return b.String()
+}
+
+// describeCheckViolation は違反の値と集計の単位を1行で返します
+func describeCheckViolation(rule CheckRule, v CheckViolation, width int) string {
+	var parts []string
+	if !v.Window.IsZero() {
+		parts = append(parts, formatTime(v.Window))
+	}
+	if rule.GroupBy != "" {
+		group := v.Group
+		if group == "" {
+			group = "-"
+		}
+		parts = append(parts, rule.GroupBy+" "+group)
+	}
+
+	value := strconv.FormatFloat(v.Value, 'f', -1, 64)
+	switch rule.Metric {
+	case "query_time", "lock_time":
+		value = formatSeconds(v.Value)
+	}
+	parts = append(parts, fmt.Sprintf("%s (%d entries)", value, v.Count))
+
+	line := strings.Join(parts, "  ")
+	if v.Fingerprint != "" {
+		fingerprint := v.Fingerprint
+		if width > 0 {
+			fingerprint = truncate(fingerprint, width)
+		}
+		line += "  " + fingerprint
+	}
+	return line
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Name    string           `xml:"name,attr"`
+	Tests   int              `xml:"tests,attr"`
+	Fails   int              `xml:"failures,attr"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name  string          `xml:"name,attr"`
+	Tests int             `xml:"tests,attr"`
+	Fails int             `xml:"failures,attr"`
+	Cases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// checkJUnitSuite はJUnit XMLのテストスイートとクラスの名前です
+const checkJUnitSuite = "slowquery.check"
+
+// WriteCheckJUnit はルールを1つのテストケースとして、JUnit XML形式で結果を書き出します
+func WriteCheckJUnit(w io.Writer, result CheckResult) error {
+	suite := junitTestSuite{Name: checkJUnitSuite, Tests: len(result.Rules), Fails: result.Failed()}
+	for _, r := range result.Rules {
+		tc := junitTestCase{
+			Name:      r.Rule.Name,
+			ClassName: checkJUnitSuite,
+			SystemOut: fmt.Sprintf("%d entries matched the rule", r.Entries),
+		}
+		if len(r.Violations) > 0 {
+			lines := make([]string, len(r.Violations))
+			for i, v := range r.Violations {
+				lines[i] = describeCheckViolation(r.Rule, v, 0)
+			}
+			tc.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d violations of %s", len(r.Violations), describeCheckRule(r.Rule)),
+				Type:    "SlowQueryViolation",
+				Text:    strings.Join(lines, "\n"),
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	err := encoder.Encode(junitTestSuites{
+		Name:   checkJUnitSuite,
+		Tests:  suite.Tests,
+		Fails:  suite.Fails,
+		Suites: []junitTestSuite{suite},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
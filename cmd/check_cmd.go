@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// checkViolationExitCode はルールの違反が見つかった場合の終了コードです
+// diff と同じく、その他のエラーの終了コード1と区別できるように2を使います
+const checkViolationExitCode = 2
+
+// checkCmd はスロークエリログをルールファイルの条件で検査するコマンドです
+var checkCmd = &cobra.Command{
+	Use:   "check --rules <file> [flags] <path>...",
+	Short: "Check slow query logs against threshold rules",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, _ := cmd.Flags().GetBool("debug")
+		logger := NewLogger("info")
+		if debug {
+			logger = NewLogger("debug")
+		}
+
+		rulesPath, _ := cmd.Flags().GetString("rules")
+		junit, _ := cmd.Flags().GetString("junit")
+
+		rules, err := LoadCheckRules(rulesPath)
+		if err != nil {
+			return err
+		}
+
+		filter, err := NewEntryFilter(mergeFilterOptions(FilterOptions{}, cmd.Flags()))
+		if err != nil {
+			return err
+		}
+
+		result, err := Check(cmd.OutOrStdout(), logger, args, rules, CheckOptions{Filter: filter, JUnit: junit})
+		if err != nil {
+			return err
+		}
+
+		if n := result.Failed(); n > 0 {
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+			return &ExitError{Code: checkViolationExitCode, Err: fmt.Errorf("%d of %d rules failed", n, len(result.Rules))}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+	checkCmd.Flags().BoolP("debug", "d", false, "debug mode")
+	checkCmd.Flags().String("rules", "", "YAML file of the rules to check")
+	checkCmd.Flags().String("junit", "", "also write the results to this file as JUnit XML")
+	checkCmd.MarkFlagRequired("rules")
+	addEntryFilterFlags(checkCmd.Flags())
+}
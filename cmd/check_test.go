@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadCheckRules(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "ルールとフィルター",
+			content: `rules:
+  - name: no query over 10s
+    where: query_time > 10
+  - name: hourly slow time
+    dbs: [production]
+    metric: query_time
+    per: 1h
+    max: 300
+`,
+			want: 2,
+		},
+		{name: "未知のキー", content: "rules:\n  - name: typo\n    maximum: 1\n", wantErr: true},
+		{name: "ルールがない", content: "rules: []\n", wantErr: true},
+		{name: "空のファイル", content: "", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.yaml")
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			rules, err := LoadCheckRules(path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("LoadCheckRules() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if len(rules) != tc.want {
+				t.Errorf("LoadCheckRules() returned %d rules, want %d", len(rules), tc.want)
+			}
+		})
+	}
+}
+
+func TestNewChecker(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rule    CheckRule
+		wantErr bool
+	}{
+		{name: "正しいルール", rule: CheckRule{Name: "a", GroupBy: "fingerprint", Per: "1h", Metric: "query_time"}},
+		{name: "名前がない", rule: CheckRule{}, wantErr: true},
+		{name: "不正な group_by", rule: CheckRule{Name: "a", GroupBy: "table"}, wantErr: true},
+		{name: "不正な metric", rule: CheckRule{Name: "a", Metric: "cpu"}, wantErr: true},
+		{name: "不正な per", rule: CheckRule{Name: "a", Per: "hourly"}, wantErr: true},
+		{name: "不正な where", rule: CheckRule{Name: "a", FilterOptions: FilterOptions{Where: "query_time >"}}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewChecker([]CheckRule{tc.rule}); (err != nil) != tc.wantErr {
+				t.Errorf("NewChecker() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	if _, err := NewChecker([]CheckRule{{Name: "a"}, {Name: "a"}}); err == nil {
+		t.Error("NewChecker() with duplicate names should return error")
+	}
+}
+
+// newTestCheckResult は要望にあった3つのルールでテスト用のエントリを検査します
+func newTestCheckResult(t *testing.T) CheckResult {
+	t.Helper()
+
+	checker, err := NewChecker([]CheckRule{
+		{Name: "no query over 10s", FilterOptions: FilterOptions{Where: "query_time > 10"}},
+		{Name: "no full scans", FilterOptions: FilterOptions{Where: "rows_examined / rows_sent > 10000"}, GroupBy: "fingerprint", Max: 50},
+		{Name: "hourly slow time", Metric: "query_time", Per: "1h", Max: 300},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2023, 5, 10, 12, 0, 0, 0, time.UTC).Unix()
+	for i := 0; i < 60; i++ {
+		// 12時台に 60 * 5.5s = 330s
+		checker.Add(newTestRecord("db-1", "SELECT * FROM orders WHERE user_id = 1", 5.5, 1, 20000, base+int64(i)*60))
+	}
+	for i := 0; i < 40; i++ {
+		// 13時台に 40 * 1s = 40s
+		checker.Add(newTestRecord("db-1", "SELECT * FROM items WHERE id = 1", 1.0, 1, 50000, base+3600+int64(i)*60))
+	}
+	checker.Add(newTestRecord("db-2", "SELECT 1", 2.0, 1, 1, base+3600))
+
+	return checker.Result()
+}
+
+func TestCheckerResult(t *testing.T) {
+	result := newTestCheckResult(t)
+
+	if got := result.Failed(); got != 2 {
+		t.Errorf("Failed() = %d, want 2", got)
+	}
+
+	testCases := []struct {
+		rule       string
+		entries    int64
+		violations []string
+	}{
+		{rule: "no query over 10s", entries: 0},
+		{
+			rule:       "no full scans",
+			entries:    100,
+			violations: []string{"fingerprint " + FingerprintID("select * from orders where user_id = ?") + "  60 (60 entries)  select * from orders where user_id = ?"},
+		},
+		{
+			rule:       "hourly slow time",
+			entries:    101,
+			violations: []string{"2023-05-10 12:00:00  330.000s (60 entries)"},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.rule, func(t *testing.T) {
+			r := result.Rules[i]
+			if r.Rule.Name != tc.rule || r.Entries != tc.entries {
+				t.Errorf("Rules[%d] = %s (%d entries), want %s (%d entries)", i, r.Rule.Name, r.Entries, tc.rule, tc.entries)
+			}
+			var got []string
+			for _, v := range r.Violations {
+				got = append(got, describeCheckViolation(r.Rule, v, 0))
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.violations, "\n") {
+				t.Errorf("Violations = %q, want %q", got, tc.violations)
+			}
+		})
+	}
+}
+
+func TestWriteCheck(t *testing.T) {
+	result := newTestCheckResult(t)
+
+	var buf bytes.Buffer
+	if err := WriteCheckText(&buf, result); err != nil {
+		t.Fatalf("WriteCheckText() returned error: %v", err)
+	}
+	for _, want := range []string{
+		"PASS  no query over 10s (0 entries)\n",
+		"FAIL  no full scans: 1 violations (count by fingerprint > 50)\n",
+		"FAIL  hourly slow time: 1 violations (sum of query_time per 1h > 300)\n",
+		"# 3 rules, 2 failed\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("WriteCheckText() does not contain %q:\n%s", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := WriteCheckJUnit(&buf, result); err != nil {
+		t.Fatalf("WriteCheckJUnit() returned error: %v", err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatalf("WriteCheckJUnit() wrote invalid XML: %v\n%s", err, buf.String())
+	}
+	if suites.Tests != 3 || suites.Fails != 2 || len(suites.Suites) != 1 || len(suites.Suites[0].Cases) != 3 {
+		t.Fatalf("WriteCheckJUnit() = %+v", suites)
+	}
+	cases := suites.Suites[0].Cases
+	if cases[0].Failure != nil {
+		t.Errorf("testcase %s should pass", cases[0].Name)
+	}
+	if f := cases[2].Failure; f == nil || f.Message != "1 violations of sum of query_time per 1h > 300" || !strings.Contains(f.Text, "330.000s") {
+		t.Errorf("testcase %s failure = %+v", cases[2].Name, f)
+	}
+}
+
+func TestCheckCommandExitCode(t *testing.T) {
+	dir := t.TempDir()
+	if err := GenerateTestLogs(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		rules    string
+		wantCode int
+	}{
+		{name: "違反あり", rules: "rules:\n  - name: no query over 5s\n    where: query_time > 5\n", wantCode: checkViolationExitCode},
+		{name: "違反なし", rules: "rules:\n  - name: no query over 60s\n    where: query_time > 60\n", wantCode: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rules := filepath.Join(t.TempDir(), "rules.yaml")
+			junit := filepath.Join(t.TempDir(), "junit.xml")
+			if err := os.WriteFile(rules, []byte(tc.rules), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			rootCmd.SetOut(&out)
+			rootCmd.SetArgs([]string{"check", "--rules", rules, "--junit", junit, dir})
+			t.Cleanup(func() {
+				rootCmd.SetOut(nil)
+				rootCmd.SetArgs(nil)
+			})
+
+			err := rootCmd.Execute()
+			code := 0
+			if exitErr, ok := err.(*ExitError); ok {
+				code = exitErr.Code
+			} else if err != nil {
+				t.Fatalf("check returned error: %v", err)
+			}
+			if code != tc.wantCode {
+				t.Errorf("exit code = %d, want %d\n%s", code, tc.wantCode, out.String())
+			}
+			if _, err := os.Stat(junit); err != nil {
+				t.Errorf("JUnit XML was not written: %v", err)
+			}
+		})
+	}
+}
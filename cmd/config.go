@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Config は設定ファイルの内容を表します
+type Config struct {
+	Targets   map[string]Target      `yaml:"targets"`
+	Schedules map[string]ScheduleJob `yaml:"schedules"`
+}
+
+// Target は設定ファイルに定義する名前付きのダウンロード対象です
+type Target struct {
+	Name         string           `yaml:"-"`
+	Provider     string           `yaml:"provider"`
+	Profile      string           `yaml:"profile"`
+	Region       string           `yaml:"region"`
+	Project      string           `yaml:"project"`
+	Credentials  string           `yaml:"credentials"`
+	Path         string           `yaml:"path"`
+	SSH          SSHConfig        `yaml:"ssh"`
+	Azure        AzureConfig      `yaml:"azure"`
+	Entries      FilterOptions    `yaml:"entries"`
+	Redact       RedactOptions    `yaml:"redact"`
+	Instances    []string         `yaml:"instances"`
+	LogType      string           `yaml:"log_type"`
+	Output       string           `yaml:"output"`
+	Format       string           `yaml:"format"`
+	RowGroupSize int64            `yaml:"row_group_size"`
+	Filter       string           `yaml:"filter"`
+	Notify       NotifyConfig     `yaml:"notify"`
+	Warehouse    string           `yaml:"warehouse"`
+	OpenSearch   OpenSearchConfig `yaml:"opensearch"`
+	OTLP         OTLPConfig       `yaml:"otlp"`
+}
+
+// DefaultConfigPath は --config を省略したときに読み込む設定ファイルのパスを返します
+func DefaultConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "mysql-slowquery-downloder", "config.yaml")
+}
+
+// LoadConfig は設定ファイルを読み込みます
+func LoadConfig(path string) (Config, error) {
+	var config Config
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// loadConfigFromFlags は --config で指定された設定ファイルを読み込みます
+// デフォルトのパスにファイルが存在しない場合は空の設定を返します
+func loadConfigFromFlags(cmd *cobra.Command) (Config, error) {
+	path := ""
+	if f := cmd.Flag("config"); f != nil {
+		path = f.Value.String()
+	}
+
+	if path == "" {
+		path = DefaultConfigPath()
+		if _, err := os.Stat(path); path == "" || errors.Is(err, os.ErrNotExist) {
+			return Config{}, nil
+		}
+	}
+
+	return LoadConfig(path)
+}
+
+// resolveTarget は設定ファイルのターゲットとコマンドラインフラグをマージします
+func resolveTarget(cmd *cobra.Command) (Target, error) {
+	var target Target
+
+	name := ""
+	if f := cmd.Flag("target"); f != nil {
+		name = f.Value.String()
+	}
+
+	if name != "" {
+		config, err := loadConfigFromFlags(cmd)
+		if err != nil {
+			return target, err
+		}
+
+		t, ok := config.Targets[name]
+		if !ok {
+			return target, fmt.Errorf("target %q not found in config", name)
+		}
+		target = t
+		target.Name = name
+	}
+
+	return mergeTarget(target, cmd.Flags()), nil
+}
+
+// resolveTargets は複数のターゲットを扱うコマンドのターゲットを返します
+// --target を指定した場合はそのターゲットだけを、指定しない場合は設定ファイルの全てのターゲットを返します
+// 設定ファイルにターゲットがない場合は、フラグだけのターゲットを default という名前で返します
+func resolveTargets(cmd *cobra.Command) (map[string]Target, error) {
+	if f := cmd.Flag("target"); f != nil && f.Value.String() != "" {
+		target, err := resolveTarget(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]Target{target.Name: target}, nil
+	}
+
+	config, err := loadConfigFromFlags(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := map[string]Target{}
+	for name, t := range config.Targets {
+		t.Name = name
+		targets[name] = mergeTarget(t, cmd.Flags())
+	}
+	if len(targets) == 0 {
+		target := mergeTarget(Target{Name: "default"}, cmd.Flags())
+		targets[target.Name] = target
+	}
+	return targets, nil
+}
+
+// configTargets は設定ファイルの全てのターゲットに名前とフラグのデフォルト値を補って返します
+func configTargets(config Config) map[string]Target {
+	defaults := pflag.NewFlagSet("defaults", pflag.ContinueOnError)
+	addDownloadFlags(defaults)
+
+	targets := map[string]Target{}
+	for name, t := range config.Targets {
+		t.Name = name
+		targets[name] = mergeTarget(t, defaults)
+	}
+	return targets
+}
+
+// mergeTarget はフラグの値でターゲットを上書きします
+// 明示的に指定されたフラグは常に優先し、未指定のフラグはターゲットの値が空の場合のみデフォルト値を使います
+func mergeTarget(target Target, flags *pflag.FlagSet) Target {
+	merge := func(name string, value *string) {
+		f := flags.Lookup(name)
+		if f == nil {
+			return
+		}
+		if f.Changed || *value == "" {
+			*value = f.Value.String()
+		}
+	}
+
+	merge("provider", &target.Provider)
+	merge("profile", &target.Profile)
+	merge("region", &target.Region)
+	merge("project", &target.Project)
+	merge("credentials", &target.Credentials)
+	merge("path", &target.Path)
+	merge("log-type", &target.LogType)
+	merge("output", &target.Output)
+	merge("format", &target.Format)
+	if f := flags.Lookup("row-group-size"); f != nil && (f.Changed || target.RowGroupSize == 0) {
+		target.RowGroupSize, _ = flags.GetInt64("row-group-size")
+	}
+	merge("filter", &target.Filter)
+	merge("warehouse", &target.Warehouse)
+	merge("opensearch-url", &target.OpenSearch.URL)
+	merge("opensearch-index", &target.OpenSearch.Index)
+	merge("otlp-endpoint", &target.OTLP.Endpoint)
+	merge("otlp-protocol", &target.OTLP.Protocol)
+
+	merge("ssh-user", &target.SSH.User)
+	merge("ssh-key", &target.SSH.Key)
+	merge("ssh-known-hosts", &target.SSH.KnownHosts)
+	merge("ssh-log-path", &target.SSH.LogPath)
+	merge("azure-subscription", &target.Azure.Subscription)
+	merge("azure-resource-group", &target.Azure.ResourceGroup)
+
+	mergeList := func(name string, value *[]string) {
+		f := flags.Lookup(name)
+		if f == nil || f.Value.String() == "" {
+			return
+		}
+		if f.Changed || len(*value) == 0 {
+			*value = strings.Split(f.Value.String(), ",")
+		}
+	}
+
+	mergeList("instance", &target.Instances)
+	mergeList("ssh-hosts", &target.SSH.Hosts)
+
+	target.Entries = mergeFilterOptions(target.Entries, flags)
+	target.Redact = mergeRedactOptions(target.Redact, flags)
+
+	return target
+}
+
+// addDownloadFlags はダウンロードに関するフラグを登録します
+func addDownloadFlags(flags *pflag.FlagSet) {
+	addTargetFlags(flags)
+	flags.StringP("output", "o", "stdout", "output file path (Go template: {{.Target}} {{.Provider}} {{.Instance}} {{.LogFile}} {{.Date}})")
+	flags.String("format", "slowlog", "output format (slowlog, jsonl, csv or parquet)")
+	flags.Int64("row-group-size", DefaultRowGroupSize, "rows per row group of parquet files")
+	flags.Bool("notify-dry-run", false, "print the notifications of the target instead of sending them")
+	flags.String("warehouse", "", "SQLite database to import the downloaded entries into (e.g. ~/.local/share/mysql-slowquery-downloder/warehouse.db)")
+	flags.String("opensearch-url", "", "OpenSearch or Elasticsearch URL to send the downloaded entries to with the bulk API")
+	flags.String("opensearch-index", "", "index of the documents (Go template: {{.Target}} {{.Provider}} {{.Instance}} {{.Date}}) (default \"mysql-slowquery-{{.Date}}\")")
+	flags.String("otlp-endpoint", "", "OTLP endpoint to export the downloaded entries to as log records (e.g. http://localhost:4318)")
+	flags.String("otlp-protocol", "", "OTLP protocol (http/protobuf or grpc) (default \"http/protobuf\")")
+	addRedactFlags(flags)
+}
+
+// addTargetFlags はターゲットのインスタンスとログを選ぶフラグを登録します
+func addTargetFlags(flags *pflag.FlagSet) {
+	flags.BoolP("debug", "d", false, "debug mode")
+	flags.String("target", "", "named target defined in the config file")
+	flags.String("instance", "", "instance name prefix (comma separated, default all instances)")
+	flags.String("filter", "", "log filter string")
+	flags.String("provider", "aws", "cloud provider (aws, gcp, azure, local or ssh)")
+	flags.String("profile", "", "AWS shared config profile")
+	flags.String("region", "", "AWS region")
+	flags.String("project", "", "GCP project ID")
+	flags.String("credentials", "", "path to GCP credentials file")
+	flags.String("path", "", "directory, file or glob of slow query logs for the local provider (comma separated)")
+	flags.String("ssh-hosts", "", "hosts for the ssh provider (comma separated)")
+	flags.String("ssh-user", "", "SSH user name")
+	flags.String("ssh-key", "", "path to SSH private key (SSH agent is used when SSH_AUTH_SOCK is set)")
+	flags.String("ssh-known-hosts", "", "path to known_hosts file (default ~/.ssh/known_hosts)")
+	flags.String("ssh-log-path", "", "glob of slow query log files on the host (default /var/log/mysql/mysql-slow.log*)")
+	flags.String("azure-subscription", "", "Azure subscription ID")
+	flags.String("azure-resource-group", "", "Azure resource group of the flexible servers")
+	flags.String("log-type", "slowquery", "log type to download")
+	addEntryFilterFlags(flags)
+}
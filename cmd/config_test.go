@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+const testConfig = `targets:
+  payments-prod:
+    provider: aws
+    profile: payments
+    region: ap-northeast-1
+    instances:
+      - payments-db-1
+      - payments-db-2
+    log_type: slowquery
+    output: "out/{{.Instance}}/{{.LogFile}}"
+    filter: "2024-05"
+  analytics:
+    provider: gcp
+    project: analytics-project
+    instances:
+      - analytics
+    format: jsonl
+  onprem:
+    provider: ssh
+    ssh:
+      user: mysql
+      key: ~/.ssh/id_ed25519
+      hosts:
+        - db1.example.com
+        - db2.example.com:2222
+`
+
+// newTestDownloadCmd はテスト用にダウンロードフラグを持つコマンドを生成します
+func newTestDownloadCmd(t *testing.T, args ...string) *cobra.Command {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &cobra.Command{Use: "test"}
+	cmd.Flags().String("config", path, "")
+	addDownloadFlags(cmd.Flags())
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
+	}
+
+	if len(config.Targets) != 3 {
+		t.Fatalf("LoadConfig() returned %d targets, want 3", len(config.Targets))
+	}
+
+	got := config.Targets["payments-prod"]
+	if got.Profile != "payments" || got.Region != "ap-northeast-1" {
+		t.Errorf("LoadConfig() payments-prod = %+v", got)
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadConfig() with missing file should return error")
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	testCases := []struct {
+		name     string
+		args     []string
+		expected Target
+		wantErr  bool
+	}{
+		{
+			name: "ターゲットの値をそのまま使う",
+			args: []string{"--target", "payments-prod"},
+			expected: Target{
+				Name:         "payments-prod",
+				Provider:     "aws",
+				Profile:      "payments",
+				Region:       "ap-northeast-1",
+				Instances:    []string{"payments-db-1", "payments-db-2"},
+				LogType:      "slowquery",
+				Output:       "out/{{.Instance}}/{{.LogFile}}",
+				Format:       "slowlog",
+				RowGroupSize: 100000,
+				Filter:       "2024-05",
+			},
+		},
+		{
+			name: "フラグがターゲットの値を上書きする",
+			args: []string{"--target", "payments-prod", "--region", "us-east-1", "--instance", "payments-db-3", "-o", "stdout"},
+			expected: Target{
+				Name:         "payments-prod",
+				Provider:     "aws",
+				Profile:      "payments",
+				Region:       "us-east-1",
+				Instances:    []string{"payments-db-3"},
+				LogType:      "slowquery",
+				Output:       "stdout",
+				Format:       "slowlog",
+				RowGroupSize: 100000,
+				Filter:       "2024-05",
+			},
+		},
+		{
+			name: "ターゲットにない値はフラグのデフォルト値を使う",
+			args: []string{"--target", "analytics"},
+			expected: Target{
+				Name:         "analytics",
+				Provider:     "gcp",
+				Project:      "analytics-project",
+				Instances:    []string{"analytics"},
+				LogType:      "slowquery",
+				Output:       "stdout",
+				Format:       "jsonl",
+				RowGroupSize: 100000,
+				Filter:       "",
+			},
+		},
+		{
+			name: "SSHのホスト一覧",
+			args: []string{"--target", "onprem", "--ssh-log-path", "/data/mysql/slow.log*"},
+			expected: Target{
+				Name:         "onprem",
+				Provider:     "ssh",
+				LogType:      "slowquery",
+				Output:       "stdout",
+				Format:       "slowlog",
+				RowGroupSize: 100000,
+				SSH: SSHConfig{
+					User:    "mysql",
+					Key:     "~/.ssh/id_ed25519",
+					LogPath: "/data/mysql/slow.log*",
+					Hosts:   []string{"db1.example.com", "db2.example.com:2222"},
+				},
+			},
+		},
+		{
+			name: "ターゲットなし",
+			args: []string{"--provider", "gcp", "--instance", "a,b"},
+			expected: Target{
+				Provider:     "gcp",
+				Instances:    []string{"a", "b"},
+				LogType:      "slowquery",
+				Output:       "stdout",
+				Format:       "slowlog",
+				RowGroupSize: 100000,
+				Filter:       "",
+			},
+		},
+		{
+			name: "インスタンスとフィルタを省略すると全てのインスタンスを対象にする",
+			args: []string{"--provider", "gcp"},
+			expected: Target{
+				Provider:     "gcp",
+				LogType:      "slowquery",
+				Output:       "stdout",
+				Format:       "slowlog",
+				RowGroupSize: 100000,
+				Filter:       "",
+			},
+		},
+		{
+			name:    "存在しないターゲット",
+			args:    []string{"--target", "unknown"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			target, err := resolveTarget(newTestDownloadCmd(t, tc.args...))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("resolveTarget() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+
+			if !reflect.DeepEqual(target, tc.expected) {
+				t.Errorf("resolveTarget() = %+v, want %+v", target, tc.expected)
+			}
+		})
+	}
+}
+
+func TestResolveTargets(t *testing.T) {
+	testCases := []struct {
+		name string
+		cmd  func(t *testing.T) *cobra.Command
+		want []string
+	}{
+		{
+			name: "設定ファイルの全てのターゲット",
+			cmd:  func(t *testing.T) *cobra.Command { return newTestDownloadCmd(t) },
+			want: []string{"analytics", "onprem", "payments-prod"},
+		},
+		{
+			name: "指定したターゲットだけ",
+			cmd:  func(t *testing.T) *cobra.Command { return newTestDownloadCmd(t, "--target", "analytics") },
+			want: []string{"analytics"},
+		},
+		{
+			name: "設定ファイルがない場合はフラグのターゲット",
+			cmd: func(t *testing.T) *cobra.Command {
+				t.Setenv("HOME", t.TempDir())
+				cmd := &cobra.Command{Use: "test"}
+				cmd.Flags().String("config", "", "")
+				addTargetFlags(cmd.Flags())
+				if err := cmd.ParseFlags([]string{"--provider", "local", "--path", "logs"}); err != nil {
+					t.Fatal(err)
+				}
+				return cmd
+			},
+			want: []string{"default"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targets, err := resolveTargets(tc.cmd(t))
+			if err != nil {
+				t.Fatalf("resolveTargets() returned error: %v", err)
+			}
+			var names []string
+			for name, target := range targets {
+				if target.Name != name {
+					t.Errorf("target %q has name %q", name, target.Name)
+				}
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tc.want) {
+				t.Errorf("resolveTargets() = %v, want %v", names, tc.want)
+			}
+		})
+	}
+
+	targets, _ := resolveTargets(newTestDownloadCmd(t, "--region", "us-east-1"))
+	if targets["payments-prod"].Region != "us-east-1" || targets["analytics"].Provider != "gcp" {
+		t.Errorf("resolveTargets() did not merge the flags: %+v", targets)
+	}
+}
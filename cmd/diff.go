@@ -0,0 +1,412 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DiffSpec は比較する一方のログと期間です
+// "<path>[,<path>...][@<start>/<end>]" の形式で指定し、期間の開始と終了はどちらも省略できます
+type DiffSpec struct {
+	Paths []string
+	Start time.Time
+	End   time.Time
+}
+
+// diffTimeLayouts は期間に指定できる時刻の形式です。タイムゾーンのない形式はUTCとして扱います
+var diffTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ParseDiffSpec は --before と --after の値を解析します
+// パスを省略した場合は defaultPaths を使います
+func ParseDiffSpec(s string, defaultPaths []string) (DiffSpec, error) {
+	var spec DiffSpec
+
+	paths, window, hasWindow := strings.Cut(s, "@")
+	spec.Paths = splitList(paths)
+	if len(spec.Paths) == 0 {
+		spec.Paths = defaultPaths
+	}
+	if len(spec.Paths) == 0 {
+		return spec, fmt.Errorf("no log paths in %q: give paths before '@' or as arguments", s)
+	}
+
+	if hasWindow {
+		start, end, ok := strings.Cut(window, "/")
+		if !ok {
+			return spec, fmt.Errorf("invalid time window %q: use <start>/<end>", window)
+		}
+
+		var err error
+		if spec.Start, err = parseDiffTime(start); err != nil {
+			return spec, err
+		}
+		if spec.End, err = parseDiffTime(end); err != nil {
+			return spec, err
+		}
+		if !spec.Start.IsZero() && !spec.End.IsZero() && !spec.Start.Before(spec.End) {
+			return spec, fmt.Errorf("invalid time window %q: start must be before end", window)
+		}
+	}
+
+	return spec, nil
+}
+
+func parseDiffTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range diffTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use RFC 3339 or YYYY-MM-DD[THH:MM[:SS]]", s)
+}
+
+// Contains はエントリが期間に含まれるかどうかを返します。期間の終了は含みません
+func (s DiffSpec) Contains(r Record) bool {
+	if s.Start.IsZero() && s.End.IsZero() {
+		return true
+	}
+
+	t := r.StartTime()
+	if t.IsZero() {
+		return false
+	}
+	return !t.Before(s.Start) && (s.End.IsZero() || t.Before(s.End))
+}
+
+// LoadDigest はログを読み込み、期間とフィルタに合うエントリを集計します
+func LoadDigest(logger *slog.Logger, spec DiffSpec, filter *EntryFilter) (*Digest, error) {
+	client, err := NewLocalClient(logger, strings.Join(spec.Paths, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	digest := NewDigest()
+	err = ReadRecords(client, client.GetInstanceList(), func(r Record) error {
+		if spec.Contains(r) && filter.Match(r.Entry) {
+			digest.Add(r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	filter.WarnErrors(logger)
+	return digest, nil
+}
+
+// DiffStatus はフィンガープリントの比較結果です
+type DiffStatus string
+
+const (
+	DiffRegressed DiffStatus = "regressed"
+	DiffNew       DiffStatus = "new"
+	DiffVanished  DiffStatus = "vanished"
+	DiffImproved  DiffStatus = "improved"
+	DiffUnchanged DiffStatus = "unchanged"
+)
+
+// diffStatusOrder はレポートに出力する順序です
+var diffStatusOrder = map[DiffStatus]int{
+	DiffRegressed: 0,
+	DiffNew:       1,
+	DiffVanished:  2,
+	DiffImproved:  3,
+	DiffUnchanged: 4,
+}
+
+// DiffOptions は比較の条件です
+type DiffOptions struct {
+	// Threshold は p95 または合計時間がこの割合 (%) を超えて増えた場合に悪化とみなす閾値です
+	Threshold float64
+	// MinCount は悪化の判定に必要な比較後の実行回数です。これより少ないクエリは判定しません
+	MinCount int64
+	// All は変化のないクエリも出力するかどうかです
+	All bool
+}
+
+// DiffClass はフィンガープリントごとの比較結果です
+type DiffClass struct {
+	Status DiffStatus
+	Before *Class
+	After  *Class
+}
+
+// ID はフィンガープリントの識別子を返します
+func (c DiffClass) ID() string {
+	if c.After != nil {
+		return c.After.ID
+	}
+	return c.Before.ID
+}
+
+// Fingerprint はフィンガープリントを返します
+func (c DiffClass) Fingerprint() string {
+	if c.After != nil {
+		return c.After.Fingerprint
+	}
+	return c.Before.Fingerprint
+}
+
+// P95Change は p95 の変化率 (%) を返します。比較前がない場合はfalseを返します
+func (c DiffClass) P95Change() (float64, bool) {
+	return change(classP95(c.Before), classP95(c.After), c.Before != nil && c.After != nil)
+}
+
+// TotalChange は合計時間の変化率 (%) を返します。比較前がない場合はfalseを返します
+func (c DiffClass) TotalChange() (float64, bool) {
+	return change(classTotal(c.Before), classTotal(c.After), c.Before != nil && c.After != nil)
+}
+
+// impact は合計時間の変化量の絶対値です。レポートの並び順に使います
+func (c DiffClass) impact() float64 {
+	return math.Abs(classTotal(c.After) - classTotal(c.Before))
+}
+
+func classP95(c *Class) float64 {
+	if c == nil {
+		return 0
+	}
+	return c.Latency.Quantile(0.95)
+}
+
+func classTotal(c *Class) float64 {
+	if c == nil {
+		return 0
+	}
+	return c.QueryTime.Total
+}
+
+func classCount(c *Class) float64 {
+	if c == nil {
+		return 0
+	}
+	return float64(c.Count)
+}
+
+func change(before, after float64, ok bool) (float64, bool) {
+	if !ok || before == 0 {
+		return 0, false
+	}
+	return (after - before) / before * 100, true
+}
+
+// DiffResult は2つの集計の比較結果です
+type DiffResult struct {
+	Before  *Digest
+	After   *Digest
+	Options DiffOptions
+	Classes []DiffClass
+}
+
+// Count は状態ごとのフィンガープリントの数を返します
+func (r *DiffResult) Count(status DiffStatus) int {
+	n := 0
+	for _, c := range r.Classes {
+		if c.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// CompareDigests はフィンガープリントごとに2つの集計を比較します
+func CompareDigests(before, after *Digest, opts DiffOptions) *DiffResult {
+	result := &DiffResult{Before: before, After: after, Options: opts}
+
+	for fingerprint, a := range after.classes {
+		c := DiffClass{Before: before.classes[fingerprint], After: a}
+		c.Status = diffStatus(c, opts)
+		result.Classes = append(result.Classes, c)
+	}
+	for fingerprint, b := range before.classes {
+		if _, ok := after.classes[fingerprint]; !ok {
+			result.Classes = append(result.Classes, DiffClass{Status: DiffVanished, Before: b})
+		}
+	}
+
+	sort.Slice(result.Classes, func(i, j int) bool {
+		ci, cj := result.Classes[i], result.Classes[j]
+		if ci.Status != cj.Status {
+			return diffStatusOrder[ci.Status] < diffStatusOrder[cj.Status]
+		}
+		if ci.impact() != cj.impact() {
+			return ci.impact() > cj.impact()
+		}
+		return ci.ID() < cj.ID()
+	})
+
+	if !opts.All {
+		classes := result.Classes[:0]
+		for _, c := range result.Classes {
+			if c.Status != DiffUnchanged && c.Status != DiffImproved {
+				classes = append(classes, c)
+			}
+		}
+		result.Classes = classes
+	}
+	return result
+}
+
+func diffStatus(c DiffClass, opts DiffOptions) DiffStatus {
+	if c.Before == nil {
+		return DiffNew
+	}
+
+	p95, _ := c.P95Change()
+	total, _ := c.TotalChange()
+	if c.After.Count >= opts.MinCount && (p95 > opts.Threshold || total > opts.Threshold) {
+		return DiffRegressed
+	}
+	if p95 < -opts.Threshold && total < -opts.Threshold {
+		return DiffImproved
+	}
+	return DiffUnchanged
+}
+
+// WriteTextDiff は比較結果を順位付きの表として書き出します
+func WriteTextDiff(w io.Writer, r *DiffResult) error {
+	var b strings.Builder
+
+	writeDigestSummary(&b, "Before", r.Before)
+	writeDigestSummary(&b, "After", r.After)
+	fmt.Fprintf(&b, "# Regressed: %d, New: %d, Vanished: %d (threshold %.0f%%)\n\n",
+		r.Count(DiffRegressed), r.Count(DiffNew), r.Count(DiffVanished), r.Options.Threshold)
+
+	fmt.Fprintf(&b, "# %4s %-10s %-16s %15s %21s %21s  %s\n",
+		"Rank", "Status", "Query ID", "Calls", "p95", "Total", "Item")
+	for i, c := range r.Classes {
+		fmt.Fprintf(&b, "# %4d %-10s %-16s %15s %21s %21s  %s\n",
+			i+1, c.Status, c.ID(),
+			formatDiffSide(c.Before, "%.0f", classCount)+" -> "+formatDiffSide(c.After, "%.0f", classCount),
+			formatDiffValue(c, classP95, c.P95Change),
+			formatDiffValue(c, classTotal, c.TotalChange),
+			truncate(c.Fingerprint(), 40))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeDigestSummary(b *strings.Builder, name string, d *Digest) {
+	fmt.Fprintf(b, "# %-7s %d queries, %d unique, total %s", name+":", d.QueryTime.Count, d.Len(), formatSeconds(d.QueryTime.Total))
+	if !d.FirstSeen.IsZero() {
+		fmt.Fprintf(b, ", %s to %s", formatTime(d.FirstSeen), formatTime(d.LastSeen))
+	}
+	b.WriteByte('\n')
+}
+
+// formatDiffValue は "比較前 -> 比較後 変化率" の形式で返します
+func formatDiffValue(c DiffClass, value func(*Class) float64, changeFn func() (float64, bool)) string {
+	s := formatDiffSide(c.Before, "%.3f", value) + " -> " + formatDiffSide(c.After, "%.3f", value)
+	if pct, ok := changeFn(); ok {
+		s += fmt.Sprintf(" %+.0f%%", pct)
+	}
+	return s
+}
+
+// formatDiffSide は一方の値を返します。その期間にクエリがない場合は - を返します
+func formatDiffSide(c *Class, format string, value func(*Class) float64) string {
+	if c == nil {
+		return "-"
+	}
+	return fmt.Sprintf(format, value(c))
+}
+
+// JSONDiff はJSON形式の比較結果です
+type JSONDiff struct {
+	Before    JSONOverall     `json:"before"`
+	After     JSONOverall     `json:"after"`
+	Threshold float64         `json:"threshold"`
+	Regressed int             `json:"regressed"`
+	New       int             `json:"new"`
+	Vanished  int             `json:"vanished"`
+	Classes   []JSONDiffClass `json:"classes"`
+}
+
+// JSONDiffClass はフィンガープリントごとの比較結果です。比較前または比較後にない場合は null です
+type JSONDiffClass struct {
+	Rank        int           `json:"rank"`
+	Status      DiffStatus    `json:"status"`
+	ID          string        `json:"id"`
+	Fingerprint string        `json:"fingerprint"`
+	Before      *JSONDiffSide `json:"before"`
+	After       *JSONDiffSide `json:"after"`
+	P95Change   *float64      `json:"p95_change"`
+	TotalChange *float64      `json:"total_change"`
+}
+
+// JSONDiffSide は一方の期間の集計です
+type JSONDiffSide struct {
+	Count int64   `json:"count"`
+	Total float64 `json:"total"`
+	Avg   float64 `json:"avg"`
+	P95   float64 `json:"p95"`
+	Max   float64 `json:"max"`
+}
+
+func newJSONDiffSide(c *Class) *JSONDiffSide {
+	if c == nil {
+		return nil
+	}
+	return &JSONDiffSide{
+		Count: c.Count,
+		Total: c.QueryTime.Total,
+		Avg:   c.QueryTime.Avg(),
+		P95:   c.Latency.Quantile(0.95),
+		Max:   c.QueryTime.Max,
+	}
+}
+
+func changePtr(v float64, ok bool) *float64 {
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
+// WriteJSONDiff は比較結果をJSON形式で書き出します
+func WriteJSONDiff(w io.Writer, r *DiffResult) error {
+	diff := JSONDiff{
+		Before:    newJSONOverall(r.Before),
+		After:     newJSONOverall(r.After),
+		Threshold: r.Options.Threshold,
+		Regressed: r.Count(DiffRegressed),
+		New:       r.Count(DiffNew),
+		Vanished:  r.Count(DiffVanished),
+		Classes:   []JSONDiffClass{},
+	}
+
+	for i, c := range r.Classes {
+		diff.Classes = append(diff.Classes, JSONDiffClass{
+			Rank:        i + 1,
+			Status:      c.Status,
+			ID:          c.ID(),
+			Fingerprint: c.Fingerprint(),
+			Before:      newJSONDiffSide(c.Before),
+			After:       newJSONDiffSide(c.After),
+			P95Change:   changePtr(c.P95Change()),
+			TotalChange: changePtr(c.TotalChange()),
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(diff)
+}
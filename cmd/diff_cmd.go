@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// diffRegressionExitCode はクエリの悪化が見つかった場合の終了コードです
+// その他のエラーの終了コード1と区別できるように2を使います
+const diffRegressionExitCode = 2
+
+// diffCmd は2つの期間または2つのインスタンスのスロークエリログを比較するコマンドです
+var diffCmd = &cobra.Command{
+	Use:   "diff --before <logs|window> --after <logs|window> [flags] [<path>...]",
+	Short: "Compare query fingerprints between two periods or instances",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, _ := cmd.Flags().GetBool("debug")
+		logger := NewLogger("info")
+		if debug {
+			logger = NewLogger("debug")
+		}
+
+		beforeFlag, _ := cmd.Flags().GetString("before")
+		afterFlag, _ := cmd.Flags().GetString("after")
+		format, _ := cmd.Flags().GetString("format")
+		threshold, _ := cmd.Flags().GetFloat64("threshold")
+		minCount, _ := cmd.Flags().GetInt64("min-count")
+		all, _ := cmd.Flags().GetBool("all")
+
+		if format != "text" && format != "json" {
+			return fmt.Errorf("Unsupported format: %s. Use 'text' or 'json'", format)
+		}
+
+		before, err := ParseDiffSpec(beforeFlag, args)
+		if err != nil {
+			return fmt.Errorf("--before: %w", err)
+		}
+		after, err := ParseDiffSpec(afterFlag, args)
+		if err != nil {
+			return fmt.Errorf("--after: %w", err)
+		}
+
+		filter, err := NewEntryFilter(mergeFilterOptions(FilterOptions{}, cmd.Flags()))
+		if err != nil {
+			return err
+		}
+
+		beforeDigest, err := LoadDigest(logger, before, filter)
+		if err != nil {
+			return err
+		}
+		afterDigest, err := LoadDigest(logger, after, filter)
+		if err != nil {
+			return err
+		}
+
+		result := CompareDigests(beforeDigest, afterDigest, DiffOptions{Threshold: threshold, MinCount: minCount, All: all})
+		if format == "json" {
+			err = WriteJSONDiff(cmd.OutOrStdout(), result)
+		} else {
+			err = WriteTextDiff(cmd.OutOrStdout(), result)
+		}
+		if err != nil {
+			return err
+		}
+
+		if n := result.Count(DiffRegressed); n > 0 {
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+			return &ExitError{Code: diffRegressionExitCode, Err: fmt.Errorf("%d query regressions found", n)}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().BoolP("debug", "d", false, "debug mode")
+	diffCmd.Flags().String("before", "", "logs and/or time window before the change: <path>[,<path>...][@<start>/<end>]")
+	diffCmd.Flags().String("after", "", "logs and/or time window after the change: <path>[,<path>...][@<start>/<end>]")
+	diffCmd.Flags().String("format", "text", "output format (text or json)")
+	diffCmd.Flags().Float64("threshold", 20, "report a query as regressed when its p95 or total time grows by more than this percentage")
+	diffCmd.Flags().Int64("min-count", 1, "minimum calls after the change for a query to be reported as regressed")
+	diffCmd.Flags().Bool("all", false, "also show improved and unchanged queries")
+	diffCmd.MarkFlagRequired("before")
+	diffCmd.MarkFlagRequired("after")
+	addEntryFilterFlags(diffCmd.Flags())
+}
@@ -0,0 +1,273 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDiffSpec(t *testing.T) {
+	testCases := []struct {
+		name     string
+		spec     string
+		args     []string
+		expected DiffSpec
+		wantErr  bool
+	}{
+		{
+			name:     "パスだけ",
+			spec:     "before/,old.log",
+			expected: DiffSpec{Paths: []string{"before/", "old.log"}},
+		},
+		{
+			name: "パスと期間",
+			spec: "logs@2023-05-10/2023-05-11T12:00",
+			expected: DiffSpec{
+				Paths: []string{"logs"},
+				Start: time.Date(2023, 5, 10, 0, 0, 0, 0, time.UTC),
+				End:   time.Date(2023, 5, 11, 12, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "期間だけの場合は引数のパスを使う",
+			spec: "@2023-05-10T09:00:00+09:00/",
+			args: []string{"testdata"},
+			expected: DiffSpec{
+				Paths: []string{"testdata"},
+				Start: time.Date(2023, 5, 10, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{name: "パスがない", spec: "@2023-05-10/2023-05-11", wantErr: true},
+		{name: "期間の区切りがない", spec: "logs@2023-05-10", wantErr: true},
+		{name: "不正な時刻", spec: "logs@yesterday/today", wantErr: true},
+		{name: "開始が終了より後", spec: "logs@2023-05-11/2023-05-10", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseDiffSpec(tc.spec, tc.args)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseDiffSpec() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.Paths, tc.expected.Paths) || !got.Start.Equal(tc.expected.Start) || !got.End.Equal(tc.expected.End) {
+				t.Errorf("ParseDiffSpec() = %+v, want %+v", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestDiffSpecContains(t *testing.T) {
+	spec := DiffSpec{
+		Start: time.Date(2023, 5, 10, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2023, 5, 11, 0, 0, 0, 0, time.UTC),
+	}
+
+	testCases := []struct {
+		name     string
+		ts       int64
+		expected bool
+	}{
+		{name: "期間内", ts: time.Date(2023, 5, 10, 12, 0, 0, 0, time.UTC).Unix(), expected: true},
+		{name: "開始時刻ちょうど", ts: spec.Start.Unix(), expected: true},
+		{name: "終了時刻ちょうど", ts: spec.End.Unix(), expected: false},
+		{name: "期間より前", ts: time.Date(2023, 5, 9, 23, 59, 59, 0, time.UTC).Unix(), expected: false},
+		{name: "時刻がない", ts: 0, expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRecord("db-1", "SELECT 1", 1, 1, 1, tc.ts)
+			if got := spec.Contains(r); got != tc.expected {
+				t.Errorf("Contains() = %v, want %v", got, tc.expected)
+			}
+		})
+	}
+
+	if !(DiffSpec{}).Contains(newTestRecord("db-1", "SELECT 1", 1, 1, 1, 0)) {
+		t.Error("Contains() without window should return true")
+	}
+}
+
+// newTestDiffDigests は比較前と比較後のテスト用の集計を生成します
+func newTestDiffDigests() (*Digest, *Digest) {
+	before := NewDigest()
+	after := NewDigest()
+
+	for i := 0; i < 10; i++ {
+		// 変化なし
+		before.Add(newTestRecord("db-1", "SELECT * FROM users WHERE id = 1", 1.0, 1, 1, 1683721815))
+		after.Add(newTestRecord("db-1", "SELECT * FROM users WHERE id = 2", 1.1, 1, 1, 1683808215))
+		// p95 が悪化
+		before.Add(newTestRecord("db-1", "SELECT * FROM orders WHERE user_id = 1", 0.5, 1, 1, 1683721815))
+		after.Add(newTestRecord("db-1", "SELECT * FROM orders WHERE user_id = 1", 2.0, 1, 1, 1683808215))
+		// 改善
+		before.Add(newTestRecord("db-1", "SELECT COUNT(*) FROM items", 4.0, 1, 1, 1683721815))
+		after.Add(newTestRecord("db-1", "SELECT COUNT(*) FROM items", 1.0, 1, 1, 1683808215))
+	}
+	// 合計時間が悪化 (p95 は同じで実行回数が増えた)
+	for i := 0; i < 2; i++ {
+		before.Add(newTestRecord("db-1", "UPDATE jobs SET state = 'done' WHERE id = 1", 1.0, 0, 1, 1683721815))
+	}
+	for i := 0; i < 5; i++ {
+		after.Add(newTestRecord("db-1", "UPDATE jobs SET state = 'done' WHERE id = 1", 1.0, 0, 1, 1683808215))
+	}
+	// 新規と消滅
+	after.Add(newTestRecord("db-1", "DELETE FROM sessions WHERE expired = 1", 3.0, 0, 1, 1683808215))
+	before.Add(newTestRecord("db-1", "SELECT * FROM legacy", 2.0, 1, 1, 1683721815))
+
+	return before, after
+}
+
+func TestCompareDigests(t *testing.T) {
+	before, after := newTestDiffDigests()
+
+	testCases := []struct {
+		name     string
+		opts     DiffOptions
+		expected []DiffStatus
+	}{
+		{
+			name:     "悪化、新規、消滅だけ",
+			opts:     DiffOptions{Threshold: 20, MinCount: 1},
+			expected: []DiffStatus{DiffRegressed, DiffRegressed, DiffNew, DiffVanished},
+		},
+		{
+			name:     "全て",
+			opts:     DiffOptions{Threshold: 20, MinCount: 1, All: true},
+			expected: []DiffStatus{DiffRegressed, DiffRegressed, DiffNew, DiffVanished, DiffImproved, DiffUnchanged},
+		},
+		{
+			name:     "閾値が大きい",
+			opts:     DiffOptions{Threshold: 500, MinCount: 1},
+			expected: []DiffStatus{DiffNew, DiffVanished},
+		},
+		{
+			name:     "実行回数が少ないクエリは悪化と判定しない",
+			opts:     DiffOptions{Threshold: 20, MinCount: 6},
+			expected: []DiffStatus{DiffRegressed, DiffNew, DiffVanished},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := CompareDigests(before, after, tc.opts)
+
+			var got []DiffStatus
+			for _, c := range result.Classes {
+				got = append(got, c.Status)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("CompareDigests() statuses = %v, want %v", got, tc.expected)
+			}
+		})
+	}
+
+	result := CompareDigests(before, after, DiffOptions{Threshold: 20, MinCount: 1})
+	// 悪化したクエリは合計時間の変化が大きい順に並ぶ
+	if got := result.Classes[0].Fingerprint(); got != "select * from orders where user_id = ?" {
+		t.Errorf("Classes[0] = %v", got)
+	}
+	if pct, ok := result.Classes[1].TotalChange(); !ok || pct != 150 {
+		t.Errorf("TotalChange() = %v, %v, want 150", pct, ok)
+	}
+	if _, ok := result.Classes[2].P95Change(); ok {
+		t.Error("P95Change() of new query should return false")
+	}
+}
+
+func TestWriteDiff(t *testing.T) {
+	before, after := newTestDiffDigests()
+	result := CompareDigests(before, after, DiffOptions{Threshold: 20, MinCount: 1})
+
+	var buf bytes.Buffer
+	if err := WriteTextDiff(&buf, result); err != nil {
+		t.Fatalf("WriteTextDiff() returned error: %v", err)
+	}
+	text := buf.String()
+	for _, want := range []string{
+		"# Before: 33 queries, 5 unique",
+		"# Regressed: 2, New: 1, Vanished: 1 (threshold 20%)",
+		"regressed  ",
+		"0.500 -> 2.000 +300%",
+		"- -> 1",
+		"1 -> -",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("WriteTextDiff() does not contain %q:\n%s", want, text)
+		}
+	}
+
+	buf.Reset()
+	if err := WriteJSONDiff(&buf, result); err != nil {
+		t.Fatalf("WriteJSONDiff() returned error: %v", err)
+	}
+	var diff JSONDiff
+	if err := json.Unmarshal(buf.Bytes(), &diff); err != nil {
+		t.Fatalf("WriteJSONDiff() returned invalid JSON: %v", err)
+	}
+	if diff.Regressed != 2 || diff.New != 1 || diff.Vanished != 1 || len(diff.Classes) != 4 {
+		t.Errorf("WriteJSONDiff() = %+v", diff)
+	}
+	if c := diff.Classes[2]; c.Status != DiffNew || c.Before != nil || c.P95Change != nil || c.After.Count != 1 {
+		t.Errorf("WriteJSONDiff() new class = %+v", c)
+	}
+}
+
+func TestDiffCommandExitCode(t *testing.T) {
+	dir := t.TempDir()
+	before, after := newTestDiffDigests()
+	for name, d := range map[string]*Digest{"before.log": before, "after.log": after} {
+		var b strings.Builder
+		for _, c := range d.classes {
+			for i := int64(0); i < c.Count; i++ {
+				c.Example.WriteTo(&b)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(b.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		args     []string
+		wantCode int
+	}{
+		{name: "悪化あり", args: []string{"--threshold", "20"}, wantCode: diffRegressionExitCode},
+		{name: "悪化なし", args: []string{"--threshold", "1000"}, wantCode: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			rootCmd.SetOut(&out)
+			rootCmd.SetArgs(append([]string{"diff",
+				"--before", filepath.Join(dir, "before.log"),
+				"--after", filepath.Join(dir, "after.log")}, tc.args...))
+			t.Cleanup(func() {
+				rootCmd.SetOut(nil)
+				rootCmd.SetArgs(nil)
+				diffCmd.Flags().Set("threshold", "20")
+			})
+
+			err := rootCmd.Execute()
+			code := 0
+			if exitErr, ok := err.(*ExitError); ok {
+				code = exitErr.Code
+			} else if err != nil {
+				t.Fatalf("diff returned error: %v", err)
+			}
+			if code != tc.wantCode {
+				t.Errorf("exit code = %d, want %d\n%s", code, tc.wantCode, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+)
+
+// Record は取得元の情報を付けたスロークエリログのエントリです
+type Record struct {
+	*parser.Entry
+	Instance string
+	Provider string
+	Source   string
+}
+
+// Stats は数値の件数、合計、最小値、最大値を集計します
+type Stats struct {
+	Count int64   `json:"count"`
+	Total float64 `json:"total"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// Add は値を集計に加えます
+func (s *Stats) Add(v float64) {
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Total += v
+}
+
+// Avg は平均値を返します
+func (s Stats) Avg() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / float64(s.Count)
+}
+
+// Class はフィンガープリントごとのクエリの集計です
+type Class struct {
+	ID           string
+	Fingerprint  string
+	Count        int64
+	QueryTime    Stats
+	LockTime     Stats
+	RowsSent     Stats
+	RowsExamined Stats
+	FirstSeen    time.Time
+	LastSeen     time.Time
+	Databases    map[string]int64
+	Users        map[string]int64
+	Instances    map[string]int64
+
+	// Latency は Query_time のパーセンタイルとヒストグラムを求めるためのSketchです
+	Latency *Sketch
+
+	// Example はこのクラスで最も Query_time が長かったエントリです
+	Example Record
+}
+
+// RowsRatio は Rows_examined の合計を Rows_sent の合計で割った値を返します
+func (c *Class) RowsRatio() float64 {
+	return c.RowsExamined.Total / math.Max(c.RowsSent.Total, 1)
+}
+
+// Digest はフィンガープリントごとにエントリを集計します
+type Digest struct {
+	QueryTime Stats
+	FirstSeen time.Time
+	LastSeen  time.Time
+	classes   map[string]*Class
+}
+
+// NewDigest は空のDigestを生成します
+func NewDigest() *Digest {
+	return &Digest{classes: map[string]*Class{}}
+}
+
+// Add はエントリを集計に加えます
+func (d *Digest) Add(r Record) {
+	fingerprint := Fingerprint(r.Statement)
+
+	c, ok := d.classes[fingerprint]
+	if !ok {
+		c = &Class{
+			ID:          FingerprintID(fingerprint),
+			Fingerprint: fingerprint,
+			Databases:   map[string]int64{},
+			Users:       map[string]int64{},
+			Instances:   map[string]int64{},
+			Latency:     NewSketch(),
+		}
+		d.classes[fingerprint] = c
+	}
+
+	if c.Count == 0 || r.QueryTime > c.QueryTime.Max {
+		c.Example = r
+	}
+
+	c.Count++
+	c.QueryTime.Add(r.QueryTime)
+	c.Latency.Add(r.QueryTime)
+	c.LockTime.Add(r.LockTime)
+	c.RowsSent.Add(float64(r.RowsSent))
+	c.RowsExamined.Add(float64(r.RowsExamined))
+	if r.DB != "" {
+		c.Databases[r.DB]++
+	}
+	if r.User != "" {
+		c.Users[r.User]++
+	}
+	if r.Instance != "" {
+		c.Instances[r.Instance]++
+	}
+
+	d.QueryTime.Add(r.QueryTime)
+	if t := r.StartTime(); !t.IsZero() {
+		if c.FirstSeen.IsZero() || t.Before(c.FirstSeen) {
+			c.FirstSeen = t
+		}
+		if t.After(c.LastSeen) {
+			c.LastSeen = t
+		}
+		if d.FirstSeen.IsZero() || t.Before(d.FirstSeen) {
+			d.FirstSeen = t
+		}
+		if t.After(d.LastSeen) {
+			d.LastSeen = t
+		}
+	}
+}
+
+// Len はフィンガープリントの数を返します
+func (d *Digest) Len() int {
+	return len(d.classes)
+}
+
+// Classes は集計結果を orderBy の降順で返します
+// orderBy には total、count、avg、max、lock、rows を指定できます
+func (d *Digest) Classes(orderBy string) []*Class {
+	classes := make([]*Class, 0, len(d.classes))
+	for _, c := range d.classes {
+		classes = append(classes, c)
+	}
+
+	key := func(c *Class) float64 {
+		switch orderBy {
+		case "count":
+			return float64(c.Count)
+		case "avg":
+			return c.QueryTime.Avg()
+		case "max":
+			return c.QueryTime.Max
+		case "lock":
+			return c.LockTime.Total
+		case "rows":
+			return c.RowsExamined.Total
+		default:
+			return c.QueryTime.Total
+		}
+	}
+
+	sort.Slice(classes, func(i, j int) bool {
+		ki, kj := key(classes[i]), key(classes[j])
+		if ki != kj {
+			return ki > kj
+		}
+		return classes[i].ID < classes[j].ID
+	})
+	return classes
+}
+
+// ReportOptions はレポートの出力内容を指定します
+type ReportOptions struct {
+	Top     int
+	OrderBy string
+}
+
+// rankedClasses はレポートに出力するクラスを返します
+func rankedClasses(d *Digest, opts ReportOptions) []*Class {
+	classes := d.Classes(opts.OrderBy)
+	if opts.Top > 0 && len(classes) > opts.Top {
+		classes = classes[:opts.Top]
+	}
+	return classes
+}
+
+// WriteTextReport はpt-query-digestに似たテキスト形式のレポートを書き出します
+func WriteTextReport(w io.Writer, d *Digest, opts ReportOptions) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Overall: %d queries, %d unique\n", d.QueryTime.Count, d.Len())
+	if !d.FirstSeen.IsZero() {
+		fmt.Fprintf(&b, "# Time range: %s to %s\n", formatTime(d.FirstSeen), formatTime(d.LastSeen))
+	}
+	fmt.Fprintf(&b, "# Total query time: %s\n\n", formatSeconds(d.QueryTime.Total))
+
+	classes := rankedClasses(d, opts)
+
+	b.WriteString("# Profile\n")
+	fmt.Fprintf(&b, "# %4s %-16s %14s %6s %7s %10s %10s %10s %12s  %s\n",
+		"Rank", "Query ID", "Response time", "", "Calls", "R/Call", "p95", "Max", "Exam/Sent", "Item")
+	for i, c := range classes {
+		fmt.Fprintf(&b, "# %4d %-16s %14s %5.1f%% %7d %10s %10s %10s %12.1f  %s\n",
+			i+1, c.ID, formatSeconds(c.QueryTime.Total), percent(c.QueryTime.Total, d.QueryTime.Total), c.Count,
+			formatSeconds(c.QueryTime.Avg()), formatSeconds(c.Latency.Quantile(0.95)), formatSeconds(c.QueryTime.Max),
+			c.RowsRatio(), truncate(c.Fingerprint, 40))
+	}
+
+	for i, c := range classes {
+		fmt.Fprintf(&b, "\n# Query %d: ID %s\n", i+1, c.ID)
+		fmt.Fprintf(&b, "# Fingerprint: %s\n", c.Fingerprint)
+		fmt.Fprintf(&b, "# Count: %d (%.1f%% of total query time)\n", c.Count, percent(c.QueryTime.Total, d.QueryTime.Total))
+		if !c.FirstSeen.IsZero() {
+			fmt.Fprintf(&b, "# Time range: %s to %s\n", formatTime(c.FirstSeen), formatTime(c.LastSeen))
+		}
+		fmt.Fprintf(&b, "# %-14s %12s %12s %12s\n", "Attribute", "total", "avg", "max")
+		fmt.Fprintf(&b, "# %-14s %12s %12s %12s\n", "Query_time",
+			formatSeconds(c.QueryTime.Total), formatSeconds(c.QueryTime.Avg()), formatSeconds(c.QueryTime.Max))
+		fmt.Fprintf(&b, "# %-14s %12s %12s %12s\n", "Lock_time",
+			formatSeconds(c.LockTime.Total), formatSeconds(c.LockTime.Avg()), formatSeconds(c.LockTime.Max))
+		fmt.Fprintf(&b, "# %-14s %12.0f %12.0f %12.0f\n", "Rows_sent", c.RowsSent.Total, c.RowsSent.Avg(), c.RowsSent.Max)
+		fmt.Fprintf(&b, "# %-14s %12.0f %12.0f %12.0f\n", "Rows_examined", c.RowsExamined.Total, c.RowsExamined.Avg(), c.RowsExamined.Max)
+		fmt.Fprintf(&b, "# Rows examined/sent: %.1f\n", c.RowsRatio())
+		fmt.Fprintf(&b, "# Query_time percentiles: p50 %s  p95 %s  p99 %s  max %s\n",
+			formatSeconds(c.Latency.Quantile(0.5)), formatSeconds(c.Latency.Quantile(0.95)),
+			formatSeconds(c.Latency.Quantile(0.99)), formatSeconds(c.QueryTime.Max))
+		b.WriteString("# Query_time distribution\n")
+		writeHistogram(&b, c.Latency.Histogram())
+		if len(c.Databases) > 0 {
+			fmt.Fprintf(&b, "# Databases: %s\n", formatCounts(c.Databases))
+		}
+		if len(c.Users) > 0 {
+			fmt.Fprintf(&b, "# Users: %s\n", formatCounts(c.Users))
+		}
+		if len(c.Instances) > 0 {
+			fmt.Fprintf(&b, "# Instances: %s\n", formatCounts(c.Instances))
+		}
+		b.WriteString("# Example:\n")
+		b.WriteString(c.Example.Statement)
+		b.WriteString(";\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// histogramWidth はヒストグラムの最も長いバーの長さです
+const histogramWidth = 64
+
+// writeHistogram はヒストグラムを # で始まるASCIIのバーとして書き出します
+func writeHistogram(b *strings.Builder, buckets []HistogramBucket) {
+	var max int64
+	for _, bucket := range buckets {
+		if bucket.Count > max {
+			max = bucket.Count
+		}
+	}
+
+	for _, bucket := range buckets {
+		bar := 0
+		if max > 0 {
+			bar = int(math.Ceil(float64(bucket.Count) / float64(max) * histogramWidth))
+		}
+		fmt.Fprintf(b, "# %6s", bucket.Label)
+		if bar > 0 {
+			fmt.Fprintf(b, "  %s", strings.Repeat("#", bar))
+		}
+		b.WriteByte('\n')
+	}
+}
+
+func formatSeconds(v float64) string {
+	return fmt.Sprintf("%.3fs", v)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func percent(v, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return v / total * 100
+}
+
+// truncate は s が n 文字より長い場合に、末尾を "..." にして n 文字に切り詰めます
+// マルチバイト文字の途中では切りません
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-3]) + "..."
+}
+
+// formatCounts は件数の多い順に "name (count)" の形式で並べます
+func formatCounts(counts map[string]int64) string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s (%d)", k, counts[k])
+	}
+	return strings.Join(parts, ", ")
+}
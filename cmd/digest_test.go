@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+)
+
+func TestStats(t *testing.T) {
+	var s Stats
+	if s.Avg() != 0 {
+		t.Errorf("Avg() of empty stats = %v, want 0", s.Avg())
+	}
+
+	for _, v := range []float64{2, 1, 6} {
+		s.Add(v)
+	}
+
+	expected := Stats{Count: 3, Total: 9, Min: 1, Max: 6}
+	if s != expected {
+		t.Errorf("Stats = %+v, want %+v", s, expected)
+	}
+	if s.Avg() != 3 {
+		t.Errorf("Avg() = %v, want 3", s.Avg())
+	}
+}
+
+// newTestRecord はテスト用のレコードを生成します
+func newTestRecord(instance, statement string, queryTime float64, rowsSent, rowsExamined int64, ts int64) Record {
+	return Record{
+		Entry: &parser.Entry{
+			User:         "app",
+			DB:           "production",
+			QueryTime:    queryTime,
+			LockTime:     queryTime / 10,
+			RowsSent:     rowsSent,
+			RowsExamined: rowsExamined,
+			Timestamp:    ts,
+			Statement:    statement,
+		},
+		Instance: instance,
+		Source:   "slow.log",
+	}
+}
+
+func TestDigest(t *testing.T) {
+	d := NewDigest()
+	d.Add(newTestRecord("db-1", "SELECT * FROM users WHERE id = 1", 1.0, 1, 100, 1683721815))
+	d.Add(newTestRecord("db-2", "SELECT * FROM users WHERE id = 2", 3.0, 1, 300, 1683721900))
+	d.Add(newTestRecord("db-1", "SELECT * FROM users WHERE id = 3", 2.0, 0, 200, 1683721800))
+	d.Add(newTestRecord("db-1", "DELETE FROM logs WHERE id < 100", 5.0, 0, 1000, 1683722000))
+
+	if d.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", d.Len())
+	}
+
+	classes := d.Classes("total")
+	users := classes[0]
+	if users.Fingerprint != "select * from users where id = ?" {
+		t.Fatalf("Classes()[0].Fingerprint = %q", users.Fingerprint)
+	}
+	if users.Count != 3 || users.QueryTime.Total != 6 || users.QueryTime.Max != 3 {
+		t.Errorf("Classes()[0] = %+v", users)
+	}
+	if users.Example.Statement != "SELECT * FROM users WHERE id = 2" {
+		t.Errorf("Example = %q, want the slowest query", users.Example.Statement)
+	}
+	if users.RowsRatio() != 300 {
+		t.Errorf("RowsRatio() = %v, want 300", users.RowsRatio())
+	}
+	if users.Instances["db-1"] != 2 || users.Instances["db-2"] != 1 {
+		t.Errorf("Instances = %v", users.Instances)
+	}
+	if !users.FirstSeen.Equal(time.Unix(1683721800, 0)) || !users.LastSeen.Equal(time.Unix(1683721900, 0)) {
+		t.Errorf("FirstSeen, LastSeen = %v, %v", users.FirstSeen, users.LastSeen)
+	}
+
+	testCases := []struct {
+		orderBy  string
+		expected string
+	}{
+		{orderBy: "total", expected: users.ID},
+		{orderBy: "count", expected: users.ID},
+		{orderBy: "max", expected: FingerprintID("delete from logs where id < ?")},
+		{orderBy: "avg", expected: FingerprintID("delete from logs where id < ?")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.orderBy, func(t *testing.T) {
+			if got := d.Classes(tc.orderBy)[0].ID; got != tc.expected {
+				t.Errorf("Classes(%q)[0].ID = %v, want %v", tc.orderBy, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	testCases := []struct {
+		name string
+		s    string
+		n    int
+		want string
+	}{
+		{name: "短い文字列", s: "SELECT 1", n: 10, want: "SELECT 1"},
+		{name: "ちょうどの長さ", s: "SELECT 1", n: 8, want: "SELECT 1"},
+		{name: "長い文字列", s: "SELECT * FROM users", n: 10, want: "SELECT ..."},
+		{name: "マルチバイト文字の途中で切らない", s: "SELECT '日本語のコメント' FROM t", n: 13, want: "SELECT '日本..."},
+		{name: "マルチバイト文字は1文字として数える", s: "SELECT '日本語'", n: 12, want: "SELECT '日本語'"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := truncate(tc.s, tc.n)
+			if got != tc.want || !utf8.ValidString(got) {
+				t.Errorf("truncate(%q, %d) = %q, want %q", tc.s, tc.n, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteTextReport(t *testing.T) {
+	d := NewDigest()
+	d.Add(newTestRecord("db-1", "SELECT * FROM users WHERE id = 1", 1.0, 1, 100, 1683721815))
+	d.Add(newTestRecord("db-1", "DELETE FROM logs WHERE id < 100", 5.0, 0, 1000, 1683722000))
+
+	var buf bytes.Buffer
+	if err := WriteTextReport(&buf, d, ReportOptions{Top: 1}); err != nil {
+		t.Fatalf("WriteTextReport() returned error: %v", err)
+	}
+
+	report := buf.String()
+	for _, want := range []string{
+		"# Overall: 2 queries, 2 unique",
+		"# Total query time: 6.000s",
+		"# Query 1: ID " + FingerprintID("delete from logs where id < ?"),
+		"DELETE FROM logs WHERE id < 100;",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("WriteTextReport() does not contain %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "# Query 2:") {
+		t.Errorf("WriteTextReport() should report only the top query:\n%s", report)
+	}
+}
@@ -0,0 +1,19 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// downloadCmd は設定ファイルのターゲットやフラグに従ってスロークエリログをダウンロードするコマンドです
+var downloadCmd = &cobra.Command{
+	Use:   "download",
+	Short: "Download slow query logs of a target",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return Do(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(downloadCmd)
+	addDownloadFlags(downloadCmd.Flags())
+}
@@ -0,0 +1,253 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+)
+
+// ExportRecord はjsonlとcsvで出力するエントリのスキーマです
+// フィールドの追加は末尾にだけ行い、既存のフィールドの名前と型は変えません
+type ExportRecord struct {
+	Instance      string            `json:"instance"`
+	Provider      string            `json:"provider"`
+	Source        string            `json:"source"`
+	Time          string            `json:"time"`
+	Timestamp     int64             `json:"timestamp"`
+	User          string            `json:"user"`
+	Host          string            `json:"host"`
+	IP            string            `json:"ip"`
+	ThreadID      int64             `json:"thread_id"`
+	DB            string            `json:"db"`
+	QueryTime     float64           `json:"query_time"`
+	LockTime      float64           `json:"lock_time"`
+	RowsSent      int64             `json:"rows_sent"`
+	RowsExamined  int64             `json:"rows_examined"`
+	StatementType string            `json:"statement_type"`
+	QueryID       string            `json:"query_id"`
+	SQL           string            `json:"sql"`
+	Extra         map[string]string `json:"extra"`
+}
+
+// exportColumns はcsvのヘッダーです。ExportRecord のフィールドと同じ順序です
+var exportColumns = []string{
+	"instance", "provider", "source", "time", "timestamp", "user", "host", "ip", "thread_id", "db",
+	"query_time", "lock_time", "rows_sent", "rows_examined", "statement_type", "query_id", "sql", "extra",
+}
+
+// NewExportRecord はRecordを出力用のスキーマに変換します
+func NewExportRecord(r Record) ExportRecord {
+	er := ExportRecord{
+		Instance:      r.Instance,
+		Provider:      r.Provider,
+		Source:        r.Source,
+		Timestamp:     r.Timestamp,
+		User:          r.User,
+		Host:          r.Host,
+		IP:            r.IP,
+		ThreadID:      r.ThreadID,
+		DB:            r.DB,
+		QueryTime:     r.QueryTime,
+		LockTime:      r.LockTime,
+		RowsSent:      r.RowsSent,
+		RowsExamined:  r.RowsExamined,
+		StatementType: StatementType(r.Statement),
+		QueryID:       FingerprintID(Fingerprint(r.Statement)),
+		SQL:           r.Statement,
+		Extra:         r.Extra,
+	}
+	if !r.Time.IsZero() {
+		er.Time = r.Time.UTC().Format(time.RFC3339Nano)
+	}
+	if er.Extra == nil {
+		er.Extra = map[string]string{}
+	}
+	return er
+}
+
+// EntryID はエントリを識別する ID を返します
+// ローテーションなどで同じエントリが別のファイルからダウンロードされても同じ ID になります
+func EntryID(r Record) string {
+	sum := sha256.Sum256([]byte(r.Provider + "\x00" + r.Instance + "\x00" + r.Entry.String()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// csvRow はcsvの1行を exportColumns の順序で返します
+func (er ExportRecord) csvRow() ([]string, error) {
+	extra, err := json.Marshal(er.Extra)
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		er.Instance,
+		er.Provider,
+		er.Source,
+		er.Time,
+		strconv.FormatInt(er.Timestamp, 10),
+		er.User,
+		er.Host,
+		er.IP,
+		strconv.FormatInt(er.ThreadID, 10),
+		er.DB,
+		strconv.FormatFloat(er.QueryTime, 'f', -1, 64),
+		strconv.FormatFloat(er.LockTime, 'f', -1, 64),
+		strconv.FormatInt(er.RowsSent, 10),
+		strconv.FormatInt(er.RowsExamined, 10),
+		er.StatementType,
+		er.QueryID,
+		er.SQL,
+		string(extra),
+	}, nil
+}
+
+// RecordWriter はエントリを指定された形式で書き出します
+type RecordWriter interface {
+	Write(r Record) error
+	Flush() error
+}
+
+// exportFormats はエントリ単位で書き出せる形式です
+var exportFormats = []string{"slowlog", "jsonl", "csv", "parquet"}
+
+// isExportFormat はエントリ単位で書き出す形式かどうかを返します
+func isExportFormat(format string) bool {
+	return contains(exportFormats, format)
+}
+
+// NewRecordWriter は形式に応じたRecordWriterを生成します
+// header が false の場合、csvのヘッダーを書き出しません
+func NewRecordWriter(w io.Writer, format string, header bool) (RecordWriter, error) {
+	switch format {
+	case "", "slowlog":
+		return &slowlogWriter{w: w}, nil
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return &jsonlWriter{enc: enc}, nil
+	case "csv":
+		return &csvWriter{w: csv.NewWriter(w), header: header}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported format: %s. Use 'slowlog', 'jsonl' or 'csv'", format)
+	}
+}
+
+type slowlogWriter struct {
+	w io.Writer
+}
+
+func (s *slowlogWriter) Write(r Record) error {
+	_, err := r.Entry.WriteTo(s.w)
+	return err
+}
+
+func (s *slowlogWriter) Flush() error {
+	return nil
+}
+
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonlWriter) Write(r Record) error {
+	return j.enc.Encode(NewExportRecord(r))
+}
+
+func (j *jsonlWriter) Flush() error {
+	return nil
+}
+
+// csvWriter はRFC 4180に従ってcsvを書き出します。改行やカンマを含むSQLはダブルクォートで囲まれます
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (c *csvWriter) Write(r Record) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+
+	row, err := NewExportRecord(r).csvRow()
+	if err != nil {
+		return err
+	}
+	return c.w.Write(row)
+}
+
+// Flush はバッファを書き出します。エントリが1件もない場合もヘッダーは書き出します
+func (c *csvWriter) Flush() error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) writeHeader() error {
+	if !c.header {
+		return nil
+	}
+	c.header = false
+	return c.w.Write(exportColumns)
+}
+
+// ConvertOptions はスロークエリログのエントリを書き出す条件です
+type ConvertOptions struct {
+	Format string
+	// Header はcsvのヘッダーを書き出すかどうかです
+	Header bool
+	// RowGroupSize は Format が parquet の場合の行グループの行数です
+	RowGroupSize int64
+	Filter       *EntryFilter
+	Redactor     *Redactor
+
+	// Collect は書き出すエントリごとに、書き出す前に呼び出されます
+	// エラーを返した場合は書き出しを中止します
+	Collect func(Record) error
+}
+
+// ConvertLogData はスロークエリログを1エントリずつ解析し、条件に合うエントリを指定された形式で w に書き出します
+// ログ全体をメモリに読み込まないので、大きなログでも使用するメモリは一定です
+func ConvertLogData(w io.Writer, r io.Reader, base Record, opts ConvertOptions) error {
+	rw, err := NewRecordWriter(w, opts.Format, opts.Header)
+	if err != nil {
+		return err
+	}
+	return writeLogData(rw, r, base, opts)
+}
+
+// writeLogData はスロークエリログを1エントリずつ解析し、条件に合うエントリを伏せてから書き出します
+func writeLogData(w RecordWriter, data io.Reader, base Record, opts ConvertOptions) error {
+	scanner := parser.NewScanner(data)
+	for scanner.Scan() {
+		e := scanner.Entry()
+		if !opts.Filter.Match(e) {
+			continue
+		}
+
+		r := base
+		r.Entry = opts.Redactor.Redact(e)
+		if opts.Collect != nil {
+			if err := opts.Collect(r); err != nil {
+				w.Flush()
+				return err
+			}
+		}
+		if err := w.Write(r); err != nil {
+			w.Flush()
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		w.Flush()
+		return err
+	}
+	return w.Flush()
+}
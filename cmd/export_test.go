@@ -0,0 +1,316 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+)
+
+const multiLineLog = `# Time: 2023-05-10T12:30:15.123456Z
+# User@Host: app[app] @ app-1.example.com [10.0.1.10]  Id:    42
+# Query_time: 2.500000  Lock_time: 0.000100 Rows_sent: 1  Rows_examined: 100000 Bytes_sent: 56
+use production;
+SET timestamp=1683721815;
+SELECT id, "name"
+FROM users
+WHERE email = 'a,b@example.com';
+`
+
+// exportTestRecords はtestlogで生成したログと複数行のSQLを含むログを読み込みます
+func exportTestRecords(t *testing.T) []Record {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := GenerateTestLogs(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "multiline.log"), []byte(multiLineLog), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewLocalClient(NewLogger("error"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []Record
+	err = ReadRecords(client, client.GetInstanceList(), func(r Record) error {
+		r.Provider = "local"
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	records := exportTestRecords(t)
+	if len(records) == 0 {
+		t.Fatal("no records were read")
+	}
+
+	expected := make([]ExportRecord, len(records))
+	for i, r := range records {
+		expected[i] = NewExportRecord(r)
+	}
+
+	t.Run("jsonl", func(t *testing.T) {
+		var b strings.Builder
+		w, err := NewRecordWriter(&b, "jsonl", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range records {
+			if err := w.Write(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []ExportRecord
+		scanner := bufio.NewScanner(strings.NewReader(b.String()))
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			var er ExportRecord
+			if err := json.Unmarshal(scanner.Bytes(), &er); err != nil {
+				t.Fatalf("invalid JSON line %q: %v", scanner.Text(), err)
+			}
+			got = append(got, er)
+		}
+
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("jsonl round trip = %+v, want %+v", got, expected)
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		var b strings.Builder
+		w, err := NewRecordWriter(&b, "csv", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range records {
+			if err := w.Write(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+		if err != nil {
+			t.Fatalf("invalid CSV: %v", err)
+		}
+		if len(rows) != len(records)+1 {
+			t.Fatalf("csv has %d rows, want %d", len(rows), len(records)+1)
+		}
+		if !reflect.DeepEqual(rows[0], exportColumns) {
+			t.Errorf("csv header = %v, want %v", rows[0], exportColumns)
+		}
+
+		for i, row := range rows[1:] {
+			want, err := expected[i].csvRow()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(row, want) {
+				t.Errorf("csv row[%d] = %q, want %q", i, row, want)
+			}
+		}
+	})
+
+	t.Run("slowlog", func(t *testing.T) {
+		var b strings.Builder
+		w, err := NewRecordWriter(&b, "slowlog", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range records {
+			if err := w.Write(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		entries, err := parser.ParseString(b.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(records) {
+			t.Fatalf("slowlog round trip returned %d entries, want %d", len(entries), len(records))
+		}
+		for i, e := range entries {
+			if e.Statement != records[i].Statement || e.QueryTime != records[i].QueryTime {
+				t.Errorf("slowlog round trip entry[%d] = %+v, want %+v", i, e, records[i].Entry)
+			}
+		}
+	})
+}
+
+func TestNewExportRecord(t *testing.T) {
+	entries, err := parser.ParseString(multiLineLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := NewExportRecord(Record{Entry: entries[0], Instance: "db-1", Provider: "aws", Source: "slowquery/mysql-slowquery.log"})
+	expected := ExportRecord{
+		Instance:      "db-1",
+		Provider:      "aws",
+		Source:        "slowquery/mysql-slowquery.log",
+		Time:          "2023-05-10T12:30:15.123456Z",
+		Timestamp:     1683721815,
+		User:          "app",
+		Host:          "app-1.example.com",
+		IP:            "10.0.1.10",
+		ThreadID:      42,
+		DB:            "production",
+		QueryTime:     2.5,
+		LockTime:      0.0001,
+		RowsSent:      1,
+		RowsExamined:  100000,
+		StatementType: "select",
+		QueryID:       FingerprintID(Fingerprint(entries[0].Statement)),
+		SQL:           "SELECT id, \"name\"\nFROM users\nWHERE email = 'a,b@example.com'",
+		Extra:         map[string]string{"Bytes_sent": "56"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("NewExportRecord() = %+v, want %+v", got, expected)
+	}
+
+	row, err := got.csvRow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(row) != len(exportColumns) {
+		t.Errorf("csvRow() returned %d columns, want %d", len(row), len(exportColumns))
+	}
+}
+
+func TestNewRecordWriter(t *testing.T) {
+	testCases := []struct {
+		format  string
+		wantErr bool
+	}{
+		{format: ""},
+		{format: "slowlog"},
+		{format: "jsonl"},
+		{format: "csv"},
+		{format: "parquet", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.format, func(t *testing.T) {
+			_, err := NewRecordWriter(&strings.Builder{}, tc.format, true)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("NewRecordWriter() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDownloadSlowQueryLogCSV(t *testing.T) {
+	data := multiLineLog
+	client := AWSClientMock{DownloadSlowQueryResult: &data}
+	output := filepath.Join(t.TempDir(), "out.csv")
+
+	opts := DownloadOptions{Provider: "aws", Output: output, Format: "csv", headers: map[string]bool{}}
+	for _, instance := range []string{"db-1", "db-2"} {
+		if err := DownloadSlowQueryLog(client, instance, []string{"slowquery/mysql-slowquery.log"}, opts); err != nil {
+			t.Fatalf("DownloadSlowQueryLog() returned error: %v", err)
+		}
+	}
+
+	file, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+
+	// ヘッダーは1回だけ書き出される
+	if len(rows) != 3 {
+		t.Fatalf("csv has %d rows, want 3: %q", len(rows), rows)
+	}
+	if rows[1][0] != "db-1" || rows[2][0] != "db-2" || rows[2][1] != "aws" || rows[2][2] != "slowquery/mysql-slowquery.log" {
+		t.Errorf("csv rows = %q", rows[1:])
+	}
+}
+
+// openerClientMock は OpenSlowQueryLog でだけログを返すクライアントです
+type openerClientMock struct {
+	AWSClientMock
+	data string
+}
+
+func (m openerClientMock) DownloadSlowQueryLog(instance string, logFile string) (*string, error) {
+	return nil, fmt.Errorf("DownloadSlowQueryLog should not be called")
+}
+
+func (m openerClientMock) OpenSlowQueryLog(instance string, logFile string) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(m.data)), nil
+}
+
+func TestDownloadSlowQueryLogOpener(t *testing.T) {
+	client := openerClientMock{data: multiLineLog}
+	want, err := parser.ParseString(multiLineLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		format string
+		lines  int
+	}{
+		{name: "そのまま書き出す", format: "slowlog", lines: strings.Count(multiLineLog, "\n")},
+		{name: "形式を変換して書き出す", format: "jsonl", lines: len(want)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "out.log")
+			var collected []Record
+			err := DownloadSlowQueryLog(client, "db-1", []string{"slowquery/mysql-slowquery.log"}, DownloadOptions{
+				Provider: "aws",
+				Output:   output,
+				Format:   tc.format,
+				Collect: func(r Record) error {
+					collected = append(collected, r)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("DownloadSlowQueryLog() returned error: %v", err)
+			}
+
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lines := strings.Count(string(got), "\n"); lines != tc.lines {
+				t.Errorf("output has %d lines, want %d", lines, tc.lines)
+			}
+			if len(collected) != len(want) {
+				t.Errorf("Collect was called %d times, want %d", len(collected), len(want))
+			}
+		})
+	}
+}
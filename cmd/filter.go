@@ -0,0 +1,364 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+	"github.com/spf13/pflag"
+)
+
+// FilterOptions はエントリ単位のフィルタの設定です
+type FilterOptions struct {
+	MinQueryTime    float64  `yaml:"min_query_time"`
+	MinRowsExamined int64    `yaml:"min_rows_examined"`
+	Users           []string `yaml:"users"`
+	Hosts           []string `yaml:"hosts"`
+	ClientIPs       []string `yaml:"client_ips"`
+	DBs             []string `yaml:"dbs"`
+	StatementTypes  []string `yaml:"statement_types"`
+	Match           string   `yaml:"match"`
+	Where           string   `yaml:"where"`
+}
+
+// EntryFilter はスロークエリログのエントリを条件で絞り込みます
+type EntryFilter struct {
+	minQueryTime    float64
+	minRowsExamined int64
+	users           []string
+	hosts           []string
+	clientNets      []*net.IPNet
+	dbs             []string
+	statementTypes  []string
+	match           *regexp.Regexp
+	where           *vm.Program
+	whereErrors     whereErrors
+}
+
+// whereErrors は --where の式の評価に失敗したエントリの件数と最初のエラーです
+type whereErrors struct {
+	mu    sync.Mutex
+	count int
+	first error
+}
+
+// whereEnv は --where の式から参照できるエントリのフィールドです
+type whereEnv struct {
+	QueryTime    float64   `expr:"query_time"`
+	LockTime     float64   `expr:"lock_time"`
+	RowsSent     int64     `expr:"rows_sent"`
+	RowsExamined int64     `expr:"rows_examined"`
+	User         string    `expr:"user"`
+	Host         string    `expr:"host"`
+	IP           string    `expr:"ip"`
+	DB           string    `expr:"db"`
+	SQL          string    `expr:"sql"`
+	Type         string    `expr:"statement_type"`
+	Timestamp    time.Time `expr:"timestamp"`
+}
+
+func newWhereEnv(e *parser.Entry) whereEnv {
+	return whereEnv{
+		QueryTime:    e.QueryTime,
+		LockTime:     e.LockTime,
+		RowsSent:     e.RowsSent,
+		RowsExamined: e.RowsExamined,
+		User:         e.User,
+		Host:         e.Host,
+		IP:           e.IP,
+		DB:           e.DB,
+		SQL:          e.Statement,
+		Type:         StatementType(e.Statement),
+		Timestamp:    e.StartTime(),
+	}
+}
+
+// compileWhere は --where の式を真偽値を返す式としてコンパイルします
+func compileWhere(where string) (*vm.Program, error) {
+	program, err := expr.Compile(where, expr.Env(whereEnv{}), expr.AsBool())
+	if err != nil {
+		return nil, fmt.Errorf("invalid where expression: %w\nfields: query_time, lock_time, rows_sent, rows_examined, user, host, ip, db, sql, statement_type, timestamp", err)
+	}
+	return program, nil
+}
+
+// statementTypes は --statement-type に指定できる値と、それに対応するSQLの先頭のキーワードです
+var statementTypes = map[string][]string{
+	"select": {"select", "with"},
+	"update": {"update"},
+	"delete": {"delete"},
+	"insert": {"insert", "replace"},
+	"ddl":    {"create", "alter", "drop", "truncate", "rename"},
+}
+
+// NewEntryFilter は設定からフィルタを生成します。条件が1つもない場合はnilを返します
+func NewEntryFilter(opts FilterOptions) (*EntryFilter, error) {
+	f := &EntryFilter{
+		minQueryTime:    opts.MinQueryTime,
+		minRowsExamined: opts.MinRowsExamined,
+		users:           opts.Users,
+		hosts:           opts.Hosts,
+		dbs:             opts.DBs,
+	}
+
+	for _, cidr := range opts.ClientIPs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client IP %q: %w", cidr, err)
+		}
+		f.clientNets = append(f.clientNets, ipNet)
+	}
+
+	for _, host := range opts.Hosts {
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", host, err)
+		}
+	}
+
+	for _, t := range opts.StatementTypes {
+		t = strings.ToLower(t)
+		if _, ok := statementTypes[t]; !ok {
+			return nil, fmt.Errorf("Unsupported statement type: %s. Use select, update, delete, insert or ddl", t)
+		}
+		f.statementTypes = append(f.statementTypes, t)
+	}
+
+	if opts.Match != "" {
+		match, err := regexp.Compile(opts.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match pattern %q: %w", opts.Match, err)
+		}
+		f.match = match
+	}
+
+	if strings.TrimSpace(opts.Where) != "" {
+		where, err := compileWhere(opts.Where)
+		if err != nil {
+			return nil, err
+		}
+		f.where = where
+	}
+
+	if f.minQueryTime == 0 && f.minRowsExamined == 0 && len(f.users) == 0 && len(f.hosts) == 0 &&
+		len(f.clientNets) == 0 && len(f.dbs) == 0 && len(f.statementTypes) == 0 && f.match == nil && f.where == nil {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// Match はエントリが全ての条件を満たすかどうかを返します。nilのフィルタは全てのエントリにマッチします
+func (f *EntryFilter) Match(e *parser.Entry) bool {
+	if f == nil {
+		return true
+	}
+
+	if e.QueryTime < f.minQueryTime || e.RowsExamined < f.minRowsExamined {
+		return false
+	}
+	if len(f.users) > 0 && !contains(f.users, e.User) {
+		return false
+	}
+	if len(f.dbs) > 0 && !contains(f.dbs, e.DB) {
+		return false
+	}
+	if len(f.hosts) > 0 && !f.matchHost(e) {
+		return false
+	}
+	if len(f.clientNets) > 0 && !f.matchClientIP(e.IP) {
+		return false
+	}
+	if len(f.statementTypes) > 0 && !contains(f.statementTypes, StatementType(e.Statement)) {
+		return false
+	}
+	if f.match != nil && !f.match.MatchString(e.Statement) {
+		return false
+	}
+	if f.where != nil && !f.matchWhere(e) {
+		return false
+	}
+	return true
+}
+
+// matchWhere は --where の式を評価します。評価に失敗したエントリはマッチしないものとして扱い、WarnErrors で報告します
+func (f *EntryFilter) matchWhere(e *parser.Entry) bool {
+	out, err := expr.Run(f.where, newWhereEnv(e))
+	if err != nil {
+		f.whereErrors.mu.Lock()
+		if f.whereErrors.count == 0 {
+			f.whereErrors.first = err
+		}
+		f.whereErrors.count++
+		f.whereErrors.mu.Unlock()
+		return false
+	}
+	ok, _ := out.(bool)
+	return ok
+}
+
+// WhereErrors は --where の式の評価に失敗したエントリの件数と最初のエラーを返します
+func (f *EntryFilter) WhereErrors() (int, error) {
+	if f == nil {
+		return 0, nil
+	}
+	f.whereErrors.mu.Lock()
+	defer f.whereErrors.mu.Unlock()
+	return f.whereErrors.count, f.whereErrors.first
+}
+
+// WarnErrors は --where の式の評価に失敗してスキップしたエントリがあれば、件数と最初のエラーを警告として出力します
+// 出力した後は件数を数え直します。args は警告に加える属性です
+func (f *EntryFilter) WarnErrors(logger *slog.Logger, args ...any) {
+	if f == nil {
+		return
+	}
+	f.whereErrors.mu.Lock()
+	count, first := f.whereErrors.count, f.whereErrors.first
+	f.whereErrors.count, f.whereErrors.first = 0, nil
+	f.whereErrors.mu.Unlock()
+
+	if count > 0 {
+		logger.Warn("Skipped entries that failed to evaluate the where expression", append([]any{"count", count, "error", first}, args...)...)
+	}
+}
+
+// matchHost はホスト名またはIPアドレスがglobパターンのいずれかにマッチするかどうかを返します
+func (f *EntryFilter) matchHost(e *parser.Entry) bool {
+	for _, pattern := range f.hosts {
+		for _, host := range []string{e.Host, e.IP} {
+			if host == "" {
+				continue
+			}
+			if ok, _ := path.Match(pattern, host); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *EntryFilter) matchClientIP(s string) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range f.clientNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// StatementType はSQLの種類を select、update、delete、insert、ddl のいずれかで返します
+// どれにも当てはまらない場合は先頭のキーワードを小文字で返します
+func StatementType(sql string) string {
+	s := strings.TrimLeft(sql, " \t\r\n(")
+	for strings.HasPrefix(s, "/*") {
+		end := strings.Index(s, "*/")
+		if end < 0 {
+			return ""
+		}
+		s = strings.TrimLeft(s[end+2:], " \t\r\n(")
+	}
+
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'))
+	})
+	if end < 0 {
+		end = len(s)
+	}
+	keyword := strings.ToLower(s[:end])
+
+	for t, keywords := range statementTypes {
+		if contains(keywords, keyword) {
+			return t
+		}
+	}
+	return keyword
+}
+
+// FilterLogData はスロークエリログから条件に合うエントリだけをスロークエリログの形式で返します
+func FilterLogData(data string, f *EntryFilter) (string, error) {
+	var b strings.Builder
+	if err := ConvertLogData(&b, strings.NewReader(data), Record{}, ConvertOptions{Format: "slowlog", Filter: f}); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// addEntryFilterFlags はエントリ単位のフィルタのフラグを登録します
+func addEntryFilterFlags(flags *pflag.FlagSet) {
+	flags.Float64("min-query-time", 0, "only entries with Query_time at least this many seconds")
+	flags.Int64("min-rows-examined", 0, "only entries with Rows_examined at least this value")
+	flags.String("user", "", "only entries of these users (comma separated)")
+	flags.String("host", "", "only entries from these client hosts or IPs (comma separated, glob)")
+	flags.String("client-ip", "", "only entries from these client IP ranges (comma separated, CIDR)")
+	flags.String("db", "", "only entries on these databases (comma separated)")
+	flags.String("statement-type", "", "only entries of these statement types: select, update, delete, insert, ddl (comma separated)")
+	flags.String("match", "", "only entries whose SQL matches this regular expression")
+	flags.String("where", "", "only entries for which this expression is true (e.g. 'db == \"production\" && lock_time > 0.5')")
+}
+
+// mergeFilterOptions はフラグの値でフィルタの設定を上書きします
+func mergeFilterOptions(opts FilterOptions, flags *pflag.FlagSet) FilterOptions {
+	if f := flags.Lookup("min-query-time"); f != nil && f.Changed {
+		opts.MinQueryTime, _ = flags.GetFloat64("min-query-time")
+	}
+	if f := flags.Lookup("min-rows-examined"); f != nil && f.Changed {
+		opts.MinRowsExamined, _ = flags.GetInt64("min-rows-examined")
+	}
+
+	mergeList := func(name string, value *[]string) {
+		if f := flags.Lookup(name); f != nil && f.Changed {
+			*value = splitList(f.Value.String())
+		}
+	}
+	mergeList("user", &opts.Users)
+	mergeList("host", &opts.Hosts)
+	mergeList("client-ip", &opts.ClientIPs)
+	mergeList("db", &opts.DBs)
+	mergeList("statement-type", &opts.StatementTypes)
+
+	if f := flags.Lookup("match"); f != nil && f.Changed {
+		opts.Match = f.Value.String()
+	}
+	if f := flags.Lookup("where"); f != nil && f.Changed {
+		opts.Where = f.Value.String()
+	}
+	return opts
+}
+
+// splitList はカンマ区切りの文字列を空の要素を除いて分割します
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
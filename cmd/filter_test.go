@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+)
+
+func TestStatementType(t *testing.T) {
+	testCases := []struct {
+		sql      string
+		expected string
+	}{
+		{sql: "SELECT 1", expected: "select"},
+		{sql: "  (select a from t) union (select b from u)", expected: "select"},
+		{sql: "/* app:web */ UPDATE users SET a = 1", expected: "update"},
+		{sql: "WITH x AS (SELECT 1) SELECT * FROM x", expected: "select"},
+		{sql: "delete from logs", expected: "delete"},
+		{sql: "REPLACE INTO t VALUES (1)", expected: "insert"},
+		{sql: "ALTER TABLE t ADD COLUMN c INT", expected: "ddl"},
+		{sql: "SHOW TABLES", expected: "show"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.sql, func(t *testing.T) {
+			if got := StatementType(tc.sql); got != tc.expected {
+				t.Errorf("StatementType() = %v, want %v", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestNewEntryFilter(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    FilterOptions
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "条件なし", opts: FilterOptions{}, wantNil: true},
+		{name: "正常", opts: FilterOptions{MinQueryTime: 1, ClientIPs: []string{"10.0.0.0/8", "192.168.0.1"}}},
+		{name: "不正なCIDR", opts: FilterOptions{ClientIPs: []string{"10.0.0.0/33"}}, wantErr: true},
+		{name: "不正なステートメントの種類", opts: FilterOptions{StatementTypes: []string{"merge"}}, wantErr: true},
+		{name: "不正な正規表現", opts: FilterOptions{Match: "("}, wantErr: true},
+		{name: "不正なホストのパターン", opts: FilterOptions{Hosts: []string{"["}}, wantErr: true},
+		{name: "式", opts: FilterOptions{Where: "lock_time > 0.5"}},
+		{name: "空白だけの式", opts: FilterOptions{Where: " "}, wantNil: true},
+		{name: "式の構文エラー", opts: FilterOptions{Where: "query_time >"}, wantErr: true},
+		{name: "式の未知のフィールド", opts: FilterOptions{Where: "query_tme > 1"}, wantErr: true},
+		{name: "真偽値を返さない式", opts: FilterOptions{Where: "query_time + 1"}, wantErr: true},
+		{name: "式の型の不一致", opts: FilterOptions{Where: `user > 1`}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := NewEntryFilter(tc.opts)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("NewEntryFilter() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && (f == nil) != tc.wantNil {
+				t.Errorf("NewEntryFilter() = %v, wantNil %v", f, tc.wantNil)
+			}
+		})
+	}
+}
+
+func TestEntryFilterMatch(t *testing.T) {
+	entry := &parser.Entry{
+		User:         "batch",
+		Host:         "batch-1.example.com",
+		IP:           "10.0.1.12",
+		QueryTime:    3.2,
+		RowsExamined: 500000,
+		DB:           "production",
+		Statement:    "UPDATE users SET last_login = NOW() WHERE id = 1",
+		Timestamp:    1683721815,
+		LockTime:     0.8,
+		RowsSent:     0,
+	}
+
+	testCases := []struct {
+		name     string
+		opts     FilterOptions
+		expected bool
+	}{
+		{name: "Query_timeが閾値以上", opts: FilterOptions{MinQueryTime: 3}, expected: true},
+		{name: "Query_timeが閾値未満", opts: FilterOptions{MinQueryTime: 5}, expected: false},
+		{name: "Rows_examinedが閾値未満", opts: FilterOptions{MinRowsExamined: 1000000}, expected: false},
+		{name: "ユーザー一致", opts: FilterOptions{Users: []string{"app", "batch"}}, expected: true},
+		{name: "ユーザー不一致", opts: FilterOptions{Users: []string{"app"}}, expected: false},
+		{name: "ホスト名のglob", opts: FilterOptions{Hosts: []string{"batch-*"}}, expected: true},
+		{name: "IPアドレスのglob", opts: FilterOptions{Hosts: []string{"10.0.1.*"}}, expected: true},
+		{name: "ホスト不一致", opts: FilterOptions{Hosts: []string{"web-*"}}, expected: false},
+		{name: "CIDR一致", opts: FilterOptions{ClientIPs: []string{"10.0.0.0/16"}}, expected: true},
+		{name: "CIDR不一致", opts: FilterOptions{ClientIPs: []string{"192.168.0.0/16"}}, expected: false},
+		{name: "DB一致", opts: FilterOptions{DBs: []string{"production"}}, expected: true},
+		{name: "DB不一致", opts: FilterOptions{DBs: []string{"finance"}}, expected: false},
+		{name: "ステートメントの種類一致", opts: FilterOptions{StatementTypes: []string{"UPDATE", "delete"}}, expected: true},
+		{name: "ステートメントの種類不一致", opts: FilterOptions{StatementTypes: []string{"select"}}, expected: false},
+		{name: "正規表現一致", opts: FilterOptions{Match: `(?i)last_login\s*=`}, expected: true},
+		{name: "正規表現不一致", opts: FilterOptions{Match: "orders"}, expected: false},
+		{name: "式が真", opts: FilterOptions{Where: `statement_type == "update" && db == "production" && lock_time > 0.5`}, expected: true},
+		{name: "式が偽", opts: FilterOptions{Where: `user == "app" || rows_examined < 1000`}, expected: false},
+		{name: "式でRows_sentが0の比率", opts: FilterOptions{Where: `rows_examined / rows_sent > 1000`}, expected: true},
+		{name: "式でSQLの部分一致", opts: FilterOptions{Where: `sql contains "last_login" and host startsWith "batch-"`}, expected: true},
+		{name: "式で時刻の比較", opts: FilterOptions{Where: `timestamp >= date("2023-05-10T12:00:00Z") && ip == "10.0.1.12"`}, expected: true},
+		{name: "複数条件", opts: FilterOptions{MinQueryTime: 1, Users: []string{"batch"}, DBs: []string{"finance"}}, expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := NewEntryFilter(tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Match(entry); got != tc.expected {
+				t.Errorf("Match() = %v, want %v", got, tc.expected)
+			}
+		})
+	}
+
+	var f *EntryFilter
+	if !f.Match(entry) {
+		t.Error("Match() of nil filter should return true")
+	}
+}
+
+func TestEntryFilterWhereErrors(t *testing.T) {
+	// SQLの単語の数を超える添字は実行時エラーになる
+	f, err := NewEntryFilter(FilterOptions{Where: `split(sql, " ")[10] == "id"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range []string{"SELECT 1", "SELECT * FROM users", "SELECT a, b, c FROM users WHERE a = 1 AND id = 2"} {
+		f.Match(&parser.Entry{Statement: sql})
+	}
+
+	n, first := f.WhereErrors()
+	if n != 2 || first == nil || !strings.Contains(first.Error(), "index out of range") {
+		t.Fatalf("WhereErrors() = %d, %v, want 2 and the index error of the first entry", n, first)
+	}
+
+	var b strings.Builder
+	f.WarnErrors(slog.New(slog.NewTextHandler(&b, nil)), "job", "job-1")
+	if got := b.String(); !strings.Contains(got, "count=2") || !strings.Contains(got, "job=job-1") {
+		t.Errorf("WarnErrors() logged %q, want the count and attributes", got)
+	}
+	if n, _ := f.WhereErrors(); n != 0 {
+		t.Errorf("WhereErrors() after WarnErrors() = %d, want 0", n)
+	}
+}
+
+func TestFilterLogData(t *testing.T) {
+	data, err := os.ReadFile("../testdata/aws-slowquery.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewEntryFilter(FilterOptions{DBs: []string{"production"}, StatementTypes: []string{"select"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filtered, err := FilterLogData(string(data), f)
+	if err != nil {
+		t.Fatalf("FilterLogData() returned error: %v", err)
+	}
+
+	// 出力もスロークエリログとして読み込めること
+	entries, err := parser.ParseString(filtered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("FilterLogData() kept %d entries, want 3:\n%s", len(entries), filtered)
+	}
+	for _, e := range entries {
+		if e.DB != "production" || !strings.HasPrefix(e.Statement, "SELECT") {
+			t.Errorf("FilterLogData() kept unexpected entry: %+v", e)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+var (
+	inListPattern = regexp.MustCompile(`\bin\s*\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	valuesPattern = regexp.MustCompile(`\b(values?)\s*\(\s*\?(?:\s*,\s*\?)*\s*\)(?:\s*,\s*\(\s*\?(?:\s*,\s*\?)*\s*\))*`)
+	limitPattern  = regexp.MustCompile(`\blimit \?\s*(?:,|offset)\s*\?`)
+)
+
+// Fingerprint はクエリのリテラルやコメントを取り除き、同じ形のクエリが同じ文字列になるように正規化します
+//   - 文字列と数値のリテラルは ? に置き換えます
+//   - IN (...) と VALUES (...) のリストは1つにまとめます
+//   - コメントを取り除き、空白を1つにまとめて小文字にします
+func Fingerprint(sql string) string {
+	s := strings.TrimSpace(sql)
+	if strings.HasPrefix(s, "# administrator command:") {
+		return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(s, "# "), ";"))
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	// space は空白を出力する必要があるかどうかを表します
+	space := false
+	// ident は直前の文字が識別子の一部かどうかを表します
+	ident := false
+	// operand は直前のトークンが値を取る演算子などで、続く - が符号になり得るかを表します
+	operand := true
+
+	emit := func(str string) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(str)
+	}
+
+	for i := 0; i < len(s); {
+		c := s[i]
+
+		switch {
+		case c == '/' && i+1 < len(s) && s[i+1] == '*':
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				i = len(s)
+			} else {
+				i += end + 4
+			}
+			space, ident = true, false
+
+		case c == '#' || (c == '-' && i+2 < len(s) && s[i+1] == '-' && isSpace(s[i+2])):
+			end := strings.IndexByte(s[i:], '\n')
+			if end < 0 {
+				i = len(s)
+			} else {
+				i += end
+			}
+			space, ident = true, false
+
+		case c == '\'' || c == '"':
+			i = skipQuoted(s, i)
+			emit("?")
+			ident, operand = false, false
+
+		case c == '`':
+			end := strings.IndexByte(s[i+1:], '`')
+			if end < 0 {
+				end = len(s) - i - 1
+			}
+			emit(s[i+1 : i+1+end])
+			i += end + 2
+			ident, operand = true, false
+
+		case !ident && (isDigit(c) || (c == '.' && i+1 < len(s) && isDigit(s[i+1])) ||
+			(c == '-' && operand && i+1 < len(s) && isDigit(s[i+1]))):
+			i = skipNumber(s, i)
+			emit("?")
+			ident, operand = false, false
+
+		case isSpace(c):
+			space = true
+			ident = false
+			i++
+
+		default:
+			emit(string(c))
+			ident = isIdentChar(c)
+			operand = !ident && c != ')'
+			i++
+		}
+	}
+
+	fingerprint := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(b.String()), ";"))
+	fingerprint = inListPattern.ReplaceAllString(fingerprint, "in(?+)")
+	fingerprint = valuesPattern.ReplaceAllString(fingerprint, "$1(?+)")
+	fingerprint = limitPattern.ReplaceAllString(fingerprint, "limit ?")
+	return strings.TrimSpace(fingerprint)
+}
+
+// FingerprintID はフィンガープリントから16桁の識別子を生成します
+func FingerprintID(fingerprint string) string {
+	sum := md5.Sum([]byte(fingerprint))
+	return strings.ToUpper(hex.EncodeToString(sum[8:]))
+}
+
+// skipQuoted はクォートされた文字列の終わりの次の位置を返します
+func skipQuoted(s string, i int) int {
+	quote := s[i]
+	for i++; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// skipNumber は数値リテラルの終わりの次の位置を返します
+func skipNumber(s string, i int) int {
+	if s[i] == '-' {
+		i++
+	}
+	if strings.HasPrefix(s[i:], "0x") || strings.HasPrefix(s[i:], "0X") {
+		i += 2
+		for i < len(s) && strings.IndexByte("0123456789abcdefABCDEF", s[i]) >= 0 {
+			i++
+		}
+		return i
+	}
+
+	for i < len(s) && (isDigit(s[i]) || s[i] == '.') {
+		i++
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			i = j
+			for i < len(s) && isDigit(s[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "数値と文字列",
+			query:    "SELECT * FROM users WHERE id > 1000 AND last_login > '2023-01-01' ORDER BY created_at DESC LIMIT 100",
+			expected: "select * from users where id > ? and last_login > ? order by created_at desc limit ?",
+		},
+		{
+			name:     "空白と改行",
+			query:    "SELECT *\n  FROM   users\n\tWHERE email = \"a@example.com\";",
+			expected: "select * from users where email = ?",
+		},
+		{
+			name:     "INリスト",
+			query:    "SELECT name FROM users WHERE id IN (1, 2, 3, 4)",
+			expected: "select name from users where id in(?+)",
+		},
+		{
+			name:     "VALUESリスト",
+			query:    "INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y')",
+			expected: "insert into t (a, b) values(?+)",
+		},
+		{
+			name:     "コメント",
+			query:    "/* controller:users */ SELECT 1 -- trailing\nFROM dual # hash",
+			expected: "select ? from dual",
+		},
+		{
+			name:     "識別子の数字は残す",
+			query:    "SELECT t1.col2 FROM table_2 t1 WHERE t1.x = -5 AND t1.y = 1.5e3 AND t1.z = 0xFF",
+			expected: "select t1.col2 from table_2 t1 where t1.x = ? and t1.y = ? and t1.z = ?",
+		},
+		{
+			name:     "引き算は残す",
+			query:    "SELECT a-1 FROM t",
+			expected: "select a-? from t",
+		},
+		{
+			name:     "エスケープされた文字列",
+			query:    `SELECT * FROM t WHERE a = 'it''s' AND b = 'c\'d'`,
+			expected: "select * from t where a = ? and b = ?",
+		},
+		{
+			name:     "バッククォート",
+			query:    "SELECT `id` FROM `Users` LIMIT 10, 20",
+			expected: "select id from users limit ?",
+		},
+		{
+			name:     "管理コマンド",
+			query:    "# administrator command: Quit",
+			expected: "administrator command: quit",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Fingerprint(tc.query); got != tc.expected {
+				t.Errorf("Fingerprint() = %q, want %q", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestFingerprintID(t *testing.T) {
+	a := FingerprintID(Fingerprint("SELECT * FROM users WHERE id = 1"))
+	b := FingerprintID(Fingerprint("select *  from users where id = 42"))
+	c := FingerprintID(Fingerprint("SELECT * FROM orders WHERE id = 1"))
+
+	if len(a) != 16 {
+		t.Errorf("FingerprintID() = %q, want 16 characters", a)
+	}
+	if a != b {
+		t.Errorf("FingerprintID() differs for the same fingerprint: %s, %s", a, b)
+	}
+	if a == c {
+		t.Errorf("FingerprintID() is the same for different fingerprints: %s", a)
+	}
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"errors"
+	"path/filepath"
 	"testing"
 )
 
@@ -166,7 +167,10 @@ func TestGCPDownloadSlowQueryLog(t *testing.T) {
 				DownloadError:           tc.downloadError,
 			}
 
-			_, err := DownloadSlowQueryLog(mockClient, tc.instance, tc.filter, tc.logFiles)
+			err := DownloadSlowQueryLog(mockClient, tc.instance, tc.logFiles, DownloadOptions{
+				Filter: tc.filter,
+				Output: filepath.Join(t.TempDir(), "a.log"),
+			})
 
 			if (err != nil) != tc.expectedError {
 				t.Errorf("DownloadSlowQueryLog() with GCP client error = %v, expectedError %v", err, tc.expectedError)
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// historyCmd はウェアハウスからクエリのフィンガープリントの推移を集計するコマンドです
+var historyCmd = &cobra.Command{
+	Use:   "history [flags] <query-id>",
+	Short: "Show how a query fingerprint has trended in the warehouse",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, _ := cmd.Flags().GetString("warehouse")
+		if path == "" {
+			path = DefaultWarehousePath()
+		}
+		format, _ := cmd.Flags().GetString("format")
+		period, _ := cmd.Flags().GetString("period")
+		periods, _ := cmd.Flags().GetInt("periods")
+		instance, _ := cmd.Flags().GetString("instance")
+
+		warehouse, err := OpenWarehouseReadOnly(path)
+		if err != nil {
+			return err
+		}
+		defer warehouse.Close()
+
+		history, err := warehouse.History(cmd.Context(), args[0], HistoryOptions{
+			Period:   period,
+			Periods:  periods,
+			Instance: instance,
+			Now:      time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		return WriteHistory(cmd.OutOrStdout(), history, format)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.Flags().String("warehouse", "", "SQLite database of the downloaded entries (default ~/.local/share/mysql-slowquery-downloder/warehouse.db)")
+	historyCmd.Flags().String("format", "text", "output format (text, csv or json)")
+	historyCmd.Flags().String("period", "week", "length of a period (day, week or month)")
+	historyCmd.Flags().Int("periods", 12, "number of periods up to the current one (0 for all since the first entry)")
+	historyCmd.Flags().String("instance", "", "instance name prefix (default all instances)")
+}
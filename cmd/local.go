@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// LocalClient はローカルに保存済みのスロークエリログを読み込むクライアントです
+type LocalClient struct {
+	logger *slog.Logger
+	files  map[string][]string
+}
+
+// instanceLogPattern は slowquery.<instance>.log 形式のファイル名にマッチします
+var instanceLogPattern = regexp.MustCompile(`^slowquery\.(.+)\.log(\..+)?$`)
+
+// NewLocalClient はディレクトリ、ファイル、またはglobパターンからクライアントを生成します
+// 複数のパスはカンマで区切って指定できます
+func NewLocalClient(logger *slog.Logger, path string) (LocalClient, error) {
+	if path == "" {
+		return LocalClient{}, fmt.Errorf("local path is required")
+	}
+
+	files := map[string][]string{}
+	for _, p := range strings.Split(path, ",") {
+		matches, err := expandLocalPath(p)
+		if err != nil {
+			return LocalClient{}, err
+		}
+
+		for _, file := range matches {
+			instance := LocalInstanceName(file)
+			files[instance] = append(files[instance], file)
+		}
+	}
+
+	if len(files) == 0 {
+		return LocalClient{}, fmt.Errorf("no log files found in %s", path)
+	}
+
+	for instance := range files {
+		sort.Strings(files[instance])
+	}
+
+	return LocalClient{
+		logger: logger,
+		files:  files,
+	}, nil
+}
+
+// expandLocalPath はパスを読み込み対象のファイル一覧に展開します
+func expandLocalPath(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var files []string
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+		return files, nil
+	}
+	if err == nil {
+		return []string{path}, nil
+	}
+
+	matches, err := filepath.Glob(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %s: %w", path, err)
+	}
+
+	var files []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && !info.IsDir() {
+			files = append(files, match)
+		}
+	}
+	return files, nil
+}
+
+// LocalInstanceName はファイル名からインスタンス名を求めます
+// slowquery.<instance>.log 形式であれば <instance> を、それ以外は拡張子を除いたファイル名を返します
+func LocalInstanceName(file string) string {
+	base := filepath.Base(file)
+	if m := instanceLogPattern.FindStringSubmatch(base); m != nil {
+		return m[1]
+	}
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func (l LocalClient) GetInstanceList() []string {
+	var instanceList []string
+	for instance := range l.files {
+		instanceList = append(instanceList, instance)
+	}
+	sort.Strings(instanceList)
+	return instanceList
+}
+
+func (l LocalClient) GetSlowQueryList(instance string) ([]string, error) {
+	files, ok := l.files[instance]
+	if !ok {
+		return nil, fmt.Errorf("No log files found for instance: %s", instance)
+	}
+	return files, nil
+}
+
+func (l LocalClient) DownloadSlowQueryLog(instance string, logFile string) (*string, error) {
+	l.logger.Debug(fmt.Sprintf("read local log file: %s", logFile))
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		return nil, err
+	}
+
+	str := string(data)
+	return &str, nil
+}
+
+// OpenSlowQueryLog はログファイルを読み込み用に開きます
+func (l LocalClient) OpenSlowQueryLog(instance string, logFile string) (io.ReadCloser, error) {
+	l.logger.Debug(fmt.Sprintf("open local log file: %s", logFile))
+	return os.Open(logFile)
+}
+
+// TailSlowQueryLog はログファイルの marker のバイト位置以降を返します
+func (l LocalClient) TailSlowQueryLog(instance string, logFile string, marker string) (string, string, error) {
+	l.logger.Debug(fmt.Sprintf("tail local log file: %s from %q", logFile, marker))
+
+	file, err := os.Open(logFile)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	return tailLog(file, marker)
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocalInstanceName(t *testing.T) {
+	testCases := []struct {
+		file     string
+		expected string
+	}{
+		{file: "testdata/slowquery.mysql-instance-1.log", expected: "mysql-instance-1"},
+		{file: "slowquery.gcp-mysql-prod.log.1", expected: "gcp-mysql-prod"},
+		{file: "logs/aws-slowquery.log", expected: "aws-slowquery"},
+		{file: "mysql-slow", expected: "mysql-slow"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.file, func(t *testing.T) {
+			if got := LocalInstanceName(tc.file); got != tc.expected {
+				t.Errorf("LocalInstanceName() = %v, want %v", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestLocalClient(t *testing.T) {
+	dir := t.TempDir()
+	if err := GenerateTestLogs(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name      string
+		path      string
+		instances []string
+		wantErr   bool
+	}{
+		{
+			name: "ディレクトリ",
+			path: dir,
+			instances: []string{
+				"aws-slowquery", "gcp-mysql-dev", "gcp-mysql-prod", "gcp-slowquery-1", "gcp-slowquery-2",
+				"mysql-instance-1", "mysql-instance-2",
+			},
+		},
+		{
+			name:      "globパターン",
+			path:      filepath.Join(dir, "slowquery.mysql-*.log"),
+			instances: []string{"mysql-instance-1", "mysql-instance-2"},
+		},
+		{
+			name:      "複数のファイル",
+			path:      filepath.Join(dir, "aws-slowquery.log") + "," + filepath.Join(dir, "slowquery.gcp-mysql-dev.log"),
+			instances: []string{"aws-slowquery", "gcp-mysql-dev"},
+		},
+		{
+			name:    "一致なし",
+			path:    filepath.Join(dir, "*.txt"),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewLocalClient(NewLogger("error"), tc.path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("NewLocalClient() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+
+			if got := client.GetInstanceList(); !reflect.DeepEqual(got, tc.instances) {
+				t.Errorf("GetInstanceList() = %v, want %v", got, tc.instances)
+			}
+		})
+	}
+}
+
+func TestLocalClientDownload(t *testing.T) {
+	dir := t.TempDir()
+	if err := GenerateTestLogs(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewLocalClient(NewLogger("error"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance := FilterInstance(client, "mysql-instance-2")
+	logList, err := GetSlowQueryList(client, instance)
+	if err != nil {
+		t.Fatalf("GetSlowQueryList() returned error: %v", err)
+	}
+	if len(logList) != 1 {
+		t.Fatalf("GetSlowQueryList() returned %d logs, want 1", len(logList))
+	}
+
+	if _, err := GetSlowQueryList(client, "unknown"); err == nil {
+		t.Error("GetSlowQueryList() with unknown instance should return error")
+	}
+
+	output := filepath.Join(t.TempDir(), "{{.Instance}}", "{{.LogFile}}")
+	if err := DownloadSlowQueryLog(client, instance, logList, DownloadOptions{Provider: "local", Output: output}); err != nil {
+		t.Fatalf("DownloadSlowQueryLog() returned error: %v", err)
+	}
+
+	path, _ := OutputPath(output, OutputData{Instance: instance, LogFile: "slowquery.mysql-instance-2.log"})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "# Query_time:") {
+		t.Errorf("downloaded log does not contain slow query entries: %q", data)
+	}
+}
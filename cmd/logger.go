@@ -23,5 +23,5 @@ func NewLogger(logLevel string) *slog.Logger {
 		Level: level,
 	}
 
-	return slog.New(slog.NewJSONHandler(os.Stdout, &opts))
+	return slog.New(slog.NewJSONHandler(os.Stderr, &opts))
 }
@@ -0,0 +1,474 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// 通知のデフォルト値です
+const (
+	defaultNotifyTop     = 5
+	defaultNotifyRetries = 3
+	defaultNotifyTimeout = 10 * time.Second
+	defaultNotifyBackoff = time.Second
+)
+
+// notifyTypes は通知先の種類です
+var notifyTypes = []string{"webhook", "slack", "mattermost"}
+
+// defaultNotifyTemplate は template を指定していない通知先のメッセージです
+// Slack と Mattermost のどちらでも読めるように、箇条書きとコードだけを使います
+const defaultNotifyTemplate = `*Slow query summary{{if .Target}} for {{.Target}}{{end}}*
+{{.Queries}} queries, {{.Unique}} fingerprints, {{seconds .TotalTime}} total{{if not .FirstSeen.IsZero}} ({{time .FirstSeen}} to {{time .LastSeen}} UTC){{end}}
+{{- if .Breaches}}
+
+*Threshold breaches*
+{{- range .Breaches}}
+• {{.Rule}}: {{.Violations}} violations ({{.Description}})
+{{- end}}
+{{- end}}
+{{- if .New}}
+
+*New fingerprints*
+{{- range .New}}
+• ` + "`{{.ID}}`" + ` {{.Count}} calls, {{seconds .Total}} total: ` + "`{{code .Fingerprint}}`" + `
+{{- end}}
+{{- end}}
+{{- if .Top}}
+
+*Top fingerprints*
+{{- range .Top}}
+• ` + "`{{.ID}}`" + ` {{.Count}} calls, {{seconds .Total}} total, p95 {{seconds .P95}}: ` + "`{{code .Fingerprint}}`" + `
+{{- end}}
+{{- end}}
+`
+
+// NotifyConfig はダウンロード後に集計結果を通知する設定です
+type NotifyConfig struct {
+	Sinks []NotifySink `yaml:"sinks"`
+	// Top は通知する上位のフィンガープリントの数です
+	Top int `yaml:"top"`
+	// Rules は閾値の違反として通知するcheckコマンドのルールです
+	Rules []CheckRule `yaml:"rules"`
+	// StateFile は新しいフィンガープリントを見つけるために、これまでに見たフィンガープリントを保存するファイルです
+	StateFile string `yaml:"state_file"`
+}
+
+// NotifySink は通知先です
+// URL とヘッダーの値の ${VAR} は環境変数の値に置き換えます
+type NotifySink struct {
+	Name     string            `yaml:"name"`
+	Type     string            `yaml:"type"`
+	URL      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers"`
+	Template string            `yaml:"template"`
+	// Username と Channel は Slack と Mattermost の投稿者名とチャンネルです
+	Username string `yaml:"username"`
+	Channel  string `yaml:"channel"`
+	Retries  *int   `yaml:"retries"`
+}
+
+// NotifySummary は通知する集計結果です。メッセージのテンプレートにはこの値を渡します
+type NotifySummary struct {
+	Target    string              `json:"target,omitempty"`
+	Instances []string            `json:"instances"`
+	Queries   int64               `json:"queries"`
+	Unique    int                 `json:"unique"`
+	TotalTime float64             `json:"total_time"`
+	FirstSeen time.Time           `json:"first_seen"`
+	LastSeen  time.Time           `json:"last_seen"`
+	Top       []NotifyFingerprint `json:"top"`
+	New       []NotifyFingerprint `json:"new"`
+	Breaches  []NotifyBreach      `json:"breaches"`
+}
+
+// NotifyFingerprint はフィンガープリントごとの集計です
+type NotifyFingerprint struct {
+	ID          string  `json:"id"`
+	Fingerprint string  `json:"fingerprint"`
+	Count       int64   `json:"count"`
+	Total       float64 `json:"total"`
+	P95         float64 `json:"p95"`
+}
+
+// NotifyBreach は違反のあったcheckコマンドのルールです
+type NotifyBreach struct {
+	Rule        string   `json:"rule"`
+	Description string   `json:"description"`
+	Violations  int      `json:"violations"`
+	Details     []string `json:"details"`
+}
+
+// notifyMaxDetails は違反ごとに通知する詳細の数です
+const notifyMaxDetails = 3
+
+// NewNotifySummary は集計結果から通知する内容を組み立てます
+// known がnilでない場合は、known にないフィンガープリントを新しいフィンガープリントとします
+func NewNotifySummary(target string, d *Digest, check CheckResult, known map[string]bool, top int) NotifySummary {
+	if top <= 0 {
+		top = defaultNotifyTop
+	}
+
+	summary := NotifySummary{
+		Target:    target,
+		Instances: []string{},
+		Queries:   d.QueryTime.Count,
+		Unique:    d.Len(),
+		TotalTime: d.QueryTime.Total,
+		FirstSeen: d.FirstSeen,
+		LastSeen:  d.LastSeen,
+		Top:       []NotifyFingerprint{},
+		New:       []NotifyFingerprint{},
+		Breaches:  []NotifyBreach{},
+	}
+
+	instances := map[string]bool{}
+	for i, c := range d.Classes("total") {
+		for instance := range c.Instances {
+			instances[instance] = true
+		}
+		f := NotifyFingerprint{
+			ID:          c.ID,
+			Fingerprint: c.Fingerprint,
+			Count:       c.Count,
+			Total:       c.QueryTime.Total,
+			P95:         c.Latency.Quantile(0.95),
+		}
+		if i < top {
+			summary.Top = append(summary.Top, f)
+		}
+		if known != nil && !known[c.ID] && len(summary.New) < top {
+			summary.New = append(summary.New, f)
+		}
+	}
+	for instance := range instances {
+		summary.Instances = append(summary.Instances, instance)
+	}
+	sort.Strings(summary.Instances)
+
+	for _, r := range check.Rules {
+		if len(r.Violations) == 0 {
+			continue
+		}
+		breach := NotifyBreach{Rule: r.Rule.Name, Description: describeCheckRule(r.Rule), Violations: len(r.Violations)}
+		for i, v := range r.Violations {
+			if i == notifyMaxDetails {
+				break
+			}
+			breach.Details = append(breach.Details, describeCheckViolation(r.Rule, v, 80))
+		}
+		summary.Breaches = append(summary.Breaches, breach)
+	}
+
+	return summary
+}
+
+// Notifier は集計結果を通知先に送ります
+type Notifier struct {
+	logger  *slog.Logger
+	client  *http.Client
+	sinks   []notifySink
+	backoff time.Duration
+}
+
+type notifySink struct {
+	NotifySink
+	url      string
+	headers  map[string]string
+	template *template.Template
+	retries  int
+}
+
+var notifyFuncs = template.FuncMap{
+	"seconds":  formatSeconds,
+	"time":     formatTime,
+	"truncate": truncate,
+	// code はバッククォートで囲めるように、値のバッククォートを置き換えます
+	"code": func(s string) string {
+		return strings.ReplaceAll(truncate(s, 120), "`", "'")
+	},
+}
+
+// NewNotifier は設定から Notifier を生成します。通知先がない場合はnilを返します
+func NewNotifier(logger *slog.Logger, config NotifyConfig) (*Notifier, error) {
+	if len(config.Sinks) == 0 {
+		return nil, nil
+	}
+
+	n := &Notifier{
+		logger:  logger,
+		client:  &http.Client{Timeout: defaultNotifyTimeout},
+		backoff: defaultNotifyBackoff,
+	}
+	for i, sink := range config.Sinks {
+		if sink.Name == "" {
+			sink.Name = fmt.Sprintf("%s-%d", sink.Type, i+1)
+		}
+		if !contains(notifyTypes, sink.Type) {
+			return nil, fmt.Errorf("notify sink %q: unsupported type %q. Use %s", sink.Name, sink.Type, strings.Join(notifyTypes, ", "))
+		}
+
+		s := notifySink{NotifySink: sink, url: os.ExpandEnv(sink.URL), headers: map[string]string{}, retries: defaultNotifyRetries}
+		if s.url == "" {
+			return nil, fmt.Errorf("notify sink %q: url is required", sink.Name)
+		}
+		for k, v := range sink.Headers {
+			s.headers[k] = os.ExpandEnv(v)
+		}
+		if sink.Retries != nil {
+			s.retries = max(*sink.Retries, 0)
+		}
+
+		text := sink.Template
+		if text == "" {
+			text = defaultNotifyTemplate
+		}
+		tmpl, err := template.New(sink.Name).Funcs(notifyFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("notify sink %q: invalid template: %w", sink.Name, err)
+		}
+		s.template = tmpl
+
+		n.sinks = append(n.sinks, s)
+	}
+	return n, nil
+}
+
+// payload は通知先の種類に合わせたJSONを組み立てます
+// slack と mattermost は Incoming Webhook の形式で、webhook はメッセージと集計結果の両方を送ります
+func (s notifySink) payload(summary NotifySummary) ([]byte, error) {
+	var text strings.Builder
+	if err := s.template.Execute(&text, summary); err != nil {
+		return nil, fmt.Errorf("notify sink %q: failed to render template: %w", s.Name, err)
+	}
+
+	var body any
+	switch s.Type {
+	case "slack", "mattermost":
+		body = struct {
+			Text     string `json:"text"`
+			Username string `json:"username,omitempty"`
+			Channel  string `json:"channel,omitempty"`
+		}{text.String(), s.Username, s.Channel}
+	default:
+		body = struct {
+			Text    string        `json:"text"`
+			Summary NotifySummary `json:"summary"`
+		}{text.String(), summary}
+	}
+	return json.Marshal(body)
+}
+
+// Notify は全ての通知先に集計結果を送ります
+// 一部の通知先に失敗しても残りの通知先には送り、失敗をまとめて返します
+func (n *Notifier) Notify(ctx context.Context, summary NotifySummary) error {
+	if n == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, s := range n.sinks {
+		body, err := s.payload(summary)
+		if err == nil {
+			err = n.send(ctx, s, body)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to notify %s: %w", s.Name, err))
+			continue
+		}
+		n.logger.Info("Notified", "sink", s.Name, "type", s.Type)
+	}
+	return errors.Join(errs...)
+}
+
+// send は通知を送ります。接続のエラー、429、5xx の場合は待ち時間を倍にしながら再送します
+func (n *Notifier) send(ctx context.Context, s notifySink, body []byte) error {
+	wait := n.backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = n.post(ctx, s, body)
+		if err == nil || !retry || attempt >= s.retries {
+			return err
+		}
+
+		n.logger.Warn("Retrying notification", "sink", s.Name, "attempt", attempt+1, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// post は1回だけ通知を送り、エラーの場合は再送するべきかどうかを返します
+func (n *Notifier) post(ctx context.Context, s notifySink, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// Preview は通知を送らずに、通知先ごとに送る内容を書き出します
+func (n *Notifier) Preview(w io.Writer, summary NotifySummary) error {
+	if n == nil {
+		return nil
+	}
+
+	for _, s := range n.sinks {
+		body, err := s.payload(summary)
+		if err != nil {
+			return err
+		}
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, body, "", "  "); err != nil {
+			return err
+		}
+		// URL にはトークンが含まれることが多いので、ホストまでしか表示しない
+		fmt.Fprintf(w, "# %s (%s) %s\n%s\n", s.Name, s.Type, redactURL(s.url), indented.String())
+	}
+	return nil
+}
+
+// redactURL はURLのパスとクエリを省略します
+func redactURL(u string) string {
+	scheme, rest, ok := strings.Cut(u, "://")
+	if !ok {
+		return "***"
+	}
+	host, _, _ := strings.Cut(rest, "/")
+	return scheme + "://" + host + "/***"
+}
+
+// notifyState は通知済みのフィンガープリントです
+type notifyState struct {
+	Fingerprints map[string]time.Time `json:"fingerprints"`
+}
+
+// defaultNotifyStateFile はターゲットごとの状態ファイルのパスを返します
+func defaultNotifyStateFile(target string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	if target == "" {
+		target = "default"
+	}
+	return filepath.Join(dir, "mysql-slowquery-downloder", "notify", target+".json")
+}
+
+// LoadKnownFingerprints は状態ファイルからこれまでに見たフィンガープリントを読み込みます
+// 状態ファイルがない初回はnilを返し、全てのフィンガープリントを新しいとは扱いません
+func LoadKnownFingerprints(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state notifyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	known := map[string]bool{}
+	for id := range state.Fingerprints {
+		known[id] = true
+	}
+	return known, nil
+}
+
+// SaveKnownFingerprints は集計したフィンガープリントを状態ファイルに追加します
+func SaveKnownFingerprints(path string, d *Digest, now time.Time) error {
+	state := notifyState{Fingerprints: map[string]time.Time{}}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		if state.Fingerprints == nil {
+			state.Fingerprints = map[string]time.Time{}
+		}
+	}
+	for _, c := range d.Classes("total") {
+		if _, ok := state.Fingerprints[c.ID]; !ok {
+			state.Fingerprints[c.ID] = now.UTC()
+		}
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// notifyDownload はダウンロードしたエントリの集計結果を通知します
+// dryRun の場合は送る内容を w に書き出すだけで、状態ファイルも更新しません
+func notifyDownload(ctx context.Context, w io.Writer, n *Notifier, target Target, d *Digest, check CheckResult, dryRun bool) error {
+	stateFile := target.Notify.StateFile
+	if stateFile == "" {
+		stateFile = defaultNotifyStateFile(target.Name)
+	}
+
+	var known map[string]bool
+	if stateFile != "" {
+		var err error
+		if known, err = LoadKnownFingerprints(stateFile); err != nil {
+			return err
+		}
+	}
+
+	summary := NewNotifySummary(target.Name, d, check, known, target.Notify.Top)
+	if dryRun {
+		return n.Preview(w, summary)
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := n.Notify(ctx, summary); err != nil {
+		return err
+	}
+	if stateFile != "" {
+		return SaveKnownFingerprints(stateFile, d, time.Now())
+	}
+	return nil
+}
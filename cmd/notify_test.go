@@ -0,0 +1,387 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notifyRecorder は通知を受け取るテスト用のサーバーです
+type notifyRecorder struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []map[string]any
+}
+
+func newNotifyServer(t *testing.T, statuses ...int) (*httptest.Server, *notifyRecorder) {
+	t.Helper()
+	rec := &notifyRecorder{statuses: statuses}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+
+		data, _ := io.ReadAll(r.Body)
+		var body map[string]any
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("invalid JSON payload: %v\n%s", err, data)
+		}
+		rec.requests = append(rec.requests, r)
+		rec.bodies = append(rec.bodies, body)
+
+		status := http.StatusOK
+		if len(rec.statuses) > 0 {
+			status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, rec
+}
+
+func newTestNotifier(t *testing.T, sinks ...NotifySink) *Notifier {
+	t.Helper()
+	n, err := NewNotifier(NewLogger("error"), NotifyConfig{Sinks: sinks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.backoff = 0
+	return n
+}
+
+// newTestNotifyDigest はテスト用のエントリを集計します
+func newTestNotifyDigest() *Digest {
+	d := NewDigest()
+	base := time.Date(2023, 5, 10, 12, 0, 0, 0, time.UTC).Unix()
+	for i := 0; i < 3; i++ {
+		d.Add(newTestRecord("db-1", "SELECT * FROM orders WHERE user_id = 1", 5.0, 1, 1000, base+int64(i)))
+	}
+	d.Add(newTestRecord("db-2", "SELECT `name` FROM users WHERE id = 2", 1.0, 1, 1, base+10))
+	return d
+}
+
+func TestNewNotifier(t *testing.T) {
+	retries := -1
+	testCases := []struct {
+		name    string
+		sinks   []NotifySink
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "通知先がない", wantNil: true},
+		{name: "webhook", sinks: []NotifySink{{Type: "webhook", URL: "http://localhost/hook"}}},
+		{name: "負の再送回数", sinks: []NotifySink{{Type: "slack", URL: "http://localhost/hook", Retries: &retries}}},
+		{name: "不明な種類", sinks: []NotifySink{{Type: "teams", URL: "http://localhost/hook"}}, wantErr: true},
+		{name: "URLがない", sinks: []NotifySink{{Type: "slack"}}, wantErr: true},
+		{name: "不正なテンプレート", sinks: []NotifySink{{Type: "slack", URL: "http://localhost/hook", Template: "{{.Queries"}}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := NewNotifier(NewLogger("error"), NotifyConfig{Sinks: tc.sinks})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("NewNotifier() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if (n == nil) != (tc.wantNil || tc.wantErr) {
+				t.Errorf("NewNotifier() = %v, wantNil %v", n, tc.wantNil)
+			}
+		})
+	}
+
+	t.Setenv("NOTIFY_TEST_TOKEN", "secret")
+	n := newTestNotifier(t, NotifySink{Type: "webhook", URL: "http://localhost/${NOTIFY_TEST_TOKEN}", Headers: map[string]string{"Authorization": "Bearer ${NOTIFY_TEST_TOKEN}"}})
+	if s := n.sinks[0]; s.Name != "webhook-1" || s.url != "http://localhost/secret" || s.headers["Authorization"] != "Bearer secret" {
+		t.Errorf("NewNotifier() sink = %s %s %v, want expanded environment variables", s.Name, s.url, s.headers)
+	}
+}
+
+func TestNewNotifySummary(t *testing.T) {
+	d := newTestNotifyDigest()
+	orders := FingerprintID(Fingerprint("SELECT * FROM orders WHERE user_id = 1"))
+	users := FingerprintID(Fingerprint("SELECT `name` FROM users WHERE id = 2"))
+
+	testCases := []struct {
+		name    string
+		known   map[string]bool
+		top     int
+		wantTop []string
+		wantNew []string
+	}{
+		{name: "初回は新しいフィンガープリントなし", wantTop: []string{orders, users}},
+		{name: "既知のフィンガープリントを除く", known: map[string]bool{orders: true}, wantTop: []string{orders, users}, wantNew: []string{users}},
+		{name: "上位の数", known: map[string]bool{}, top: 1, wantTop: []string{orders}, wantNew: []string{orders}},
+	}
+
+	ids := func(fs []NotifyFingerprint) string {
+		var s []string
+		for _, f := range fs {
+			s = append(s, f.ID)
+		}
+		return strings.Join(s, ",")
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewNotifySummary("prod", d, CheckResult{}, tc.known, tc.top)
+			if got, want := ids(s.Top), strings.Join(tc.wantTop, ","); got != want {
+				t.Errorf("NewNotifySummary() Top = %s, want %s", got, want)
+			}
+			if got, want := ids(s.New), strings.Join(tc.wantNew, ","); got != want {
+				t.Errorf("NewNotifySummary() New = %s, want %s", got, want)
+			}
+			if s.Queries != 4 || s.Unique != 2 || strings.Join(s.Instances, ",") != "db-1,db-2" {
+				t.Errorf("NewNotifySummary() = %d queries, %d unique, %v", s.Queries, s.Unique, s.Instances)
+			}
+		})
+	}
+
+	s := NewNotifySummary("prod", d, newTestCheckResult(t), nil, 0)
+	if len(s.Breaches) != 2 || s.Breaches[0].Rule != "no full scans" || s.Breaches[1].Description != "sum of query_time per 1h > 300" {
+		t.Errorf("NewNotifySummary() Breaches = %+v", s.Breaches)
+	}
+}
+
+func TestNotifierNotify(t *testing.T) {
+	summary := NewNotifySummary("prod", newTestNotifyDigest(), newTestCheckResult(t), map[string]bool{}, 0)
+
+	testCases := []struct {
+		name     string
+		sink     NotifySink
+		statuses []int
+		wantReqs int
+		wantErr  bool
+		wantKeys []string
+	}{
+		{name: "webhook", sink: NotifySink{Type: "webhook"}, wantReqs: 1, wantKeys: []string{"summary", "text"}},
+		{name: "slack", sink: NotifySink{Type: "slack", Username: "slowquery", Channel: "#db"}, wantReqs: 1, wantKeys: []string{"channel", "text", "username"}},
+		{name: "mattermost", sink: NotifySink{Type: "mattermost"}, wantReqs: 1, wantKeys: []string{"text"}},
+		{name: "5xxは再送する", sink: NotifySink{Type: "slack"}, statuses: []int{500, 503}, wantReqs: 3, wantKeys: []string{"text"}},
+		{name: "429は再送する", sink: NotifySink{Type: "slack"}, statuses: []int{429}, wantReqs: 2, wantKeys: []string{"text"}},
+		{name: "再送回数を超える", sink: NotifySink{Type: "slack"}, statuses: []int{500, 500, 500, 500}, wantReqs: 4, wantErr: true},
+		{name: "4xxは再送しない", sink: NotifySink{Type: "slack"}, statuses: []int{400}, wantReqs: 1, wantErr: true},
+		{name: "テンプレートの実行エラー", sink: NotifySink{Type: "slack", Template: "{{.Missing}}"}, wantReqs: 0, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, rec := newNotifyServer(t, tc.statuses...)
+			tc.sink.URL = srv.URL + "/hooks/token"
+			tc.sink.Headers = map[string]string{"X-Test": "1"}
+			n := newTestNotifier(t, tc.sink)
+
+			err := n.Notify(context.Background(), summary)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Notify() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if len(rec.requests) != tc.wantReqs {
+				t.Fatalf("Notify() sent %d requests, want %d", len(rec.requests), tc.wantReqs)
+			}
+			if tc.wantErr || tc.wantReqs == 0 {
+				return
+			}
+
+			req, body := rec.requests[len(rec.requests)-1], rec.bodies[len(rec.bodies)-1]
+			if req.Header.Get("Content-Type") != "application/json" || req.Header.Get("X-Test") != "1" {
+				t.Errorf("Notify() headers = %v", req.Header)
+			}
+			var keys []string
+			for k := range body {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			if got, want := strings.Join(keys, ","), strings.Join(tc.wantKeys, ","); got != want {
+				t.Errorf("Notify() payload keys = %s, want %s", got, want)
+			}
+			text, _ := body["text"].(string)
+			for _, want := range []string{"Slow query summary for prod", "*Threshold breaches*", "*New fingerprints*", "*Top fingerprints*", "`select name from users where id = ?`"} {
+				if !strings.Contains(text, want) {
+					t.Errorf("Notify() text does not contain %q:\n%s", want, text)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifierNotifyContinuesAfterFailure(t *testing.T) {
+	failing, _ := newNotifyServer(t, 400)
+	ok, rec := newNotifyServer(t)
+	n := newTestNotifier(t,
+		NotifySink{Name: "broken", Type: "webhook", URL: failing.URL},
+		NotifySink{Name: "chat", Type: "slack", URL: ok.URL},
+	)
+
+	err := n.Notify(context.Background(), NewNotifySummary("", newTestNotifyDigest(), CheckResult{}, nil, 0))
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("Notify() error = %v, want error of broken", err)
+	}
+	if len(rec.requests) != 1 {
+		t.Errorf("Notify() sent %d requests to chat, want 1", len(rec.requests))
+	}
+}
+
+func TestNotifierPreview(t *testing.T) {
+	srv, rec := newNotifyServer(t)
+	n := newTestNotifier(t, NotifySink{Name: "chat", Type: "slack", URL: srv.URL + "/hooks/secret-token"})
+
+	var buf bytes.Buffer
+	if err := n.Preview(&buf, NewNotifySummary("prod", newTestNotifyDigest(), CheckResult{}, nil, 0)); err != nil {
+		t.Fatalf("Preview() returned error: %v", err)
+	}
+	if len(rec.requests) != 0 {
+		t.Errorf("Preview() sent %d requests, want 0", len(rec.requests))
+	}
+	if !strings.HasPrefix(buf.String(), "# chat (slack) "+srv.URL+"/***\n") || strings.Contains(buf.String(), "secret-token") {
+		t.Errorf("Preview() = %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"text": "*Slow query summary for prod*`) {
+		t.Errorf("Preview() does not contain the message:\n%s", buf.String())
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	testCases := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{name: "パスとクエリ", url: "https://hooks.slack.com/services/T000/B000/XXXX?a=1", want: "https://hooks.slack.com/***"},
+		{name: "ホストのみ", url: "http://localhost:8080", want: "http://localhost:8080/***"},
+		{name: "スキームなし", url: "hooks.example.com/token", want: "***"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := redactURL(tc.url); got != tc.want {
+				t.Errorf("redactURL() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestKnownFingerprints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify", "prod.json")
+
+	known, err := LoadKnownFingerprints(path)
+	if err != nil || known != nil {
+		t.Fatalf("LoadKnownFingerprints() = %v, %v, want nil for the first run", known, err)
+	}
+
+	d := newTestNotifyDigest()
+	first := time.Date(2023, 5, 10, 0, 0, 0, 0, time.UTC)
+	if err := SaveKnownFingerprints(path, d, first); err != nil {
+		t.Fatalf("SaveKnownFingerprints() returned error: %v", err)
+	}
+
+	d.Add(newTestRecord("db-1", "DELETE FROM sessions WHERE id = 1", 2.0, 0, 1, first.Unix()))
+	if err := SaveKnownFingerprints(path, d, first.Add(time.Hour)); err != nil {
+		t.Fatalf("SaveKnownFingerprints() returned error: %v", err)
+	}
+
+	known, err = LoadKnownFingerprints(path)
+	if err != nil || len(known) != 3 {
+		t.Fatalf("LoadKnownFingerprints() = %v, %v, want 3 fingerprints", known, err)
+	}
+
+	// 最初に見た時刻は上書きしない
+	var state notifyState
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Fingerprints[FingerprintID(Fingerprint("SELECT * FROM orders WHERE user_id = 1"))]; !got.Equal(first) {
+		t.Errorf("first seen = %v, want %v", got, first)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKnownFingerprints(path); err == nil {
+		t.Error("LoadKnownFingerprints() with broken state should return error")
+	}
+}
+
+func TestDoNotify(t *testing.T) {
+	logs := t.TempDir()
+	if err := GenerateTestLogs(logs); err != nil {
+		t.Fatal(err)
+	}
+	srv, rec := newNotifyServer(t)
+
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state.json")
+	config := filepath.Join(dir, "config.yaml")
+	content := `targets:
+  local:
+    provider: local
+    path: ` + logs + `
+    output: ` + filepath.Join(dir, "out.log") + `
+    notify:
+      top: 3
+      state_file: ` + state + `
+      rules:
+        - name: no query over 5s
+          where: query_time > 5
+      sinks:
+        - name: hook
+          type: webhook
+          url: ` + srv.URL + `
+`
+	if err := os.WriteFile(config, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(args ...string) string {
+		t.Helper()
+		var stderr bytes.Buffer
+		rootCmd.SetErr(&stderr)
+		rootCmd.SetArgs(append([]string{"--config", config, "--target", "local"}, args...))
+		defer func() {
+			// フラグの値は rootCmd に残るので、他のテストのために元に戻す
+			rootCmd.SetErr(nil)
+			rootCmd.SetArgs(nil)
+			for _, name := range []string{"config", "target", "notify-dry-run"} {
+				f := rootCmd.Flag(name)
+				f.Value.Set(f.DefValue)
+				f.Changed = false
+			}
+		}()
+		if err := rootCmd.Execute(); err != nil {
+			t.Fatalf("Execute() returned error: %v", err)
+		}
+		return stderr.String()
+	}
+
+	// dry-run は送らずに内容を表示し、状態ファイルも作らない
+	preview := run("--notify-dry-run")
+	if len(rec.requests) != 0 || !strings.Contains(preview, "# hook (webhook)") {
+		t.Fatalf("dry-run sent %d requests, preview:\n%s", len(rec.requests), preview)
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Errorf("dry-run wrote the state file: %v", err)
+	}
+
+	run()
+	if len(rec.requests) != 1 {
+		t.Fatalf("Do() sent %d requests, want 1", len(rec.requests))
+	}
+	summary, _ := rec.bodies[0]["summary"].(map[string]any)
+	if summary["queries"] != float64(24) || summary["unique"] != float64(8) || len(summary["top"].([]any)) != 3 {
+		t.Errorf("summary = %v", summary)
+	}
+	if breaches, _ := summary["breaches"].([]any); len(breaches) != 1 {
+		t.Errorf("breaches = %v, want 1", summary["breaches"])
+	}
+	if known, err := LoadKnownFingerprints(state); err != nil || len(known) != 8 {
+		t.Errorf("LoadKnownFingerprints() = %d, %v, want 8", len(known), err)
+	}
+}
@@ -0,0 +1,457 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// OpenSearch に送る設定のデフォルト値です
+const (
+	defaultOpenSearchIndex         = "mysql-slowquery-{{.Date}}"
+	defaultOpenSearchTemplateName  = "mysql-slowquery"
+	defaultOpenSearchBatchSize     = 1000
+	defaultOpenSearchBatchBytes    = 5 << 20
+	defaultOpenSearchFlushInterval = 5 * time.Second
+	defaultOpenSearchRetries       = 3
+	defaultOpenSearchTimeout       = 30 * time.Second
+	defaultOpenSearchBackoff       = time.Second
+)
+
+// OpenSearchConfig はダウンロードしたエントリを OpenSearch や Elasticsearch に送る設定です
+// URL、Username、Password、ヘッダーの値の ${VAR} は環境変数の値に置き換えます
+type OpenSearchConfig struct {
+	URL string `yaml:"url"`
+	// Index はドキュメントを送るインデックスの Go テンプレートです
+	// {{.Target}}、{{.Provider}}、{{.Instance}} と、エントリの日付の {{.Date}} (2006.01.02) を使えます
+	Index    string            `yaml:"index"`
+	Username string            `yaml:"username"`
+	Password string            `yaml:"password"`
+	Headers  map[string]string `yaml:"headers"`
+	// BatchSize と BatchBytes のどちらかを超えるか、FlushInterval が過ぎると _bulk に送ります
+	BatchSize     int           `yaml:"batch_size"`
+	BatchBytes    int           `yaml:"batch_bytes"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	Retries       *int          `yaml:"retries"`
+	// TemplateName はマッピングを定義するインデックステンプレートの名前です
+	TemplateName string `yaml:"template_name"`
+	SkipTemplate bool   `yaml:"skip_template"`
+}
+
+// openSearchDocument は OpenSearch に送るドキュメントです。jsonl のスキーマに @timestamp とフィンガープリントを加えます
+type openSearchDocument struct {
+	AtTimestamp string `json:"@timestamp,omitempty"`
+	ExportRecord
+	// Time は日付型にするので、時刻がない場合は空文字列ではなくフィールドを省略します
+	Time        string `json:"time,omitempty"`
+	Target      string `json:"target,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// openSearchMappings はインデックステンプレートのマッピングです
+var openSearchMappings = map[string]any{
+	"dynamic_templates": []any{
+		map[string]any{"extra": map[string]any{
+			"path_match": "extra.*",
+			"mapping":    map[string]any{"type": "keyword", "ignore_above": 1024},
+		}},
+	},
+	"properties": map[string]any{
+		"@timestamp":     map[string]any{"type": "date"},
+		"time":           map[string]any{"type": "date"},
+		"timestamp":      map[string]any{"type": "long"},
+		"target":         map[string]any{"type": "keyword"},
+		"instance":       map[string]any{"type": "keyword"},
+		"provider":       map[string]any{"type": "keyword"},
+		"source":         map[string]any{"type": "keyword"},
+		"user":           map[string]any{"type": "keyword"},
+		"host":           map[string]any{"type": "keyword"},
+		"ip":             map[string]any{"type": "keyword"},
+		"thread_id":      map[string]any{"type": "long"},
+		"db":             map[string]any{"type": "keyword"},
+		"query_time":     map[string]any{"type": "double"},
+		"lock_time":      map[string]any{"type": "double"},
+		"rows_sent":      map[string]any{"type": "long"},
+		"rows_examined":  map[string]any{"type": "long"},
+		"statement_type": map[string]any{"type": "keyword"},
+		"query_id":       map[string]any{"type": "keyword"},
+		"sql":            map[string]any{"type": "text"},
+		"fingerprint": map[string]any{
+			"type":   "text",
+			"fields": map[string]any{"keyword": map[string]any{"type": "keyword", "ignore_above": 1024}},
+		},
+		"extra": map[string]any{"type": "object"},
+	},
+}
+
+// templateActionPattern はインデックスのテンプレートの {{...}} です
+var templateActionPattern = regexp.MustCompile(`\{\{.*?\}\}`)
+
+// OpenSearchSink はエントリをまとめて OpenSearch の _bulk に送ります
+// ドキュメントの ID はエントリから決まるので、同じログを送り直しても重複しません
+type OpenSearchSink struct {
+	logger  *slog.Logger
+	client  *http.Client
+	url     string
+	headers map[string]string
+	target  string
+	index   *template.Template
+	config  OpenSearchConfig
+	retries int
+	backoff time.Duration
+
+	mu        sync.Mutex
+	docs      [][]byte
+	size      int
+	templated bool
+	err       error
+	indexed   int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewOpenSearchSink は設定から OpenSearchSink を生成し、FlushInterval ごとに送る処理を始めます
+// URL がない場合はnilを返します。使い終わったら Close を呼び出します
+func NewOpenSearchSink(logger *slog.Logger, target string, config OpenSearchConfig) (*OpenSearchSink, error) {
+	url := strings.TrimSuffix(os.ExpandEnv(config.URL), "/")
+	if url == "" {
+		return nil, nil
+	}
+
+	if config.Index == "" {
+		config.Index = defaultOpenSearchIndex
+	}
+	index, err := template.New("index").Option("missingkey=error").Parse(config.Index)
+	if err != nil {
+		return nil, fmt.Errorf("opensearch: invalid index template %q: %w", config.Index, err)
+	}
+	if config.TemplateName == "" {
+		config.TemplateName = defaultOpenSearchTemplateName
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultOpenSearchBatchSize
+	}
+	if config.BatchBytes <= 0 {
+		config.BatchBytes = defaultOpenSearchBatchBytes
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultOpenSearchFlushInterval
+	}
+
+	s := &OpenSearchSink{
+		logger:  logger,
+		client:  &http.Client{Timeout: defaultOpenSearchTimeout},
+		url:     url,
+		headers: map[string]string{},
+		target:  target,
+		index:   index,
+		config:  config,
+		retries: defaultOpenSearchRetries,
+		backoff: defaultOpenSearchBackoff,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for k, v := range config.Headers {
+		s.headers[k] = os.ExpandEnv(v)
+	}
+	if config.Retries != nil {
+		s.retries = max(*config.Retries, 0)
+	}
+
+	go s.loop()
+	return s, nil
+}
+
+// loop は FlushInterval ごとに溜まったドキュメントを送ります
+func (s *OpenSearchSink) loop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.err == nil {
+				s.err = s.flush(context.Background())
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Add はエントリをバッチに加え、BatchSize か BatchBytes を超えた場合は送ります
+func (s *OpenSearchSink) Add(ctx context.Context, r Record) error {
+	if s == nil {
+		return nil
+	}
+
+	doc, err := s.document(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	if len(s.docs) > 0 && s.size+len(doc) > s.config.BatchBytes {
+		if s.err = s.flush(ctx); s.err != nil {
+			return s.err
+		}
+	}
+	s.docs = append(s.docs, doc)
+	s.size += len(doc)
+	if len(s.docs) >= s.config.BatchSize || s.size >= s.config.BatchBytes {
+		s.err = s.flush(ctx)
+	}
+	return s.err
+}
+
+// document はエントリを _bulk の index アクションとドキュメントの2行にします
+func (s *OpenSearchSink) document(r Record) ([]byte, error) {
+	start := r.StartTime()
+	data := OutputData{Target: s.target, Provider: r.Provider, Instance: r.Instance, LogFile: filepath.Base(r.Source), Date: "undated"}
+	if !start.IsZero() {
+		data.Date = start.UTC().Format("2006.01.02")
+	}
+	var index strings.Builder
+	if err := s.index.Execute(&index, data); err != nil {
+		return nil, fmt.Errorf("opensearch: invalid index template %q: %w", s.config.Index, err)
+	}
+
+	record := NewExportRecord(r)
+	doc := openSearchDocument{
+		ExportRecord: record,
+		Time:         record.Time,
+		Target:       s.target,
+		Fingerprint:  Fingerprint(r.Statement),
+	}
+	if !start.IsZero() {
+		doc.AtTimestamp = start.UTC().Format(time.RFC3339Nano)
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	// インデックス名には大文字を使えない
+	action := map[string]any{"index": map[string]string{"_index": strings.ToLower(index.String()), "_id": EntryID(r)}}
+	if err := enc.Encode(action); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Flush は溜まったドキュメントを送ります
+func (s *OpenSearchSink) Flush(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.err = s.flush(ctx)
+	return s.err
+}
+
+// Close は定期的に送る処理を止めて、残りのドキュメントを送ります
+func (s *OpenSearchSink) Close(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	close(s.stop)
+	<-s.done
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+	s.logger.Info("Indexed entries into OpenSearch", "url", redactURL(s.url), "documents", s.indexed)
+	return nil
+}
+
+// flush は s.mu を持った状態で呼び出します
+func (s *OpenSearchSink) flush(ctx context.Context) error {
+	if len(s.docs) == 0 {
+		return nil
+	}
+
+	if !s.templated && !s.config.SkipTemplate {
+		if err := s.putTemplate(ctx); err != nil {
+			return err
+		}
+	}
+	s.templated = true
+
+	docs := s.docs
+	s.docs, s.size = nil, 0
+	if err := s.send(ctx, docs); err != nil {
+		return fmt.Errorf("opensearch: %w", err)
+	}
+	s.indexed += len(docs)
+	return nil
+}
+
+// putTemplate はインデックスのテンプレートに合うインデックスのマッピングを登録します
+// インデックスの {{...}} は * に置き換え、ドキュメントのインデックスと同じように小文字にしてインデックスパターンにします
+func (s *OpenSearchSink) putTemplate(ctx context.Context) error {
+	pattern := strings.ToLower(templateActionPattern.ReplaceAllString(s.config.Index, "*"))
+	body, err := json.Marshal(map[string]any{
+		"index_patterns": []string{pattern},
+		"template":       map[string]any{"mappings": openSearchMappings},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, "/_index_template/"+s.config.TemplateName, "application/json", body)
+	if err != nil {
+		return fmt.Errorf("opensearch: failed to put index template %s: %w", s.config.TemplateName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("opensearch: failed to put index template %s: unexpected status %s: %s", s.config.TemplateName, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// send はドキュメントを _bulk に送ります。429、5xx、接続のエラーと、429 で拒否されたドキュメントは待ち時間を倍にしながら再送します
+func (s *OpenSearchSink) send(ctx context.Context, docs [][]byte) error {
+	wait := s.backoff
+	var errs []error
+	for attempt := 0; ; attempt++ {
+		retry, err := s.bulk(ctx, docs)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if len(retry.docs) == 0 {
+			return errors.Join(errs...)
+		}
+		if attempt >= s.retries {
+			return errors.Join(append(errs, fmt.Errorf("%d documents were not indexed after %d retries: %w", len(retry.docs), attempt, retry.reason))...)
+		}
+
+		s.logger.Warn("Retrying bulk request", "documents", len(retry.docs), "attempt", attempt+1, "error", retry.reason)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+		docs = retry.docs
+	}
+}
+
+// bulkResponse は _bulk のレスポンスのうち、失敗したドキュメントを見つけるのに使う部分です
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		ID     string `json:"_id"`
+		Status int    `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// bulkRetry は再送するべきドキュメントとその理由です
+type bulkRetry struct {
+	docs   [][]byte
+	reason error
+}
+
+// bulk は1回だけ _bulk にドキュメントを送ります
+// 再送するべきドキュメントと、再送しても成功しないドキュメントのエラーを返します
+func (s *OpenSearchSink) bulk(ctx context.Context, docs [][]byte) (bulkRetry, error) {
+	resp, err := s.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", bytes.Join(docs, nil))
+	if err != nil {
+		if ctx.Err() != nil {
+			return bulkRetry{}, err
+		}
+		return bulkRetry{docs: docs, reason: err}, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return bulkRetry{docs: docs, reason: err}, nil
+		}
+		return bulkRetry{}, err
+	}
+
+	var result bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return bulkRetry{}, fmt.Errorf("failed to parse bulk response: %w", err)
+	}
+	if !result.Errors {
+		return bulkRetry{}, nil
+	}
+	if len(result.Items) != len(docs) {
+		return bulkRetry{}, fmt.Errorf("bulk response has %d items for %d documents", len(result.Items), len(docs))
+	}
+
+	var retry bulkRetry
+	failed := 0
+	var firstErr string
+	for i, item := range result.Items {
+		for _, r := range item {
+			switch {
+			case r.Status >= 200 && r.Status < 300:
+			case r.Status == http.StatusTooManyRequests:
+				retry.docs = append(retry.docs, docs[i])
+				retry.reason = fmt.Errorf("%s: %s", r.Error.Type, r.Error.Reason)
+			default:
+				if failed == 0 {
+					firstErr = fmt.Sprintf("document %s: status %d %s: %s", r.ID, r.Status, r.Error.Type, r.Error.Reason)
+				}
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		err = fmt.Errorf("%d documents were rejected, first: %s", failed, firstErr)
+	}
+	return retry, err
+}
+
+// do は OpenSearch にリクエストを送ります
+func (s *OpenSearchSink) do(ctx context.Context, method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.config.Username != "" {
+		req.SetBasicAuth(os.ExpandEnv(s.config.Username), os.ExpandEnv(s.config.Password))
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	return s.client.Do(req)
+}
@@ -0,0 +1,409 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bulkRequest は OpenSearch のスタンドインが受け取った _bulk の1回分です
+type bulkRequest struct {
+	actions []map[string]map[string]string
+	docs    []map[string]any
+}
+
+// openSearchStub は _index_template と _bulk を受け付ける OpenSearch のスタンドインです
+// respond を設定すると、_bulk の n 回目のリクエストへのレスポンスを差し替えます
+type openSearchStub struct {
+	t         *testing.T
+	mu        sync.Mutex
+	templates map[string]map[string]any
+	requests  []bulkRequest
+	auth      []string
+	respond   func(n int, req bulkRequest, w http.ResponseWriter) bool
+}
+
+func newOpenSearchStub(t *testing.T) (*openSearchStub, *httptest.Server) {
+	stub := &openSearchStub{t: t, templates: map[string]map[string]any{}}
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+	return stub, srv
+}
+
+func (s *openSearchStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth = append(s.auth, r.Header.Get("Authorization"))
+
+	switch {
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/_index_template/"):
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			s.t.Errorf("invalid index template: %v", err)
+		}
+		s.templates[strings.TrimPrefix(r.URL.Path, "/_index_template/")] = body
+		io.WriteString(w, `{"acknowledged": true}`)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/_bulk":
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+			s.t.Errorf("Content-Type = %q, want application/x-ndjson", ct)
+		}
+		req := s.parse(r.Body)
+		n := len(s.requests)
+		s.requests = append(s.requests, req)
+		if s.respond != nil && s.respond(n, req, w) {
+			return
+		}
+		io.WriteString(w, `{"took": 1, "errors": false, "items": []}`)
+
+	default:
+		s.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// parse は _bulk の本文をアクションとドキュメントの組に分けます。本文は改行で終わる必要があります
+func (s *openSearchStub) parse(body io.Reader) bulkRequest {
+	data, _ := io.ReadAll(body)
+	if !strings.HasSuffix(string(data), "\n") {
+		s.t.Errorf("bulk body does not end with a newline: %q", data)
+	}
+
+	var req bulkRequest
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for i := 0; scanner.Scan(); i++ {
+		if i%2 == 0 {
+			var action map[string]map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				s.t.Errorf("invalid bulk action %q: %v", scanner.Text(), err)
+			}
+			req.actions = append(req.actions, action)
+		} else {
+			var doc map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+				s.t.Errorf("invalid bulk document %q: %v", scanner.Text(), err)
+			}
+			req.docs = append(req.docs, doc)
+		}
+	}
+	if len(req.actions) != len(req.docs) {
+		s.t.Errorf("bulk body has %d actions for %d documents", len(req.actions), len(req.docs))
+	}
+	return req
+}
+
+// bulkSizes は _bulk のリクエストごとのドキュメントの数を返します
+func (s *openSearchStub) bulkSizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sizes []int
+	for _, req := range s.requests {
+		sizes = append(sizes, len(req.docs))
+	}
+	return sizes
+}
+
+// newTestOpenSearchSink は再送の待ち時間をなくした OpenSearchSink を生成します
+func newTestOpenSearchSink(t *testing.T, config OpenSearchConfig) *OpenSearchSink {
+	t.Helper()
+	s, err := NewOpenSearchSink(NewLogger("error"), "payments", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.backoff = time.Millisecond
+	return s
+}
+
+func TestOpenSearchSink(t *testing.T) {
+	stub, srv := newOpenSearchStub(t)
+	t.Setenv("TEST_OPENSEARCH_PASSWORD", "secret")
+	s := newTestOpenSearchSink(t, OpenSearchConfig{
+		URL:      srv.URL + "/",
+		Index:    "slowquery-{{.Instance}}-{{.Date}}",
+		Username: "admin",
+		Password: "${TEST_OPENSEARCH_PASSWORD}",
+	})
+
+	r := newTestRecord("DB-1", "SELECT * FROM users WHERE id = 1", 1.5, 1, 100, 1683721815)
+	r.Provider = "aws"
+	if err := s.Add(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// マッピングはドキュメントより先に登録する
+	template, ok := stub.templates["mysql-slowquery"]
+	if !ok {
+		t.Fatalf("index template was not created: %v", stub.templates)
+	}
+	if patterns := fmt.Sprint(template["index_patterns"]); patterns != "[slowquery-*-*]" {
+		t.Errorf("index_patterns = %s, want [slowquery-*-*]", patterns)
+	}
+	mappings := template["template"].(map[string]any)["mappings"].(map[string]any)["properties"].(map[string]any)
+	if typ := mappings["query_time"].(map[string]any)["type"]; typ != "double" {
+		t.Errorf("query_time mapping = %v, want double", typ)
+	}
+
+	if len(stub.requests) != 1 {
+		t.Fatalf("bulk requests = %d, want 1", len(stub.requests))
+	}
+	action := stub.requests[0].actions[0]["index"]
+	if action["_index"] != "slowquery-db-1-2023.05.10" || action["_id"] != EntryID(r) {
+		t.Errorf("action = %v, want index slowquery-db-1-2023.05.10 and id %s", action, EntryID(r))
+	}
+	doc := stub.requests[0].docs[0]
+	for key, want := range map[string]any{
+		"@timestamp":    "2023-05-10T12:30:15Z",
+		"instance":      "DB-1",
+		"target":        "payments",
+		"query_id":      FingerprintID(Fingerprint(r.Statement)),
+		"fingerprint":   "select * from users where id = ?",
+		"query_time":    1.5,
+		"rows_examined": 100.0,
+	} {
+		if doc[key] != want {
+			t.Errorf("document[%q] = %v, want %v", key, doc[key], want)
+		}
+	}
+	if _, ok := doc["time"]; ok {
+		t.Errorf("document has empty time: %v", doc)
+	}
+	if stub.auth[0] == "" {
+		t.Error("request has no basic auth")
+	}
+}
+
+func TestOpenSearchSinkMixedCaseIndex(t *testing.T) {
+	stub, srv := newOpenSearchStub(t)
+	s := newTestOpenSearchSink(t, OpenSearchConfig{URL: srv.URL, Index: "Slow-{{.Instance}}"})
+
+	if err := s.Add(context.Background(), newTestRecord("DB-1", "SELECT 1", 1.5, 1, 100, 1683721815)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// テンプレートのパターンもドキュメントのインデックスと同じように小文字にする
+	if patterns := fmt.Sprint(stub.templates["mysql-slowquery"]["index_patterns"]); patterns != "[slow-*]" {
+		t.Errorf("index_patterns = %s, want [slow-*]", patterns)
+	}
+	if index := stub.requests[0].actions[0]["index"]["_index"]; index != "slow-db-1" {
+		t.Errorf("_index = %s, want slow-db-1", index)
+	}
+}
+
+func TestOpenSearchSinkBatch(t *testing.T) {
+	records := make([]Record, 5)
+	for i := range records {
+		records[i] = newTestRecord("db-1", fmt.Sprintf("SELECT %d", i), 1.0, 1, 1, 1683721815+int64(i))
+	}
+	probe := newTestOpenSearchSink(t, OpenSearchConfig{URL: "http://localhost:9200"})
+	doc, err := probe.document(records[0])
+	probe.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		config OpenSearchConfig
+		want   string
+	}{
+		{name: "ドキュメントの数", config: OpenSearchConfig{BatchSize: 2}, want: "[2 2 1]"},
+		{name: "バイト数", config: OpenSearchConfig{BatchBytes: len(doc) * 3}, want: "[3 2]"},
+		{name: "デフォルト", want: "[5]"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stub, srv := newOpenSearchStub(t)
+			tc.config.URL = srv.URL
+			s := newTestOpenSearchSink(t, tc.config)
+			for _, r := range records {
+				if err := s.Add(context.Background(), r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(stub.bulkSizes()); got != tc.want {
+				t.Errorf("bulk sizes = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOpenSearchSinkFlushInterval(t *testing.T) {
+	stub, srv := newOpenSearchStub(t)
+	s := newTestOpenSearchSink(t, OpenSearchConfig{URL: srv.URL, FlushInterval: 10 * time.Millisecond, SkipTemplate: true})
+	defer s.Close(context.Background())
+
+	if err := s.Add(context.Background(), newTestRecord("db-1", "SELECT 1", 1.0, 1, 1, 1683721815)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close を呼ばなくても FlushInterval が過ぎれば送る
+	deadline := time.Now().Add(5 * time.Second)
+	for len(stub.bulkSizes()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("documents were not flushed after the flush interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(stub.templates) != 0 {
+		t.Errorf("index template was created with skip_template: %v", stub.templates)
+	}
+}
+
+func TestOpenSearchSinkRetry(t *testing.T) {
+	retries := 2
+	testCases := []struct {
+		name    string
+		respond func(n int, req bulkRequest, w http.ResponseWriter) bool
+		want    string
+		wantErr string
+	}{
+		{
+			name: "429 のリクエストを再送",
+			respond: func(n int, req bulkRequest, w http.ResponseWriter) bool {
+				if n == 0 {
+					w.WriteHeader(http.StatusTooManyRequests)
+					return true
+				}
+				return false
+			},
+			want: "[2 2]",
+		},
+		{
+			name: "429 のドキュメントだけを再送",
+			respond: func(n int, req bulkRequest, w http.ResponseWriter) bool {
+				if n == 0 {
+					io.WriteString(w, `{"errors": true, "items": [
+						{"index": {"_id": "a", "status": 201}},
+						{"index": {"_id": "b", "status": 429, "error": {"type": "es_rejected_execution_exception", "reason": "queue is full"}}}
+					]}`)
+					return true
+				}
+				return false
+			},
+			want: "[2 1]",
+		},
+		{
+			name: "再送の上限",
+			respond: func(n int, req bulkRequest, w http.ResponseWriter) bool {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return true
+			},
+			want:    "[2 2 2]",
+			wantErr: "2 documents were not indexed after 2 retries",
+		},
+		{
+			name: "400 のリクエストは再送しない",
+			respond: func(n int, req bulkRequest, w http.ResponseWriter) bool {
+				w.WriteHeader(http.StatusBadRequest)
+				return true
+			},
+			want:    "[2]",
+			wantErr: "400 Bad Request",
+		},
+		{
+			name: "拒否されたドキュメント",
+			respond: func(n int, req bulkRequest, w http.ResponseWriter) bool {
+				io.WriteString(w, `{"errors": true, "items": [
+					{"index": {"_id": "a", "status": 400, "error": {"type": "mapper_parsing_exception", "reason": "failed to parse field [query_time]"}}},
+					{"index": {"_id": "b", "status": 201}}
+				]}`)
+				return true
+			},
+			want:    "[2]",
+			wantErr: "1 documents were rejected, first: document a: status 400 mapper_parsing_exception",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stub, srv := newOpenSearchStub(t)
+			stub.respond = tc.respond
+			s := newTestOpenSearchSink(t, OpenSearchConfig{URL: srv.URL, Retries: &retries})
+			for _, r := range []Record{
+				newTestRecord("db-1", "SELECT 1", 1.0, 1, 1, 1683721815),
+				newTestRecord("db-1", "SELECT 2", 1.0, 1, 1, 1683721816),
+			} {
+				if err := s.Add(context.Background(), r); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := s.Close(context.Background())
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("Close() returned error: %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("Close() error = %v, want %q", err, tc.wantErr)
+			}
+			if got := fmt.Sprint(stub.bulkSizes()); got != tc.want {
+				t.Errorf("bulk sizes = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewOpenSearchSink(t *testing.T) {
+	if s, err := NewOpenSearchSink(NewLogger("error"), "", OpenSearchConfig{}); s != nil || err != nil {
+		t.Errorf("NewOpenSearchSink() = %v, %v, want nil without url", s, err)
+	}
+	if _, err := NewOpenSearchSink(NewLogger("error"), "", OpenSearchConfig{URL: "http://localhost:9200", Index: "{{.Date"}); err == nil {
+		t.Error("NewOpenSearchSink() should return error for an invalid index template")
+	}
+}
+
+func TestDownloadOpenSearch(t *testing.T) {
+	logDir := t.TempDir()
+	if err := GenerateTestLogs(logDir); err != nil {
+		t.Fatal(err)
+	}
+	stub, srv := newOpenSearchStub(t)
+	target := Target{
+		Name:       "local",
+		Provider:   "local",
+		Path:       filepath.Join(logDir, "*"),
+		Output:     filepath.Join(t.TempDir(), "{{.Instance}}.log"),
+		Format:     "slowlog",
+		OpenSearch: OpenSearchConfig{URL: srv.URL},
+	}
+
+	// 同じログを2回送ってもドキュメントの ID は変わらない
+	for i := 0; i < 2; i++ {
+		if err := Download(context.Background(), NewLogger("error"), target, nil); err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+	}
+
+	ids := map[string]int{}
+	for _, req := range stub.requests {
+		for _, action := range req.actions {
+			ids[action["index"]["_id"]]++
+		}
+	}
+	if len(ids) != 24 {
+		t.Errorf("documents = %d, want 24", len(ids))
+	}
+	for id, n := range ids {
+		if n != 2 {
+			t.Errorf("document %s was sent %d times, want 2", id, n)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// OTLP で送る設定のデフォルト値です
+const (
+	defaultOTLPBatchSize = 512
+	defaultOTLPRetries   = 3
+	defaultOTLPTimeout   = 10 * time.Second
+	defaultOTLPBackoff   = time.Second
+)
+
+// otlpProtocols は OTLP の送信方法です
+var otlpProtocols = []string{"http/protobuf", "grpc"}
+
+// otlpScopeName は LogRecord の計装スコープの名前です
+const otlpScopeName = "github.com/ryuichi1208/rds-slowquery-downloder"
+
+// OTLPConfig はダウンロードしたエントリを OpenTelemetry の LogRecord として OTLP で送る設定です
+// Endpoint とヘッダーの値の ${VAR} は環境変数の値に置き換えます
+type OTLPConfig struct {
+	// Endpoint は http/protobuf では http://collector:4318 のような URL で、パスがなければ /v1/logs に送ります
+	// grpc では collector:4317 のようなアドレスで、http:// を付けると TLS を使わずに接続します
+	Endpoint string            `yaml:"endpoint"`
+	Protocol string            `yaml:"protocol"`
+	Headers  map[string]string `yaml:"headers"`
+	// RedactStatement は db.statement と本文のリテラルを ? に置き換えるかどうかです
+	RedactStatement bool `yaml:"redact_statement"`
+	BatchSize       int  `yaml:"batch_size"`
+	Retries         *int `yaml:"retries"`
+}
+
+// otlpClient は LogRecord を OTLP の受信側に送ります
+type otlpClient interface {
+	// export は1回だけ送り、エラーの場合は再送するべきかどうかを返します
+	export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (bool, error)
+	close() error
+}
+
+// OTLPExporter はエントリをまとめて OTLP で送ります
+type OTLPExporter struct {
+	logger  *slog.Logger
+	client  otlpClient
+	target  string
+	config  OTLPConfig
+	retries int
+	backoff time.Duration
+
+	batch    []Record
+	exported int
+}
+
+// NewOTLPExporter は設定から OTLPExporter を生成します。Endpoint がない場合はnilを返します
+// 使い終わったら Close を呼び出します
+func NewOTLPExporter(logger *slog.Logger, target string, config OTLPConfig) (*OTLPExporter, error) {
+	endpoint := os.ExpandEnv(config.Endpoint)
+	if endpoint == "" {
+		return nil, nil
+	}
+	if config.Protocol == "" {
+		config.Protocol = "http/protobuf"
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultOTLPBatchSize
+	}
+	headers := map[string]string{}
+	for k, v := range config.Headers {
+		headers[k] = os.ExpandEnv(v)
+	}
+
+	var client otlpClient
+	var err error
+	switch config.Protocol {
+	case "http/protobuf":
+		client, err = newOTLPHTTPClient(endpoint, headers)
+	case "grpc":
+		client, err = newOTLPGRPCClient(endpoint, headers)
+	default:
+		err = fmt.Errorf("unsupported protocol %q. Use %s", config.Protocol, strings.Join(otlpProtocols, " or "))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("otlp: %w", err)
+	}
+
+	e := &OTLPExporter{
+		logger:  logger,
+		client:  client,
+		target:  target,
+		config:  config,
+		retries: defaultOTLPRetries,
+		backoff: defaultOTLPBackoff,
+	}
+	if config.Retries != nil {
+		e.retries = max(*config.Retries, 0)
+	}
+	return e, nil
+}
+
+// Add はエントリをバッチに加え、BatchSize に達した場合は送ります
+func (e *OTLPExporter) Add(ctx context.Context, r Record) error {
+	if e == nil {
+		return nil
+	}
+	e.batch = append(e.batch, r)
+	if len(e.batch) >= e.config.BatchSize {
+		return e.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush は溜まったエントリを送ります
+func (e *OTLPExporter) Flush(ctx context.Context) error {
+	if e == nil || len(e.batch) == 0 {
+		return nil
+	}
+
+	req := e.request(e.batch, time.Now())
+	n := len(e.batch)
+	e.batch = nil
+	if err := e.send(ctx, req); err != nil {
+		return fmt.Errorf("otlp: %w", err)
+	}
+	e.exported += n
+	return nil
+}
+
+// Close は残りのエントリを送って接続を閉じます
+func (e *OTLPExporter) Close(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+	err := e.Flush(ctx)
+	if cerr := e.client.close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err == nil {
+		e.logger.Info("Exported entries with OTLP", "protocol", e.config.Protocol, "records", e.exported)
+	}
+	return err
+}
+
+// send は待ち時間を倍にしながら再送します
+func (e *OTLPExporter) send(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	wait := e.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := e.client.export(ctx, req)
+		if err == nil || !retry || attempt >= e.retries {
+			return err
+		}
+
+		e.logger.Warn("Retrying OTLP export", "attempt", attempt+1, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// request はエントリをインスタンスごとの ResourceLogs にまとめます
+func (e *OTLPExporter) request(records []Record, observed time.Time) *collogspb.ExportLogsServiceRequest {
+	req := &collogspb.ExportLogsServiceRequest{}
+	resources := map[string]*logspb.ScopeLogs{}
+	for _, r := range records {
+		key := r.Provider + "\x00" + r.Instance
+		scope, ok := resources[key]
+		if !ok {
+			scope = &logspb.ScopeLogs{Scope: &commonpb.InstrumentationScope{Name: otlpScopeName}}
+			resources[key] = scope
+			req.ResourceLogs = append(req.ResourceLogs, &logspb.ResourceLogs{
+				Resource:  &resourcepb.Resource{Attributes: e.resourceAttributes(r)},
+				ScopeLogs: []*logspb.ScopeLogs{scope},
+			})
+		}
+		scope.LogRecords = append(scope.LogRecords, e.logRecord(r, observed))
+	}
+	return req
+}
+
+// resourceAttributes はインスタンスを表すリソースの属性です
+func (e *OTLPExporter) resourceAttributes(r Record) []*commonpb.KeyValue {
+	attrs := []*commonpb.KeyValue{
+		otlpString("service.name", "mysql"),
+		otlpString("db.system", "mysql"),
+		otlpString("db.instance.id", r.Instance),
+	}
+	if contains([]string{"aws", "gcp", "azure"}, r.Provider) {
+		attrs = append(attrs, otlpString("cloud.provider", r.Provider))
+	}
+	if e.target != "" {
+		attrs = append(attrs, otlpString("mysql_slowquery.target", e.target))
+	}
+	return attrs
+}
+
+// logRecord はエントリを LogRecord に変換します。時刻はログの # Time: の値を使います
+func (e *OTLPExporter) logRecord(r Record, observed time.Time) *logspb.LogRecord {
+	statement := r.Statement
+	if e.config.RedactStatement {
+		statement = RedactLiterals(statement)
+	}
+
+	attrs := []*commonpb.KeyValue{
+		otlpString("db.system", "mysql"),
+		otlpString("db.statement", statement),
+		otlpString("db.operation", strings.ToUpper(StatementType(r.Statement))),
+		otlpDouble("mysql.query_time", r.QueryTime),
+		otlpDouble("mysql.lock_time", r.LockTime),
+		otlpInt("mysql.rows_sent", r.RowsSent),
+		otlpInt("mysql.rows_examined", r.RowsExamined),
+		otlpString("mysql.query_id", FingerprintID(Fingerprint(r.Statement))),
+	}
+	if r.DB != "" {
+		attrs = append(attrs, otlpString("db.name", r.DB))
+	}
+	if r.User != "" {
+		attrs = append(attrs, otlpString("db.user", r.User))
+	}
+	if client := firstNonEmpty(r.IP, r.Host); client != "" {
+		attrs = append(attrs, otlpString("client.address", client))
+	}
+	if r.ThreadID != 0 {
+		attrs = append(attrs, otlpInt("thread.id", r.ThreadID))
+	}
+	if r.Source != "" {
+		attrs = append(attrs, otlpString("log.file.name", r.Source))
+	}
+
+	record := &logspb.LogRecord{
+		ObservedTimeUnixNano: uint64(observed.UnixNano()),
+		SeverityNumber:       logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+		SeverityText:         "INFO",
+		Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: statement}},
+		Attributes:           attrs,
+	}
+	// # Time: がない場合は SET timestamp の値を使う
+	t := r.Time
+	if t.IsZero() {
+		t = r.StartTime()
+	}
+	if !t.IsZero() {
+		record.TimeUnixNano = uint64(t.UnixNano())
+	}
+	return record
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func otlpString(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func otlpInt(key string, value int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}}}
+}
+
+func otlpDouble(key string, value float64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: value}}}
+}
+
+// otlpHTTPClient は OTLP/HTTP の protobuf で送ります
+type otlpHTTPClient struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+}
+
+func newOTLPHTTPClient(endpoint string, headers map[string]string) (*otlpHTTPClient, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid endpoint %q. Use a URL such as http://localhost:4318", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/logs"
+	}
+	return &otlpHTTPClient{client: &http.Client{Timeout: defaultOTLPTimeout}, url: u.String(), headers: headers}, nil
+}
+
+func (c *otlpHTTPClient) export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (bool, error) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range c.headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := fmt.Errorf("unexpected status %s", resp.Status)
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true, err
+		}
+		return false, err
+	}
+
+	var result collogspb.ExportLogsServiceResponse
+	if err := proto.Unmarshal(data, &result); err != nil {
+		return false, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return false, partialSuccessError(&result)
+}
+
+func (c *otlpHTTPClient) close() error {
+	return nil
+}
+
+// otlpGRPCClient は OTLP/gRPC で送ります
+type otlpGRPCClient struct {
+	conn    *grpc.ClientConn
+	client  collogspb.LogsServiceClient
+	headers metadata.MD
+}
+
+func newOTLPGRPCClient(endpoint string, headers map[string]string) (*otlpGRPCClient, error) {
+	creds := credentials.NewTLS(&tls.Config{})
+	switch {
+	case strings.HasPrefix(endpoint, "http://"):
+		endpoint = strings.TrimPrefix(endpoint, "http://")
+		creds = insecure.NewCredentials()
+	case strings.HasPrefix(endpoint, "https://"):
+		endpoint = strings.TrimPrefix(endpoint, "https://")
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	conn, err := grpc.NewClient(endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return &otlpGRPCClient{conn: conn, client: collogspb.NewLogsServiceClient(conn), headers: metadata.New(headers)}, nil
+}
+
+func (c *otlpGRPCClient) export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (bool, error) {
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(ctx, c.headers), defaultOTLPTimeout)
+	defer cancel()
+
+	resp, err := c.client.Export(ctx, req)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded:
+			return true, err
+		}
+		return false, err
+	}
+	return false, partialSuccessError(resp)
+}
+
+func (c *otlpGRPCClient) close() error {
+	return c.conn.Close()
+}
+
+// partialSuccessError は受信側が一部の LogRecord を拒否した場合にエラーを返します
+func partialSuccessError(resp *collogspb.ExportLogsServiceResponse) error {
+	if p := resp.GetPartialSuccess(); p != nil && p.GetRejectedLogRecords() > 0 {
+		return fmt.Errorf("%d log records were rejected: %s", p.GetRejectedLogRecords(), p.GetErrorMessage())
+	}
+	return nil
+}
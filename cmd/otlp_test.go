@@ -0,0 +1,382 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpReceiver は OTLP/HTTP と OTLP/gRPC の LogRecord を受け付けるプロセス内の受信側です
+// fail を設定すると、n 回目のリクエストを HTTP のステータスコードで失敗させます
+type otlpReceiver struct {
+	collogspb.UnimplementedLogsServiceServer
+
+	mu       sync.Mutex
+	requests []*collogspb.ExportLogsServiceRequest
+	headers  []string
+	fail     func(n int) int
+}
+
+// receive はリクエストを記録し、失敗させる場合はステータスコードを返します
+func (s *otlpReceiver) receive(req *collogspb.ExportLogsServiceRequest, header string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.requests)
+	s.requests = append(s.requests, req)
+	s.headers = append(s.headers, header)
+	if s.fail != nil {
+		return s.fail(n)
+	}
+	return 0
+}
+
+func (s *otlpReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unexpected request", http.StatusNotFound)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var req collogspb.ExportLogsServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if code := s.receive(&req, r.Header.Get("Authorization")); code != 0 {
+		w.WriteHeader(code)
+		return
+	}
+	data, _ := proto.Marshal(&collogspb.ExportLogsServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(data)
+}
+
+func (s *otlpReceiver) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if code := s.receive(req, strings.Join(md.Get("authorization"), "")); code != 0 {
+		if code == http.StatusServiceUnavailable {
+			return nil, status.Error(codes.Unavailable, "unavailable")
+		}
+		return nil, status.Error(codes.InvalidArgument, "invalid")
+	}
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+// records は受け取った LogRecord をインスタンスごとに返します
+func (s *otlpReceiver) records() map[string][]*logspb.LogRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := map[string][]*logspb.LogRecord{}
+	for _, req := range s.requests {
+		for _, rl := range req.ResourceLogs {
+			instance := otlpAttributes(rl.Resource.Attributes)["db.instance.id"]
+			for _, sl := range rl.ScopeLogs {
+				records[instance] = append(records[instance], sl.LogRecords...)
+			}
+		}
+	}
+	return records
+}
+
+// otlpAttributes は属性を文字列にして返します
+func otlpAttributes(attrs []*commonpb.KeyValue) map[string]string {
+	m := map[string]string{}
+	for _, kv := range attrs {
+		switch v := kv.Value.Value.(type) {
+		case *commonpb.AnyValue_StringValue:
+			m[kv.Key] = v.StringValue
+		case *commonpb.AnyValue_IntValue:
+			m[kv.Key] = fmt.Sprint(v.IntValue)
+		case *commonpb.AnyValue_DoubleValue:
+			m[kv.Key] = fmt.Sprint(v.DoubleValue)
+		}
+	}
+	return m
+}
+
+// startOTLPReceiver は指定したプロトコルの受信側を起動し、エンドポイントを返します
+func startOTLPReceiver(t *testing.T, protocol string) (*otlpReceiver, string) {
+	t.Helper()
+	receiver := &otlpReceiver{}
+	if protocol == "grpc" {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := grpc.NewServer()
+		collogspb.RegisterLogsServiceServer(srv, receiver)
+		go srv.Serve(lis)
+		t.Cleanup(srv.Stop)
+		return receiver, "http://" + lis.Addr().String()
+	}
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+	return receiver, srv.URL
+}
+
+func newTestOTLPExporter(t *testing.T, config OTLPConfig) *OTLPExporter {
+	t.Helper()
+	e, err := NewOTLPExporter(NewLogger("error"), "payments", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.backoff = time.Millisecond
+	return e
+}
+
+func TestOTLPExporter(t *testing.T) {
+	testCases := []struct {
+		name     string
+		protocol string
+		redact   bool
+		want     string
+	}{
+		{
+			name:     "http/protobuf",
+			protocol: "http/protobuf",
+			want:     "SELECT * FROM users WHERE email = 'alice@example.com'",
+		},
+		{
+			name:     "grpc",
+			protocol: "grpc",
+			want:     "SELECT * FROM users WHERE email = 'alice@example.com'",
+		},
+		{
+			name:     "リテラルを伏せる",
+			protocol: "http/protobuf",
+			redact:   true,
+			want:     "SELECT * FROM users WHERE email = ?",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			receiver, endpoint := startOTLPReceiver(t, tc.protocol)
+			t.Setenv("TEST_OTLP_TOKEN", "secret")
+			e := newTestOTLPExporter(t, OTLPConfig{
+				Endpoint:        endpoint,
+				Protocol:        tc.protocol,
+				Headers:         map[string]string{"Authorization": "Bearer ${TEST_OTLP_TOKEN}"},
+				RedactStatement: tc.redact,
+			})
+
+			r := newTestRecord("db-1", "SELECT * FROM users WHERE email = 'alice@example.com'", 1.5, 1, 100, 1683721815)
+			r.Provider = "aws"
+			r.Time = time.Date(2023, 5, 10, 12, 30, 17, 0, time.UTC)
+			other := newTestRecord("db-2", "SELECT 1", 0.5, 1, 1, 1683721816)
+			for _, r := range []Record{r, other} {
+				if err := e.Add(context.Background(), r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := e.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(receiver.requests) != 1 || receiver.headers[0] != "Bearer secret" {
+				t.Fatalf("requests = %d, headers = %v, want 1 request with the authorization header", len(receiver.requests), receiver.headers)
+			}
+			resources := receiver.requests[0].ResourceLogs
+			if len(resources) != 2 {
+				t.Fatalf("resource logs = %d, want 2", len(resources))
+			}
+			resource := otlpAttributes(resources[0].Resource.Attributes)
+			for key, want := range map[string]string{
+				"service.name":   "mysql",
+				"db.system":      "mysql",
+				"db.instance.id": "db-1",
+				"cloud.provider": "aws",
+			} {
+				if resource[key] != want {
+					t.Errorf("resource[%q] = %q, want %q", key, resource[key], want)
+				}
+			}
+
+			record := resources[0].ScopeLogs[0].LogRecords[0]
+			if got := time.Unix(0, int64(record.TimeUnixNano)).UTC(); !got.Equal(r.Time) {
+				t.Errorf("time = %v, want # Time: %v", got, r.Time)
+			}
+			if record.Body.GetStringValue() != tc.want {
+				t.Errorf("body = %q, want %q", record.Body.GetStringValue(), tc.want)
+			}
+			attrs := otlpAttributes(record.Attributes)
+			for key, want := range map[string]string{
+				"db.system":           "mysql",
+				"db.statement":        tc.want,
+				"db.name":             "production",
+				"db.user":             "app",
+				"db.operation":        "SELECT",
+				"mysql.query_time":    "1.5",
+				"mysql.rows_examined": "100",
+				"mysql.query_id":      FingerprintID(Fingerprint(r.Statement)),
+			} {
+				if attrs[key] != want {
+					t.Errorf("attributes[%q] = %q, want %q", key, attrs[key], want)
+				}
+			}
+
+			// # Time: がないエントリは SET timestamp の時刻を使う
+			record = resources[1].ScopeLogs[0].LogRecords[0]
+			if got := time.Unix(0, int64(record.TimeUnixNano)).Unix(); got != 1683721816 {
+				t.Errorf("time = %d, want SET timestamp 1683721816", got)
+			}
+		})
+	}
+}
+
+func TestOTLPExporterBatch(t *testing.T) {
+	receiver, endpoint := startOTLPReceiver(t, "http/protobuf")
+	e := newTestOTLPExporter(t, OTLPConfig{Endpoint: endpoint, BatchSize: 2})
+	for i := 0; i < 5; i++ {
+		if err := e.Add(context.Background(), newTestRecord("db-1", fmt.Sprintf("SELECT %d", i), 1.0, 1, 1, 1683721815)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []int
+	for _, req := range receiver.requests {
+		sizes = append(sizes, len(req.ResourceLogs[0].ScopeLogs[0].LogRecords))
+	}
+	if got := fmt.Sprint(sizes); got != "[2 2 1]" {
+		t.Errorf("batch sizes = %s, want [2 2 1]", got)
+	}
+}
+
+func TestOTLPExporterRetry(t *testing.T) {
+	retries := 2
+	testCases := []struct {
+		name     string
+		protocol string
+		fail     func(n int) int
+		want     int
+		wantErr  bool
+	}{
+		{
+			name:     "503 のリクエストを再送",
+			protocol: "http/protobuf",
+			fail: func(n int) int {
+				if n == 0 {
+					return http.StatusServiceUnavailable
+				}
+				return 0
+			},
+			want: 2,
+		},
+		{
+			name:     "Unavailable のリクエストを再送",
+			protocol: "grpc",
+			fail: func(n int) int {
+				if n == 0 {
+					return http.StatusServiceUnavailable
+				}
+				return 0
+			},
+			want: 2,
+		},
+		{
+			name:     "再送の上限",
+			protocol: "http/protobuf",
+			fail:     func(n int) int { return http.StatusTooManyRequests },
+			want:     3,
+			wantErr:  true,
+		},
+		{
+			name:     "400 のリクエストは再送しない",
+			protocol: "http/protobuf",
+			fail:     func(n int) int { return http.StatusBadRequest },
+			want:     1,
+			wantErr:  true,
+		},
+		{
+			name:     "InvalidArgument のリクエストは再送しない",
+			protocol: "grpc",
+			fail:     func(n int) int { return http.StatusBadRequest },
+			want:     1,
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			receiver, endpoint := startOTLPReceiver(t, tc.protocol)
+			receiver.fail = tc.fail
+			e := newTestOTLPExporter(t, OTLPConfig{Endpoint: endpoint, Protocol: tc.protocol, Retries: &retries})
+			if err := e.Add(context.Background(), newTestRecord("db-1", "SELECT 1", 1.0, 1, 1, 1683721815)); err != nil {
+				t.Fatal(err)
+			}
+
+			err := e.Close(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Close() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if len(receiver.requests) != tc.want {
+				t.Errorf("requests = %d, want %d", len(receiver.requests), tc.want)
+			}
+		})
+	}
+}
+
+func TestNewOTLPExporter(t *testing.T) {
+	if e, err := NewOTLPExporter(NewLogger("error"), "", OTLPConfig{}); e != nil || err != nil {
+		t.Errorf("NewOTLPExporter() = %v, %v, want nil without endpoint", e, err)
+	}
+	for _, config := range []OTLPConfig{
+		{Endpoint: "localhost:4318"},
+		{Endpoint: "http://localhost:4318", Protocol: "http/json"},
+	} {
+		if _, err := NewOTLPExporter(NewLogger("error"), "", config); err == nil {
+			t.Errorf("NewOTLPExporter(%+v) should return error", config)
+		}
+	}
+}
+
+func TestDownloadOTLP(t *testing.T) {
+	logDir := t.TempDir()
+	if err := GenerateTestLogs(logDir); err != nil {
+		t.Fatal(err)
+	}
+	receiver, endpoint := startOTLPReceiver(t, "grpc")
+	target := Target{
+		Name:     "local",
+		Provider: "local",
+		Path:     filepath.Join(logDir, "*"),
+		Output:   filepath.Join(t.TempDir(), "{{.Instance}}.log"),
+		Format:   "slowlog",
+		OTLP:     OTLPConfig{Endpoint: endpoint, Protocol: "grpc"},
+	}
+	if err := Download(context.Background(), NewLogger("error"), target, nil); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	n := 0
+	for instance, records := range receiver.records() {
+		for _, record := range records {
+			n++
+			if record.TimeUnixNano == 0 {
+				t.Errorf("%s: record has no time: %v", instance, record)
+			}
+		}
+	}
+	if n != 24 {
+		t.Errorf("log records = %d, want 24", n)
+	}
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// OutputData は出力先テンプレートに渡す値です
+type OutputData struct {
+	Target   string
+	Provider string
+	Instance string
+	LogFile  string
+	Date     string
+}
+
+// isStdout は出力先が標準出力かどうかを返します
+func isStdout(path string) bool {
+	return path == "" || path == "stdout" || path == "-"
+}
+
+// OutputPath は出力先のテンプレートを展開してファイルパスを返します
+func OutputPath(output string, data OutputData) (string, error) {
+	if isStdout(output) || !strings.Contains(output, "{{") {
+		return output, nil
+	}
+
+	tmpl, err := template.New("output").Option("missingkey=error").Parse(output)
+	if err != nil {
+		return "", fmt.Errorf("invalid output template %q: %w", output, err)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("invalid output template %q: %w", output, err)
+	}
+
+	return b.String(), nil
+}
+
+func WriteLogData(path string, logData *string) error {
+	if logData == nil {
+		return nil
+	}
+
+	w, err := openOutput(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, *logData); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// openOutput は出力先を追記モードで開きます
+// 出力先が標準出力の場合、返した io.WriteCloser を閉じても標準出力は閉じません
+func openOutput(path string) (io.WriteCloser, error) {
+	if isStdout(path) {
+		return stdoutWriter{}, nil
+	}
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	// 追記モードでファイルを開く
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// stdoutWriter は閉じても何もしない標準出力です
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdoutWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputPath(t *testing.T) {
+	data := OutputData{
+		Target:   "payments-prod",
+		Provider: "aws",
+		Instance: "payments-db-1",
+		LogFile:  "mysql-slowquery.log",
+		Date:     "2024-05-06",
+	}
+
+	testCases := []struct {
+		name     string
+		output   string
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "標準出力",
+			output:   "stdout",
+			expected: "stdout",
+		},
+		{
+			name:     "固定のパス",
+			output:   "slow.log",
+			expected: "slow.log",
+		},
+		{
+			name:     "テンプレート",
+			output:   "{{.Target}}/{{.Date}}/{{.Instance}}-{{.LogFile}}",
+			expected: "payments-prod/2024-05-06/payments-db-1-mysql-slowquery.log",
+		},
+		{
+			name:    "存在しないフィールド",
+			output:  "{{.Unknown}}.log",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path, err := OutputPath(tc.output, data)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("OutputPath() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if path != tc.expected {
+				t.Errorf("OutputPath() = %v, want %v", path, tc.expected)
+			}
+		})
+	}
+}
+
+func TestWriteLogData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "slow.log")
+	data := "SELECT 1;\n"
+
+	for i := 0; i < 2; i++ {
+		if err := WriteLogData(path, &data); err != nil {
+			t.Fatalf("WriteLogData() returned error: %v", err)
+		}
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != data+data {
+		t.Errorf("WriteLogData() wrote %q, want %q", got, data+data)
+	}
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// DefaultRowGroupSize はparquetの行グループあたりの行数のデフォルト値です
+const DefaultRowGroupSize = 100000
+
+// hiveDefaultPartition は日付がわからないエントリのパーティション名です。Sparkと同じ値を使います
+const hiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// ParquetRecord はparquetで出力するエントリのスキーマです
+// jsonlとcsvと同じ列を持ちますが、instance はパーティションのディレクトリ名に含まれるため列には含めません
+type ParquetRecord struct {
+	Provider      string            `parquet:"provider,dict"`
+	Source        string            `parquet:"source,dict"`
+	Time          time.Time         `parquet:"time,timestamp(microsecond),optional"`
+	Timestamp     time.Time         `parquet:"timestamp,timestamp(millisecond),optional"`
+	User          string            `parquet:"user,dict"`
+	Host          string            `parquet:"host,dict"`
+	IP            string            `parquet:"ip,dict"`
+	ThreadID      int64             `parquet:"thread_id"`
+	DB            string            `parquet:"db,dict"`
+	QueryTime     float64           `parquet:"query_time"`
+	LockTime      float64           `parquet:"lock_time"`
+	RowsSent      int64             `parquet:"rows_sent"`
+	RowsExamined  int64             `parquet:"rows_examined"`
+	StatementType string            `parquet:"statement_type,dict"`
+	QueryID       string            `parquet:"query_id,dict"`
+	SQL           string            `parquet:"sql"`
+	Extra         map[string]string `parquet:"extra"`
+}
+
+// NewParquetRecord はRecordをparquetのスキーマに変換します
+func NewParquetRecord(r Record) ParquetRecord {
+	pr := ParquetRecord{
+		Provider:      r.Provider,
+		Source:        r.Source,
+		Time:          r.Time.UTC(),
+		User:          r.User,
+		Host:          r.Host,
+		IP:            r.IP,
+		ThreadID:      r.ThreadID,
+		DB:            r.DB,
+		QueryTime:     r.QueryTime,
+		LockTime:      r.LockTime,
+		RowsSent:      r.RowsSent,
+		RowsExamined:  r.RowsExamined,
+		StatementType: StatementType(r.Statement),
+		QueryID:       FingerprintID(Fingerprint(r.Statement)),
+		SQL:           r.Statement,
+		Extra:         r.Extra,
+	}
+	if r.Timestamp != 0 {
+		pr.Timestamp = time.Unix(r.Timestamp, 0).UTC()
+	}
+	return pr
+}
+
+// ParquetWriter はエントリを instance=<instance>/date=<YYYY-MM-DD>/part-<source>.parquet に書き出します
+// 開いているファイルは1つのログファイル分だけで、各ファイルは行グループ1つ分の行だけをメモリに保持します
+type ParquetWriter struct {
+	dir          string
+	rowGroupSize int64
+	source       string
+	files        map[string]*parquetFile
+}
+
+type parquetFile struct {
+	path   string
+	file   *os.File
+	writer *parquet.GenericWriter[ParquetRecord]
+}
+
+// NewParquetWriter はdirの下にパーティションを作って書き出すParquetWriterを生成します
+func NewParquetWriter(dir string, rowGroupSize int64) (*ParquetWriter, error) {
+	if isStdout(dir) {
+		return nil, fmt.Errorf("parquet format requires --output to be a directory")
+	}
+	if rowGroupSize <= 0 {
+		rowGroupSize = DefaultRowGroupSize
+	}
+	return &ParquetWriter{dir: dir, rowGroupSize: rowGroupSize, files: map[string]*parquetFile{}}, nil
+}
+
+// Write はエントリをパーティションのファイルに書き出します
+// 取得元のログファイルが変わると、それまでのファイルを閉じます
+func (w *ParquetWriter) Write(r Record) error {
+	if r.Source != w.source {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		w.source = r.Source
+	}
+
+	path := w.partitionPath(r)
+	f, ok := w.files[path]
+	if !ok {
+		var err error
+		f, err = w.create(path)
+		if err != nil {
+			return err
+		}
+		w.files[path] = f
+	}
+
+	_, err := f.writer.Write([]ParquetRecord{NewParquetRecord(r)})
+	return err
+}
+
+// Flush は開いている全てのファイルを閉じます
+func (w *ParquetWriter) Flush() error {
+	var errs []error
+	for path, f := range w.files {
+		if err := f.close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(w.files, path)
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// partitionPath はエントリを書き出すファイルのパスを返します
+func (w *ParquetWriter) partitionPath(r Record) string {
+	date := hiveDefaultPartition
+	if t := r.StartTime(); !t.IsZero() {
+		date = t.UTC().Format("2006-01-02")
+	}
+
+	return filepath.Join(w.dir,
+		"instance="+partitionValue(r.Instance),
+		"date="+date,
+		"part-"+partitionValue(filepath.Base(r.Source))+".parquet")
+}
+
+// create は一時ファイルにparquetの書き出しを開始します。Closeするまで本来のパスには現れません
+func (w *ParquetWriter) create(path string) (*parquetFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	writer := parquet.NewGenericWriter[ParquetRecord](file,
+		parquet.MaxRowsPerRowGroup(w.rowGroupSize),
+		parquet.Compression(&parquet.Snappy),
+		parquet.CreatedBy("mysql-slowquery-downloder", "", ""),
+	)
+	return &parquetFile{path: path, file: file, writer: writer}, nil
+}
+
+func (f *parquetFile) close() error {
+	if err := f.writer.Close(); err != nil {
+		f.file.Close()
+		os.Remove(f.file.Name())
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		os.Remove(f.file.Name())
+		return err
+	}
+	return os.Rename(f.file.Name(), f.path)
+}
+
+// partitionValue はHiveと同じ規則でパーティションの値をエスケープします
+func partitionValue(s string) string {
+	if s == "" {
+		return hiveDefaultPartition
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (isIdentChar(c) && c < 0x80) || c == '-' || c == '.' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// WriteParquetData はスロークエリログを解析し、条件に合うエントリをparquetで書き出します
+func WriteParquetData(r io.Reader, base Record, dir string, opts ConvertOptions) error {
+	w, err := NewParquetWriter(dir, opts.RowGroupSize)
+	if err != nil {
+		return err
+	}
+	return writeLogData(w, r, base, opts)
+}
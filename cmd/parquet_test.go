@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestPartitionValue(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{value: "payments-db-1", expected: "payments-db-1"},
+		{value: "db1.example.com", expected: "db1.example.com"},
+		{value: "db2.example.com:2222", expected: "db2.example.com%3A2222"},
+		{value: "a/b=c", expected: "a%2Fb%3Dc"},
+		{value: "", expected: "__HIVE_DEFAULT_PARTITION__"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			if got := partitionValue(tc.value); got != tc.expected {
+				t.Errorf("partitionValue() = %v, want %v", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestParquetWriter(t *testing.T) {
+	records := exportTestRecords(t)
+	dir := t.TempDir()
+
+	w, err := NewParquetWriter(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]ParquetRecord{}
+	for _, r := range records {
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+		path := w.partitionPath(r)
+		expected[path] = append(expected[path], NewParquetRecord(r))
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("ParquetWriter wrote %d files, want %d: %v", len(files), len(expected), files)
+	}
+
+	for _, path := range files {
+		rows, err := parquet.ReadFile[ParquetRecord](path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		if !reflect.DeepEqual(normalizeParquetRecords(rows), normalizeParquetRecords(expected[path])) {
+			t.Errorf("%s = %+v, want %+v", path, rows, expected[path])
+		}
+
+		// 行グループは2行ずつに分かれる
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := file.Stat()
+		pf, err := parquet.OpenFile(file, info.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(pf.RowGroups()), (len(rows)+1)/2; got != want {
+			t.Errorf("%s has %d row groups, want %d", path, got, want)
+		}
+		file.Close()
+	}
+
+	// 複数行のSQLを含むログは日付とインスタンスでパーティションが決まる
+	path := filepath.Join(dir, "instance=multiline", "date=2023-05-10", "part-multiline.log.parquet")
+	if _, ok := expected[path]; !ok {
+		t.Errorf("partition %s was not written", path)
+	}
+}
+
+func TestParquetSchema(t *testing.T) {
+	dir := t.TempDir()
+	if err := WriteParquetData(strings.NewReader(multiLineLog), Record{Instance: "db-1", Provider: "aws", Source: "slowquery/mysql-slowquery.log.3"}, dir, ConvertOptions{}); err != nil {
+		t.Fatalf("WriteParquetData() returned error: %v", err)
+	}
+
+	path := filepath.Join(dir, "instance=db-1", "date=2023-05-10", "part-mysql-slowquery.log.3.parquet")
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pf, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		column   string
+		expected string
+	}{
+		{column: "time", expected: "TIMESTAMP(isAdjustedToUTC=true,unit=MICROS)"},
+		{column: "timestamp", expected: "TIMESTAMP(isAdjustedToUTC=true,unit=MILLIS)"},
+		{column: "query_time", expected: "DOUBLE"},
+		{column: "rows_examined", expected: "INT(64,true)"},
+		{column: "sql", expected: "STRING"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.column, func(t *testing.T) {
+			field, ok := pf.Schema().Lookup(tc.column)
+			if !ok {
+				t.Fatalf("column %s not found", tc.column)
+			}
+			if got := field.Node.Type().String(); got != tc.expected {
+				t.Errorf("type of %s = %v, want %v", tc.column, got, tc.expected)
+			}
+		})
+	}
+
+	if _, ok := pf.Schema().Lookup("instance"); ok {
+		t.Error("instance should not be a column because it is a partition")
+	}
+}
+
+func TestNewParquetWriterRequiresDirectory(t *testing.T) {
+	for _, output := range []string{"", "stdout", "-"} {
+		if _, err := NewParquetWriter(output, 0); err == nil {
+			t.Errorf("NewParquetWriter(%q) should return error", output)
+		}
+	}
+}
+
+// normalizeParquetRecords は比較のためにparquetの読み込みで変わる値を揃えます
+func normalizeParquetRecords(rows []ParquetRecord) []ParquetRecord {
+	normalized := make([]ParquetRecord, len(rows))
+	for i, r := range rows {
+		if len(r.Extra) == 0 {
+			r.Extra = nil
+		}
+		r.Time = r.Time.UTC()
+		r.Timestamp = r.Timestamp.UTC()
+		normalized[i] = r
+	}
+	return normalized
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// queryCmd はウェアハウスに任意の SQL を実行するコマンドです
+var queryCmd = &cobra.Command{
+	Use:   "query [flags] <sql>",
+	Short: "Run SQL against the warehouse of downloaded entries",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, _ := cmd.Flags().GetString("warehouse")
+		if path == "" {
+			path = DefaultWarehousePath()
+		}
+		format, _ := cmd.Flags().GetString("format")
+
+		warehouse, err := OpenWarehouseReadOnly(path)
+		if err != nil {
+			return err
+		}
+		defer warehouse.Close()
+
+		return warehouse.Query(cmd.Context(), cmd.OutOrStdout(), strings.Join(args, " "), format)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(queryCmd)
+	queryCmd.Flags().String("warehouse", "", "SQLite database of the downloaded entries (default ~/.local/share/mysql-slowquery-downloder/warehouse.db)")
+	queryCmd.Flags().String("format", "text", "output format (text, csv or json)")
+}
@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+	"github.com/spf13/pflag"
+)
+
+// defaultRedactReplacement は置換後の文字列を指定していないルールで使う文字列です
+const defaultRedactReplacement = "[REDACTED]"
+
+// RedactOptions はSQLや個人情報を伏せる設定です
+type RedactOptions struct {
+	// Literals はSQLの文字列と数値のリテラルを ? に置き換えるかどうかです
+	Literals bool `yaml:"literals"`
+	// Rules はエントリのテキストに適用する正規表現のルールです
+	Rules []RedactRule `yaml:"rules"`
+}
+
+// RedactRule は正規表現にマッチした部分を置き換えるルールです
+// Replacement では $1 などでキャプチャした値を参照できます
+type RedactRule struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+// Redactor はエントリの書き出し前にリテラルや個人情報を伏せます
+type Redactor struct {
+	literals bool
+	rules    []redactRule
+}
+
+type redactRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// NewRedactor は設定からRedactorを生成します。伏せる対象がない場合はnilを返します
+func NewRedactor(opts RedactOptions) (*Redactor, error) {
+	r := &Redactor{literals: opts.Literals}
+
+	for _, rule := range opts.Rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact rule %q: %w", rule.Pattern, err)
+		}
+		replacement := rule.Replacement
+		if replacement == "" {
+			replacement = defaultRedactReplacement
+		}
+		r.rules = append(r.rules, redactRule{pattern: pattern, replacement: replacement})
+	}
+
+	if !r.literals && len(r.rules) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// Redact はリテラルとルールにマッチした値を伏せたエントリのコピーを返します
+// ルールはSQL、# で始まる行、ユーザー、ホスト、IPアドレス、データベース、その他のフィールドの値に適用します
+// nilのRedactorはエントリをそのまま返します
+func (r *Redactor) Redact(e *parser.Entry) *parser.Entry {
+	if r == nil {
+		return e
+	}
+
+	redacted := *e
+	if r.literals {
+		redacted.Statement = RedactLiterals(redacted.Statement)
+	}
+	if len(r.rules) == 0 {
+		return &redacted
+	}
+
+	redacted.Statement = r.apply(redacted.Statement)
+	redacted.User = r.apply(redacted.User)
+	redacted.Host = r.apply(redacted.Host)
+	redacted.IP = r.apply(redacted.IP)
+	redacted.DB = r.apply(redacted.DB)
+
+	if e.Comments != nil {
+		redacted.Comments = make([]string, len(e.Comments))
+		for i, line := range e.Comments {
+			redacted.Comments[i] = r.apply(line)
+		}
+	}
+	if e.Extra != nil {
+		redacted.Extra = make(map[string]string, len(e.Extra))
+		for k, v := range e.Extra {
+			redacted.Extra[k] = r.apply(v)
+		}
+	}
+	return &redacted
+}
+
+func (r *Redactor) apply(s string) string {
+	for _, rule := range r.rules {
+		s = rule.pattern.ReplaceAllString(s, rule.replacement)
+	}
+	return s
+}
+
+// RedactLiterals はSQLの文字列と数値のリテラルを ? に置き換えます
+// Fingerprint と違い、コメント、識別子、空白、大文字と小文字はそのまま残します
+func RedactLiterals(sql string) string {
+	if strings.HasPrefix(strings.TrimSpace(sql), "# administrator command:") {
+		return sql
+	}
+
+	var b strings.Builder
+	b.Grow(len(sql))
+
+	// ident は直前の文字が識別子の一部かどうかを表します
+	ident := false
+	// operand は直前のトークンが値を取る演算子などで、続く - が符号になり得るかを表します
+	operand := true
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		switch {
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				end = len(sql)
+			} else {
+				end += i + 4
+			}
+			b.WriteString(sql[i:end])
+			i = end
+			ident = false
+
+		case c == '#' || (c == '-' && i+2 < len(sql) && sql[i+1] == '-' && isSpace(sql[i+2])):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql)
+			} else {
+				end += i
+			}
+			b.WriteString(sql[i:end])
+			i = end
+			ident = false
+
+		case c == '\'' || c == '"':
+			i = skipQuoted(sql, i)
+			b.WriteByte('?')
+			ident, operand = false, false
+
+		case c == '`':
+			end := strings.IndexByte(sql[i+1:], '`')
+			if end < 0 {
+				end = len(sql)
+			} else {
+				end += i + 2
+			}
+			b.WriteString(sql[i:end])
+			i = end
+			ident, operand = true, false
+
+		case !ident && (isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])) ||
+			(c == '-' && operand && i+1 < len(sql) && isDigit(sql[i+1]))):
+			i = skipNumber(sql, i)
+			b.WriteByte('?')
+			ident, operand = false, false
+
+		case isSpace(c):
+			b.WriteByte(c)
+			ident = false
+			i++
+
+		default:
+			b.WriteByte(c)
+			ident = isIdentChar(c)
+			operand = !ident && c != ')'
+			i++
+		}
+	}
+
+	return b.String()
+}
+
+// addRedactFlags はリテラルや個人情報を伏せるフラグを登録します
+func addRedactFlags(flags *pflag.FlagSet) {
+	flags.Bool("redact", false, "replace string and numeric literals in SQL with ?")
+	flags.StringArray("redact-rule", nil, "regular expression whose matches in SQL, comments and fields are replaced with "+defaultRedactReplacement+" (repeatable)")
+}
+
+// mergeRedactOptions はフラグの値で伏せる設定を上書きします。--redact-rule のルールは設定ファイルのルールに追加します
+func mergeRedactOptions(opts RedactOptions, flags *pflag.FlagSet) RedactOptions {
+	if f := flags.Lookup("redact"); f != nil && f.Changed {
+		opts.Literals, _ = flags.GetBool("redact")
+	}
+	if f := flags.Lookup("redact-rule"); f != nil && f.Changed {
+		patterns, _ := flags.GetStringArray("redact-rule")
+		rules := append([]RedactRule{}, opts.Rules...)
+		for _, pattern := range patterns {
+			rules = append(rules, RedactRule{Pattern: pattern})
+		}
+		opts.Rules = rules
+	}
+	return opts
+}
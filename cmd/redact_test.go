@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+	"github.com/spf13/pflag"
+)
+
+const piiLog = `# Time: 2023-05-10T12:30:15.000000Z
+# User@Host: app[app] @ alice-laptop.example.com [10.0.1.10]  Id: 42
+# Query_time: 2.500000  Lock_time: 0.100000 Rows_sent: 1  Rows_examined: 100
+use production;
+SET timestamp=1683721815;
+/* user:alice@example.com */ SELECT * FROM users WHERE email = 'alice@example.com' AND token = "tok_4f9a" AND customer_id = 123456;
+`
+
+func TestRedactLiterals(t *testing.T) {
+	testCases := []struct {
+		name     string
+		sql      string
+		expected string
+	}{
+		{
+			name:     "文字列と数値",
+			sql:      "SELECT * FROM users WHERE email = 'a@example.com' AND id = 42",
+			expected: "SELECT * FROM users WHERE email = ? AND id = ?",
+		},
+		{
+			name:     "エスケープされたクォート",
+			sql:      `SELECT 'it''s', "say \"hi\""`,
+			expected: "SELECT ?, ?",
+		},
+		{
+			name:     "負の数、小数、指数、16進数",
+			sql:      "SELECT 1, 3.14, 1e10, 0xFF FROM t WHERE a > -2.5 AND b = (-3)",
+			expected: "SELECT ?, ?, ?, ? FROM t WHERE a > ? AND b = (?)",
+		},
+		{
+			name:     "識別子の数字はそのまま",
+			sql:      "SELECT col1 FROM t2 JOIN `order 3` ON t2.id = `order 3`.id - 1",
+			expected: "SELECT col1 FROM t2 JOIN `order 3` ON t2.id = `order 3`.id - ?",
+		},
+		{
+			name:     "コメントと改行と大文字小文字はそのまま",
+			sql:      "/* app:web 1 */ SELECT a\n  FROM t -- limit 10\n WHERE b IN (1, 2)",
+			expected: "/* app:web 1 */ SELECT a\n  FROM t -- limit 10\n WHERE b IN (?, ?)",
+		},
+		{
+			name:     "管理コマンド",
+			sql:      "# administrator command: Quit",
+			expected: "# administrator command: Quit",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := RedactLiterals(tc.sql); got != tc.expected {
+				t.Errorf("RedactLiterals() = %q, want %q", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestNewRedactor(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    RedactOptions
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "設定なし", opts: RedactOptions{}, wantNil: true},
+		{name: "リテラル", opts: RedactOptions{Literals: true}},
+		{name: "ルール", opts: RedactOptions{Rules: []RedactRule{{Pattern: `tok_\w+`}}}},
+		{name: "不正な正規表現", opts: RedactOptions{Rules: []RedactRule{{Pattern: "("}}}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRedactor(tc.opts)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("NewRedactor() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && (r == nil) != tc.wantNil {
+				t.Errorf("NewRedactor() = %v, wantNil %v", r, tc.wantNil)
+			}
+		})
+	}
+}
+
+func TestRedactorRedact(t *testing.T) {
+	entries, err := parser.ParseString(piiLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := entries[0]
+	original := e.String()
+
+	r, err := NewRedactor(RedactOptions{
+		Literals: true,
+		Rules: []RedactRule{
+			{Pattern: `[\w.+-]+@[\w-]+\.[\w.]+`},
+			{Pattern: `(\w+)-laptop`, Replacement: "$1-host"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redacted := r.Redact(e)
+	if expected := "/* user:[REDACTED] */ SELECT * FROM users WHERE email = ? AND token = ? AND customer_id = ?"; redacted.Statement != expected {
+		t.Errorf("Redact().Statement = %q, want %q", redacted.Statement, expected)
+	}
+	if redacted.Host != "alice-host.example.com" {
+		t.Errorf("Redact().Host = %q", redacted.Host)
+	}
+	if !strings.Contains(redacted.String(), "@ alice-host.example.com [10.0.1.10]") {
+		t.Errorf("Redact() comments = %q", redacted.Comments)
+	}
+
+	// 元のエントリは変更しない
+	if e.String() != original {
+		t.Errorf("Redact() modified the original entry: %q", e.String())
+	}
+
+	var nilRedactor *Redactor
+	if nilRedactor.Redact(e) != e {
+		t.Error("Redact() of nil redactor should return the entry as is")
+	}
+}
+
+func TestMergeRedactOptions(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	addRedactFlags(flags)
+	if err := flags.Parse([]string{"--redact", "--redact-rule", `tok_\w+`, "--redact-rule", `\d{16}`}); err != nil {
+		t.Fatal(err)
+	}
+
+	base := RedactOptions{Rules: []RedactRule{{Pattern: "secret", Replacement: "***"}}}
+	got := mergeRedactOptions(base, flags)
+
+	if !got.Literals {
+		t.Error("mergeRedactOptions() Literals = false, want true")
+	}
+	if len(got.Rules) != 3 || got.Rules[0].Replacement != "***" || got.Rules[2].Pattern != `\d{16}` {
+		t.Errorf("mergeRedactOptions() Rules = %+v", got.Rules)
+	}
+	if len(base.Rules) != 1 {
+		t.Errorf("mergeRedactOptions() modified the base rules: %+v", base.Rules)
+	}
+}
+
+// TestRedactOutputs はどの出力形式でも伏せる前の値が書き出されないことを確認します
+func TestRedactOutputs(t *testing.T) {
+	redactor, err := NewRedactor(RedactOptions{Literals: true, Rules: []RedactRule{{Pattern: `[\w.+-]+@[\w-]+\.[\w.]+`}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := []string{"alice@example.com", "tok_4f9a", "123456"}
+
+	data := piiLog
+	client := AWSClientMock{DownloadSlowQueryResult: &data}
+
+	for _, format := range []string{"slowlog", "jsonl", "csv", "parquet"} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			output := filepath.Join(dir, "out.log")
+			if format == "parquet" {
+				output = dir
+			}
+
+			err := DownloadSlowQueryLog(client, "db-1", []string{"slowquery/mysql-slowquery.log"}, DownloadOptions{
+				Output:   output,
+				Format:   format,
+				Redactor: redactor,
+			})
+			if err != nil {
+				t.Fatalf("DownloadSlowQueryLog() returned error: %v", err)
+			}
+
+			written := 0
+			err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				b, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				written++
+				for _, secret := range secrets {
+					if bytes.Contains(b, []byte(secret)) {
+						t.Errorf("%s contains %q", path, secret)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written == 0 {
+				t.Error("no file was written")
+			}
+		})
+	}
+
+	t.Run("analyze", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "slowquery.db-1.log")
+		if err := os.WriteFile(path, []byte(piiLog), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, format := range []string{"text", "json", "jsonl"} {
+			var buf bytes.Buffer
+			if err := Analyze(&buf, NewLogger("error"), []string{path}, AnalyzeOptions{Format: format, Redactor: redactor}); err != nil {
+				t.Fatalf("Analyze() returned error: %v", err)
+			}
+			for _, secret := range secrets {
+				if strings.Contains(buf.String(), secret) {
+					t.Errorf("Analyze() %s report contains %q:\n%s", format, secret, buf.String())
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,427 @@
+package cmd
+
+import (
+	_ "embed"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed templates/report.html.tmpl
+var htmlReportTemplate string
+
+var htmlReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"seconds": formatSeconds,
+	"time":    formatTime,
+}).Parse(htmlReportTemplate))
+
+// LoadProfile は時間帯、インスタンス、ユーザー、データベース、クライアントごとのクエリの負荷を集計します
+type LoadProfile struct {
+	Instances map[string]*Stats
+	Users     map[string]*Stats
+	Databases map[string]*Stats
+	Hosts     map[string]*Stats
+
+	// minutes はインスタンスごと、1分ごとの Query_time の集計です
+	minutes map[string]map[int64]*Stats
+}
+
+// NewLoadProfile は空のLoadProfileを生成します
+func NewLoadProfile() *LoadProfile {
+	return &LoadProfile{
+		Instances: map[string]*Stats{},
+		Users:     map[string]*Stats{},
+		Databases: map[string]*Stats{},
+		Hosts:     map[string]*Stats{},
+		minutes:   map[string]map[int64]*Stats{},
+	}
+}
+
+// Add はエントリを集計に加えます。nilのLoadProfileは何もしません
+func (p *LoadProfile) Add(r Record) {
+	if p == nil {
+		return
+	}
+
+	addStats(p.Instances, r.Instance, r.QueryTime)
+	addStats(p.Users, r.User, r.QueryTime)
+	addStats(p.Databases, r.DB, r.QueryTime)
+	host := r.Host
+	if host == "" {
+		host = r.IP
+	}
+	addStats(p.Hosts, host, r.QueryTime)
+
+	t := r.StartTime()
+	if t.IsZero() {
+		return
+	}
+	minutes, ok := p.minutes[r.Instance]
+	if !ok {
+		minutes = map[int64]*Stats{}
+		p.minutes[r.Instance] = minutes
+	}
+	minute := t.Unix() / 60
+	s, ok := minutes[minute]
+	if !ok {
+		s = &Stats{}
+		minutes[minute] = s
+	}
+	s.Add(r.QueryTime)
+}
+
+func addStats(m map[string]*Stats, key string, v float64) {
+	if key == "" {
+		return
+	}
+	s, ok := m[key]
+	if !ok {
+		s = &Stats{}
+		m[key] = s
+	}
+	s.Add(v)
+}
+
+// htmlChartBuckets はグラフの1点あたりの時間の候補です
+var htmlChartBuckets = []time.Duration{
+	time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour,
+}
+
+// htmlChartMaxPoints はグラフの点の数の上限の目安です
+const htmlChartMaxPoints = 120
+
+// chartBucket は first から last までを htmlChartMaxPoints 以下の点で描ける最小の時間の幅を返します
+func chartBucket(first, last time.Time) time.Duration {
+	for _, b := range htmlChartBuckets {
+		if int(last.Truncate(b).Sub(first.Truncate(b))/b) < htmlChartMaxPoints {
+			return b
+		}
+	}
+	return htmlChartBuckets[len(htmlChartBuckets)-1]
+}
+
+// formatBucket は時間の幅を 5m、1h、1d のような短い形式で返します
+func formatBucket(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	case d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	default:
+		return d.String()
+	}
+}
+
+// htmlChartColors はインスタンスごとの線の色です
+var htmlChartColors = []string{"#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f", "#edc948", "#b07aa1", "#ff9da7"}
+
+// グラフの大きさと余白です
+const (
+	htmlChartWidth  = 880
+	htmlChartHeight = 220
+	htmlChartLeft   = 64
+	htmlChartRight  = 16
+	htmlChartTop    = 12
+	htmlChartBottom = 24
+)
+
+type htmlReportData struct {
+	Overall    JSONOverall
+	Instances  int
+	Bucket     string
+	Charts     []htmlChart
+	Classes    []htmlClass
+	Breakdowns []htmlBreakdown
+}
+
+type htmlChart struct {
+	Title  string
+	Series []htmlSeries
+	XTicks []htmlTick
+	YTicks []htmlTick
+	Width  int
+	Height int
+	Left   int
+	Right  int
+	Bottom int
+}
+
+type htmlSeries struct {
+	Name   string
+	Color  string
+	Points string
+}
+
+type htmlTick struct {
+	Pos   float64
+	Label string
+}
+
+type htmlClass struct {
+	*Class
+	Rank      int
+	Percent   float64
+	P50       float64
+	P95       float64
+	P99       float64
+	Histogram []htmlBar
+	Databases string
+	Users     string
+	Instances string
+}
+
+type htmlBar struct {
+	X      float64
+	Y      float64
+	Width  float64
+	Height float64
+	Label  string
+	Count  int64
+}
+
+type htmlBreakdown struct {
+	Title string
+	Rows  []htmlBreakdownRow
+}
+
+type htmlBreakdownRow struct {
+	Name    string
+	Stats   Stats
+	Percent float64
+}
+
+// WriteHTMLReport は集計結果をグラフ付きのHTML形式のレポートとして書き出します
+// CSSとグラフはHTMLに埋め込むので、オフラインでもそのまま開けます
+func WriteHTMLReport(w io.Writer, d *Digest, p *LoadProfile, opts ReportOptions) error {
+	if p == nil {
+		p = NewLoadProfile()
+	}
+
+	data := htmlReportData{
+		Overall:   newJSONOverall(d),
+		Instances: len(p.Instances),
+	}
+
+	if !d.FirstSeen.IsZero() {
+		bucket := chartBucket(d.FirstSeen, d.LastSeen)
+		data.Bucket = formatBucket(bucket)
+		data.Charts = newHTMLCharts(p, d.FirstSeen, d.LastSeen, bucket)
+	}
+
+	for i, c := range rankedClasses(d, opts) {
+		data.Classes = append(data.Classes, htmlClass{
+			Class:     c,
+			Rank:      i + 1,
+			Percent:   percent(c.QueryTime.Total, d.QueryTime.Total),
+			P50:       c.Latency.Quantile(0.5),
+			P95:       c.Latency.Quantile(0.95),
+			P99:       c.Latency.Quantile(0.99),
+			Histogram: newHTMLBars(c.Latency.Histogram()),
+			Databases: formatCounts(c.Databases),
+			Users:     formatCounts(c.Users),
+			Instances: formatCounts(c.Instances),
+		})
+	}
+
+	for _, b := range []struct {
+		title string
+		stats map[string]*Stats
+	}{
+		{"Instances", p.Instances},
+		{"Users", p.Users},
+		{"Databases", p.Databases},
+		{"Hosts", p.Hosts},
+	} {
+		if len(b.stats) > 0 {
+			data.Breakdowns = append(data.Breakdowns, newHTMLBreakdown(b.title, b.stats, d.QueryTime.Total, opts.Top))
+		}
+	}
+
+	return htmlReport.Execute(w, data)
+}
+
+// newHTMLCharts はインスタンスごとの合計時間とクエリ数の推移のグラフを組み立てます
+func newHTMLCharts(p *LoadProfile, first, last time.Time, bucket time.Duration) []htmlChart {
+	start := first.Truncate(bucket)
+	n := int(last.Truncate(bucket).Sub(start)/bucket) + 1
+
+	instances := make([]string, 0, len(p.minutes))
+	for instance := range p.minutes {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+
+	totals := make([][]float64, len(instances))
+	counts := make([][]float64, len(instances))
+	for i, instance := range instances {
+		totals[i] = make([]float64, n)
+		counts[i] = make([]float64, n)
+		for minute, s := range p.minutes[instance] {
+			j := int(time.Unix(minute*60, 0).Sub(start) / bucket)
+			totals[i][j] += s.Total
+			counts[i][j] += float64(s.Count)
+		}
+	}
+
+	xTicks := newHTMLTimeTicks(start, n, bucket)
+	return []htmlChart{
+		newHTMLChart("Total query time (seconds) per "+formatBucket(bucket), instances, totals, xTicks),
+		newHTMLChart("Queries per "+formatBucket(bucket), instances, counts, xTicks),
+	}
+}
+
+func newHTMLChart(title string, names []string, values [][]float64, xTicks []htmlTick) htmlChart {
+	chart := htmlChart{
+		Title:  title,
+		XTicks: xTicks,
+		Width:  htmlChartWidth,
+		Height: htmlChartHeight,
+		Left:   htmlChartLeft,
+		Right:  htmlChartWidth - htmlChartRight,
+		Bottom: htmlChartHeight - htmlChartBottom,
+	}
+
+	var max float64
+	for _, vs := range values {
+		for _, v := range vs {
+			max = math.Max(max, v)
+		}
+	}
+	max = niceCeil(max)
+
+	plotHeight := float64(htmlChartHeight - htmlChartTop - htmlChartBottom)
+	for i := 0; i <= 4; i++ {
+		v := max * float64(i) / 4
+		chart.YTicks = append(chart.YTicks, htmlTick{
+			Pos:   float64(chart.Bottom) - plotHeight*float64(i)/4,
+			Label: strconv.FormatFloat(v, 'g', 4, 64),
+		})
+	}
+
+	for i, name := range names {
+		if name == "" {
+			name = "-"
+		}
+		var points []byte
+		for j, v := range values[i] {
+			if j > 0 {
+				points = append(points, ' ')
+			}
+			points = strconv.AppendFloat(points, chartX(j, len(values[i])), 'f', 1, 64)
+			points = append(points, ',')
+			points = strconv.AppendFloat(points, float64(chart.Bottom)-plotHeight*v/max, 'f', 1, 64)
+		}
+		chart.Series = append(chart.Series, htmlSeries{
+			Name:   name,
+			Color:  htmlChartColors[i%len(htmlChartColors)],
+			Points: string(points),
+		})
+	}
+
+	return chart
+}
+
+// chartX は n 個の点のうち i 番目の点のX座標を返します
+func chartX(i, n int) float64 {
+	width := float64(htmlChartWidth - htmlChartLeft - htmlChartRight)
+	if n <= 1 {
+		return htmlChartLeft + width/2
+	}
+	return htmlChartLeft + width*float64(i)/float64(n-1)
+}
+
+// newHTMLTimeTicks はグラフのX軸に最大5個の時刻の目盛りを付けます
+func newHTMLTimeTicks(start time.Time, n int, bucket time.Duration) []htmlTick {
+	layout := "01-02 15:04"
+	if bucket >= 24*time.Hour {
+		layout = "2006-01-02"
+	}
+
+	step := 1
+	if n > 5 {
+		step = (n - 1 + 3) / 4
+	}
+	var ticks []htmlTick
+	for i := 0; i < n; i += step {
+		ticks = append(ticks, htmlTick{
+			Pos:   chartX(i, n),
+			Label: start.Add(time.Duration(i) * bucket).UTC().Format(layout),
+		})
+	}
+	return ticks
+}
+
+// niceCeil は v 以上で 1、2、5 の10のべき乗倍の最小の値を返します
+func niceCeil(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	p := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if m*p >= v {
+			return m * p
+		}
+	}
+	return 10 * p
+}
+
+// htmlHistogramWidth と htmlHistogramHeight はヒストグラムのグラフの大きさです
+const (
+	htmlHistogramWidth  = 360
+	htmlHistogramHeight = 80
+)
+
+// newHTMLBars は Query_time のヒストグラムを棒グラフの座標に変換します
+func newHTMLBars(buckets []HistogramBucket) []htmlBar {
+	var max int64
+	for _, b := range buckets {
+		if b.Count > max {
+			max = b.Count
+		}
+	}
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	width := float64(htmlHistogramWidth) / float64(len(buckets))
+	plotHeight := float64(htmlHistogramHeight - 16)
+	bars := make([]htmlBar, len(buckets))
+	for i, b := range buckets {
+		height := 0.0
+		if max > 0 {
+			height = plotHeight * float64(b.Count) / float64(max)
+		}
+		bars[i] = htmlBar{
+			X:      float64(i) * width,
+			Y:      plotHeight - height,
+			Width:  width - 2,
+			Height: height,
+			Label:  b.Label,
+			Count:  b.Count,
+		}
+	}
+	return bars
+}
+
+// newHTMLBreakdown は合計時間の長い順に top 件までの内訳を組み立てます
+func newHTMLBreakdown(title string, stats map[string]*Stats, total float64, top int) htmlBreakdown {
+	rows := make([]htmlBreakdownRow, 0, len(stats))
+	for name, s := range stats {
+		rows = append(rows, htmlBreakdownRow{Name: name, Stats: *s, Percent: percent(s.Total, total)})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Stats.Total != rows[j].Stats.Total {
+			return rows[i].Stats.Total > rows[j].Stats.Total
+		}
+		return rows[i].Name < rows[j].Name
+	})
+	if top > 0 && len(rows) > top {
+		rows = rows[:top]
+	}
+	return htmlBreakdown{Title: title, Rows: rows}
+}
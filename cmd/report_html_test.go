@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChartBucket(t *testing.T) {
+	first := time.Date(2023, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		span     time.Duration
+		expected string
+	}{
+		{name: "同じ時刻", span: 0, expected: "1m"},
+		{name: "1時間", span: time.Hour, expected: "1m"},
+		{name: "3時間", span: 3 * time.Hour, expected: "5m"},
+		{name: "1日", span: 24 * time.Hour, expected: "15m"},
+		{name: "1週間", span: 7 * 24 * time.Hour, expected: "6h"},
+		{name: "1年", span: 365 * 24 * time.Hour, expected: "1d"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := formatBucket(chartBucket(first, first.Add(tc.span))); got != tc.expected {
+				t.Errorf("chartBucket() = %v, want %v", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestNiceCeil(t *testing.T) {
+	testCases := []struct {
+		value    float64
+		expected float64
+	}{
+		{value: 0, expected: 1},
+		{value: 0.03, expected: 0.05},
+		{value: 1, expected: 1},
+		{value: 1.2, expected: 2},
+		{value: 340, expected: 500},
+		{value: 7000, expected: 10000},
+	}
+
+	for _, tc := range testCases {
+		if got := niceCeil(tc.value); got != tc.expected {
+			t.Errorf("niceCeil(%v) = %v, want %v", tc.value, got, tc.expected)
+		}
+	}
+}
+
+func TestWriteHTMLReport(t *testing.T) {
+	d := NewDigest()
+	p := NewLoadProfile()
+	add := func(r Record) {
+		d.Add(r)
+		p.Add(r)
+	}
+	for i := 0; i < 10; i++ {
+		add(newTestRecord("db-1", "SELECT * FROM users WHERE id = 1", 1.5, 1, 100, 1683721815+int64(i)*600))
+		add(newTestRecord("db-2", "SELECT * FROM users WHERE id = 2", 0.5, 1, 100, 1683721815+int64(i)*600))
+	}
+	r := newTestRecord("db-2", "SELECT '<script>alert(1)</script>' FROM orders", 3.0, 1, 1, 1683725000)
+	r.User = "batch"
+	r.Host = "worker-1"
+	add(r)
+
+	var buf bytes.Buffer
+	if err := WriteHTMLReport(&buf, d, p, ReportOptions{Top: 10}); err != nil {
+		t.Fatalf("WriteHTMLReport() returned error: %v", err)
+	}
+	html := buf.String()
+
+	for _, want := range []string{
+		"<title>Slow query report</title>",
+		"<div><b>21</b>queries</div>",
+		"<h3>Total query time (seconds) per 1m</h3>",
+		`<a href="#query-` + d.Classes("total")[0].ID + `">`,
+		`<details id="query-`,
+		"<td class=\"text\">batch</td>",
+		"<td class=\"text\">worker-1</td>",
+		"&lt;script&gt;alert(1)&lt;/script&gt;",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("WriteHTMLReport() does not contain %q", want)
+		}
+	}
+	if got := strings.Count(html, "<polyline"); got != 4 {
+		t.Errorf("WriteHTMLReport() has %d series, want 4", got)
+	}
+
+	// 外部のファイルを読み込まず、値の埋め込みにも失敗していない
+	for _, unwanted := range []string{"<script", "http://", "https://", "<link", "ZgotmplZ"} {
+		if strings.Contains(html, unwanted) {
+			t.Errorf("WriteHTMLReport() contains %q", unwanted)
+		}
+	}
+}
+
+func TestWriteHTMLReportWithoutTime(t *testing.T) {
+	d := NewDigest()
+	d.Add(newTestRecord("db-1", "SELECT 1", 1, 1, 1, 0))
+
+	var buf bytes.Buffer
+	if err := WriteHTMLReport(&buf, d, nil, ReportOptions{}); err != nil {
+		t.Fatalf("WriteHTMLReport() returned error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "The entries have no timestamps.") {
+		t.Errorf("WriteHTMLReport() = %s", buf.String())
+	}
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// JSONReport はJSON形式のレポートです
+type JSONReport struct {
+	Overall JSONOverall `json:"overall"`
+	Classes []JSONClass `json:"classes"`
+}
+
+// JSONOverall はレポート全体の集計です
+type JSONOverall struct {
+	Queries   int64      `json:"queries"`
+	Unique    int        `json:"unique"`
+	QueryTime JSONMetric `json:"query_time"`
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+}
+
+// JSONMetric は属性ごとの集計値です
+type JSONMetric struct {
+	Total float64 `json:"total"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+}
+
+// JSONLatency は Query_time の集計値とパーセンタイルです
+type JSONLatency struct {
+	JSONMetric
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// JSONClass はフィンガープリントごとの集計です
+type JSONClass struct {
+	Rank         int               `json:"rank"`
+	ID           string            `json:"id"`
+	Fingerprint  string            `json:"fingerprint"`
+	Count        int64             `json:"count"`
+	QueryTime    JSONLatency       `json:"query_time"`
+	LockTime     JSONMetric        `json:"lock_time"`
+	RowsSent     JSONMetric        `json:"rows_sent"`
+	RowsExamined JSONMetric        `json:"rows_examined"`
+	RowsRatio    float64           `json:"rows_examined_per_sent"`
+	Histogram    []HistogramBucket `json:"query_time_histogram"`
+	FirstSeen    *time.Time        `json:"first_seen,omitempty"`
+	LastSeen     *time.Time        `json:"last_seen,omitempty"`
+	Databases    map[string]int64  `json:"databases"`
+	Users        map[string]int64  `json:"users"`
+	Instances    map[string]int64  `json:"instances"`
+	Example      string            `json:"example"`
+}
+
+func newJSONMetric(s Stats) JSONMetric {
+	return JSONMetric{Total: s.Total, Min: s.Min, Max: s.Max, Avg: s.Avg()}
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+func newJSONOverall(d *Digest) JSONOverall {
+	return JSONOverall{
+		Queries:   d.QueryTime.Count,
+		Unique:    d.Len(),
+		QueryTime: newJSONMetric(d.QueryTime),
+		FirstSeen: timePtr(d.FirstSeen),
+		LastSeen:  timePtr(d.LastSeen),
+	}
+}
+
+// NewJSONReport は集計結果からJSON形式のレポートを組み立てます
+func NewJSONReport(d *Digest, opts ReportOptions) JSONReport {
+	report := JSONReport{
+		Overall: newJSONOverall(d),
+		Classes: []JSONClass{},
+	}
+
+	for i, c := range rankedClasses(d, opts) {
+		report.Classes = append(report.Classes, JSONClass{
+			Rank:        i + 1,
+			ID:          c.ID,
+			Fingerprint: c.Fingerprint,
+			Count:       c.Count,
+			QueryTime: JSONLatency{
+				JSONMetric: newJSONMetric(c.QueryTime),
+				P50:        c.Latency.Quantile(0.5),
+				P95:        c.Latency.Quantile(0.95),
+				P99:        c.Latency.Quantile(0.99),
+			},
+			LockTime:     newJSONMetric(c.LockTime),
+			RowsSent:     newJSONMetric(c.RowsSent),
+			RowsExamined: newJSONMetric(c.RowsExamined),
+			RowsRatio:    c.RowsRatio(),
+			Histogram:    c.Latency.Histogram(),
+			FirstSeen:    timePtr(c.FirstSeen),
+			LastSeen:     timePtr(c.LastSeen),
+			Databases:    c.Databases,
+			Users:        c.Users,
+			Instances:    c.Instances,
+			Example:      c.Example.Statement,
+		})
+	}
+
+	return report
+}
+
+// WriteJSONReport はJSON形式のレポートを書き出します
+func WriteJSONReport(w io.Writer, d *Digest, opts ReportOptions) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(NewJSONReport(d, opts))
+}
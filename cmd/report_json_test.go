@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteJSONReport(t *testing.T) {
+	d := NewDigest()
+	for i := 1; i <= 100; i++ {
+		d.Add(newTestRecord("db-1", "SELECT * FROM users WHERE id = 1", float64(i)/10, 1, 100, 1683721815+int64(i)))
+	}
+	d.Add(newTestRecord("db-2", "DELETE FROM logs WHERE id < 100", 0.5, 0, 1000, 1683722000))
+
+	var buf bytes.Buffer
+	if err := WriteJSONReport(&buf, d, ReportOptions{Top: 1}); err != nil {
+		t.Fatalf("WriteJSONReport() returned error: %v", err)
+	}
+
+	var report JSONReport
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("WriteJSONReport() wrote invalid JSON: %v", err)
+	}
+
+	if report.Overall.Queries != 101 || report.Overall.Unique != 2 {
+		t.Errorf("Overall = %+v", report.Overall)
+	}
+	if len(report.Classes) != 1 {
+		t.Fatalf("Classes has %d entries, want 1", len(report.Classes))
+	}
+
+	c := report.Classes[0]
+	if c.Rank != 1 || c.Fingerprint != "select * from users where id = ?" || c.Count != 100 {
+		t.Errorf("Classes[0] = %+v", c)
+	}
+	if c.QueryTime.P50 < 4.9 || c.QueryTime.P50 > 5.1 {
+		t.Errorf("p50 = %v, want about 5.0", c.QueryTime.P50)
+	}
+	if c.QueryTime.P95 < 9.3 || c.QueryTime.P95 > 9.7 {
+		t.Errorf("p95 = %v, want about 9.5", c.QueryTime.P95)
+	}
+	if c.QueryTime.Max != 10 {
+		t.Errorf("max = %v, want 10", c.QueryTime.Max)
+	}
+
+	var histogram int64
+	for _, b := range c.Histogram {
+		histogram += b.Count
+	}
+	if histogram != c.Count {
+		t.Errorf("histogram has %d queries, want %d", histogram, c.Count)
+	}
+}
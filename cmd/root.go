@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 
@@ -27,87 +30,247 @@ func Do(cmd *cobra.Command, args []string) error {
 
 	logger.Info("Start mysql-slowquery-downloder")
 
+	// 設定ファイルのターゲットとフラグをマージする
+	target, err := resolveTarget(cmd)
+	if err != nil {
+		return err
+	}
+
+	var preview io.Writer
+	if dryRun, _ := cmd.Flags().GetBool("notify-dry-run"); dryRun {
+		preview = cmd.ErrOrStderr()
+	}
+	return Download(cmd.Context(), logger, target, preview)
+}
+
+// Download はターゲットのインスタンスのログをダウンロードして書き出し、設定があれば集計結果を通知します
+// preview がnilでない場合は、通知を送らずに送る内容を preview に書き出します
+func Download(ctx context.Context, logger *slog.Logger, target Target, preview io.Writer) (err error) {
+	entryFilter, err := NewEntryFilter(target.Entries)
+	if err != nil {
+		return err
+	}
+
+	redactor, err := NewRedactor(target.Redact)
+	if err != nil {
+		return err
+	}
+
 	// クラウドプロバイダーの選択
-	provider := cmd.Flag("provider").Value.String()
-	instance := ""
-	var logList []string
-	var err error
+	client, err := NewClient(logger, target)
+	if err != nil {
+		return err
+	}
+	defer closeClient(client)
 
-	switch provider {
-	case "aws":
-		var aws AWSClient
-		aws, err = NewAWSClient(logger)
+	instances, err := selectInstances(client, target.Instances)
+	if err != nil {
+		return err
+	}
+
+	if !isExportFormat(target.Format) {
+		return fmt.Errorf("Unsupported format: %s. Use 'slowlog', 'jsonl', 'csv' or 'parquet'", target.Format)
+	}
+	headers := map[string]bool{}
+
+	// 通知先がある場合はダウンロードしたエントリを集計する
+	notifier, err := NewNotifier(logger, target.Notify)
+	if err != nil {
+		return err
+	}
+	var digest *Digest
+	var checker *Checker
+	if notifier != nil {
+		digest = NewDigest()
+		checker, err = NewChecker(target.Notify.Rules)
 		if err != nil {
-			return err
+			return fmt.Errorf("notify: %w", err)
 		}
+	}
 
-		instance = FilterInstance(aws, cmd.Flag("instance").Value.String())
-		logList, err = GetSlowQueryList(aws, instance)
+	// ウェアハウスを指定した場合はダウンロードしたエントリを取り込む
+	var warehouse *Warehouse
+	var imp *WarehouseImport
+	if target.Warehouse != "" {
+		warehouse, err = OpenWarehouse(target.Warehouse)
 		if err != nil {
 			return err
 		}
+		defer warehouse.Close()
+	}
 
-		for _, logFile := range logList {
-			logger.Debug(fmt.Sprintf("logFile: %s", logFile))
+	// OpenSearch の設定がある場合はダウンロードしたエントリを送る
+	sink, err := NewOpenSearchSink(logger, target.Name, target.OpenSearch)
+	if err != nil {
+		return err
+	}
+	if sink != nil {
+		defer func() {
+			err = errors.Join(err, sink.Close(ctx))
+		}()
+	}
+
+	// OTLP のエンドポイントがある場合はダウンロードしたエントリを LogRecord として送る
+	exporter, err := NewOTLPExporter(logger, target.Name, target.OTLP)
+	if err != nil {
+		return err
+	}
+	if exporter != nil {
+		defer func() {
+			err = errors.Join(err, exporter.Close(ctx))
+		}()
+	}
+
+	var collect func(Record) error
+	if notifier != nil || warehouse != nil || sink != nil || exporter != nil {
+		collect = func(r Record) error {
+			if digest != nil {
+				digest.Add(r)
+				checker.Add(r)
+			}
+			if err := sink.Add(ctx, r); err != nil {
+				return err
+			}
+			if err := exporter.Add(ctx, r); err != nil {
+				return err
+			}
+			if imp != nil {
+				return imp.Add(r)
+			}
+			return nil
 		}
+	}
 
-		_, err = DownloadSlowQueryLog(aws, instance, cmd.Flag("filter").Value.String(), logList)
+	for _, instance := range instances {
+		logList, err := GetSlowQueryList(client, instance)
 		if err != nil {
 			return err
 		}
-	case "gcp":
-		projectID := cmd.Flag("project").Value.String()
-		if projectID == "" {
-			return fmt.Errorf("GCP project ID is required")
-		}
 
-		credentials := cmd.Flag("credentials").Value.String()
-		var gcp GCPClient
-		gcp, err = NewGCPClient(logger, projectID, credentials)
-		if err != nil {
-			return err
+		for _, logFile := range logList {
+			logger.Debug(fmt.Sprintf("logFile: %s", logFile))
 		}
 
-		instance = FilterInstance(gcp, cmd.Flag("instance").Value.String())
-		if instance == "" {
-			return fmt.Errorf("No matching instance found")
+		// インスタンスごとに1つのトランザクションで取り込む
+		if warehouse != nil {
+			imp, err = warehouse.Begin(ctx)
+			if err != nil {
+				return err
+			}
 		}
 
-		logList, err = GetSlowQueryList(gcp, instance)
+		err = DownloadSlowQueryLog(client, instance, logList, DownloadOptions{
+			Target:       target.Name,
+			Provider:     target.Provider,
+			Filter:       target.Filter,
+			Output:       target.Output,
+			Format:       target.Format,
+			EntryFilter:  entryFilter,
+			Redactor:     redactor,
+			RowGroupSize: target.RowGroupSize,
+			Collect:      collect,
+			headers:      headers,
+		})
 		if err != nil {
+			if imp != nil {
+				imp.Rollback()
+			}
 			return err
 		}
 
-		for _, logFile := range logList {
-			logger.Debug(fmt.Sprintf("logFile: %s", logFile))
+		if imp != nil {
+			if err := imp.Commit(); err != nil {
+				return fmt.Errorf("failed to import into warehouse %s: %w", target.Warehouse, err)
+			}
+			logger.Info("Imported entries into warehouse", "instance", instance, "inserted", imp.Inserted, "duplicates", imp.Duplicates)
 		}
+	}
 
-		_, err = DownloadSlowQueryLog(gcp, instance, cmd.Flag("filter").Value.String(), logList)
-		if err != nil {
-			return err
+	entryFilter.WarnErrors(logger)
+	checker.WarnErrors(logger)
+
+	if notifier != nil {
+		return notifyDownload(ctx, preview, notifier, target, digest, checker.Result(), preview != nil)
+	}
+	return nil
+}
+
+// selectInstances はセレクタごとに前方一致するインスタンスを選びます
+// セレクタが指定されていない場合は全てのインスタンスを対象にします
+func selectInstances(client AWSClientInterface, selectors []string) ([]string, error) {
+	if len(selectors) == 0 {
+		return client.GetInstanceList(), nil
+	}
+
+	var instances []string
+	for _, selector := range selectors {
+		instance := FilterInstance(client, selector)
+		if instance == "" {
+			return nil, fmt.Errorf("No matching instance found: %s", selector)
 		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// NewClient はターゲットのプロバイダーに対応するクライアントを生成します
+func NewClient(logger *slog.Logger, target Target) (AWSClientInterface, error) {
+	switch target.Provider {
+	case "aws":
+		return NewAWSClient(logger, target.Profile, target.Region, target.LogType)
+	case "gcp":
+		if target.Project == "" {
+			return nil, fmt.Errorf("GCP project ID is required")
+		}
+		return NewGCPClient(logger, target.Project, target.Credentials)
+	case "azure":
+		return NewAzureClient(logger, target.Azure)
+	case "local":
+		return NewLocalClient(logger, target.Path)
+	case "ssh":
+		return NewSSHClient(logger, target.SSH)
 	default:
-		return fmt.Errorf("Unsupported provider: %s. Use 'aws' or 'gcp'", provider)
+		return nil, fmt.Errorf("Unsupported provider: %s. Use 'aws', 'gcp', 'azure', 'local' or 'ssh'", target.Provider)
 	}
+}
 
-	return nil
+// closeClient はクライアントが接続などを持っている (io.Closer を実装している) 場合に閉じます
+func closeClient(client AWSClientInterface) {
+	if c, ok := client.(io.Closer); ok {
+		c.Close()
+	}
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	err := rootCmd.Execute()
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		fmt.Fprintln(os.Stderr, exitErr.Error())
+		os.Exit(exitErr.Code)
+	}
 	if err != nil {
 		os.Exit(1)
 	}
 }
 
+// ExitError は終了コードを指定してコマンドを終了するためのエラーです
+// 使い方のメッセージは表示せず、エラーメッセージだけを標準エラー出力に書き出します
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
 func init() {
-	rootCmd.Flags().BoolP("debug", "d", false, "debug mode")
-	rootCmd.Flags().String("instance", "i", "instance name")
-	rootCmd.Flags().String("filter", "f", "log filter string")
-	rootCmd.Flags().StringP("output", "o", "stdout", "output file path")
-	rootCmd.Flags().String("provider", "aws", "cloud provider (aws or gcp)")
-	rootCmd.Flags().String("project", "", "GCP project ID")
-	rootCmd.Flags().String("credentials", "", "path to GCP credentials file")
+	rootCmd.PersistentFlags().String("config", "", "config file (default ~/.config/mysql-slowquery-downloder/config.yaml)")
+	addDownloadFlags(rootCmd.Flags())
 }
@@ -0,0 +1,318 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// ScheduleJob は設定ファイルの schedules に定義する定期的なダウンロードです
+type ScheduleJob struct {
+	// Cron は分、時、日、月、曜日の5つのフィールドの cron 式です。@hourly などの記述子も使えます
+	Cron   string `yaml:"cron"`
+	Target string `yaml:"target"`
+	// Output と Format を指定した場合はターゲットの値を上書きします
+	Output string `yaml:"output"`
+	Format string `yaml:"format"`
+	// Jitter は実行を遅らせる時間の上限です。同じ時刻のジョブがクラウドの API に集中しないように使います
+	Jitter time.Duration `yaml:"jitter"`
+	// CatchUp が true の場合は、停止していた間に実行できなかったジョブを起動時に1回だけ実行します
+	CatchUp bool `yaml:"catch_up"`
+}
+
+// Clock は現在時刻と待ち合わせを提供します。テストでは時刻を進められる偽の時計に差し替えます
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// ScheduleRunFunc はジョブのターゲットをダウンロードします
+type ScheduleRunFunc func(ctx context.Context, name string, target Target) error
+
+// SchedulerOptions はスケジューラーの設定です
+type SchedulerOptions struct {
+	// StateFile はジョブを最後に実行した時刻を保存するファイルです。空の場合は保存せず、CatchUp もしません
+	StateFile string
+	Clock     Clock
+	// Jitter は0以上 max 未満の遅延を返します。省略した場合はランダムな値を使います
+	Jitter func(max time.Duration) time.Duration
+}
+
+// scheduledJob は実行を待っているジョブです
+type scheduledJob struct {
+	name     string
+	job      ScheduleJob
+	target   Target
+	schedule cron.Schedule
+	// next は次に実行する予定の時刻で、due はそれに Jitter を加えた時刻です
+	next    time.Time
+	due     time.Time
+	running bool
+}
+
+// ScheduleJobState はジョブを最後に実行した結果です
+type ScheduleJobState struct {
+	LastScheduled time.Time `json:"last_scheduled"`
+	LastFinished  time.Time `json:"last_finished"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// Scheduler は cron 式に従ってジョブを実行します
+// 同じジョブは重ねて実行せず、前回の実行が終わっていない場合はその回を飛ばします
+type Scheduler struct {
+	logger *slog.Logger
+	run    ScheduleRunFunc
+	opts   SchedulerOptions
+	jobs   []*scheduledJob
+
+	mu    sync.Mutex
+	state map[string]ScheduleJobState
+	wg    sync.WaitGroup
+}
+
+// cronParser は5つのフィールドの cron 式と @hourly などの記述子を解析します
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// NewScheduler は設定のジョブからスケジューラーを生成します
+// targets はジョブが参照するターゲットで、Output と Format はジョブの値で上書きします
+func NewScheduler(logger *slog.Logger, jobs map[string]ScheduleJob, targets map[string]Target, run ScheduleRunFunc, opts SchedulerOptions) (*Scheduler, error) {
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no schedules in config")
+	}
+	if opts.Clock == nil {
+		opts.Clock = realClock{}
+	}
+	if opts.Jitter == nil {
+		opts.Jitter = func(max time.Duration) time.Duration { return time.Duration(rand.Int63n(int64(max))) }
+	}
+
+	s := &Scheduler{logger: logger, run: run, opts: opts, state: map[string]ScheduleJobState{}}
+	for name, job := range jobs {
+		schedule, err := cronParser.Parse(job.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: invalid cron %q: %w", name, job.Cron, err)
+		}
+		if job.Jitter < 0 {
+			return nil, fmt.Errorf("schedule %q: jitter must not be negative", name)
+		}
+		target, ok := targets[job.Target]
+		if !ok {
+			return nil, fmt.Errorf("schedule %q: target %q not found in config", name, job.Target)
+		}
+		if job.Output != "" {
+			target.Output = job.Output
+		}
+		if job.Format != "" {
+			target.Format = job.Format
+		}
+		if !isExportFormat(target.Format) {
+			return nil, fmt.Errorf("schedule %q: Unsupported format: %s. Use 'slowlog', 'jsonl', 'csv' or 'parquet'", name, target.Format)
+		}
+		s.jobs = append(s.jobs, &scheduledJob{name: name, job: job, target: target, schedule: schedule})
+	}
+	sort.Slice(s.jobs, func(i, j int) bool { return s.jobs[i].name < s.jobs[j].name })
+
+	if opts.StateFile != "" {
+		state, err := loadScheduleState(opts.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		s.state = state
+	}
+	return s, nil
+}
+
+// plan は now より後の次の実行予定を決めます
+func (s *Scheduler) plan(j *scheduledJob, now time.Time) {
+	j.next = j.schedule.Next(now)
+	j.due = j.next
+	if j.job.Jitter > 0 {
+		j.due = j.due.Add(s.opts.Jitter(j.job.Jitter))
+	}
+}
+
+// start は起動時の実行予定を決めます
+// CatchUp のジョブは、前回の実行予定の次の予定が過ぎていれば、すぐに1回だけ実行します
+func (s *Scheduler) start(now time.Time) {
+	for _, j := range s.jobs {
+		s.plan(j, now)
+
+		last := s.state[j.name].LastScheduled
+		if j.job.CatchUp && !last.IsZero() {
+			if missed := j.schedule.Next(last); !missed.After(now) {
+				s.logger.Info("Catching up missed schedule", "schedule", j.name, "missed", missed.UTC().Format(time.RFC3339))
+				j.next, j.due = missed, now
+			}
+		}
+	}
+}
+
+// Next はジョブの次の実行予定を名前順に返します
+func (s *Scheduler) Next(now time.Time) []ScheduledRun {
+	s.start(now)
+	var runs []ScheduledRun
+	for _, j := range s.jobs {
+		runs = append(runs, ScheduledRun{Name: j.name, Target: j.job.Target, Cron: j.job.Cron, Next: j.next, Due: j.due})
+	}
+	return runs
+}
+
+// ScheduledRun はジョブの次の実行予定です
+type ScheduledRun struct {
+	Name   string
+	Target string
+	Cron   string
+	Next   time.Time
+	Due    time.Time
+}
+
+// WriteScheduledRuns はジョブの次の実行予定を書き出します
+func WriteScheduledRuns(w io.Writer, runs []ScheduledRun) error {
+	for _, r := range runs {
+		if _, err := fmt.Fprintf(w, "%-20s %-20s %-16s next %s\n", r.Name, r.Target, r.Cron, r.Due.Local().Format("2006-01-02 15:04:05 MST")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run は ctx が終わるまでジョブを実行します。終わる前に実行中のジョブを待ちます
+func (s *Scheduler) Run(ctx context.Context) error {
+	s.start(s.opts.Clock.Now())
+	defer s.wg.Wait()
+
+	for {
+		now := s.opts.Clock.Now()
+		due := s.jobs[0].due
+		for _, j := range s.jobs[1:] {
+			if j.due.Before(due) {
+				due = j.due
+			}
+		}
+
+		if due.After(now) {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-s.opts.Clock.After(due.Sub(now)):
+			}
+			now = s.opts.Clock.Now()
+		}
+
+		for _, j := range s.jobs {
+			if !j.due.After(now) {
+				s.fire(ctx, j)
+				s.plan(j, now)
+			}
+		}
+	}
+}
+
+// fire はジョブを実行します。前回の実行が終わっていない場合は飛ばします
+func (s *Scheduler) fire(ctx context.Context, j *scheduledJob) {
+	s.mu.Lock()
+	if j.running {
+		s.mu.Unlock()
+		s.logger.Warn("Skipped schedule because the previous run is still running", "schedule", j.name, "scheduled", j.next.UTC().Format(time.RFC3339))
+		return
+	}
+	j.running = true
+	s.mu.Unlock()
+
+	scheduled := j.next
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		s.logger.Info("Running schedule", "schedule", j.name, "target", j.job.Target)
+		err := s.run(ctx, j.name, j.target)
+		if err != nil {
+			s.logger.Error("Schedule failed", "schedule", j.name, "target", j.job.Target, "error", err)
+		} else {
+			s.logger.Info("Schedule finished", "schedule", j.name, "target", j.job.Target)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		j.running = false
+		state := ScheduleJobState{LastScheduled: scheduled.UTC(), LastFinished: s.opts.Clock.Now().UTC()}
+		if err != nil {
+			state.LastError = err.Error()
+		}
+		s.state[j.name] = state
+		if s.opts.StateFile != "" {
+			if err := saveScheduleState(s.opts.StateFile, s.state); err != nil {
+				s.logger.Error("Failed to save schedule state", "error", err)
+			}
+		}
+	}()
+}
+
+// State はジョブごとの最後の実行結果を返します
+func (s *Scheduler) State() map[string]ScheduleJobState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := map[string]ScheduleJobState{}
+	for name, st := range s.state {
+		state[name] = st
+	}
+	return state
+}
+
+// defaultScheduleStateFile はスケジューラーの状態ファイルのデフォルトのパスを返します
+func defaultScheduleStateFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "mysql-slowquery-downloder", "schedule.json")
+}
+
+// loadScheduleState は状態ファイルを読み込みます。ファイルがない場合は空の状態を返します
+func loadScheduleState(path string) (map[string]ScheduleJobState, error) {
+	state := map[string]ScheduleJobState{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// saveScheduleState は状態ファイルを書き換えます
+func saveScheduleState(path string, state map[string]ScheduleJobState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// scheduleCmd は設定ファイルの schedules のジョブを cron 式に従って実行し続けるコマンドです
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Run the scheduled downloads of the config file in the foreground",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, _ := cmd.Flags().GetBool("debug")
+		logger := NewLogger("info")
+		if debug {
+			logger = NewLogger("debug")
+		}
+
+		stateFile, _ := cmd.Flags().GetString("state-file")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if stateFile == "" {
+			stateFile = defaultScheduleStateFile()
+		}
+
+		config, err := loadConfigFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		run := func(ctx context.Context, name string, target Target) error {
+			return Download(ctx, logger.With("schedule", name), target, nil)
+		}
+		scheduler, err := NewScheduler(logger, config.Schedules, configTargets(config), run, SchedulerOptions{StateFile: stateFile})
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			return WriteScheduledRuns(cmd.OutOrStdout(), scheduler.Next(time.Now()))
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return scheduler.Run(ctx)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(scheduleCmd)
+	scheduleCmd.Flags().BoolP("debug", "d", false, "debug mode")
+	scheduleCmd.Flags().String("state-file", "", "file to keep the last run of each schedule in (default <user cache dir>/mysql-slowquery-downloder/schedule.json)")
+	scheduleCmd.Flags().Bool("dry-run", false, "print the next run of each schedule and exit")
+}
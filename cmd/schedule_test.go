@@ -0,0 +1,293 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock は Advance で時刻を進める偽の時計です
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+	// blocked は After で待ち始めるたびに通知されます
+	blocked chan struct{}
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, blocked: make(chan struct{}, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	c.blocked <- struct{}{}
+	return ch
+}
+
+// Advance は時刻を進め、待ち時間が過ぎた After に通知します
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var waiters []fakeWaiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+// waitBlocked はスケジューラーが次の実行予定を待ち始めるまで待ちます
+func (c *fakeClock) waitBlocked(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduler did not wait for the next run")
+	}
+}
+
+// scheduleCall はテスト用の実行関数が呼ばれた記録です
+type scheduleCall struct {
+	name string
+	at   time.Time
+}
+
+// startTestScheduler はスケジューラーを起動し、止める関数を返します
+func startTestScheduler(t *testing.T, s *Scheduler, clock *fakeClock) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	clock.waitBlocked(t)
+
+	return func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run() returned error: %v", err)
+		}
+	}
+}
+
+var testScheduleTargets = map[string]Target{
+	"payments": {Name: "payments", Provider: "aws", Output: "stdout", Format: "slowlog"},
+}
+
+func TestNewScheduler(t *testing.T) {
+	testCases := []struct {
+		name    string
+		jobs    map[string]ScheduleJob
+		wantErr bool
+	}{
+		{name: "正しいジョブ", jobs: map[string]ScheduleJob{"hourly": {Cron: "5 * * * *", Target: "payments", Format: "jsonl"}}},
+		{name: "記述子", jobs: map[string]ScheduleJob{"daily": {Cron: "@daily", Target: "payments"}}},
+		{name: "ジョブがない", wantErr: true},
+		{name: "不正な cron", jobs: map[string]ScheduleJob{"a": {Cron: "every hour", Target: "payments"}}, wantErr: true},
+		{name: "秒のフィールド", jobs: map[string]ScheduleJob{"a": {Cron: "0 5 * * * *", Target: "payments"}}, wantErr: true},
+		{name: "存在しないターゲット", jobs: map[string]ScheduleJob{"a": {Cron: "@hourly", Target: "unknown"}}, wantErr: true},
+		{name: "不正な形式", jobs: map[string]ScheduleJob{"a": {Cron: "@hourly", Target: "payments", Format: "html"}}, wantErr: true},
+		{name: "負のジッター", jobs: map[string]ScheduleJob{"a": {Cron: "@hourly", Target: "payments", Jitter: -time.Second}}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewScheduler(NewLogger("error"), tc.jobs, testScheduleTargets, nil, SchedulerOptions{})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("NewScheduler() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchedulerRun(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC))
+	calls := make(chan scheduleCall, 10)
+	run := func(ctx context.Context, name string, target Target) error {
+		calls <- scheduleCall{name: name + " " + target.Output + " " + target.Format, at: clock.Now()}
+		if name == "broken" {
+			return errors.New("throttled")
+		}
+		return nil
+	}
+
+	s, err := NewScheduler(NewLogger("error"), map[string]ScheduleJob{
+		"hourly": {Cron: "0 * * * *", Target: "payments", Output: "logs/{{.Instance}}.log", Jitter: 10 * time.Minute},
+		"broken": {Cron: "0 13 * * *", Target: "payments", Format: "jsonl"},
+	}, testScheduleTargets, run, SchedulerOptions{
+		Clock:  clock,
+		Jitter: func(max time.Duration) time.Duration { return max / 2 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := startTestScheduler(t, s, clock)
+
+	// 13:00 に broken を、ジッターの5分後に hourly を実行する
+	for _, step := range []struct {
+		advance time.Duration
+		want    string
+	}{
+		{advance: 30 * time.Minute, want: "broken stdout jsonl at 13:00"},
+		{advance: 5 * time.Minute, want: "hourly logs/{{.Instance}}.log slowlog at 13:05"},
+	} {
+		clock.Advance(step.advance)
+		clock.waitBlocked(t)
+		c := <-calls
+		if got := c.name + " at " + c.at.Format("15:04"); got != step.want {
+			t.Errorf("run = %q, want %q", got, step.want)
+		}
+	}
+	stop()
+
+	// エラーはジョブごとに記録する
+	state := s.State()
+	if state["broken"].LastError != "throttled" || state["hourly"].LastError != "" || !state["hourly"].LastScheduled.Equal(time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("State() = %+v", state)
+	}
+}
+
+func TestSchedulerNoOverlap(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	started := make(chan time.Time, 10)
+	release := make(chan struct{})
+	run := func(ctx context.Context, name string, target Target) error {
+		started <- clock.Now()
+		<-release
+		return nil
+	}
+
+	s, err := NewScheduler(NewLogger("error"), map[string]ScheduleJob{
+		"minutely": {Cron: "* * * * *", Target: "payments"},
+	}, testScheduleTargets, run, SchedulerOptions{Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := startTestScheduler(t, s, clock)
+
+	clock.Advance(time.Minute)
+	clock.waitBlocked(t)
+	<-started
+
+	// 前回の実行が終わっていないので 12:02 と 12:03 は飛ばす
+	for i := 0; i < 2; i++ {
+		clock.Advance(time.Minute)
+		clock.waitBlocked(t)
+	}
+	select {
+	case at := <-started:
+		t.Fatalf("overlapping run started at %s", at.Format("15:04"))
+	default:
+	}
+
+	release <- struct{}{}
+	for s.State()["minutely"].LastFinished.IsZero() {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Minute)
+	clock.waitBlocked(t)
+	if at := <-started; at.Format("15:04") != "12:04" {
+		t.Errorf("next run started at %s, want 12:04", at.Format("15:04"))
+	}
+	close(release)
+	stop()
+}
+
+func TestSchedulerCatchUp(t *testing.T) {
+	testCases := []struct {
+		name    string
+		catchUp bool
+		last    time.Time
+		want    string
+	}{
+		{name: "停止中の予定を起動時に実行", catchUp: true, last: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC), want: "12:30"},
+		{name: "catch_up なし", last: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC), want: "13:00"},
+		{name: "予定を逃していない", catchUp: true, last: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), want: "13:00"},
+		{name: "初回", catchUp: true, want: "13:00"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stateFile := filepath.Join(t.TempDir(), "schedule.json")
+			if !tc.last.IsZero() {
+				if err := saveScheduleState(stateFile, map[string]ScheduleJobState{"hourly": {LastScheduled: tc.last}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			clock := newFakeClock(time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC))
+			started := make(chan time.Time, 10)
+			run := func(ctx context.Context, name string, target Target) error {
+				started <- clock.Now()
+				return nil
+			}
+			s, err := NewScheduler(NewLogger("error"), map[string]ScheduleJob{
+				"hourly": {Cron: "@hourly", Target: "payments", CatchUp: tc.catchUp},
+			}, testScheduleTargets, run, SchedulerOptions{Clock: clock, StateFile: stateFile})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stop := startTestScheduler(t, s, clock)
+			if tc.want != "12:30" {
+				clock.Advance(30 * time.Minute)
+				clock.waitBlocked(t)
+			}
+			at := <-started
+			stop()
+
+			if at.Format("15:04") != tc.want {
+				t.Errorf("first run at %s, want %s", at.Format("15:04"), tc.want)
+			}
+			state, err := loadScheduleState(stateFile)
+			if err != nil || state["hourly"].LastFinished.IsZero() {
+				t.Errorf("state file = %+v, %v", state, err)
+			}
+		})
+	}
+}
+
+func TestWriteScheduledRuns(t *testing.T) {
+	s, err := NewScheduler(NewLogger("error"), map[string]ScheduleJob{
+		"hourly": {Cron: "5 * * * *", Target: "payments"},
+		"daily":  {Cron: "30 2 * * *", Target: "payments"},
+	}, testScheduleTargets, nil, SchedulerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runs := s.Next(time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC))
+	if len(runs) != 2 || runs[0].Name != "daily" || !runs[0].Next.Equal(time.Date(2024, 5, 2, 2, 30, 0, 0, time.UTC)) || !runs[1].Next.Equal(time.Date(2024, 5, 1, 13, 5, 0, 0, time.UTC)) {
+		t.Fatalf("Next() = %+v", runs)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteScheduledRuns(&buf, runs); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "daily ") || !strings.Contains(lines[1], "5 * * * *") {
+		t.Errorf("WriteScheduledRuns() = %s", buf.String())
+	}
+}
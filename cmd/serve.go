@@ -0,0 +1,427 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serve のデフォルト値です
+const (
+	defaultServeInterval        = time.Minute
+	defaultServeMaxFingerprints = 500
+	defaultServeMaxSeries       = 5000
+)
+
+// metricsOtherLabel は上限を超えたラベルの値の代わりに使う値です
+const metricsOtherLabel = "other"
+
+// queryTimeBuckets はクエリ時間のヒストグラムのバケットです。スロークエリに合わせて秒単位で粗く区切ります
+var queryTimeBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// ServeOptions はメトリクスを公開するデーモンの設定です
+type ServeOptions struct {
+	Addr     string
+	Interval time.Duration
+	// Backfill が true の場合は、起動時に既にあるエントリもメトリクスに数えます
+	Backfill bool
+	// MaxFingerprints は fingerprint ラベルの値の数の上限です
+	MaxFingerprints int
+	// MaxSeries は instance, db, user, fingerprint の組み合わせの数の上限です
+	MaxSeries   int
+	Filter      string
+	EntryFilter *EntryFilter
+}
+
+// SlowQueryMetrics はスロークエリのエントリを Prometheus のメトリクスに集計します
+// ラベルの組み合わせが上限を超えた場合は、上限を超えた値を other にまとめます
+type SlowQueryMetrics struct {
+	registry     *prometheus.Registry
+	queries      *prometheus.CounterVec
+	queryTime    *prometheus.HistogramVec
+	rowsExamined *prometheus.CounterVec
+	lockTime     *prometheus.CounterVec
+	fingerprints *prometheus.GaugeVec
+	pollErrors   *prometheus.CounterVec
+	lastPoll     *prometheus.GaugeVec
+	dropped      prometheus.Counter
+
+	mu              sync.Mutex
+	maxFingerprints int
+	maxSeries       int
+	knownIDs        map[string]bool
+	knownSeries     map[[4]string]bool
+}
+
+// NewSlowQueryMetrics はメトリクスを登録したレジストリを生成します
+func NewSlowQueryMetrics(maxFingerprints, maxSeries int) *SlowQueryMetrics {
+	labels := []string{"instance", "db", "user", "fingerprint"}
+	m := &SlowQueryMetrics{
+		registry: prometheus.NewRegistry(),
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mysql_slowquery_queries_total",
+			Help: "Number of slow queries.",
+		}, labels),
+		queryTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mysql_slowquery_query_time_seconds",
+			Help:    "Query_time of slow queries.",
+			Buckets: queryTimeBuckets,
+		}, labels),
+		rowsExamined: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mysql_slowquery_rows_examined_total",
+			Help: "Rows_examined of slow queries.",
+		}, labels),
+		lockTime: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mysql_slowquery_lock_time_seconds_total",
+			Help: "Lock_time of slow queries.",
+		}, labels),
+		fingerprints: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mysql_slowquery_fingerprint_info",
+			Help: "Normalized SQL of each fingerprint label value.",
+		}, []string{"fingerprint", "query"}),
+		pollErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mysql_slowquery_poll_errors_total",
+			Help: "Number of failed polls of slow query logs.",
+		}, []string{"instance"}),
+		lastPoll: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mysql_slowquery_last_poll_success_timestamp_seconds",
+			Help: "Unix time of the last successful poll of slow query logs.",
+		}, []string{"instance"}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mysql_slowquery_cardinality_limited_total",
+			Help: "Number of slow queries counted under the label value other because of the cardinality limits.",
+		}),
+		maxFingerprints: maxFingerprints,
+		maxSeries:       maxSeries,
+		knownIDs:        map[string]bool{},
+		knownSeries:     map[[4]string]bool{},
+	}
+	m.registry.MustRegister(m.queries, m.queryTime, m.rowsExamined, m.lockTime, m.fingerprints, m.pollErrors, m.lastPoll, m.dropped)
+	return m
+}
+
+// labels はエントリのラベルの値を上限に合わせて返します
+func (m *SlowQueryMetrics) labels(r Record) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	limited := false
+	fingerprint := Fingerprint(r.Statement)
+	id := FingerprintID(fingerprint)
+	if !m.knownIDs[id] {
+		if m.maxFingerprints > 0 && len(m.knownIDs) >= m.maxFingerprints {
+			id = metricsOtherLabel
+			limited = true
+		} else {
+			m.knownIDs[id] = true
+			m.fingerprints.WithLabelValues(id, truncate(fingerprint, 200)).Set(1)
+		}
+	}
+
+	series := [4]string{r.Instance, r.DB, r.User, id}
+	if !m.knownSeries[series] {
+		if m.maxSeries > 0 && len(m.knownSeries) >= m.maxSeries {
+			series = [4]string{r.Instance, metricsOtherLabel, metricsOtherLabel, metricsOtherLabel}
+			limited = true
+		} else {
+			m.knownSeries[series] = true
+		}
+	}
+
+	if limited {
+		m.dropped.Inc()
+	}
+	return series[:]
+}
+
+// Observe はエントリをメトリクスに加えます
+func (m *SlowQueryMetrics) Observe(r Record) {
+	labels := m.labels(r)
+	m.queries.WithLabelValues(labels...).Inc()
+	m.queryTime.WithLabelValues(labels...).Observe(r.QueryTime)
+	m.rowsExamined.WithLabelValues(labels...).Add(float64(r.RowsExamined))
+	m.lockTime.WithLabelValues(labels...).Add(r.LockTime)
+}
+
+// Handler は /metrics のハンドラーを返します
+func (m *SlowQueryMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// LogTailer はログファイルを前回読み込んだ位置の続きから読み込めるクライアントです
+// marker は前回返した位置で、空の場合はファイルの先頭から読み込みます
+type LogTailer interface {
+	TailSlowQueryLog(instance string, logFile string, marker string) (data string, next string, err error)
+}
+
+// tailHeadSize は tailLog がファイルの置き換えを判断するために比べる先頭のバイト数です
+const tailHeadSize = 1024
+
+// tailLog はファイルの marker の位置から最後の改行までを読み込み、次に読み込む位置を返します
+// marker は読み込んだバイト数とファイルの先頭のチェックサムです。書き込み途中の最後の行は次に読み込みます
+// ファイルが marker より短い場合や先頭が変わった場合は、ファイルが置き換えられたとみなして先頭から読み込みます
+func tailLog(f io.ReadSeeker, marker string) (string, string, error) {
+	var offset int64
+	var sum uint32
+	if marker != "" {
+		if n, err := fmt.Sscanf(marker, "%d:%x", &offset, &sum); err != nil || n != 2 || offset < 0 {
+			return "", "", fmt.Errorf("invalid marker: %q", marker)
+		}
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", "", err
+	}
+	if offset > size {
+		offset = 0
+	}
+	if offset > 0 {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", "", err
+		}
+		head := make([]byte, min(offset, tailHeadSize))
+		if _, err := io.ReadFull(f, head); err != nil {
+			return "", "", err
+		}
+		if crc32.ChecksumIEEE(head) != sum {
+			offset = 0
+		}
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	data, err := io.ReadAll(io.LimitReader(f, size-offset))
+	if err != nil {
+		return "", "", err
+	}
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	next := offset + int64(len(data))
+
+	// 先頭のチェックサムは読み込んだ範囲から計算する
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	head := make([]byte, min(next, tailHeadSize))
+	if _, err := io.ReadFull(f, head); err != nil {
+		return "", "", err
+	}
+	return string(data), fmt.Sprintf("%d:%08x", next, crc32.ChecksumIEEE(head)), nil
+}
+
+// logCursor はインスタンスごとにどこまでのエントリを数えたかを記録します
+// クライアントが LogTailer を実装している場合は、ログファイルごとに読み込んだ位置を記録して続きだけを読み込みます
+// ログファイルはローテーションで名前や中身が変わるため、数えたかどうかは # Time: の時刻で判断します
+type logCursor struct {
+	last time.Time
+	// seen は last と同じ時刻のエントリです。同じ時刻のエントリを次のポーリングで数え直さないように使います
+	seen map[string]bool
+	// untimed はログファイルごとの、時刻のないエントリの内容ごとの数です
+	// ログファイル全体を読み込み直す場合に、前回までに数えた数だけ読み飛ばすために使います
+	untimed map[string]map[string]int
+	// markers はログファイルごとの次に読み込む位置です
+	markers map[string]string
+}
+
+// entryTime はエントリがログに書かれた時刻を返します
+func entryTime(r Record) time.Time {
+	if !r.Time.IsZero() {
+		return r.Time
+	}
+	return r.StartTime()
+}
+
+// entryKey は同じ時刻のエントリを区別するためのキーを返します
+// ローテーションで別のファイルに移ったエントリも同じキーになるように、ファイル名は含めません
+func entryKey(r Record) string {
+	return FingerprintID(r.Entry.String())
+}
+
+// Poller はインスタンスのスロークエリログを定期的に読み込み、前回より新しいエントリをメトリクスに加えます
+type Poller struct {
+	logger    *slog.Logger
+	client    AWSClientInterface
+	instances []string
+	metrics   *SlowQueryMetrics
+	opts      ServeOptions
+	cursors   map[string]*logCursor
+}
+
+// NewPoller は Poller を生成します
+func NewPoller(logger *slog.Logger, client AWSClientInterface, instances []string, metrics *SlowQueryMetrics, opts ServeOptions) *Poller {
+	return &Poller{
+		logger:    logger,
+		client:    client,
+		instances: instances,
+		metrics:   metrics,
+		opts:      opts,
+		cursors:   map[string]*logCursor{},
+	}
+}
+
+// Poll は全てのインスタンスのログを1回読み込みます
+// 一部のインスタンスに失敗しても残りのインスタンスは読み込み、失敗をまとめて返します
+func (p *Poller) Poll() error {
+	var errs []error
+	for _, instance := range p.instances {
+		n, err := p.pollInstance(instance)
+		if err != nil {
+			p.metrics.pollErrors.WithLabelValues(instance).Inc()
+			errs = append(errs, fmt.Errorf("%s: %w", instance, err))
+			continue
+		}
+		p.metrics.lastPoll.WithLabelValues(instance).SetToCurrentTime()
+		p.logger.Debug("Polled slow query logs", "instance", instance, "entries", n)
+	}
+	p.opts.EntryFilter.WarnErrors(p.logger)
+	return errors.Join(errs...)
+}
+
+// readLog は前回の位置より後に追加されたログと、次に読み込む位置を返します
+// クライアントが LogTailer を実装していない場合は、ログファイル全体を返します
+func (p *Poller) readLog(instance, logFile, marker string) (string, string, error) {
+	if tailer, ok := p.client.(LogTailer); ok {
+		return tailer.TailSlowQueryLog(instance, logFile, marker)
+	}
+
+	data, err := p.client.DownloadSlowQueryLog(instance, logFile)
+	if err != nil || data == nil {
+		return "", "", err
+	}
+	return *data, "", nil
+}
+
+// pollInstance はインスタンスのログを読み込み、メトリクスに加えたエントリの数を返します
+// 最初のポーリングでは Backfill でない限り、既にあるエントリは数えずに位置だけを記録します
+// 途中で失敗した場合は何も数えず、次のポーリングで前回の位置から読み直します
+func (p *Poller) pollInstance(instance string) (int, error) {
+	logList, err := GetSlowQueryList(p.client, instance)
+	if err != nil {
+		return 0, err
+	}
+
+	cursor, ok := p.cursors[instance]
+	observe := ok || p.opts.Backfill
+	if !ok {
+		cursor = &logCursor{}
+	}
+	next := logCursor{
+		last:    cursor.last,
+		seen:    maps.Clone(cursor.seen),
+		untimed: map[string]map[string]int{},
+		markers: map[string]string{},
+	}
+	if next.seen == nil {
+		next.seen = map[string]bool{}
+	}
+	_, tailing := p.client.(LogTailer)
+
+	var records []Record
+	for _, log := range logList {
+		if p.opts.Filter != "" && !strings.Contains(log, p.opts.Filter) {
+			continue
+		}
+
+		data, marker, err := p.readLog(instance, log, cursor.markers[log])
+		if err != nil {
+			return 0, err
+		}
+		// 一覧になくなったログファイルの位置と時刻のないエントリの数は次のポーリングに引き継がない
+		next.markers[log] = marker
+		untimed := map[string]int{}
+		if !tailing {
+			next.untimed[log] = untimed
+		}
+
+		err = scanRecords(strings.NewReader(data), Record{Instance: instance, Source: log}, func(r Record) error {
+			key := entryKey(r)
+			t := entryTime(r)
+			switch {
+			case t.IsZero() && tailing:
+				// 続きだけを読み込んでいるので、時刻のないエントリもそのまま数える
+			case t.IsZero():
+				// ファイル全体を読み込み直しているので、前回までに数えた同じ内容のエントリの数だけ読み飛ばす
+				untimed[key]++
+				if untimed[key] <= cursor.untimed[log][key] {
+					return nil
+				}
+			case t.Before(cursor.last):
+				return nil
+			case (t.Equal(cursor.last) && cursor.seen[key]) || (t.Equal(next.last) && next.seen[key]):
+				return nil
+			case t.After(next.last):
+				next.last = t
+				next.seen = map[string]bool{key: true}
+			case t.Equal(next.last):
+				next.seen[key] = true
+			}
+
+			if observe && p.opts.EntryFilter.Match(r.Entry) {
+				records = append(records, r)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, r := range records {
+		p.metrics.Observe(r)
+	}
+	p.cursors[instance] = &next
+	return len(records), nil
+}
+
+// Serve は /metrics を公開しながら、Interval ごとにログを読み込みます。ctx が終わるまで戻りません
+func Serve(ctx context.Context, logger *slog.Logger, client AWSClientInterface, instances []string, opts ServeOptions) error {
+	if opts.Interval <= 0 {
+		return fmt.Errorf("interval must be positive: %s", opts.Interval)
+	}
+
+	metrics := NewSlowQueryMetrics(opts.MaxFingerprints, opts.MaxSeries)
+	poller := NewPoller(logger, client, instances, metrics, opts)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{Addr: opts.Addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	errCh := make(chan error, 1)
+	go func() {
+		logger.Info("Serving metrics", "addr", opts.Addr, "instances", len(instances), "interval", opts.Interval.String())
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		if err := poller.Poll(); err != nil {
+			logger.Error("Failed to poll slow query logs", "error", err)
+		}
+
+		select {
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+			shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return server.Shutdown(shutdown)
+		case <-ticker.C:
+		}
+	}
+}
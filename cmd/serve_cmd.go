@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// serveCmd はスロークエリログを定期的に読み込み、Prometheus のメトリクスとして公開するコマンドです
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Export slow query metrics for Prometheus",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, _ := cmd.Flags().GetBool("debug")
+		logger := NewLogger("info")
+		if debug {
+			logger = NewLogger("debug")
+		}
+
+		addr, _ := cmd.Flags().GetString("metrics-addr")
+		interval, _ := cmd.Flags().GetDuration("interval")
+		backfill, _ := cmd.Flags().GetBool("backfill")
+		maxFingerprints, _ := cmd.Flags().GetInt("max-fingerprints")
+		maxSeries, _ := cmd.Flags().GetInt("max-series")
+
+		target, err := resolveTarget(cmd)
+		if err != nil {
+			return err
+		}
+
+		filter, err := NewEntryFilter(target.Entries)
+		if err != nil {
+			return err
+		}
+
+		client, err := NewClient(logger, target)
+		if err != nil {
+			return err
+		}
+		defer closeClient(client)
+
+		instances, err := selectInstances(client, target.Instances)
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		return Serve(ctx, logger, client, instances, ServeOptions{
+			Addr:            addr,
+			Interval:        interval,
+			Backfill:        backfill,
+			MaxFingerprints: maxFingerprints,
+			MaxSeries:       maxSeries,
+			Filter:          target.Filter,
+			EntryFilter:     filter,
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	addTargetFlags(serveCmd.Flags())
+	serveCmd.Flags().String("metrics-addr", ":9146", "address to serve /metrics on")
+	serveCmd.Flags().Duration("interval", defaultServeInterval, "interval between polls of the slow query logs")
+	serveCmd.Flags().Bool("backfill", false, "also count the entries already in the logs at startup")
+	serveCmd.Flags().Int("max-fingerprints", defaultServeMaxFingerprints, "fingerprint label values to keep before counting new ones as other (0 for no limit)")
+	serveCmd.Flags().Int("max-series", defaultServeMaxSeries, "label combinations to keep before counting new ones as other (0 for no limit)")
+}
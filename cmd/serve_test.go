@@ -0,0 +1,320 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// rotatingClientMock はログファイルの中身を書き換えられるクライアントのモック実装
+type rotatingClientMock struct {
+	files map[string]string
+	err   error
+}
+
+func (m *rotatingClientMock) GetInstanceList() []string {
+	return []string{"db-1"}
+}
+
+func (m *rotatingClientMock) GetSlowQueryList(instance string) ([]string, error) {
+	var logs []string
+	for name := range m.files {
+		logs = append(logs, name)
+	}
+	sort.Strings(logs)
+	return logs, nil
+}
+
+func (m *rotatingClientMock) DownloadSlowQueryLog(instance string, logFile string) (*string, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	data := m.files[logFile]
+	return &data, nil
+}
+
+// slowLogEntry はテスト用のスロークエリログのエントリを返します
+func slowLogEntry(second int, sql string, queryTime float64) string {
+	return fmt.Sprintf("# Time: 2023-05-10T12:00:%02d.000000Z\n# User@Host: app[app] @  [10.0.1.10]  Id: 1\n# Query_time: %f  Lock_time: 0.100000 Rows_sent: 1  Rows_examined: 100\nuse production;\n%s;\n", second, queryTime, sql)
+}
+
+// scrapeMetrics は /metrics の出力を返します
+func scrapeMetrics(t *testing.T, m *SlowQueryMetrics) string {
+	t.Helper()
+	srv := httptest.NewServer(m.Handler())
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+// queriesTotal は mysql_slowquery_queries_total の合計を返します
+func queriesTotal(t *testing.T, m *SlowQueryMetrics) int {
+	t.Helper()
+	total := 0
+	for _, line := range strings.Split(scrapeMetrics(t, m), "\n") {
+		if !strings.HasPrefix(line, "mysql_slowquery_queries_total{") {
+			continue
+		}
+		var n int
+		fmt.Sscanf(line[strings.LastIndex(line, " ")+1:], "%d", &n)
+		total += n
+	}
+	return total
+}
+
+func TestSlowQueryMetrics(t *testing.T) {
+	m := NewSlowQueryMetrics(0, 0)
+	m.Observe(newTestRecord("db-1", "SELECT * FROM users WHERE id = 1", 1.5, 1, 100, 1683721815))
+	m.Observe(newTestRecord("db-1", "SELECT * FROM users WHERE id = 2", 3.5, 1, 300, 1683721900))
+
+	id := FingerprintID(Fingerprint("SELECT * FROM users WHERE id = 1"))
+	labels := `{db="production",fingerprint="` + id + `",instance="db-1",user="app"}`
+	out := scrapeMetrics(t, m)
+	for _, want := range []string{
+		"mysql_slowquery_queries_total" + labels + " 2",
+		"mysql_slowquery_query_time_seconds_sum" + labels + " 5",
+		`mysql_slowquery_query_time_seconds_bucket{db="production",fingerprint="` + id + `",instance="db-1",user="app",le="2.5"} 1`,
+		"mysql_slowquery_rows_examined_total" + labels + " 400",
+		"mysql_slowquery_lock_time_seconds_total" + labels + " 0.5",
+		`mysql_slowquery_fingerprint_info{fingerprint="` + id + `",query="select * from users where id = ?"} 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestSlowQueryMetricsLimits(t *testing.T) {
+	testCases := []struct {
+		name            string
+		maxFingerprints int
+		maxSeries       int
+		want            []string
+	}{
+		{
+			name:            "フィンガープリントの上限",
+			maxFingerprints: 1,
+			want: []string{
+				`mysql_slowquery_queries_total{db="production",fingerprint="other",instance="db-1",user="app"} 2`,
+				"mysql_slowquery_cardinality_limited_total 2",
+			},
+		},
+		{
+			name:      "組み合わせの上限",
+			maxSeries: 2,
+			want: []string{
+				`mysql_slowquery_queries_total{db="other",fingerprint="other",instance="db-1",user="other"} 1`,
+				"mysql_slowquery_cardinality_limited_total 1",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewSlowQueryMetrics(tc.maxFingerprints, tc.maxSeries)
+			m.Observe(newTestRecord("db-1", "SELECT 1", 1.0, 1, 1, 1683721815))
+			m.Observe(newTestRecord("db-1", "SELECT * FROM users", 1.0, 1, 1, 1683721815))
+			m.Observe(newTestRecord("db-1", "DELETE FROM logs", 1.0, 1, 1, 1683721815))
+			m.Observe(newTestRecord("db-1", "SELECT 2", 1.0, 1, 1, 1683721815))
+
+			out := scrapeMetrics(t, m)
+			for _, want := range tc.want {
+				if !strings.Contains(out, want+"\n") {
+					t.Errorf("metrics do not contain %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestPollerPoll(t *testing.T) {
+	client := &rotatingClientMock{files: map[string]string{
+		"slowquery/mysql-slowquery.log": slowLogEntry(0, "SELECT 1", 1) + slowLogEntry(1, "SELECT 2", 1),
+	}}
+	metrics := NewSlowQueryMetrics(0, 0)
+	poller := NewPoller(NewLogger("error"), client, []string{"db-1"}, metrics, ServeOptions{})
+
+	poll := func(want int) {
+		t.Helper()
+		if err := poller.Poll(); err != nil {
+			t.Fatalf("Poll() returned error: %v", err)
+		}
+		if got := queriesTotal(t, metrics); got != want {
+			t.Errorf("queries = %d, want %d", got, want)
+		}
+	}
+
+	// 起動時に既にあるエントリは数えない
+	poll(0)
+
+	// 追記されたエントリだけを数える。同じ時刻のエントリも区別する
+	client.files["slowquery/mysql-slowquery.log"] += slowLogEntry(1, "SELECT 3", 1) + slowLogEntry(2, "SELECT 4", 1)
+	poll(2)
+	poll(2)
+
+	// ローテーションで別の名前になったエントリは数え直さない
+	client.files["slowquery/mysql-slowquery.log.2023-05-10.12"] = client.files["slowquery/mysql-slowquery.log"] + slowLogEntry(3, "SELECT 5", 1)
+	client.files["slowquery/mysql-slowquery.log"] = slowLogEntry(4, "SELECT 6", 1)
+	poll(4)
+
+	// 失敗したポーリングでは数えず、次のポーリングで数える
+	client.files["slowquery/mysql-slowquery.log"] += slowLogEntry(5, "SELECT 7", 1)
+	client.err = errors.New("throttled")
+	if err := poller.Poll(); err == nil {
+		t.Error("Poll() should return error")
+	}
+	client.err = nil
+	poll(5)
+
+	if out := scrapeMetrics(t, metrics); !strings.Contains(out, `mysql_slowquery_poll_errors_total{instance="db-1"} 1`) {
+		t.Errorf("metrics do not contain the poll error:\n%s", out)
+	}
+
+	// 時刻のないエントリは前回の時刻より前とはみなさず、追記された数だけ数える
+	const untimed = "# Query_time: 1.000000  Lock_time: 0.000000 Rows_sent: 1  Rows_examined: 1\nSELECT 8;\n"
+	client.files["slowquery/mysql-slowquery.log"] += untimed
+	poll(6)
+	poll(6)
+	client.files["slowquery/mysql-slowquery.log"] += untimed
+	poll(7)
+
+	// 一覧になくなったログファイルの時刻のないエントリの数は残さない
+	delete(client.files, "slowquery/mysql-slowquery.log")
+	poll(7)
+	if n := len(poller.cursors["db-1"].untimed); n != 1 {
+		t.Errorf("untimed entries are kept for %d files, want 1", n)
+	}
+}
+
+func TestPollerBackfill(t *testing.T) {
+	client := &rotatingClientMock{files: map[string]string{
+		"slow.log": slowLogEntry(0, "SELECT 1", 1) + slowLogEntry(1, "SELECT * FROM users", 6),
+	}}
+	filter, err := NewEntryFilter(FilterOptions{MinQueryTime: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := NewSlowQueryMetrics(0, 0)
+	poller := NewPoller(NewLogger("error"), client, []string{"db-1"}, metrics, ServeOptions{Backfill: true, EntryFilter: filter})
+
+	if err := poller.Poll(); err != nil {
+		t.Fatalf("Poll() returned error: %v", err)
+	}
+	if got := queriesTotal(t, metrics); got != 1 {
+		t.Errorf("queries = %d, want 1", got)
+	}
+}
+
+func TestTailLog(t *testing.T) {
+	const data = "line 1\nline 2\nline 3"
+	mark := func(n int) string {
+		return fmt.Sprintf("%d:%08x", n, crc32.ChecksumIEEE([]byte(data[:n])))
+	}
+
+	testCases := []struct {
+		name       string
+		marker     string
+		wantData   string
+		wantMarker string
+		wantErr    bool
+	}{
+		{name: "先頭から読み込む", marker: "", wantData: "line 1\nline 2\n", wantMarker: mark(14)},
+		{name: "続きから読み込む", marker: mark(7), wantData: "line 2\n", wantMarker: mark(14)},
+		{name: "書き込み途中の行は読み込まない", marker: mark(14), wantData: "", wantMarker: mark(14)},
+		{name: "ファイルより長い位置は先頭から読み込む", marker: "100:00000000", wantData: "line 1\nline 2\n", wantMarker: mark(14)},
+		{name: "先頭が変わったファイルは先頭から読み込む", marker: "7:00000000", wantData: "line 1\nline 2\n", wantMarker: mark(14)},
+		{name: "形式が違う位置", marker: "7", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, marker, err := tailLog(strings.NewReader(data), tc.marker)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("tailLog() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.wantData || marker != tc.wantMarker {
+				t.Errorf("tailLog() = %q, %q, want %q, %q", got, marker, tc.wantData, tc.wantMarker)
+			}
+		})
+	}
+}
+
+func TestPollerTail(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "slowquery.db-1.log")
+	writeLog := func(path, data string, flag int) {
+		t.Helper()
+		f, err := os.OpenFile(path, flag|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeLog(path, slowLogEntry(0, "SELECT 1", 1), os.O_TRUNC)
+
+	newClient := func() LocalClient {
+		t.Helper()
+		client, err := NewLocalClient(NewLogger("error"), filepath.Join(dir, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	metrics := NewSlowQueryMetrics(0, 0)
+	poller := NewPoller(NewLogger("error"), newClient(), []string{"db-1"}, metrics, ServeOptions{})
+
+	poll := func(want int) {
+		t.Helper()
+		if err := poller.Poll(); err != nil {
+			t.Fatalf("Poll() returned error: %v", err)
+		}
+		if got := queriesTotal(t, metrics); got != want {
+			t.Errorf("queries = %d, want %d", got, want)
+		}
+		// 次のポーリングではファイルの終わりから読み込む
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if marker := poller.cursors["db-1"].markers[path]; !strings.HasPrefix(marker, fmt.Sprintf("%d:", info.Size())) {
+			t.Errorf("marker = %q, want offset %d", marker, info.Size())
+		}
+	}
+
+	poll(0)
+	writeLog(path, slowLogEntry(1, "SELECT 2", 1), os.O_APPEND)
+	poll(1)
+
+	// ローテーションで置き換えられたファイルは先頭から読み込み、数えたエントリは数え直さない
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	writeLog(path, slowLogEntry(2, "SELECT 3", 1)+slowLogEntry(3, "SELECT 4", 1), os.O_TRUNC)
+	poller.client = newClient()
+	poll(3)
+
+	// 続きだけを読み込むので、同じ内容の時刻のないエントリも追記された数だけ数える
+	const untimed = "# Query_time: 1.000000  Lock_time: 0.000000 Rows_sent: 1  Rows_examined: 1\nSELECT 5;\n"
+	writeLog(path, untimed+untimed, os.O_APPEND)
+	poll(5)
+	writeLog(path, untimed, os.O_APPEND)
+	poll(6)
+	poll(6)
+}
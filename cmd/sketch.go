@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// sketchAccuracy はSketchが返すパーセンタイルの相対誤差の上限です
+	sketchAccuracy = 0.01
+	// sketchMinValue 以下の値は0として数えます
+	sketchMinValue = 1e-6
+)
+
+// Sketch は値を対数スケールのビンに数えて、少ないメモリでパーセンタイルを求めます (DDSketch)
+// 個々の値を保持しないため、複数のファイルやインスタンスの結果をMergeでまとめられます
+type Sketch struct {
+	logGamma float64
+	bins     map[int]int64
+	zeros    int64
+	count    int64
+	min      float64
+	max      float64
+	buckets  [len(histogramBounds)]int64
+}
+
+// HistogramBucket はヒストグラムの1区間です。From はその区間の下限 (秒) です
+type HistogramBucket struct {
+	Label string  `json:"label"`
+	From  float64 `json:"from"`
+	Count int64   `json:"count"`
+}
+
+// histogramBounds はpt-query-digestと同じ10倍刻みのヒストグラムの区間の下限です
+var histogramBounds = [...]struct {
+	label string
+	from  float64
+}{
+	{"1us", 0},
+	{"10us", 1e-5},
+	{"100us", 1e-4},
+	{"1ms", 1e-3},
+	{"10ms", 1e-2},
+	{"100ms", 1e-1},
+	{"1s", 1},
+	{"10s+", 10},
+}
+
+// NewSketch は空のSketchを生成します
+func NewSketch() *Sketch {
+	gamma := (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	return &Sketch{
+		logGamma: math.Log(gamma),
+		bins:     map[int]int64{},
+	}
+}
+
+// Add は値を加えます
+func (s *Sketch) Add(v float64) {
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count++
+	s.buckets[histogramBucket(v)]++
+
+	if v <= sketchMinValue {
+		s.zeros++
+		return
+	}
+	s.bins[s.index(v)]++
+}
+
+// Merge は別のSketchの値をまとめます
+func (s *Sketch) Merge(o *Sketch) {
+	if o == nil || o.count == 0 {
+		return
+	}
+	if s.count == 0 || o.min < s.min {
+		s.min = o.min
+	}
+	if s.count == 0 || o.max > s.max {
+		s.max = o.max
+	}
+	s.count += o.count
+	s.zeros += o.zeros
+	for i, n := range o.buckets {
+		s.buckets[i] += n
+	}
+	for i, n := range o.bins {
+		s.bins[i] += n
+	}
+}
+
+// Count は加えた値の数を返します
+func (s *Sketch) Count() int64 {
+	return s.count
+}
+
+// Quantile は q (0から1) に対応する値を返します
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.min
+	}
+	if q >= 1 {
+		return s.max
+	}
+
+	rank := int64(q * float64(s.count-1))
+	if rank < s.zeros {
+		return s.clamp(0)
+	}
+
+	seen := s.zeros
+	for _, i := range s.sortedIndexes() {
+		seen += s.bins[i]
+		if seen > rank {
+			return s.clamp(s.value(i))
+		}
+	}
+	return s.max
+}
+
+// Histogram はpt-query-digestと同じ10倍刻みの区間ごとの件数を返します
+func (s *Sketch) Histogram() []HistogramBucket {
+	buckets := make([]HistogramBucket, len(histogramBounds))
+	for i, b := range histogramBounds {
+		buckets[i] = HistogramBucket{Label: b.label, From: b.from, Count: s.buckets[i]}
+	}
+	return buckets
+}
+
+// histogramBucket は値が含まれるヒストグラムの区間の位置を返します
+func histogramBucket(v float64) int {
+	for i := len(histogramBounds) - 1; i > 0; i-- {
+		if v >= histogramBounds[i].from {
+			return i
+		}
+	}
+	return 0
+}
+
+func (s *Sketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value はビンに含まれる値の代表値を返します。ビン内のどの値に対しても相対誤差は sketchAccuracy 以下です
+func (s *Sketch) value(i int) float64 {
+	gamma := math.Exp(s.logGamma)
+	return 2 * math.Pow(gamma, float64(i)) / (gamma + 1)
+}
+
+func (s *Sketch) clamp(v float64) float64 {
+	return math.Min(math.Max(v, s.min), s.max)
+}
+
+func (s *Sketch) sortedIndexes() []int {
+	indexes := make([]int, 0, len(s.bins))
+	for i := range s.bins {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSketchQuantile(t *testing.T) {
+	s := NewSketch()
+	for i := 1; i <= 1000; i++ {
+		s.Add(float64(i) / 100)
+	}
+
+	testCases := []struct {
+		q        float64
+		expected float64
+	}{
+		{q: 0, expected: 0.01},
+		{q: 0.5, expected: 5.0},
+		{q: 0.95, expected: 9.5},
+		{q: 0.99, expected: 9.9},
+		{q: 1, expected: 10},
+	}
+
+	for _, tc := range testCases {
+		got := s.Quantile(tc.q)
+		if math.Abs(got-tc.expected)/tc.expected > 0.02 {
+			t.Errorf("Quantile(%v) = %v, want %v within 2%%", tc.q, got, tc.expected)
+		}
+	}
+
+	if s.Count() != 1000 {
+		t.Errorf("Count() = %d, want 1000", s.Count())
+	}
+	if NewSketch().Quantile(0.5) != 0 {
+		t.Error("Quantile() of empty sketch should be 0")
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	all := NewSketch()
+	a := NewSketch()
+	b := NewSketch()
+
+	for i := 0; i < 500; i++ {
+		v := float64(i%97) * 0.013
+		all.Add(v)
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+	}
+
+	a.Merge(b)
+	a.Merge(nil)
+
+	for _, q := range []float64{0, 0.5, 0.95, 0.99, 1} {
+		if a.Quantile(q) != all.Quantile(q) {
+			t.Errorf("merged Quantile(%v) = %v, want %v", q, a.Quantile(q), all.Quantile(q))
+		}
+	}
+	if a.Count() != all.Count() {
+		t.Errorf("merged Count() = %d, want %d", a.Count(), all.Count())
+	}
+}
+
+func TestSketchHistogram(t *testing.T) {
+	s := NewSketch()
+	for _, v := range []float64{0, 0.000005, 0.0005, 0.05, 1, 1, 9.99, 10, 120} {
+		s.Add(v)
+	}
+
+	expected := map[string]int64{
+		"1us":   2,
+		"10us":  0,
+		"100us": 1,
+		"1ms":   0,
+		"10ms":  1,
+		"100ms": 0,
+		"1s":    3,
+		"10s+":  2,
+	}
+
+	buckets := s.Histogram()
+	if len(buckets) != len(expected) {
+		t.Fatalf("Histogram() returned %d buckets, want %d", len(buckets), len(expected))
+	}
+	for _, b := range buckets {
+		if b.Count != expected[b.Label] {
+			t.Errorf("Histogram()[%s] = %d, want %d", b.Label, b.Count, expected[b.Label])
+		}
+	}
+}
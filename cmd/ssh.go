@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultSSHLogPath はSSHプロバイダーで読み込むスロークエリログのデフォルトのパスです
+// logrotate で圧縮された .gz のファイルは展開して読み込みます
+const defaultSSHLogPath = "/var/log/mysql/mysql-slow.log*"
+
+// SSHConfig はSSHプロバイダーの設定です
+type SSHConfig struct {
+	User       string   `yaml:"user"`
+	Key        string   `yaml:"key"`
+	KnownHosts string   `yaml:"known_hosts"`
+	LogPath    string   `yaml:"log_path"`
+	Hosts      []string `yaml:"hosts"`
+}
+
+// SSHClient はSSH/SFTP経由でセルフマネージドなMySQLのスロークエリログを取得するクライアントです
+type SSHClient struct {
+	logger    *slog.Logger
+	sshConfig *ssh.ClientConfig
+	hosts     []string
+	logPath   string
+	agent     net.Conn
+}
+
+// NewSSHClient はエージェント認証または鍵認証を使うSSHクライアントを生成します
+func NewSSHClient(logger *slog.Logger, config SSHConfig) (SSHClient, error) {
+	if len(config.Hosts) == 0 {
+		return SSHClient{}, fmt.Errorf("SSH hosts are required")
+	}
+
+	user := config.User
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	var auth []ssh.AuthMethod
+	var agentConn net.Conn
+	if config.Key != "" {
+		key, err := os.ReadFile(expandHome(config.Key))
+		if err != nil {
+			return SSHClient{}, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return SSHClient{}, fmt.Errorf("failed to parse SSH key %s: %w", config.Key, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("Couldn't connect to SSH agent: %v", err))
+		} else {
+			agentConn = conn
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if len(auth) == 0 {
+		return SSHClient{}, fmt.Errorf("no SSH authentication method available: set SSH_AUTH_SOCK or the SSH key")
+	}
+
+	knownHostsPath := config.KnownHosts
+	if knownHostsPath == "" {
+		knownHostsPath = "~/.ssh/known_hosts"
+	}
+	hostKeyCallback, err := knownhosts.New(expandHome(knownHostsPath))
+	if err != nil {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+		return SSHClient{}, fmt.Errorf("failed to load known hosts %s: %w", knownHostsPath, err)
+	}
+
+	logPath := config.LogPath
+	if logPath == "" {
+		logPath = defaultSSHLogPath
+	}
+
+	return SSHClient{
+		logger: logger,
+		sshConfig: &ssh.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+		hosts:   config.Hosts,
+		logPath: logPath,
+		agent:   agentConn,
+	}, nil
+}
+
+// Close はSSHエージェントへの接続を閉じます
+func (s SSHClient) Close() error {
+	if s.agent == nil {
+		return nil
+	}
+	return s.agent.Close()
+}
+
+// expandHome は先頭の ~ をホームディレクトリに展開します
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// sshAddress はポートが省略されたホストに22番ポートを補います
+func sshAddress(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, "22")
+}
+
+// dialSFTP はホストに接続してSFTPセッションを開始します
+func (s SSHClient) dialSFTP(host string) (*ssh.Client, *sftp.Client, error) {
+	conn, err := ssh.Dial("tcp", sshAddress(host), s.sshConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to %s: %w", host, err)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to start SFTP session on %s: %w", host, err)
+	}
+	return conn, client, nil
+}
+
+// withSFTP はホストに接続してSFTPセッションで処理を実行します
+func (s SSHClient) withSFTP(host string, fn func(*sftp.Client) error) error {
+	conn, client, err := s.dialSFTP(host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	return fn(client)
+}
+
+func (s SSHClient) GetInstanceList() []string {
+	return s.hosts
+}
+
+func (s SSHClient) GetSlowQueryList(instance string) ([]string, error) {
+	var slowQueryList []string
+
+	err := s.withSFTP(instance, func(client *sftp.Client) error {
+		matches, err := client.Glob(s.logPath)
+		if err != nil {
+			return err
+		}
+
+		for _, match := range matches {
+			info, err := client.Stat(match)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			slowQueryList = append(slowQueryList, match)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(slowQueryList)
+	return slowQueryList, nil
+}
+
+func (s SSHClient) DownloadSlowQueryLog(instance string, logFile string) (*string, error) {
+	r, err := s.OpenSlowQueryLog(instance, logFile)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var b strings.Builder
+	if _, err := io.Copy(&b, r); err != nil {
+		return nil, err
+	}
+
+	str := b.String()
+	return &str, nil
+}
+
+// TailSlowQueryLog はホストのログファイルの marker のバイト位置以降を返します
+func (s SSHClient) TailSlowQueryLog(instance string, logFile string, marker string) (string, string, error) {
+	var data, next string
+
+	err := s.withSFTP(instance, func(client *sftp.Client) error {
+		file, err := client.Open(logFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		// 圧縮されたファイルは展開したログの位置で読み込む
+		var r io.ReadSeeker = file
+		if isGzipLog(logFile) {
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				return fmt.Errorf("failed to decompress %s: %w", logFile, err)
+			}
+			defer gz.Close()
+			b, err := io.ReadAll(gz)
+			if err != nil {
+				return fmt.Errorf("failed to decompress %s: %w", logFile, err)
+			}
+			r = bytes.NewReader(b)
+		}
+
+		data, next, err = tailLog(r, marker)
+		return err
+	})
+	return data, next, err
+}
+
+// OpenSlowQueryLog はホストのログファイルを読み込み用に開きます。.gz のファイルは展開しながら読み込みます
+// 返した io.ReadCloser を閉じるとSSHの接続も閉じます
+func (s SSHClient) OpenSlowQueryLog(instance string, logFile string) (io.ReadCloser, error) {
+	conn, client, err := s.dialSFTP(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := client.Open(logFile)
+	if err != nil {
+		client.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	f := &sftpFile{Reader: file, file: file, client: client, conn: conn}
+	if isGzipLog(logFile) {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to decompress %s: %w", logFile, err)
+		}
+		f.Reader, f.gzip = gz, gz
+	}
+	return f, nil
+}
+
+// isGzipLog はログファイルが logrotate で圧縮されたファイルかどうかを返します
+func isGzipLog(logFile string) bool {
+	return strings.HasSuffix(logFile, ".gz")
+}
+
+// sftpFile は閉じるときに展開用のリーダー、SFTPセッションとSSHの接続も閉じるファイルです
+type sftpFile struct {
+	io.Reader
+	file   *sftp.File
+	gzip   *gzip.Reader
+	client *sftp.Client
+	conn   *ssh.Client
+}
+
+func (f *sftpFile) Close() error {
+	var errs []error
+	if f.gzip != nil {
+		errs = append(errs, f.gzip.Close())
+	}
+	errs = append(errs, f.file.Close(), f.client.Close())
+	f.conn.Close()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,267 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startTestSSHServer はSFTPサブシステムを持つSSHサーバーをテスト用に起動します
+// 戻り値はサーバーのアドレス、known_hostsのパス、クライアントの秘密鍵のパスです
+func startTestSSHServer(t *testing.T) (string, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(conn, config)
+		}
+	}()
+
+	addr := listener.Addr().String()
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostSigner.PublicKey())
+	if err := os.WriteFile(knownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return addr, knownHostsPath, keyPath
+}
+
+func serveTestSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					channel.Close()
+					return
+				}
+				server.Serve()
+				channel.Close()
+				return
+			}
+		}()
+	}
+}
+
+func TestSSHClient(t *testing.T) {
+	addr, knownHostsPath, keyPath := startTestSSHServer(t)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	logDir := t.TempDir()
+	files := map[string]string{
+		"mysql-slow.log":      "# Time: 2023-05-10T12:30:15.000000Z\nSELECT 1;\n",
+		"mysql-slow.log.1":    "# Time: 2023-05-09T12:30:15.000000Z\nSELECT 2;\n",
+		"mysql-slow.log.2.gz": "# Time: 2023-05-08T12:30:15.000000Z\nSELECT 3;\n",
+		"mysql-error.log":     "error\n",
+	}
+	for name, data := range files {
+		// ローテート済みのログは logrotate と同じように圧縮して置く
+		b := []byte(data)
+		if strings.HasSuffix(name, ".gz") {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(b)
+			gz.Close()
+			b = buf.Bytes()
+		}
+		if err := os.WriteFile(filepath.Join(logDir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := NewSSHClient(NewLogger("error"), SSHConfig{
+		User:       "mysql",
+		Key:        keyPath,
+		KnownHosts: knownHostsPath,
+		LogPath:    filepath.Join(logDir, "mysql-slow.log*"),
+		Hosts:      []string{addr},
+	})
+	if err != nil {
+		t.Fatalf("NewSSHClient() returned error: %v", err)
+	}
+
+	if instance := FilterInstance(client, "127.0.0.1"); instance != addr {
+		t.Errorf("FilterInstance() = %v, want %v", instance, addr)
+	}
+
+	logList, err := GetSlowQueryList(client, addr)
+	if err != nil {
+		t.Fatalf("GetSlowQueryList() returned error: %v", err)
+	}
+	if len(logList) != 3 {
+		t.Fatalf("GetSlowQueryList() returned %v, want 3 files", logList)
+	}
+
+	for _, logFile := range logList {
+		data, err := client.DownloadSlowQueryLog(addr, logFile)
+		if err != nil {
+			t.Fatalf("DownloadSlowQueryLog() returned error: %v", err)
+		}
+		if *data != files[filepath.Base(logFile)] {
+			t.Errorf("DownloadSlowQueryLog() = %q, want %q", *data, files[filepath.Base(logFile)])
+		}
+	}
+
+	gzLog := filepath.Join(logDir, "mysql-slow.log.2.gz")
+	data, marker, err := client.TailSlowQueryLog(addr, gzLog, "")
+	if err != nil || data != files["mysql-slow.log.2.gz"] {
+		t.Errorf("TailSlowQueryLog() = %q, %v, want the decompressed log", data, err)
+	}
+	if data, _, err := client.TailSlowQueryLog(addr, gzLog, marker); err != nil || data != "" {
+		t.Errorf("TailSlowQueryLog() from %q = %q, %v, want no new data", marker, data, err)
+	}
+}
+
+func TestSSHClientUnknownHostKey(t *testing.T) {
+	addr, _, keyPath := startTestSSHServer(t)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	knownHostsPath := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(knownHostsPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewSSHClient(NewLogger("error"), SSHConfig{
+		Key:        keyPath,
+		KnownHosts: knownHostsPath,
+		Hosts:      []string{addr},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.GetSlowQueryList(addr)
+	if err == nil || !strings.Contains(err.Error(), "knownhosts") {
+		t.Errorf("GetSlowQueryList() error = %v, want host key error", err)
+	}
+}
+
+func TestNewSSHClientWithoutAuth(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	if _, err := NewSSHClient(NewLogger("error"), SSHConfig{Hosts: []string{"db1"}}); err == nil {
+		t.Error("NewSSHClient() without authentication should return error")
+	}
+	if _, err := NewSSHClient(NewLogger("error"), SSHConfig{}); err == nil {
+		t.Error("NewSSHClient() without hosts should return error")
+	}
+}
+
+func TestSSHClientClose(t *testing.T) {
+	addr, knownHostsPath, _ := startTestSSHServer(t)
+
+	// 接続を受け付けて、閉じられるまで待つSSHエージェントのソケット
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		agent.ServeAgent(agent.NewKeyring(), conn)
+		close(closed)
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	client, err := NewSSHClient(NewLogger("error"), SSHConfig{KnownHosts: knownHostsPath, Hosts: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close() returned error: %v", err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("Close() should close the connection to the SSH agent")
+	}
+}
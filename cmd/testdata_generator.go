@@ -131,14 +131,15 @@ func GenerateTestLogs(outputDir string) error {
 	}
 	defer awsFile.Close()
 
-	// GCPスタイルのログファイル1
+	// サンプルを2つに分けたログファイル1。名前はGCPですが、形式は他のファイルと同じスロークエリログです
+	// Cloud Logging の形式のログは GenerateSampleLogs に gcp を指定して生成します
 	gcpFile1, err := os.Create(filepath.Join(outputDir, "gcp-slowquery-1.log"))
 	if err != nil {
 		return fmt.Errorf("GCPスタイルログファイル1の作成に失敗しました: %w", err)
 	}
 	defer gcpFile1.Close()
 
-	// GCPスタイルのログファイル2
+	// サンプルを2つに分けたログファイル2
 	gcpFile2, err := os.Create(filepath.Join(outputDir, "gcp-slowquery-2.log"))
 	if err != nil {
 		return fmt.Errorf("GCPスタイルログファイル2の作成に失敗しました: %w", err)
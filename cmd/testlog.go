@@ -0,0 +1,445 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+)
+
+// Distribution はテスト用ログの数値が従う分布です
+type Distribution struct {
+	Kind   string
+	Params []float64
+}
+
+// distributionParams は分布の種類ごとのパラメータの数です
+var distributionParams = map[string]int{
+	"fixed":       1, // 値
+	"uniform":     2, // 最小値, 最大値
+	"normal":      2, // 平均, 標準偏差
+	"lognormal":   2, // 中央値, 対数の標準偏差
+	"exponential": 1, // 平均
+	"pareto":      2, // 最小値, 形状
+}
+
+// ParseDistribution は lognormal:1,0.8 のような分布の指定を解釈します
+func ParseDistribution(spec string) (Distribution, error) {
+	kind, args, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	n, ok := distributionParams[kind]
+	if !ok {
+		return Distribution{}, fmt.Errorf("invalid distribution %q: use fixed, uniform, normal, lognormal, exponential or pareto", spec)
+	}
+
+	d := Distribution{Kind: kind}
+	if args != "" {
+		for _, s := range strings.Split(args, ",") {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return Distribution{}, fmt.Errorf("invalid distribution %q: %q is not a number", spec, s)
+			}
+			d.Params = append(d.Params, v)
+		}
+	}
+	if len(d.Params) != n {
+		return Distribution{}, fmt.Errorf("invalid distribution %q: %s takes %d parameters", spec, kind, n)
+	}
+
+	p := d.Params
+	var invalid bool
+	switch kind {
+	case "fixed":
+		invalid = p[0] < 0
+	case "uniform":
+		invalid = p[0] < 0 || p[0] > p[1]
+	case "normal":
+		invalid = p[1] < 0
+	case "lognormal", "pareto":
+		invalid = p[0] <= 0 || p[1] <= 0
+	case "exponential":
+		invalid = p[0] <= 0
+	}
+	if invalid {
+		return Distribution{}, fmt.Errorf("invalid distribution %q: parameters out of range", spec)
+	}
+	return d, nil
+}
+
+// MustParseDistribution は ParseDistribution と同じですが、エラーの場合は panic します
+func MustParseDistribution(spec string) Distribution {
+	d, err := ParseDistribution(spec)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// String は分布を ParseDistribution で解釈できる形式で返します
+func (d Distribution) String() string {
+	params := make([]string, len(d.Params))
+	for i, p := range d.Params {
+		params[i] = strconv.FormatFloat(p, 'g', -1, 64)
+	}
+	return d.Kind + ":" + strings.Join(params, ",")
+}
+
+// Sample は分布から値を1つ取り出します。負の値は0にします
+func (d Distribution) Sample(r *rand.Rand) float64 {
+	p := d.Params
+	var v float64
+	switch d.Kind {
+	case "fixed":
+		v = p[0]
+	case "uniform":
+		v = p[0] + r.Float64()*(p[1]-p[0])
+	case "normal":
+		v = p[0] + r.NormFloat64()*p[1]
+	case "lognormal":
+		v = p[0] * math.Exp(r.NormFloat64()*p[1])
+	case "exponential":
+		v = r.ExpFloat64() * p[0]
+	case "pareto":
+		v = p[0] / math.Pow(1-r.Float64(), 1/p[1])
+	}
+	return max(v, 0)
+}
+
+// WeightedChoice は値を重みに比例した確率で選びます
+type WeightedChoice struct {
+	Values  []string
+	Weights []float64
+}
+
+// ParseWeightedChoice は app=60,web=30,batch=10 のような重み付きの値の指定を解釈します
+// 重みを省略した値の重みは1です
+func ParseWeightedChoice(spec string) (WeightedChoice, error) {
+	var c WeightedChoice
+	for _, item := range strings.Split(spec, ",") {
+		value, weight, hasWeight := strings.Cut(strings.TrimSpace(item), "=")
+		if value == "" {
+			return WeightedChoice{}, fmt.Errorf("invalid choice %q: empty value", spec)
+		}
+		w := 1.0
+		if hasWeight {
+			var err error
+			w, err = strconv.ParseFloat(weight, 64)
+			if err != nil || w <= 0 {
+				return WeightedChoice{}, fmt.Errorf("invalid choice %q: weight of %s must be a positive number", spec, value)
+			}
+		}
+		c.Values = append(c.Values, value)
+		c.Weights = append(c.Weights, w)
+	}
+	return c, nil
+}
+
+// MustParseWeightedChoice は ParseWeightedChoice と同じですが、エラーの場合は panic します
+func MustParseWeightedChoice(spec string) WeightedChoice {
+	c, err := ParseWeightedChoice(spec)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// String は値を ParseWeightedChoice で解釈できる形式で返します
+func (c WeightedChoice) String() string {
+	items := make([]string, len(c.Values))
+	for i, v := range c.Values {
+		items[i] = v + "=" + strconv.FormatFloat(c.Weights[i], 'g', -1, 64)
+	}
+	return strings.Join(items, ",")
+}
+
+// Pick は値を1つ選びます
+func (c WeightedChoice) Pick(r *rand.Rand) string {
+	var total float64
+	for _, w := range c.Weights {
+		total += w
+	}
+	x := r.Float64() * total
+	for i, w := range c.Weights {
+		if x < w {
+			return c.Values[i]
+		}
+		x -= w
+	}
+	return c.Values[len(c.Values)-1]
+}
+
+// TestLogOptions はテスト用のスロークエリログを生成する設定です
+type TestLogOptions struct {
+	Entries   int
+	Instances int
+	Start     time.Time
+	End       time.Time
+	Seed      uint64
+	// Style はログの形式で、testLogStyles のいずれかです
+	Style string
+
+	// Fingerprints はクエリの形の数で、Skew が大きいほど一部の形に偏ります。Skew が0の場合は一様に選びます
+	Fingerprints int
+	Skew         float64
+
+	QueryTime    Distribution
+	LockTime     Distribution
+	RowsExamined Distribution
+	RowsSent     Distribution
+	Users        WeightedChoice
+	Databases    WeightedChoice
+}
+
+// DefaultTestLogOptions は testlog のフラグのデフォルト値です
+func DefaultTestLogOptions() TestLogOptions {
+	return TestLogOptions{
+		Instances:    4,
+		Start:        time.Date(2023, 5, 10, 0, 0, 0, 0, time.UTC),
+		End:          time.Date(2023, 5, 11, 0, 0, 0, 0, time.UTC),
+		Seed:         1,
+		Style:        "slowlog",
+		Fingerprints: 50,
+		Skew:         1.2,
+		QueryTime:    MustParseDistribution("lognormal:1,0.8"),
+		LockTime:     MustParseDistribution("exponential:0.01"),
+		RowsExamined: MustParseDistribution("lognormal:10000,2"),
+		RowsSent:     MustParseDistribution("lognormal:10,2"),
+		Users:        MustParseWeightedChoice("app=60,web=25,batch=10,analytics=5"),
+		Databases:    MustParseWeightedChoice("production=80,analytics=15,audit=5"),
+	}
+}
+
+// クエリの形のテンプレートです
+// %[1]s はテーブル、%[2]s と %[3]s はカラム、%[4]s は結合するテーブルで、{int} などのリテラルはエントリごとに変わります
+var queryTemplates = []string{
+	"SELECT * FROM %[1]s WHERE %[2]s = {int}",
+	"SELECT id, %[2]s, %[3]s FROM %[1]s WHERE %[2]s > {int} ORDER BY %[3]s DESC LIMIT {limit}",
+	"SELECT COUNT(*) FROM %[1]s WHERE %[3]s = {str} GROUP BY %[2]s",
+	"SELECT %[1]s.*, %[4]s.name FROM %[1]s JOIN %[4]s ON %[4]s.id = %[1]s.%[2]s WHERE %[1]s.%[3]s = {str}",
+	"SELECT %[2]s, SUM(%[3]s) FROM %[1]s WHERE created_at BETWEEN {date} AND {date} GROUP BY %[2]s",
+	"UPDATE %[1]s SET %[3]s = {str}, updated_at = NOW() WHERE %[2]s = {int}",
+	"DELETE FROM %[1]s WHERE %[2]s = {int} AND created_at < {date}",
+	"INSERT INTO %[1]s (%[2]s, %[3]s, created_at) VALUES ({int}, {str}, {date})",
+}
+
+var (
+	queryTables  = []string{"users", "orders", "order_items", "products", "sessions", "payments", "invoices", "carts", "reviews", "shipments", "accounts", "events"}
+	queryColumns = []string{"user_id", "account_id", "product_id", "category_id", "status", "state", "region", "email", "amount", "score", "priority", "type"}
+	queryWords   = []string{"active", "pending", "shipped", "cancelled", "tokyo", "osaka", "gold", "silver", "alice", "bob", "premium", "trial"}
+)
+
+// TestLogGenerator は設定に従ってエントリを時刻の順に1件ずつ生成します
+// 同じ設定とシードからは同じエントリを生成します
+type TestLogGenerator struct {
+	options TestLogOptions
+	rand    *rand.Rand
+	zipf    *rand.Zipf
+	shapes  []string
+	step    float64
+	n       int
+}
+
+// NewTestLogGenerator は設定を検証して TestLogGenerator を生成します
+func NewTestLogGenerator(opts TestLogOptions) (*TestLogGenerator, error) {
+	switch {
+	case opts.Entries < 0:
+		return nil, fmt.Errorf("entries must not be negative")
+	case opts.Instances < 1:
+		return nil, fmt.Errorf("instances must be at least 1")
+	case !opts.Start.Before(opts.End):
+		return nil, fmt.Errorf("start %s must be before end %s", opts.Start.Format(time.RFC3339), opts.End.Format(time.RFC3339))
+	case opts.Fingerprints < 1:
+		return nil, fmt.Errorf("fingerprints must be at least 1")
+	case opts.Skew != 0 && opts.Skew <= 1:
+		return nil, fmt.Errorf("fingerprint skew must be greater than 1, or 0 for uniform")
+	case len(opts.Users.Values) == 0 || len(opts.Databases.Values) == 0:
+		return nil, fmt.Errorf("users and databases must not be empty")
+	}
+
+	g := &TestLogGenerator{
+		options: opts,
+		rand:    rand.New(rand.NewPCG(opts.Seed, opts.Seed^0x9e3779b97f4a7c15)),
+	}
+	g.shapes = g.queryShapes(opts.Fingerprints)
+	if opts.Skew != 0 {
+		g.zipf = rand.NewZipf(g.rand, opts.Skew, 1, uint64(len(g.shapes)-1))
+	}
+	if opts.Entries > 0 {
+		g.step = float64(opts.End.Sub(opts.Start)) / float64(opts.Entries)
+	}
+	return g, nil
+}
+
+// queryShapes は重複しないクエリの形を n 個作ります
+// 形が足りない場合に備えて、n が大きいほど orders_3 のようなシャードのテーブルを増やします
+func (g *TestLogGenerator) queryShapes(n int) []string {
+	shards := 1 + n/1000
+	seen := make(map[string]bool, n)
+	shapes := make([]string, 0, n)
+	for len(shapes) < n {
+		table := g.pick(queryTables)
+		if shard := g.rand.IntN(shards); shard > 0 {
+			table = fmt.Sprintf("%s_%d", table, shard)
+		}
+		joined := g.pick(queryTables)
+		column := g.pick(queryColumns)
+		other := g.pick(queryColumns)
+		if strings.HasPrefix(table, joined) || column == other {
+			continue
+		}
+
+		shape := fmt.Sprintf(g.pick(queryTemplates), table, column, other, joined)
+		if !seen[shape] {
+			seen[shape] = true
+			shapes = append(shapes, shape)
+		}
+	}
+	return shapes
+}
+
+func (g *TestLogGenerator) pick(values []string) string {
+	return values[g.rand.IntN(len(values))]
+}
+
+// Next は次のエントリと、そのエントリを書き出すインスタンスの番号を返します
+// Entries 件を生成し終えると false を返します
+func (g *TestLogGenerator) Next() (int, *parser.Entry, bool) {
+	if g.n >= g.options.Entries {
+		return 0, nil, false
+	}
+	opts := g.options
+
+	// 期間を Entries 個に分けた n 番目の区間の中の時刻にすると、時刻の順に並ぶ
+	offset := time.Duration((float64(g.n) + g.rand.Float64()) * g.step)
+	t := opts.Start.Add(offset).Truncate(time.Microsecond)
+	g.n++
+
+	instance := g.rand.IntN(opts.Instances)
+	var shape string
+	if g.zipf != nil {
+		shape = g.shapes[g.zipf.Uint64()]
+	} else {
+		shape = g.shapes[g.rand.IntN(len(g.shapes))]
+	}
+
+	queryTime := opts.QueryTime.Sample(g.rand)
+	rowsExamined := int64(opts.RowsExamined.Sample(g.rand))
+	user := opts.Users.Pick(g.rand)
+	return instance, &parser.Entry{
+		Time:         t,
+		User:         user,
+		Host:         user + "-host",
+		IP:           fmt.Sprintf("10.0.%d.%d", instance+1, 10+g.rand.IntN(50)),
+		ThreadID:     int64(1000 + g.rand.IntN(100000)),
+		QueryTime:    queryTime,
+		LockTime:     min(opts.LockTime.Sample(g.rand), queryTime),
+		RowsSent:     min(int64(opts.RowsSent.Sample(g.rand)), rowsExamined),
+		RowsExamined: rowsExamined,
+		DB:           opts.Databases.Pick(g.rand),
+		Timestamp:    t.Unix(),
+		Statement:    g.render(shape, t),
+	}, true
+}
+
+// render はクエリの形のリテラルをランダムな値に置き換えます
+func (g *TestLogGenerator) render(shape string, t time.Time) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(shape, '{')
+		if i < 0 {
+			b.WriteString(shape)
+			return b.String()
+		}
+		j := strings.IndexByte(shape[i:], '}')
+		b.WriteString(shape[:i])
+
+		switch shape[i+1 : i+j] {
+		case "int":
+			b.WriteString(strconv.Itoa(1 + g.rand.IntN(1000000)))
+		case "limit":
+			b.WriteString(strconv.Itoa(10 * (1 + g.rand.IntN(10))))
+		case "str":
+			fmt.Fprintf(&b, "'%s'", g.pick(queryWords))
+		case "date":
+			d := t.Add(-time.Duration(g.rand.IntN(90*24)) * time.Hour)
+			fmt.Fprintf(&b, "'%s'", d.Format(time.DateTime))
+		}
+		shape = shape[i+j+1:]
+	}
+}
+
+// TestLogInstanceName はテスト用ログの n 番目のインスタンス名を返します
+func TestLogInstanceName(n int) string {
+	return fmt.Sprintf("mysql-instance-%d", n+1)
+}
+
+// GenerateSyntheticLogs は設定に従ってインスタンスごとのログを Style の形式で生成します
+// エントリは1件ずつ書き出すので、件数が多くてもメモリの使用量は増えません
+func GenerateSyntheticLogs(outputDir string, opts TestLogOptions) error {
+	g, err := NewTestLogGenerator(opts)
+	if err != nil {
+		return err
+	}
+	// RDS は時だけのファイル名で24時間分のファイルを残すので、24時間を超えると同じ名前のファイルに別の日のエントリが混ざる
+	if opts.Style == "rds" && opts.End.Sub(opts.Start) > 24*time.Hour {
+		return fmt.Errorf("style rds keeps only 24 hourly files: use --start and --end within 24 hours, or --style aurora")
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	w, err := newTestLogWriter(outputDir, opts)
+	if err != nil {
+		return err
+	}
+
+	for {
+		instance, entry, ok := g.Next()
+		if !ok {
+			break
+		}
+		if err := w.Write(TestLogInstanceName(instance), entry); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// GenerateSampleLogs は固定のサンプルのエントリを style の形式で書き出します
+// slowlog の場合は GenerateTestLogs と同じファイルを書き出します。それ以外の形式では、
+// slowquery.<instance>.log と同じようにサンプルをインスタンスに割り当てて書き出します
+func GenerateSampleLogs(outputDir string, style string) error {
+	if style == "" || style == "slowlog" {
+		return GenerateTestLogs(outputDir)
+	}
+
+	opts := TestLogOptions{
+		Style: style,
+		Start: sampleQueries[0].timestamp,
+		End:   sampleQueries[len(sampleQueries)-1].timestamp.Add(time.Second),
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	w, err := newTestLogWriter(outputDir, opts)
+	if err != nil {
+		return err
+	}
+
+	for i, q := range sampleQueries {
+		entries, err := parser.ParseString(formatSlowQueryLog(q))
+		if err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Write(instanceNames[i%len(instanceNames)], entries[0]); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
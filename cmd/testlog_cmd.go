@@ -1,20 +1,85 @@
 package cmd
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/spf13/cobra"
 )
 
 // testlogCmd はテスト用のスロークエリログを生成するコマンドです
 var testlogCmd = &cobra.Command{
 	Use:   "testlog",
-	Short: "テスト用のMySQLスロークエリログを生成します",
+	Short: "Generate MySQL slow query logs for testing",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		outputDir, _ := cmd.Flags().GetString("output-dir")
-		return GenerateTestLogs(outputDir)
+		entries, _ := cmd.Flags().GetInt("entries")
+		style, _ := cmd.Flags().GetString("style")
+		if entries == 0 {
+			return GenerateSampleLogs(outputDir, style)
+		}
+
+		opts := DefaultTestLogOptions()
+		opts.Entries = entries
+		opts.Instances, _ = cmd.Flags().GetInt("instances")
+		opts.Seed, _ = cmd.Flags().GetUint64("seed")
+		opts.Fingerprints, _ = cmd.Flags().GetInt("fingerprints")
+		opts.Skew, _ = cmd.Flags().GetFloat64("fingerprint-skew")
+		opts.Style = style
+
+		var err error
+		for name, t := range map[string]*time.Time{
+			"start": &opts.Start,
+			"end":   &opts.End,
+		} {
+			spec, _ := cmd.Flags().GetString(name)
+			if *t, err = parseDiffTime(spec); err != nil {
+				return fmt.Errorf("--%s: %w", name, err)
+			}
+		}
+		for name, d := range map[string]*Distribution{
+			"query-time":    &opts.QueryTime,
+			"lock-time":     &opts.LockTime,
+			"rows-examined": &opts.RowsExamined,
+			"rows-sent":     &opts.RowsSent,
+		} {
+			spec, _ := cmd.Flags().GetString(name)
+			if *d, err = ParseDistribution(spec); err != nil {
+				return fmt.Errorf("--%s: %w", name, err)
+			}
+		}
+		for name, c := range map[string]*WeightedChoice{
+			"users":     &opts.Users,
+			"databases": &opts.Databases,
+		} {
+			spec, _ := cmd.Flags().GetString(name)
+			if *c, err = ParseWeightedChoice(spec); err != nil {
+				return fmt.Errorf("--%s: %w", name, err)
+			}
+		}
+
+		return GenerateSyntheticLogs(outputDir, opts)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(testlogCmd)
-	testlogCmd.Flags().StringP("output-dir", "o", "testdata", "生成したログファイルの出力先ディレクトリ")
+	defaults := DefaultTestLogOptions()
+	flags := testlogCmd.Flags()
+	flags.StringP("output-dir", "o", "testdata", "directory to output generated log files")
+	flags.Int("entries", 0, "number of entries to generate with the options below (0 writes the fixed sample logs)")
+	flags.String("style", defaults.Style, "log format ("+strings.Join(testLogStyles, ", ")+")")
+	flags.Int("instances", defaults.Instances, "number of instances, each written to slowquery.<instance>.log")
+	flags.String("start", defaults.Start.Format(time.RFC3339), "time of the first entry (RFC 3339 or YYYY-MM-DD[THH:MM[:SS]])")
+	flags.String("end", defaults.End.Format(time.RFC3339), "time the entries end before (RFC 3339 or YYYY-MM-DD[THH:MM[:SS]])")
+	flags.Uint64("seed", defaults.Seed, "random seed. The same seed and options generate the same logs")
+	flags.Int("fingerprints", defaults.Fingerprints, "number of distinct query shapes")
+	flags.Float64("fingerprint-skew", defaults.Skew, "Zipf exponent of how often each query shape appears (greater than 1, or 0 for uniform)")
+	flags.String("query-time", defaults.QueryTime.String(), "distribution of Query_time in seconds (fixed:V, uniform:MIN,MAX, normal:MEAN,STDDEV, lognormal:MEDIAN,SIGMA, exponential:MEAN or pareto:MIN,ALPHA)")
+	flags.String("lock-time", defaults.LockTime.String(), "distribution of Lock_time in seconds, at most Query_time")
+	flags.String("rows-examined", defaults.RowsExamined.String(), "distribution of Rows_examined")
+	flags.String("rows-sent", defaults.RowsSent.String(), "distribution of Rows_sent, at most Rows_examined")
+	flags.String("users", defaults.Users.String(), "users with weights (comma separated value=weight)")
+	flags.String("databases", defaults.Databases.String(), "databases with weights (comma separated value=weight)")
 }
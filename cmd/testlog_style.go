@@ -0,0 +1,447 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+)
+
+// testLogStyles は testlog で書き出せるログの形式です
+var testLogStyles = []string{"slowlog", "rds", "aurora", "cloudwatch", "gcp", "mysql8-extra", "percona"}
+
+// testLogTimeFormat は MySQL 5.7 以降の # Time: の形式です
+const testLogTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// CloudWatch Logs と Cloud Logging の形式で使う値です
+const (
+	cloudWatchPageSize = 10000
+	testLogGCPProject  = "my-project"
+	testLogGCPRegion   = "asia-northeast1"
+)
+
+// testLogWriter は生成したエントリをプロバイダーのログの形式で書き出します
+type testLogWriter interface {
+	Write(instance string, e *parser.Entry) error
+	Close() error
+}
+
+// newTestLogWriter は形式に応じた testLogWriter を生成します
+func newTestLogWriter(outputDir string, opts TestLogOptions) (testLogWriter, error) {
+	out := &testLogOutput{dir: outputDir, files: map[string]*testLogFile{}}
+	switch opts.Style {
+	case "", "slowlog":
+		return &slowlogStyle{out: out, header: slowlogHeader}, nil
+	case "mysql8-extra":
+		return &slowlogStyle{out: out, header: mysql8ExtraHeader}, nil
+	case "percona":
+		return &slowlogStyle{out: out, header: perconaHeader}, nil
+	case "rds":
+		out.header = serverHeader("/rdsdbbin/mysql/bin/mysqld, Version: 8.0.35 (Source distribution). started with:")
+		return &rdsStyle{out: out, current: opts.End.Add(-time.Nanosecond).Truncate(time.Hour)}, nil
+	case "aurora":
+		out.header = serverHeader("/rdsdbbin/oscar/bin/mysqld, Version: 8.0.28 (Source distribution). started with:")
+		return &rdsStyle{out: out, aurora: true}, nil
+	case "cloudwatch":
+		out.header = func(w io.Writer, f *testLogFile) error {
+			_, err := io.WriteString(w, "{\"events\": [\n")
+			return err
+		}
+		out.footer = cloudWatchFooter
+		return &cloudWatchStyle{out: out, events: map[string]int{}}, nil
+	case "gcp":
+		out.header = func(w io.Writer, f *testLogFile) error {
+			_, err := io.WriteString(w, "[\n")
+			return err
+		}
+		out.footer = func(w io.Writer, f *testLogFile, last bool) error {
+			_, err := io.WriteString(w, "\n]\n")
+			return err
+		}
+		return &gcpStyle{out: out}, nil
+	default:
+		return nil, fmt.Errorf("unsupported style %q. Use %s", opts.Style, strings.Join(testLogStyles, ", "))
+	}
+}
+
+// testLogFile は書き出し中のファイルです
+type testLogFile struct {
+	path    string
+	file    *os.File
+	w       *bufio.Writer
+	entries int
+}
+
+// testLogOutput はインスタンスごとに1つずつファイルを開いて書き出します
+// 書き出し先が変わると前のファイルを閉じるので、開いたままのファイルはインスタンスの数を超えません
+type testLogOutput struct {
+	dir    string
+	files  map[string]*testLogFile
+	header func(w io.Writer, f *testLogFile) error
+	footer func(w io.Writer, f *testLogFile, last bool) error
+}
+
+// file はインスタンスの書き出し先のファイルを返します
+func (o *testLogOutput) file(instance, path string) (*testLogFile, error) {
+	if f, ok := o.files[instance]; ok {
+		if f.path == path {
+			return f, nil
+		}
+		if err := o.close(f, false); err != nil {
+			return nil, err
+		}
+	}
+
+	full := filepath.Join(o.dir, path)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	file, err := os.Create(full)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", full, err)
+	}
+	f := &testLogFile{path: path, file: file, w: bufio.NewWriterSize(file, 64*1024)}
+	o.files[instance] = f
+	if o.header != nil {
+		if err := o.header(f.w, f); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", full, err)
+		}
+	}
+	return f, nil
+}
+
+func (o *testLogOutput) close(f *testLogFile, last bool) error {
+	defer f.file.Close()
+	if o.footer != nil {
+		if err := o.footer(f.w, f, last); err != nil {
+			return fmt.Errorf("failed to write %s: %w", f.file.Name(), err)
+		}
+	}
+	if err := f.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.file.Name(), err)
+	}
+	return f.file.Close()
+}
+
+// Close はすべてのファイルを閉じます
+func (o *testLogOutput) Close() error {
+	var err error
+	for instance, f := range o.files {
+		if cerr := o.close(f, true); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(o.files, instance)
+	}
+	return err
+}
+
+// serverHeader は mysqld がログファイルを開いたときに書き込む行を書き出します
+func serverHeader(version string) func(w io.Writer, f *testLogFile) error {
+	return func(w io.Writer, f *testLogFile) error {
+		_, err := fmt.Fprintf(w, "%s\nTcp port: 3306  Unix socket: /tmp/mysql.sock\nTime                 Id Command    Argument\n", version)
+		return err
+	}
+}
+
+// slowlogStyle は slowquery.<instance>.log に # で始まるヘッダー行の形式を変えて書き出します
+type slowlogStyle struct {
+	out    *testLogOutput
+	header func(e *parser.Entry) []string
+}
+
+func (s *slowlogStyle) Write(instance string, e *parser.Entry) error {
+	f, err := s.out.file(instance, fmt.Sprintf("slowquery.%s.log", instance))
+	if err != nil {
+		return err
+	}
+	return writeTestLogEntry(f, e, s.header(e))
+}
+
+func (s *slowlogStyle) Close() error {
+	return s.out.Close()
+}
+
+// rdsStyle は RDS for MySQL と Aurora MySQL の1時間ごとのログファイルに書き出します
+// RDS は現在の1時間を mysql-slowquery.log に、それより前を mysql-slowquery.log.<時> に書き出し、
+// Aurora は mysql-slowquery.log.<日付>.<時> に書き出します
+type rdsStyle struct {
+	out     *testLogOutput
+	aurora  bool
+	current time.Time
+}
+
+func (s *rdsStyle) Write(instance string, e *parser.Entry) error {
+	hour := e.Time.UTC().Truncate(time.Hour)
+	name := "mysql-slowquery.log"
+	switch {
+	case s.aurora:
+		name += "." + hour.Format("2006-01-02.15")
+	case !hour.Equal(s.current):
+		name += fmt.Sprintf(".%d", hour.Hour())
+	}
+
+	f, err := s.out.file(instance, filepath.Join(instance, "slowquery", name))
+	if err != nil {
+		return err
+	}
+	return writeTestLogEntry(f, e, rdsHeader(e))
+}
+
+func (s *rdsStyle) Close() error {
+	return s.out.Close()
+}
+
+// cloudWatchEvent は CloudWatch Logs の FilterLogEvents のレスポンスのイベントです
+type cloudWatchEvent struct {
+	LogStreamName string `json:"logStreamName"`
+	Timestamp     int64  `json:"timestamp"`
+	Message       string `json:"message"`
+	IngestionTime int64  `json:"ingestionTime"`
+	EventID       string `json:"eventId"`
+}
+
+// cloudWatchStyle は /aws/rds/instance/<instance>/slowquery のロググループから
+// FilterLogEvents で取得したレスポンスを1万件ずつのページに分けて書き出します
+type cloudWatchStyle struct {
+	out    *testLogOutput
+	events map[string]int
+}
+
+func (s *cloudWatchStyle) Write(instance string, e *parser.Entry) error {
+	n := s.events[instance]
+	s.events[instance]++
+	f, err := s.out.file(instance, filepath.Join(instance, fmt.Sprintf("filter-log-events-%04d.json", n/cloudWatchPageSize+1)))
+	if err != nil {
+		return err
+	}
+
+	ms := e.Time.UnixMilli()
+	data, err := json.Marshal(cloudWatchEvent{
+		LogStreamName: instance,
+		Timestamp:     ms,
+		Message:       testLogEntryText(e, rdsHeader(e)),
+		IngestionTime: ms + 500 + e.ThreadID%2000,
+		EventID:       fmt.Sprintf("%020d%036d", ms, n),
+	})
+	if err != nil {
+		return err
+	}
+	return writeJSONElement(f, data)
+}
+
+func (s *cloudWatchStyle) Close() error {
+	return s.out.Close()
+}
+
+// cloudWatchFooter はページを閉じます。続きのページがある場合は nextToken を書き出します
+func cloudWatchFooter(w io.Writer, f *testLogFile, last bool) error {
+	instance := filepath.Base(filepath.Dir(f.path))
+	streams, _ := json.Marshal([]map[string]any{{"logStreamName": instance, "searchedCompletely": last}})
+	if _, err := fmt.Fprintf(w, "\n],\n\"searchedLogStreams\": %s", streams); err != nil {
+		return err
+	}
+	if !last {
+		token := strings.TrimSuffix(filepath.Base(f.path), ".json")
+		if _, err := fmt.Fprintf(w, ",\n\"nextToken\": %q", "Bxkq6kVGFtq2y_Moigeqscy"+token); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n}\n")
+	return err
+}
+
+// gcpLogEntry は Cloud Logging の LogEntry です
+type gcpLogEntry struct {
+	InsertID         string         `json:"insertId"`
+	LogName          string         `json:"logName"`
+	ReceiveTimestamp string         `json:"receiveTimestamp"`
+	Resource         map[string]any `json:"resource"`
+	TextPayload      string         `json:"textPayload"`
+	Timestamp        string         `json:"timestamp"`
+}
+
+// gcpStyle は Cloud SQL の mysql-slow.log を gcloud logging read --format json の形式で書き出します
+type gcpStyle struct {
+	out *testLogOutput
+}
+
+func (s *gcpStyle) Write(instance string, e *parser.Entry) error {
+	f, err := s.out.file(instance, filepath.Join(instance, "mysql-slow.log.json"))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(gcpLogEntry{
+		InsertID:         fmt.Sprintf("s=%x;i=%d;b=%x;m=%x;t=%x", e.ThreadID, f.entries, len(e.Statement), e.RowsExamined, e.Time.UnixMicro()),
+		LogName:          fmt.Sprintf("projects/%s/logs/cloudsql.googleapis.com%%2Fmysql-slow.log", testLogGCPProject),
+		ReceiveTimestamp: e.Time.Add(time.Second).UTC().Format(time.RFC3339Nano),
+		Resource: map[string]any{
+			"type": "cloudsql_database",
+			"labels": map[string]string{
+				"database_id": testLogGCPProject + ":" + instance,
+				"project_id":  testLogGCPProject,
+				"region":      testLogGCPRegion,
+			},
+		},
+		TextPayload: testLogEntryText(e, slowlogHeader(e)),
+		Timestamp:   e.Time.UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return err
+	}
+	return writeJSONElement(f, data)
+}
+
+func (s *gcpStyle) Close() error {
+	return s.out.Close()
+}
+
+// writeJSONElement は JSON の配列の要素を1行で書き出します
+func writeJSONElement(f *testLogFile, data []byte) error {
+	if f.entries > 0 {
+		if _, err := f.w.WriteString(",\n"); err != nil {
+			return err
+		}
+	}
+	f.entries++
+	_, err := f.w.Write(data)
+	return err
+}
+
+// writeTestLogEntry はエントリをヘッダー行とともにスロークエリログの形式で書き出します
+func writeTestLogEntry(f *testLogFile, e *parser.Entry, header []string) error {
+	entry := *e
+	entry.Comments = header
+	f.entries++
+	_, err := entry.WriteTo(f.w)
+	return err
+}
+
+// testLogEntryText はエントリを末尾の空行を除いたスロークエリログの形式で返します
+func testLogEntryText(e *parser.Entry, header []string) string {
+	entry := *e
+	entry.Comments = header
+	return strings.TrimRight(entry.String(), "\n")
+}
+
+// slowlogHeader は MySQL 5.7 以降のヘッダー行です
+func slowlogHeader(e *parser.Entry) []string {
+	return []string{
+		"# Time: " + e.Time.UTC().Format(testLogTimeFormat),
+		fmt.Sprintf("# User@Host: %s[%s] @ %s [%s]  Id: %d", e.User, e.User, e.Host, e.IP, e.ThreadID),
+		queryTimeLine(e),
+	}
+}
+
+// rdsHeader は RDS と Aurora のヘッダー行です。skip_name_resolve のためホスト名は空です
+func rdsHeader(e *parser.Entry) []string {
+	return []string{
+		"# Time: " + e.Time.UTC().Format(testLogTimeFormat),
+		fmt.Sprintf("# User@Host: %s[%s] @  [%s]  Id: %7d", e.User, e.User, e.IP, e.ThreadID),
+		queryTimeLine(e),
+	}
+}
+
+func queryTimeLine(e *parser.Entry) string {
+	return fmt.Sprintf("# Query_time: %.6f  Lock_time: %.6f Rows_sent: %d  Rows_examined: %d", e.QueryTime, e.LockTime, e.RowsSent, e.RowsExamined)
+}
+
+// queryStats はエントリの値から推測した log_slow_extra や Percona Server の拡張フィールドの値です
+type queryStats struct {
+	bytesReceived int
+	bytesSent     int64
+	fullScan      bool
+	sorted        bool
+	tmpTables     int
+	tmpDiskTables int
+	pages         int64
+}
+
+func newQueryStats(e *parser.Entry) queryStats {
+	stmt := strings.ToUpper(e.Statement)
+	s := queryStats{
+		bytesReceived: len(e.Statement) + 5,
+		bytesSent:     60 + e.RowsSent*64,
+		fullScan:      e.RowsExamined > 1000 && e.RowsExamined > 100*max(e.RowsSent, 1),
+		sorted:        strings.Contains(stmt, "ORDER BY"),
+		pages:         1 + e.RowsExamined/100,
+	}
+	if strings.Contains(stmt, "GROUP BY") {
+		s.tmpTables = 1
+		if e.RowsExamined > 1000000 {
+			s.tmpDiskTables = 1
+		}
+	}
+	return s
+}
+
+// mysql8ExtraHeader は MySQL 8.0 の log_slow_extra を有効にした場合のヘッダー行です
+func mysql8ExtraHeader(e *parser.Entry) []string {
+	s := newQueryStats(e)
+	var readKey, readNext, readRndNext, sortRows, sortScan int64
+	if s.fullScan {
+		readRndNext = e.RowsExamined
+	} else {
+		readKey, readNext = 1, e.RowsExamined
+	}
+	if s.sorted {
+		sortRows, sortScan = e.RowsSent, 1
+	}
+	start := e.Time.Add(-time.Duration(e.QueryTime * float64(time.Second)))
+
+	lines := slowlogHeader(e)
+	lines[2] += fmt.Sprintf(" Thread_id: %d Errno: 0 Killed: 0 Bytes_received: %d Bytes_sent: %d"+
+		" Read_first: %d Read_last: 0 Read_key: %d Read_next: %d Read_prev: 0 Read_rnd: 0 Read_rnd_next: %d"+
+		" Sort_merge_passes: 0 Sort_range_count: 0 Sort_rows: %d Sort_scan_count: %d"+
+		" Created_tmp_disk_tables: %d Created_tmp_tables: %d Start: %s End: %s",
+		e.ThreadID, s.bytesReceived, s.bytesSent,
+		boolInt(s.fullScan), readKey, readNext, readRndNext,
+		sortRows, sortScan,
+		s.tmpDiskTables, s.tmpTables, start.UTC().Format(testLogTimeFormat), e.Time.UTC().Format(testLogTimeFormat))
+	return lines
+}
+
+// perconaHeader は Percona Server の log_slow_verbosity=full のヘッダー行です
+func perconaHeader(e *parser.Entry) []string {
+	s := newQueryStats(e)
+	var affected int64
+	if !strings.HasPrefix(strings.ToUpper(e.Statement), "SELECT") {
+		affected = e.RowsExamined / 10
+	}
+	tmpSize := int64(s.tmpTables) * 16384
+
+	return []string{
+		"# Time: " + e.Time.UTC().Format(testLogTimeFormat),
+		fmt.Sprintf("# User@Host: %s[%s] @ %s [%s]  Id: %d", e.User, e.User, e.Host, e.IP, e.ThreadID),
+		fmt.Sprintf("# Schema: %s  Last_errno: 0  Killed: 0", e.DB),
+		fmt.Sprintf("# Query_time: %.6f  Lock_time: %.6f  Rows_sent: %d  Rows_examined: %d  Rows_affected: %d  Bytes_sent: %d",
+			e.QueryTime, e.LockTime, e.RowsSent, e.RowsExamined, affected, s.bytesSent),
+		fmt.Sprintf("# Tmp_tables: %d  Tmp_disk_tables: %d  Tmp_table_sizes: %d", s.tmpTables, s.tmpDiskTables, tmpSize),
+		fmt.Sprintf("# InnoDB_trx_id: %X", e.ThreadID*7919),
+		fmt.Sprintf("# Full_scan: %s  Full_join: No  Tmp_table: %s  Tmp_table_on_disk: %s", yesNo(s.fullScan), yesNo(s.tmpTables > 0), yesNo(s.tmpDiskTables > 0)),
+		fmt.Sprintf("# Filesort: %s  Filesort_on_disk: No  Merge_passes: 0", yesNo(s.sorted)),
+		fmt.Sprintf("#   InnoDB_IO_r_ops: %d  InnoDB_IO_r_bytes: %d  InnoDB_IO_r_wait: %.6f", s.pages/10, s.pages/10*16384, e.QueryTime/20),
+		fmt.Sprintf("#   InnoDB_rec_lock_wait: %.6f  InnoDB_queue_wait: 0.000000", e.LockTime),
+		fmt.Sprintf("#   InnoDB_pages_distinct: %d", s.pages),
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
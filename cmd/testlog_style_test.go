@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+)
+
+// readStyledTestLog は形式ごとのファイルからエントリを読み込み、ファイル名とインスタンスごとのエントリを返します
+func readStyledTestLog(t *testing.T, dir, style string) ([]string, map[string][]*parser.Entry) {
+	t.Helper()
+	var files []string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	sort.Strings(files)
+
+	entries := map[string][]*parser.Entry{}
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		instance, _, _ := strings.Cut(file, "/")
+
+		var messages []string
+		switch style {
+		case "cloudwatch":
+			var page struct {
+				Events []cloudWatchEvent `json:"events"`
+			}
+			if err := json.Unmarshal(data, &page); err != nil {
+				t.Fatalf("%s: %v", file, err)
+			}
+			for _, e := range page.Events {
+				messages = append(messages, e.Message)
+			}
+		case "gcp":
+			var logEntries []gcpLogEntry
+			if err := json.Unmarshal(data, &logEntries); err != nil {
+				t.Fatalf("%s: %v", file, err)
+			}
+			for _, e := range logEntries {
+				messages = append(messages, e.TextPayload)
+			}
+		default:
+			messages = []string{string(data)}
+			if m := instanceLogPattern.FindStringSubmatch(file); m != nil {
+				instance = m[1]
+			}
+		}
+
+		for _, m := range messages {
+			parsed, err := parser.ParseString(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries[instance] = append(entries[instance], parsed...)
+		}
+	}
+	// RDS の現在のファイルは名前の順では先頭になるので時刻の順に並べ直す
+	for _, list := range entries {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	}
+	return files, entries
+}
+
+func TestGenerateSyntheticLogsStyle(t *testing.T) {
+	testCases := []struct {
+		style string
+		files []string
+		check func(t *testing.T, e *parser.Entry)
+	}{
+		{
+			style: "slowlog",
+			files: []string{"slowquery.mysql-instance-1.log", "slowquery.mysql-instance-2.log"},
+		},
+		{
+			style: "rds",
+			files: []string{
+				"mysql-instance-1/slowquery/mysql-slowquery.log",
+				"mysql-instance-1/slowquery/mysql-slowquery.log.0",
+				"mysql-instance-1/slowquery/mysql-slowquery.log.1",
+				"mysql-instance-2/slowquery/mysql-slowquery.log",
+				"mysql-instance-2/slowquery/mysql-slowquery.log.0",
+				"mysql-instance-2/slowquery/mysql-slowquery.log.1",
+			},
+			check: func(t *testing.T, e *parser.Entry) {
+				if e.Host != "" || e.IP == "" {
+					t.Errorf("host = %q, ip = %q, want only ip", e.Host, e.IP)
+				}
+			},
+		},
+		{
+			style: "aurora",
+			files: []string{
+				"mysql-instance-1/slowquery/mysql-slowquery.log.2023-05-10.00",
+				"mysql-instance-1/slowquery/mysql-slowquery.log.2023-05-10.01",
+				"mysql-instance-1/slowquery/mysql-slowquery.log.2023-05-10.02",
+				"mysql-instance-2/slowquery/mysql-slowquery.log.2023-05-10.00",
+				"mysql-instance-2/slowquery/mysql-slowquery.log.2023-05-10.01",
+				"mysql-instance-2/slowquery/mysql-slowquery.log.2023-05-10.02",
+			},
+		},
+		{
+			style: "cloudwatch",
+			files: []string{"mysql-instance-1/filter-log-events-0001.json", "mysql-instance-2/filter-log-events-0001.json"},
+		},
+		{
+			style: "gcp",
+			files: []string{"mysql-instance-1/mysql-slow.log.json", "mysql-instance-2/mysql-slow.log.json"},
+		},
+		{
+			style: "mysql8-extra",
+			files: []string{"slowquery.mysql-instance-1.log", "slowquery.mysql-instance-2.log"},
+			check: func(t *testing.T, e *parser.Entry) {
+				end, _ := time.Parse(time.RFC3339Nano, e.Extra["End"])
+				if !end.Equal(e.Time) || e.Extra["Start"] == "" || e.Extra["Bytes_sent"] == "" {
+					t.Errorf("log_slow_extra fields = %v, want Start, End and Bytes_sent", e.Extra)
+				}
+			},
+		},
+		{
+			style: "percona",
+			files: []string{"slowquery.mysql-instance-1.log", "slowquery.mysql-instance-2.log"},
+			check: func(t *testing.T, e *parser.Entry) {
+				if e.Extra["Full_scan"] == "" || e.Extra["InnoDB_pages_distinct"] == "" || e.Extra["Rows_affected"] == "" {
+					t.Errorf("percona fields = %v, want Full_scan, InnoDB_pages_distinct and Rows_affected", e.Extra)
+				}
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.style, func(t *testing.T) {
+			opts := DefaultTestLogOptions()
+			opts.Entries = 200
+			opts.Instances = 2
+			opts.End = opts.Start.Add(3 * time.Hour)
+			opts.Style = tc.style
+
+			dir := t.TempDir()
+			if err := GenerateSyntheticLogs(dir, opts); err != nil {
+				t.Fatal(err)
+			}
+			files, got := readStyledTestLog(t, dir, tc.style)
+			if strings.Join(files, "\n") != strings.Join(tc.files, "\n") {
+				t.Errorf("files = %v, want %v", files, tc.files)
+			}
+
+			// どの形式でも生成したエントリと同じ値を読み込める
+			want := map[string][]*parser.Entry{}
+			g, _ := NewTestLogGenerator(opts)
+			for {
+				instance, e, ok := g.Next()
+				if !ok {
+					break
+				}
+				name := TestLogInstanceName(instance)
+				want[name] = append(want[name], e)
+			}
+			for instance, entries := range want {
+				if len(got[instance]) != len(entries) {
+					t.Fatalf("%s: entries = %d, want %d", instance, len(got[instance]), len(entries))
+				}
+				for i, e := range entries {
+					g := got[instance][i]
+					if !g.Time.Equal(e.Time) || math.Abs(g.QueryTime-e.QueryTime) > 1e-6 || g.RowsExamined != e.RowsExamined ||
+						g.User != e.User || g.DB != e.DB || g.ThreadID != e.ThreadID || g.Statement != e.Statement {
+						t.Fatalf("%s: entry %d =\n%s\nwant\n%s", instance, i, g, e)
+					}
+					if tc.check != nil {
+						tc.check(t, g)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateSyntheticLogsCloudWatchPages(t *testing.T) {
+	opts := DefaultTestLogOptions()
+	opts.Entries = cloudWatchPageSize + 1
+	opts.Instances = 1
+	opts.Style = "cloudwatch"
+
+	dir := t.TempDir()
+	if err := GenerateSyntheticLogs(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	type page struct {
+		Events             []cloudWatchEvent `json:"events"`
+		SearchedLogStreams []struct {
+			SearchedCompletely bool `json:"searchedCompletely"`
+		} `json:"searchedLogStreams"`
+		NextToken string `json:"nextToken"`
+	}
+	pages := make([]page, 2)
+	for i, name := range []string{"filter-log-events-0001.json", "filter-log-events-0002.json"} {
+		data, err := os.ReadFile(filepath.Join(dir, "mysql-instance-1", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &pages[i]); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	if len(pages[0].Events) != cloudWatchPageSize || pages[0].NextToken == "" || pages[0].SearchedLogStreams[0].SearchedCompletely {
+		t.Errorf("first page has %d events and nextToken %q, want %d events and a nextToken", len(pages[0].Events), pages[0].NextToken, cloudWatchPageSize)
+	}
+	if len(pages[1].Events) != 1 || pages[1].NextToken != "" || !pages[1].SearchedLogStreams[0].SearchedCompletely {
+		t.Errorf("last page has %d events and nextToken %q, want 1 event without nextToken", len(pages[1].Events), pages[1].NextToken)
+	}
+	e := pages[1].Events[0]
+	if e.LogStreamName != "mysql-instance-1" || e.IngestionTime < e.Timestamp || !strings.HasPrefix(e.Message, "# Time: ") {
+		t.Errorf("event = %+v", e)
+	}
+}
+
+func TestNewTestLogWriter(t *testing.T) {
+	opts := DefaultTestLogOptions()
+	opts.Entries = 10
+	opts.Style = "rds"
+	opts.End = opts.Start.Add(48 * time.Hour)
+	if err := GenerateSyntheticLogs(t.TempDir(), opts); err == nil {
+		t.Error("GenerateSyntheticLogs() should return error for rds logs longer than 24 hours")
+	}
+
+	opts.Style = "syslog"
+	if _, err := newTestLogWriter(t.TempDir(), opts); err == nil {
+		t.Error("newTestLogWriter() should return error for an unknown style")
+	}
+}
+
+func TestGenerateSampleLogsStyle(t *testing.T) {
+	for _, style := range testLogStyles {
+		t.Run(style, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := GenerateSampleLogs(dir, style); err != nil {
+				t.Fatal(err)
+			}
+			if style == "slowlog" {
+				// slowlog は GenerateTestLogs と同じファイルを書き出す
+				if _, err := os.Stat(filepath.Join(dir, "aws-slowquery.log")); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+
+			_, got := readStyledTestLog(t, dir, style)
+			for i, q := range sampleQueries {
+				instance := instanceNames[i%len(instanceNames)]
+				found := false
+				for _, e := range got[instance] {
+					if strings.TrimSuffix(e.Statement, ";") == q.query && e.Time.Equal(q.timestamp) && e.DB == q.db && e.IP == q.clientIP {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("%s: sample %d is not written", instance, i)
+				}
+			}
+			total := 0
+			for _, entries := range got {
+				total += len(entries)
+			}
+			if total != len(sampleQueries) {
+				t.Errorf("entries = %d, want %d", total, len(sampleQueries))
+			}
+		})
+	}
+}
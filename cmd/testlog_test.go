@@ -0,0 +1,243 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ryuichi1208/rds-slowquery-downloder/parser"
+)
+
+func TestParseDistribution(t *testing.T) {
+	testCases := []struct {
+		name    string
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{name: "固定値", spec: "fixed:1.5", want: "fixed:1.5"},
+		{name: "一様分布", spec: "uniform:0.5, 2", want: "uniform:0.5,2"},
+		{name: "対数正規分布", spec: "lognormal:1,0.8", want: "lognormal:1,0.8"},
+		{name: "パレート分布", spec: "pareto:1000,1.5", want: "pareto:1000,1.5"},
+		{name: "未知の分布", spec: "poisson:3", wantErr: true},
+		{name: "パラメータの数が違う", spec: "normal:1", wantErr: true},
+		{name: "数値でないパラメータ", spec: "exponential:fast", wantErr: true},
+		{name: "最小値が最大値より大きい", spec: "uniform:2,1", wantErr: true},
+		{name: "中央値が0", spec: "lognormal:0,1", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := ParseDistribution(tc.spec)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseDistribution(%q) error = %v, wantErr %v", tc.spec, err, tc.wantErr)
+			}
+			if err == nil && d.String() != tc.want {
+				t.Errorf("ParseDistribution(%q) = %s, want %s", tc.spec, d, tc.want)
+			}
+		})
+	}
+}
+
+func TestDistributionSample(t *testing.T) {
+	testCases := []struct {
+		name     string
+		spec     string
+		min, max float64
+	}{
+		{name: "固定値", spec: "fixed:2", min: 2, max: 2},
+		{name: "一様分布", spec: "uniform:1,3", min: 1, max: 3},
+		{name: "正規分布は0未満にならない", spec: "normal:0,1", min: 0, max: 10},
+		{name: "パレート分布は最小値以上", spec: "pareto:5,2", min: 5, max: 1e9},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := MustParseDistribution(tc.spec)
+			r := rand.New(rand.NewPCG(1, 2))
+			for i := 0; i < 1000; i++ {
+				if v := d.Sample(r); v < tc.min || v > tc.max {
+					t.Fatalf("Sample() = %v, want between %v and %v", v, tc.min, tc.max)
+				}
+			}
+		})
+	}
+}
+
+func TestParseWeightedChoice(t *testing.T) {
+	c, err := ParseWeightedChoice("app=3, web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.String() != "app=3,web=1" {
+		t.Errorf("ParseWeightedChoice() = %s, want app=3,web=1", c)
+	}
+
+	r := rand.New(rand.NewPCG(1, 2))
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		counts[c.Pick(r)]++
+	}
+	if counts["app"] < 2800 || counts["app"] > 3200 {
+		t.Errorf("app was picked %d times out of 4000, want about 3000", counts["app"])
+	}
+
+	for _, spec := range []string{"app=0", "app,,web", "app=x"} {
+		if _, err := ParseWeightedChoice(spec); err == nil {
+			t.Errorf("ParseWeightedChoice(%q) should return error", spec)
+		}
+	}
+}
+
+// generateTestLog は生成したエントリをインスタンスごとのスロークエリログとして返します
+func generateTestLog(t *testing.T, opts TestLogOptions) [][]byte {
+	t.Helper()
+	g, err := NewTestLogGenerator(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := make([]bytes.Buffer, opts.Instances)
+	for {
+		instance, entry, ok := g.Next()
+		if !ok {
+			break
+		}
+		entry.WriteTo(&logs[instance])
+	}
+	result := make([][]byte, len(logs))
+	for i := range logs {
+		result[i] = logs[i].Bytes()
+	}
+	return result
+}
+
+func TestTestLogGenerator(t *testing.T) {
+	opts := DefaultTestLogOptions()
+	opts.Entries = 2000
+	opts.Instances = 3
+	opts.Fingerprints = 10
+	opts.Skew = 0
+	opts.Seed = 42
+
+	logs := generateTestLog(t, opts)
+	fingerprints := map[string]bool{}
+	total := 0
+	for i, log := range logs {
+		entries, err := parser.Parse(bytes.NewReader(log))
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += len(entries)
+
+		var prev time.Time
+		for _, e := range entries {
+			if e.Time.Before(opts.Start) || !e.Time.Before(opts.End) {
+				t.Fatalf("instance %d: time %v is out of range", i, e.Time)
+			}
+			if e.Time.Before(prev) {
+				t.Fatalf("instance %d: time %v is before %v", i, e.Time, prev)
+			}
+			prev = e.Time
+			if e.LockTime > e.QueryTime || e.RowsSent > e.RowsExamined {
+				t.Errorf("lock_time %v or rows_sent %d exceeds query_time %v or rows_examined %d", e.LockTime, e.RowsSent, e.QueryTime, e.RowsExamined)
+			}
+			fingerprints[Fingerprint(e.Statement)] = true
+		}
+	}
+	if total != opts.Entries {
+		t.Errorf("entries = %d, want %d", total, opts.Entries)
+	}
+	if len(fingerprints) != opts.Fingerprints {
+		t.Errorf("fingerprints = %d, want %d", len(fingerprints), opts.Fingerprints)
+	}
+
+	// 同じシードからは同じログを、違うシードからは違うログを生成する
+	again := generateTestLog(t, opts)
+	for i := range logs {
+		if !bytes.Equal(logs[i], again[i]) {
+			t.Errorf("instance %d: logs differ with the same seed", i)
+		}
+	}
+	opts.Seed = 43
+	if other := generateTestLog(t, opts); bytes.Equal(logs[0], other[0]) {
+		t.Error("logs are the same with different seeds")
+	}
+}
+
+func TestTestLogGeneratorSkew(t *testing.T) {
+	opts := DefaultTestLogOptions()
+	opts.Entries = 5000
+	opts.Instances = 1
+	opts.Fingerprints = 100
+
+	entries, err := parser.Parse(bytes.NewReader(generateTestLog(t, opts)[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	top := 0
+	for _, e := range entries {
+		fp := Fingerprint(e.Statement)
+		counts[fp]++
+		top = max(top, counts[fp])
+	}
+
+	// Zipf 分布では最も多いクエリが一様に選んだ場合の件数 (50件) を大きく超える
+	if top < 500 {
+		t.Errorf("most frequent fingerprint appears %d times, want skewed distribution", top)
+	}
+	if len(counts) > opts.Fingerprints {
+		t.Errorf("fingerprints = %d, want at most %d", len(counts), opts.Fingerprints)
+	}
+}
+
+func TestNewTestLogGenerator(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(*TestLogOptions)
+	}{
+		{name: "インスタンスが0", modify: func(o *TestLogOptions) { o.Instances = 0 }},
+		{name: "開始が終了より後", modify: func(o *TestLogOptions) { o.Start = o.End.Add(time.Hour) }},
+		{name: "クエリの形が0", modify: func(o *TestLogOptions) { o.Fingerprints = 0 }},
+		{name: "偏りが1以下", modify: func(o *TestLogOptions) { o.Skew = 0.5 }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultTestLogOptions()
+			opts.Entries = 10
+			tc.modify(&opts)
+			if _, err := NewTestLogGenerator(opts); err == nil {
+				t.Error("NewTestLogGenerator() should return error")
+			}
+		})
+	}
+}
+
+func TestGenerateSyntheticLogs(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultTestLogOptions()
+	opts.Entries = 100
+	opts.Instances = 2
+	if err := GenerateSyntheticLogs(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	want := generateTestLog(t, opts)
+	for i := range want {
+		got, err := os.ReadFile(filepath.Join(dir, "slowquery."+TestLogInstanceName(i)+".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want[i]) {
+			t.Errorf("instance %d: file differs from the generated entries", i)
+		}
+		if LocalInstanceName(fmt.Sprintf("slowquery.%s.log", TestLogInstanceName(i))) != TestLogInstanceName(i) {
+			t.Errorf("instance name of the file is not %s", TestLogInstanceName(i))
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timelineAllInstances は全てのインスタンスを合算した系列のインスタンス名です
+const timelineAllInstances = "all"
+
+// timelineMaxBuckets は時間帯の数の上限です
+// 全ての系列は同じ時間軸を持つため、外れた時刻のエントリが1件あるだけで時間帯の数が大きくなりすぎないようにします
+const timelineMaxBuckets = 100000
+
+// timelineMinSparkWidth は1行の文字数の上限が小さい場合でもスパークラインに使う文字数です
+const timelineMinSparkWidth = 10
+
+// timelineMetrics はスパークラインに表示できる値です
+var timelineMetrics = []string{"count", "query_time", "rows_examined", "lock_time"}
+
+// TimelineOptions はtimelineコマンドのオプションです
+type TimelineOptions struct {
+	Bucket time.Duration
+	// ByFingerprint はフィンガープリントごとに系列を分けるかどうかです
+	ByFingerprint bool
+	// Stack はインスタンスごとの系列を1つに合算するかどうかです
+	Stack bool
+	// Top は ByFingerprint の場合に出力するフィンガープリントの数です。0の場合は全て出力します
+	Top    int
+	Format string
+	Metric string
+	// Width はテキスト形式の1行の文字数の上限です。時間帯がスパークラインに収まらない場合は、隣り合う時間帯をまとめて表示します
+	// 0の場合はまとめません
+	Width  int
+	Filter *EntryFilter
+}
+
+// TimelineMetrics は1つの時間帯のクエリの負荷です
+type TimelineMetrics struct {
+	Count        int64   `json:"count"`
+	QueryTime    float64 `json:"query_time"`
+	RowsExamined int64   `json:"rows_examined"`
+	MaxLockTime  float64 `json:"max_lock_time"`
+}
+
+// add はエントリの値を加えます
+func (m *TimelineMetrics) add(r Record) {
+	m.Count++
+	m.QueryTime += r.QueryTime
+	m.RowsExamined += r.RowsExamined
+	m.MaxLockTime = math.Max(m.MaxLockTime, r.LockTime)
+}
+
+// value はスパークラインに表示する値を返します
+func (m TimelineMetrics) value(metric string) float64 {
+	switch metric {
+	case "count":
+		return float64(m.Count)
+	case "rows_examined":
+		return float64(m.RowsExamined)
+	case "lock_time":
+		return m.MaxLockTime
+	default:
+		return m.QueryTime
+	}
+}
+
+// TimelinePoint は系列の1つの時間帯の値です
+type TimelinePoint struct {
+	Time time.Time `json:"time"`
+	TimelineMetrics
+}
+
+// TimelineSeries はインスタンスまたはフィンガープリントごとの時系列です
+// 全ての系列は同じ時間軸を持ち、エントリのない時間帯は0になります
+type TimelineSeries struct {
+	Instance    string          `json:"instance"`
+	QueryID     string          `json:"query_id,omitempty"`
+	Fingerprint string          `json:"fingerprint,omitempty"`
+	Points      []TimelinePoint `json:"points"`
+}
+
+type timelineKey struct {
+	instance    string
+	fingerprint string
+}
+
+// Timeline はエントリを一定の時間ごとに集計します
+// 時刻は SET timestamp または # Time: の値を使います
+type Timeline struct {
+	bucket        time.Duration
+	byFingerprint bool
+	stack         bool
+
+	series       map[timelineKey]map[int64]*TimelineMetrics
+	fingerprints map[string]float64
+	first        int64
+	last         int64
+
+	// Skipped は時刻がないため集計しなかったエントリの数です
+	Skipped int64
+}
+
+// NewTimeline は空のTimelineを生成します
+func NewTimeline(bucket time.Duration, byFingerprint, stack bool) *Timeline {
+	return &Timeline{
+		bucket:        bucket,
+		byFingerprint: byFingerprint,
+		stack:         stack,
+		series:        map[timelineKey]map[int64]*TimelineMetrics{},
+		fingerprints:  map[string]float64{},
+	}
+}
+
+// Add はエントリを集計に加えます
+func (t *Timeline) Add(r Record) {
+	start := r.StartTime()
+	if start.IsZero() {
+		t.Skipped++
+		return
+	}
+
+	i := start.UnixNano() / int64(t.bucket)
+	if len(t.series) == 0 {
+		t.first, t.last = i, i
+	}
+	t.first = min(t.first, i)
+	t.last = max(t.last, i)
+
+	key := timelineKey{instance: r.Instance}
+	if t.stack {
+		key.instance = timelineAllInstances
+	}
+	if t.byFingerprint {
+		key.fingerprint = Fingerprint(r.Statement)
+		t.fingerprints[key.fingerprint] += r.QueryTime
+	}
+
+	buckets, ok := t.series[key]
+	if !ok {
+		buckets = map[int64]*TimelineMetrics{}
+		t.series[key] = buckets
+	}
+
+	m, ok := buckets[i]
+	if !ok {
+		m = &TimelineMetrics{}
+		buckets[i] = m
+	}
+	m.add(r)
+}
+
+// Len は時間帯の数を返します
+func (t *Timeline) Len() int {
+	if len(t.series) == 0 {
+		return 0
+	}
+	return int(t.last-t.first) + 1
+}
+
+// Series は系列をインスタンス、フィンガープリントの合計時間の順で返します
+// ByFingerprint の場合は合計時間の長い順に top 個のフィンガープリントの系列だけを返します
+func (t *Timeline) Series(top int) []TimelineSeries {
+	rank := map[string]int{}
+	if t.byFingerprint {
+		fingerprints := make([]string, 0, len(t.fingerprints))
+		for f := range t.fingerprints {
+			fingerprints = append(fingerprints, f)
+		}
+		sort.Slice(fingerprints, func(i, j int) bool {
+			if t.fingerprints[fingerprints[i]] != t.fingerprints[fingerprints[j]] {
+				return t.fingerprints[fingerprints[i]] > t.fingerprints[fingerprints[j]]
+			}
+			return fingerprints[i] < fingerprints[j]
+		})
+		if top > 0 && len(fingerprints) > top {
+			fingerprints = fingerprints[:top]
+		}
+		for i, f := range fingerprints {
+			rank[f] = i
+		}
+	}
+
+	keys := make([]timelineKey, 0, len(t.series))
+	for key := range t.series {
+		if _, ok := rank[key.fingerprint]; t.byFingerprint && !ok {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].instance != keys[j].instance {
+			return keys[i].instance < keys[j].instance
+		}
+		return rank[keys[i].fingerprint] < rank[keys[j].fingerprint]
+	})
+
+	series := make([]TimelineSeries, len(keys))
+	for i, key := range keys {
+		s := TimelineSeries{Instance: key.instance, Points: make([]TimelinePoint, t.Len())}
+		if t.byFingerprint {
+			s.QueryID = FingerprintID(key.fingerprint)
+			s.Fingerprint = key.fingerprint
+		}
+		for j := range s.Points {
+			b := t.first + int64(j)
+			s.Points[j].Time = time.Unix(0, b*int64(t.bucket)).UTC()
+			if m, ok := t.series[key][b]; ok {
+				s.Points[j].TimelineMetrics = *m
+				// 合計の誤差を除くため、スロークエリログと同じマイクロ秒の精度に丸めます
+				s.Points[j].QueryTime = math.Round(m.QueryTime*1e6) / 1e6
+			}
+		}
+		series[i] = s
+	}
+	return series
+}
+
+// ParseBucket は --bucket の値を解析します
+// time.ParseDuration の形式に加えて、1d のような日数を指定できます
+func ParseBucket(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid bucket %q: use a duration of at least 1s such as 1m, 5m, 1h or 1d", s)
+	}
+	return d, nil
+}
+
+// AnalyzeTimeline はローカルのスロークエリログを時間ごとに集計して書き出します
+func AnalyzeTimeline(w io.Writer, logger *slog.Logger, paths []string, opts TimelineOptions) error {
+	switch opts.Format {
+	case "", "text", "csv", "json":
+	default:
+		return fmt.Errorf("Unsupported format: %s. Use 'text', 'csv' or 'json'", opts.Format)
+	}
+	if opts.Metric != "" && !contains(timelineMetrics, opts.Metric) {
+		return fmt.Errorf("Unsupported metric: %s. Use %s", opts.Metric, strings.Join(timelineMetrics, ", "))
+	}
+
+	client, err := NewLocalClient(logger, strings.Join(paths, ","))
+	if err != nil {
+		return err
+	}
+
+	timeline := NewTimeline(opts.Bucket, opts.ByFingerprint, opts.Stack)
+	err = ReadRecords(client, client.GetInstanceList(), func(r Record) error {
+		if opts.Filter.Match(r.Entry) {
+			timeline.Add(r)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if timeline.Skipped > 0 {
+		logger.Warn("Skipped entries without timestamp", "count", timeline.Skipped)
+	}
+	opts.Filter.WarnErrors(logger)
+	if n := timeline.Len(); n > timelineMaxBuckets {
+		start := time.Unix(0, timeline.first*int64(timeline.bucket))
+		end := time.Unix(0, (timeline.last+1)*int64(timeline.bucket))
+		return fmt.Errorf("timeline from %s to %s has %d buckets of %s, more than %d: use a larger --bucket, or drop the entries outside the period with --where (e.g. 'timestamp >= date(\"2023-05-10\")')",
+			formatTime(start), formatTime(end), n, formatBucket(timeline.bucket), timelineMaxBuckets)
+	}
+
+	switch opts.Format {
+	case "csv":
+		return WriteTimelineCSV(w, timeline, opts)
+	case "json":
+		return WriteTimelineJSON(w, timeline, opts)
+	default:
+		return WriteTimelineText(w, timeline, opts)
+	}
+}
+
+// WriteTimelineCSV は時間帯と系列ごとに1行のCSVを書き出します
+func WriteTimelineCSV(w io.Writer, t *Timeline, opts TimelineOptions) error {
+	cw := csv.NewWriter(w)
+
+	header := []string{"time", "instance"}
+	if t.byFingerprint {
+		header = append(header, "query_id", "fingerprint")
+	}
+	header = append(header, "count", "query_time", "rows_examined", "max_lock_time")
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	series := t.Series(opts.Top)
+	for i := 0; i < t.Len(); i++ {
+		for _, s := range series {
+			p := s.Points[i]
+			row := []string{p.Time.Format(time.RFC3339), s.Instance}
+			if t.byFingerprint {
+				row = append(row, s.QueryID, s.Fingerprint)
+			}
+			row = append(row,
+				strconv.FormatInt(p.Count, 10),
+				strconv.FormatFloat(p.QueryTime, 'f', -1, 64),
+				strconv.FormatInt(p.RowsExamined, 10),
+				strconv.FormatFloat(p.MaxLockTime, 'f', -1, 64),
+			)
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// JSONTimeline はJSON形式の時系列です
+type JSONTimeline struct {
+	Bucket string           `json:"bucket"`
+	Start  *time.Time       `json:"start,omitempty"`
+	End    *time.Time       `json:"end,omitempty"`
+	Series []TimelineSeries `json:"series"`
+}
+
+// WriteTimelineJSON は時系列をJSON形式で書き出します
+func WriteTimelineJSON(w io.Writer, t *Timeline, opts TimelineOptions) error {
+	timeline := JSONTimeline{
+		Bucket: formatBucket(t.bucket),
+		Series: t.Series(opts.Top),
+	}
+	if t.Len() > 0 {
+		timeline.Start = timePtr(time.Unix(0, t.first*int64(t.bucket)))
+		timeline.End = timePtr(time.Unix(0, (t.last+1)*int64(t.bucket)))
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(timeline)
+}
+
+// sparkBlocks はスパークラインの文字です。値が0の時間帯は空白にします
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// WriteTimelineText は系列ごとの値の推移をスパークラインで書き出します
+// 系列どうしを比べられるように、全ての系列で同じ最大値を使います
+// 1行が Width に収まらない場合は、隣り合う時間帯を1文字にまとめます。まとめた値は lock_time では最大値、それ以外では合計です
+func WriteTimelineText(w io.Writer, t *Timeline, opts TimelineOptions) error {
+	metric := opts.Metric
+	if metric == "" {
+		metric = "query_time"
+	}
+
+	var b strings.Builder
+	if t.Len() == 0 {
+		b.WriteString("# No entries with timestamp\n")
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	series := t.Series(opts.Top)
+	labelWidth := 0
+	summaries := make([]string, len(series))
+	summaryWidth := 0
+	for i, s := range series {
+		labelWidth = max(labelWidth, len(timelineLabel(s)))
+
+		var total, seriesMax float64
+		for _, p := range s.Points {
+			v := p.value(metric)
+			total += v
+			seriesMax = math.Max(seriesMax, v)
+		}
+		if metric == "lock_time" {
+			summaries[i] = fmt.Sprintf("max %s", formatTimelineValue(metric, seriesMax))
+		} else {
+			summaries[i] = fmt.Sprintf("total %s  max %s", formatTimelineValue(metric, total), formatTimelineValue(metric, seriesMax))
+		}
+		summaryWidth = max(summaryWidth, len(summaries[i]))
+	}
+
+	// 1文字にまとめる時間帯の数
+	per := 1
+	if opts.Width > 0 {
+		sparkWidth := max(opts.Width-labelWidth-summaryWidth-4, timelineMinSparkWidth)
+		per = (t.Len() + sparkWidth - 1) / sparkWidth
+	}
+
+	start := time.Unix(0, t.first*int64(t.bucket))
+	end := time.Unix(0, (t.last+1)*int64(t.bucket))
+	fmt.Fprintf(&b, "# Timeline: %s to %s, %d buckets of %s, %s", formatTime(start), formatTime(end), t.Len(), formatBucket(t.bucket), metric)
+	if per > 1 {
+		fmt.Fprintf(&b, ", %s per character", formatBucket(time.Duration(per)*t.bucket))
+	}
+	b.WriteString("\n")
+
+	values := make([][]float64, len(series))
+	var peak float64
+	for i, s := range series {
+		values[i] = make([]float64, (len(s.Points)+per-1)/per)
+		for j, p := range s.Points {
+			v := p.value(metric)
+			if metric == "lock_time" {
+				values[i][j/per] = math.Max(values[i][j/per], v)
+			} else {
+				values[i][j/per] += v
+			}
+		}
+		for _, v := range values[i] {
+			peak = math.Max(peak, v)
+		}
+	}
+
+	for i, s := range series {
+		line := make([]rune, len(values[i]))
+		for j, v := range values[i] {
+			line[j] = sparkRune(v, peak)
+		}
+		fmt.Fprintf(&b, "%-*s  %s  %s\n", labelWidth, timelineLabel(s), string(line), summaries[i])
+		if s.Fingerprint != "" {
+			fmt.Fprintf(&b, "%-*s  %s\n", labelWidth, "", truncate(s.Fingerprint, 60))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func timelineLabel(s TimelineSeries) string {
+	if s.QueryID != "" {
+		return s.Instance + " " + s.QueryID
+	}
+	return s.Instance
+}
+
+func sparkRune(v, peak float64) rune {
+	if v <= 0 || peak <= 0 {
+		return ' '
+	}
+	i := int(math.Ceil(v/peak*float64(len(sparkBlocks)))) - 1
+	return sparkBlocks[min(max(i, 0), len(sparkBlocks)-1)]
+}
+
+func formatTimelineValue(metric string, v float64) string {
+	switch metric {
+	case "query_time", "lock_time":
+		return formatSeconds(v)
+	default:
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// defaultTimelineWidth は出力先が端末でなく COLUMNS もない場合の1行の文字数の上限です
+const defaultTimelineWidth = 120
+
+// timelineCmd はスロークエリログを一定の時間ごとに集計するコマンドです
+var timelineCmd = &cobra.Command{
+	Use:   "timeline [flags] <path>...",
+	Short: "Show slow query load per time bucket",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, _ := cmd.Flags().GetBool("debug")
+		logger := NewLogger("info")
+		if debug {
+			logger = NewLogger("debug")
+		}
+
+		bucketFlag, _ := cmd.Flags().GetString("bucket")
+		byFingerprint, _ := cmd.Flags().GetBool("by-fingerprint")
+		stack, _ := cmd.Flags().GetBool("stack")
+		top, _ := cmd.Flags().GetInt("top")
+		format, _ := cmd.Flags().GetString("format")
+		metric, _ := cmd.Flags().GetString("metric")
+		width, _ := cmd.Flags().GetInt("width")
+		if width <= 0 {
+			width = terminalWidth(cmd.OutOrStdout())
+		}
+
+		bucket, err := ParseBucket(bucketFlag)
+		if err != nil {
+			return err
+		}
+
+		filter, err := NewEntryFilter(mergeFilterOptions(FilterOptions{}, cmd.Flags()))
+		if err != nil {
+			return err
+		}
+
+		return AnalyzeTimeline(cmd.OutOrStdout(), logger, args, TimelineOptions{
+			Bucket:        bucket,
+			ByFingerprint: byFingerprint,
+			Stack:         stack,
+			Top:           top,
+			Format:        format,
+			Metric:        metric,
+			Width:         width,
+			Filter:        filter,
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(timelineCmd)
+	timelineCmd.Flags().BoolP("debug", "d", false, "debug mode")
+	timelineCmd.Flags().String("bucket", "5m", "length of a time bucket (e.g. 1m, 5m, 1h or 1d)")
+	timelineCmd.Flags().Bool("by-fingerprint", false, "one series per query fingerprint")
+	timelineCmd.Flags().Bool("stack", false, "sum all instances into one series instead of one series per instance")
+	timelineCmd.Flags().Int("top", 10, "number of query fingerprints with --by-fingerprint (0 for all)")
+	timelineCmd.Flags().String("format", "text", "output format (text, csv or json)")
+	timelineCmd.Flags().String("metric", "query_time", "value of the sparklines in text format (count, query_time, rows_examined or lock_time)")
+	timelineCmd.Flags().Int("width", 0, "maximum line width of the text format; buckets are merged to fit (default the terminal width, or 120)")
+	addEntryFilterFlags(timelineCmd.Flags())
+}
+
+// terminalWidth は出力先の端末の幅を返します
+// 出力先が端末でない場合は COLUMNS の値を、それもない場合は defaultTimelineWidth を返します
+func terminalWidth(w io.Writer) int {
+	if f, ok := w.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		if width, _, err := term.GetSize(int(f.Fd())); err == nil && width > 0 {
+			return width
+		}
+	}
+	if width, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && width > 0 {
+		return width
+	}
+	return defaultTimelineWidth
+}
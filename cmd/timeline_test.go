@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBucket(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{value: "1m", expected: time.Minute},
+		{value: "5m", expected: 5 * time.Minute},
+		{value: "1h", expected: time.Hour},
+		{value: "1d", expected: 24 * time.Hour},
+		{value: "1h30m", expected: 90 * time.Minute},
+		{value: "500ms", wantErr: true},
+		{value: "0", wantErr: true},
+		{value: "xd", wantErr: true},
+		{value: "hourly", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			got, err := ParseBucket(tc.value)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseBucket() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.expected {
+				t.Errorf("ParseBucket() = %v, want %v", got, tc.expected)
+			}
+		})
+	}
+}
+
+// newTestTimeline は2つのインスタンスの12:00から12:15までのエントリを5分ごとに集計します
+func newTestTimeline(byFingerprint, stack bool) *Timeline {
+	base := time.Date(2023, 5, 10, 12, 0, 0, 0, time.UTC).Unix()
+	timeline := NewTimeline(5*time.Minute, byFingerprint, stack)
+	timeline.Add(newTestRecord("db-1", "SELECT * FROM users WHERE id = 1", 1.0, 1, 100, base+10))
+	timeline.Add(newTestRecord("db-1", "SELECT * FROM users WHERE id = 2", 2.0, 1, 200, base+290))
+	timeline.Add(newTestRecord("db-1", "DELETE FROM logs", 3.0, 0, 1000, base+900))
+	timeline.Add(newTestRecord("db-2", "SELECT * FROM users WHERE id = 3", 0.5, 1, 50, base+300))
+	timeline.Add(newTestRecord("db-2", "SELECT 1", 0.1, 1, 1, 0))
+	return timeline
+}
+
+func TestTimelineSeries(t *testing.T) {
+	testCases := []struct {
+		name          string
+		byFingerprint bool
+		stack         bool
+		top           int
+		expected      []string
+		counts        [][]int64
+	}{
+		{
+			name:     "インスタンスごと",
+			expected: []string{"db-1", "db-2"},
+			counts:   [][]int64{{2, 0, 0, 1}, {0, 1, 0, 0}},
+		},
+		{
+			name:     "インスタンスを合算",
+			stack:    true,
+			expected: []string{"all"},
+			counts:   [][]int64{{2, 1, 0, 1}},
+		},
+		{
+			name:          "フィンガープリントごと",
+			byFingerprint: true,
+			stack:         true,
+			expected:      []string{"all " + FingerprintID("select * from users where id = ?"), "all " + FingerprintID("delete from logs")},
+			counts:        [][]int64{{2, 1, 0, 0}, {0, 0, 0, 1}},
+		},
+		{
+			name:          "上位のフィンガープリントだけ",
+			byFingerprint: true,
+			top:           1,
+			expected:      []string{"db-1 " + FingerprintID("select * from users where id = ?"), "db-2 " + FingerprintID("select * from users where id = ?")},
+			counts:        [][]int64{{2, 0, 0, 0}, {0, 1, 0, 0}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			timeline := newTestTimeline(tc.byFingerprint, tc.stack)
+			if timeline.Skipped != 1 {
+				t.Errorf("Skipped = %d, want 1", timeline.Skipped)
+			}
+
+			series := timeline.Series(tc.top)
+			if len(series) != len(tc.expected) {
+				t.Fatalf("Series() returned %d series, want %d", len(series), len(tc.expected))
+			}
+			for i, s := range series {
+				if got := timelineLabel(s); got != tc.expected[i] {
+					t.Errorf("Series()[%d] = %v, want %v", i, got, tc.expected[i])
+				}
+				var counts []int64
+				for _, p := range s.Points {
+					counts = append(counts, p.Count)
+				}
+				if len(counts) != len(tc.counts[i]) {
+					t.Fatalf("Series()[%d] has %d points, want %d", i, len(counts), len(tc.counts[i]))
+				}
+				for j := range counts {
+					if counts[j] != tc.counts[i][j] {
+						t.Errorf("Series()[%d] counts = %v, want %v", i, counts, tc.counts[i])
+						break
+					}
+				}
+			}
+		})
+	}
+
+	// 時間帯は全ての系列で揃い、合計と最大値を集計する
+	series := newTestTimeline(false, false).Series(0)
+	p := series[0].Points[0]
+	if !p.Time.Equal(time.Date(2023, 5, 10, 12, 0, 0, 0, time.UTC)) || p.QueryTime != 3.0 || p.RowsExamined != 300 || p.MaxLockTime != 0.2 {
+		t.Errorf("Points[0] = %+v", p)
+	}
+	if !series[1].Points[3].Time.Equal(time.Date(2023, 5, 10, 12, 15, 0, 0, time.UTC)) {
+		t.Errorf("Points[3].Time = %v", series[1].Points[3].Time)
+	}
+}
+
+func TestWriteTimeline(t *testing.T) {
+	timeline := newTestTimeline(false, false)
+
+	var buf bytes.Buffer
+	if err := WriteTimelineCSV(&buf, timeline, TimelineOptions{}); err != nil {
+		t.Fatalf("WriteTimelineCSV() returned error: %v", err)
+	}
+	expected := `time,instance,count,query_time,rows_examined,max_lock_time
+2023-05-10T12:00:00Z,db-1,2,3,300,0.2
+2023-05-10T12:00:00Z,db-2,0,0,0,0
+2023-05-10T12:05:00Z,db-1,0,0,0,0
+2023-05-10T12:05:00Z,db-2,1,0.5,50,0.05
+2023-05-10T12:10:00Z,db-1,0,0,0,0
+2023-05-10T12:10:00Z,db-2,0,0,0,0
+2023-05-10T12:15:00Z,db-1,1,3,1000,0.3
+2023-05-10T12:15:00Z,db-2,0,0,0,0
+`
+	if buf.String() != expected {
+		t.Errorf("WriteTimelineCSV() = %s, want %s", buf.String(), expected)
+	}
+
+	buf.Reset()
+	if err := WriteTimelineJSON(&buf, timeline, TimelineOptions{}); err != nil {
+		t.Fatalf("WriteTimelineJSON() returned error: %v", err)
+	}
+	var got JSONTimeline
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("WriteTimelineJSON() returned invalid JSON: %v", err)
+	}
+	if got.Bucket != "5m" || !got.End.Equal(time.Date(2023, 5, 10, 12, 20, 0, 0, time.UTC)) || len(got.Series) != 2 || len(got.Series[0].Points) != 4 {
+		t.Errorf("WriteTimelineJSON() = %+v", got)
+	}
+
+	buf.Reset()
+	if err := WriteTimelineText(&buf, timeline, TimelineOptions{Metric: "query_time"}); err != nil {
+		t.Fatalf("WriteTimelineText() returned error: %v", err)
+	}
+	for _, want := range []string{
+		"# Timeline: 2023-05-10 12:00:00 to 2023-05-10 12:20:00, 4 buckets of 5m, query_time\n",
+		"db-1  █  █  total 6.000s  max 3.000s\n",
+		"db-2   ▂    total 0.500s  max 0.500s\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("WriteTimelineText() does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestSparkRune(t *testing.T) {
+	testCases := []struct {
+		value    float64
+		expected rune
+	}{
+		{value: 0, expected: ' '},
+		{value: 0.01, expected: '▁'},
+		{value: 5, expected: '▄'},
+		{value: 10, expected: '█'},
+	}
+
+	for _, tc := range testCases {
+		if got := sparkRune(tc.value, 10); got != tc.expected {
+			t.Errorf("sparkRune(%v) = %q, want %q", tc.value, got, tc.expected)
+		}
+	}
+}
+
+func TestWriteTimelineTextWidth(t *testing.T) {
+	base := time.Date(2023, 5, 10, 12, 0, 0, 0, time.UTC).Unix()
+	timeline := NewTimeline(time.Minute, false, false)
+	for i := int64(0); i < 30; i++ {
+		timeline.Add(newTestRecord("db-1", "SELECT 1", 1.0, 1, 1, base+i*60))
+	}
+
+	var buf bytes.Buffer
+	if err := WriteTimelineText(&buf, timeline, TimelineOptions{Metric: "count", Width: 30}); err != nil {
+		t.Fatalf("WriteTimelineText() returned error: %v", err)
+	}
+
+	// 30個の時間帯を3個ずつまとめて10文字で表示する
+	for _, want := range []string{
+		"30 buckets of 1m, count, 3m per character\n",
+		"db-1  ██████████  total 30  max 1\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("WriteTimelineText() does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestAnalyzeTimelineMaxBuckets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slowquery.db-1.log")
+	data := slowLogEntry(0, "SELECT 1", 1) + strings.Replace(slowLogEntry(0, "SELECT 2", 1), "2023-05-10", "1970-01-01", 1)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := AnalyzeTimeline(&bytes.Buffer{}, NewLogger("error"), []string{path}, TimelineOptions{Bucket: time.Minute})
+	if err == nil || !strings.Contains(err.Error(), "--bucket") {
+		t.Errorf("AnalyzeTimeline() error = %v, want too many buckets", err)
+	}
+
+	if err := AnalyzeTimeline(&bytes.Buffer{}, NewLogger("error"), []string{path}, TimelineOptions{Bucket: 24 * time.Hour}); err != nil {
+		t.Errorf("AnalyzeTimeline() returned error: %v", err)
+	}
+}
@@ -0,0 +1,676 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	_ "modernc.org/sqlite"
+)
+
+// warehouseSchemaVersion はウェアハウスのスキーマのバージョンです。PRAGMA user_version に保存します
+const warehouseSchemaVersion = 1
+
+// warehouseSchema はウェアハウスのテーブルです
+// 時刻は SQLite の日付関数で扱えるように UTC の "YYYY-MM-DD HH:MM:SS.SSSSSS" で保存します
+const warehouseSchema = `
+CREATE TABLE IF NOT EXISTS instances (
+	id INTEGER PRIMARY KEY,
+	provider TEXT NOT NULL,
+	name TEXT NOT NULL,
+	imported_at TEXT NOT NULL,
+	UNIQUE (provider, name)
+);
+CREATE TABLE IF NOT EXISTS source_files (
+	id INTEGER PRIMARY KEY,
+	instance_id INTEGER NOT NULL REFERENCES instances (id),
+	name TEXT NOT NULL,
+	imported_at TEXT NOT NULL,
+	UNIQUE (instance_id, name)
+);
+CREATE TABLE IF NOT EXISTS fingerprints (
+	id TEXT PRIMARY KEY,
+	fingerprint TEXT NOT NULL,
+	statement_type TEXT NOT NULL,
+	first_seen TEXT,
+	last_seen TEXT
+);
+CREATE TABLE IF NOT EXISTS entries (
+	id TEXT PRIMARY KEY,
+	instance_id INTEGER NOT NULL REFERENCES instances (id),
+	source_file_id INTEGER NOT NULL REFERENCES source_files (id),
+	fingerprint_id TEXT NOT NULL REFERENCES fingerprints (id),
+	time TEXT,
+	logged_at TEXT,
+	user TEXT NOT NULL,
+	host TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	thread_id INTEGER NOT NULL,
+	db TEXT NOT NULL,
+	query_time REAL NOT NULL,
+	lock_time REAL NOT NULL,
+	rows_sent INTEGER NOT NULL,
+	rows_examined INTEGER NOT NULL,
+	sql TEXT NOT NULL,
+	extra TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS entries_fingerprint_time ON entries (fingerprint_id, time);
+CREATE INDEX IF NOT EXISTS entries_instance_time ON entries (instance_id, time);
+`
+
+// warehouseTimeFormat はウェアハウスに保存する時刻の形式です
+const warehouseTimeFormat = "2006-01-02 15:04:05.000000"
+
+// Warehouse はダウンロードしたエントリを蓄積する SQLite のデータベースです
+type Warehouse struct {
+	db *sql.DB
+}
+
+// DefaultWarehousePath は query と history が読み込むウェアハウスのデフォルトのパスを返します
+func DefaultWarehousePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".local", "share", "mysql-slowquery-downloder", "warehouse.db")
+}
+
+// OpenWarehouse はウェアハウスを開きます。ファイルがない場合は作成します
+func OpenWarehouse(path string) (*Warehouse, error) {
+	if path == "" {
+		return nil, fmt.Errorf("warehouse path is empty")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	w, err := openWarehouse(path, "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	if err := w.migrate(); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("failed to migrate warehouse %s: %w", path, err)
+	}
+	return w, nil
+}
+
+// OpenWarehouseReadOnly は既存のウェアハウスを書き込みできない状態で開きます
+func OpenWarehouseReadOnly(path string) (*Warehouse, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("warehouse %s not found. Download with --warehouse first: %w", path, err)
+	}
+
+	w, err := openWarehouse(path, "_pragma=busy_timeout(5000)&_pragma=query_only(1)")
+	if err != nil {
+		return nil, err
+	}
+	var version int
+	if err := w.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if version != warehouseSchemaVersion {
+		w.Close()
+		return nil, fmt.Errorf("warehouse %s has schema version %d, want %d", path, version, warehouseSchemaVersion)
+	}
+	return w, nil
+}
+
+func openWarehouse(path, params string) (*Warehouse, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite への書き込みは1つの接続にまとめる
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open warehouse %s: %w", path, err)
+	}
+	return &Warehouse{db: db}, nil
+}
+
+// migrate はテーブルがなければ作成します
+func (w *Warehouse) migrate() error {
+	var version int
+	if err := w.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > warehouseSchemaVersion {
+		return fmt.Errorf("schema version %d is newer than %d", version, warehouseSchemaVersion)
+	}
+	if _, err := w.db.Exec(warehouseSchema); err != nil {
+		return err
+	}
+	_, err := w.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", warehouseSchemaVersion))
+	return err
+}
+
+// Close はウェアハウスを閉じます
+func (w *Warehouse) Close() error {
+	return w.db.Close()
+}
+
+// WarehouseImport はエントリを1つのトランザクションでウェアハウスに取り込みます
+type WarehouseImport struct {
+	tx          *sql.Tx
+	importedAt  string
+	instances   map[string]int64
+	sourceFiles map[string]int64
+
+	instanceStmt    *sql.Stmt
+	sourceFileStmt  *sql.Stmt
+	fingerprintStmt *sql.Stmt
+	entryStmt       *sql.Stmt
+
+	// Inserted は新しく追加したエントリの数で、Duplicates は既に取り込まれていたエントリの数です
+	Inserted   int
+	Duplicates int
+}
+
+// Begin はエントリの取り込みを始めます
+func (w *Warehouse) Begin(ctx context.Context) (*WarehouseImport, error) {
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	imp := &WarehouseImport{
+		tx:          tx,
+		importedAt:  time.Now().UTC().Format(warehouseTimeFormat),
+		instances:   map[string]int64{},
+		sourceFiles: map[string]int64{},
+	}
+	for _, s := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&imp.instanceStmt, `INSERT INTO instances (provider, name, imported_at) VALUES (?, ?, ?)
+			ON CONFLICT (provider, name) DO UPDATE SET imported_at = excluded.imported_at RETURNING id`},
+		{&imp.sourceFileStmt, `INSERT INTO source_files (instance_id, name, imported_at) VALUES (?, ?, ?)
+			ON CONFLICT (instance_id, name) DO UPDATE SET imported_at = excluded.imported_at RETURNING id`},
+		{&imp.fingerprintStmt, `INSERT INTO fingerprints (id, fingerprint, statement_type, first_seen, last_seen) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				first_seen = CASE WHEN first_seen IS NULL OR excluded.first_seen < first_seen THEN excluded.first_seen ELSE first_seen END,
+				last_seen = CASE WHEN last_seen IS NULL OR excluded.last_seen > last_seen THEN excluded.last_seen ELSE last_seen END`},
+		{&imp.entryStmt, `INSERT INTO entries (id, instance_id, source_file_id, fingerprint_id, time, logged_at, user, host, ip, thread_id, db,
+				query_time, lock_time, rows_sent, rows_examined, sql, extra)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO NOTHING`},
+	} {
+		*s.stmt, err = tx.PrepareContext(ctx, s.query)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return imp, nil
+}
+
+// Add はエントリを取り込みます。既に取り込まれているエントリは追加しません
+func (imp *WarehouseImport) Add(r Record) error {
+	instanceKey := r.Provider + "\x00" + r.Instance
+	instanceID, ok := imp.instances[instanceKey]
+	if !ok {
+		if err := imp.instanceStmt.QueryRow(r.Provider, r.Instance, imp.importedAt).Scan(&instanceID); err != nil {
+			return fmt.Errorf("failed to import instance %s: %w", r.Instance, err)
+		}
+		imp.instances[instanceKey] = instanceID
+	}
+
+	sourceKey := instanceKey + "\x00" + r.Source
+	sourceFileID, ok := imp.sourceFiles[sourceKey]
+	if !ok {
+		if err := imp.sourceFileStmt.QueryRow(instanceID, r.Source, imp.importedAt).Scan(&sourceFileID); err != nil {
+			return fmt.Errorf("failed to import source file %s: %w", r.Source, err)
+		}
+		imp.sourceFiles[sourceKey] = sourceFileID
+	}
+
+	extra, err := json.Marshal(r.Extra)
+	if err != nil {
+		return err
+	}
+	if r.Extra == nil {
+		extra = []byte("{}")
+	}
+
+	fingerprint := Fingerprint(r.Statement)
+	fingerprintID := FingerprintID(fingerprint)
+	start := warehouseTime(r.StartTime())
+	if _, err := imp.fingerprintStmt.Exec(fingerprintID, fingerprint, StatementType(r.Statement), start, start); err != nil {
+		return fmt.Errorf("failed to import fingerprint %s: %w", fingerprintID, err)
+	}
+	result, err := imp.entryStmt.Exec(EntryID(r), instanceID, sourceFileID, fingerprintID, start, warehouseTime(r.Time),
+		r.User, r.Host, r.IP, r.ThreadID, r.DB, r.QueryTime, r.LockTime, r.RowsSent, r.RowsExamined, r.Statement, string(extra))
+	if err != nil {
+		return fmt.Errorf("failed to import entry of %s: %w", r.Source, err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		imp.Duplicates++
+	} else {
+		imp.Inserted++
+	}
+	return nil
+}
+
+// Commit は取り込んだエントリを確定します
+func (imp *WarehouseImport) Commit() error {
+	return imp.tx.Commit()
+}
+
+// Rollback は取り込んだエントリを破棄します
+func (imp *WarehouseImport) Rollback() error {
+	return imp.tx.Rollback()
+}
+
+// warehouseTime は時刻をウェアハウスの形式に変換します。ゼロ値は NULL にします
+func warehouseTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(warehouseTimeFormat)
+}
+
+// Query は任意の SQL を実行して、結果を形式に応じて書き出します
+func (w *Warehouse) Query(ctx context.Context, out io.Writer, query, format string) error {
+	if format != "" && format != "text" && format != "csv" && format != "json" {
+		return fmt.Errorf("Unsupported format: %s. Use 'text', 'csv' or 'json'", format)
+	}
+
+	rows, err := w.db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	var result [][]any
+	for rows.Next() {
+		values := make([]any, len(columns))
+		ptrs := make([]any, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		result = append(result, values)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	switch format {
+	case "csv":
+		return writeQueryCSV(out, columns, result)
+	case "json":
+		return writeQueryJSON(out, columns, result)
+	default:
+		return writeQueryText(out, columns, result)
+	}
+}
+
+// formatQueryValue は結果の値を文字列にします。NULL は空文字列にします
+func formatQueryValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// writeQueryText は結果を列をそろえた表として書き出します
+func writeQueryText(w io.Writer, columns []string, rows [][]any) error {
+	widths := make([]int, len(columns))
+	for i, c := range columns {
+		widths[i] = utf8.RuneCountInString(c)
+	}
+	cells := make([][]string, len(rows))
+	for i, row := range rows {
+		cells[i] = make([]string, len(row))
+		for j, v := range row {
+			cells[i][j] = strings.ReplaceAll(formatQueryValue(v), "\n", " ")
+			widths[j] = max(widths[j], utf8.RuneCountInString(cells[i][j]))
+		}
+	}
+
+	var b strings.Builder
+	writeRow := func(row []string) {
+		for i, cell := range row {
+			if i == len(row)-1 {
+				b.WriteString(cell)
+				break
+			}
+			b.WriteString(cell)
+			b.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)+2))
+		}
+		b.WriteByte('\n')
+	}
+	writeRow(columns)
+	for _, row := range cells {
+		writeRow(row)
+	}
+	fmt.Fprintf(&b, "(%d rows)\n", len(rows))
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeQueryCSV は結果をヘッダー付きのCSVで書き出します
+func writeQueryCSV(w io.Writer, columns []string, rows [][]any) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = formatQueryValue(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeQueryJSON は結果を列名をキーにしたオブジェクトの配列で書き出します
+func writeQueryJSON(w io.Writer, columns []string, rows [][]any) error {
+	objects := make([]map[string]any, 0, len(rows))
+	for _, row := range rows {
+		object := map[string]any{}
+		for i, v := range row {
+			object[columns[i]] = v
+		}
+		objects = append(objects, object)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(objects)
+}
+
+// HistoryOptions は history の設定です
+type HistoryOptions struct {
+	// Period は集計する期間の長さで day、week、month のいずれかです
+	Period string
+	// Periods は Now を含む期間から遡って表示する期間の数です。0の場合は最初のエントリから表示します
+	Periods int
+	// Instance は集計するインスタンス名の前方一致です。空の場合は全てのインスタンスを集計します
+	Instance string
+	Now      time.Time
+}
+
+// HistoryPoint は1つの期間のクエリの集計です
+type HistoryPoint struct {
+	Start        time.Time `json:"start"`
+	Count        int64     `json:"count"`
+	QueryTime    float64   `json:"query_time"`
+	AvgQueryTime float64   `json:"avg_query_time"`
+	P95QueryTime float64   `json:"p95_query_time"`
+	MaxQueryTime float64   `json:"max_query_time"`
+	RowsExamined int64     `json:"rows_examined"`
+	Instances    int       `json:"instances"`
+}
+
+// History はクエリのフィンガープリントの期間ごとの推移です
+type History struct {
+	QueryID       string         `json:"query_id"`
+	Fingerprint   string         `json:"fingerprint"`
+	StatementType string         `json:"statement_type"`
+	Period        string         `json:"period"`
+	Points        []HistoryPoint `json:"points"`
+}
+
+// periodStart は t を含む期間の開始時刻を UTC で返します。週は月曜日から始まります
+func periodStart(t time.Time, period string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case "week":
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+// nextPeriod は start から始まる期間の次の期間の開始時刻を返します
+func nextPeriod(start time.Time, period string, n int) time.Time {
+	switch period {
+	case "week":
+		return start.AddDate(0, 0, 7*n)
+	case "month":
+		return start.AddDate(0, n, 0)
+	default:
+		return start.AddDate(0, 0, n)
+	}
+}
+
+// History はクエリ ID のフィンガープリントの期間ごとの推移を返します
+// クエリ ID は前方一致で探し、1つに決まらない場合はエラーを返します
+func (w *Warehouse) History(ctx context.Context, queryID string, opts HistoryOptions) (*History, error) {
+	if opts.Period == "" {
+		opts.Period = "week"
+	}
+	if opts.Period != "day" && opts.Period != "week" && opts.Period != "month" {
+		return nil, fmt.Errorf("Unsupported period: %s. Use 'day', 'week' or 'month'", opts.Period)
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+
+	h := &History{Period: opts.Period}
+	rows, err := w.db.QueryContext(ctx, "SELECT id, fingerprint, statement_type FROM fingerprints WHERE id LIKE ? || '%' ORDER BY id LIMIT 2",
+		strings.ToUpper(queryID))
+	if err != nil {
+		return nil, err
+	}
+	var matches int
+	for rows.Next() {
+		matches++
+		if err := rows.Scan(&h.QueryID, &h.Fingerprint, &h.StatementType); err != nil {
+			rows.Close()
+			return nil, err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case queryID == "" || matches == 0:
+		return nil, fmt.Errorf("query ID %s not found in warehouse", queryID)
+	case matches > 1:
+		return nil, fmt.Errorf("query ID %s matches more than one fingerprint", queryID)
+	}
+
+	last := periodStart(opts.Now, opts.Period)
+	var first time.Time
+	if opts.Periods > 0 {
+		first = nextPeriod(last, opts.Period, -(opts.Periods - 1))
+	}
+
+	rows, err = w.db.QueryContext(ctx, `SELECT e.time, e.query_time, e.rows_examined, i.name FROM entries e
+		JOIN instances i ON i.id = e.instance_id
+		WHERE e.fingerprint_id = ? AND e.time IS NOT NULL AND e.time >= ? AND substr(i.name, 1, length(?)) = ?
+		ORDER BY e.time`, h.QueryID, first.UTC().Format(warehouseTimeFormat), opts.Instance, opts.Instance)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type period struct {
+		point     HistoryPoint
+		latency   *Sketch
+		instances map[string]bool
+	}
+	periods := map[time.Time]*period{}
+	for rows.Next() {
+		var ts, instance string
+		var queryTime float64
+		var rowsExamined int64
+		if err := rows.Scan(&ts, &queryTime, &rowsExamined, &instance); err != nil {
+			return nil, err
+		}
+		t, err := time.Parse(warehouseTimeFormat, ts)
+		if err != nil {
+			return nil, err
+		}
+
+		start := periodStart(t, opts.Period)
+		if first.IsZero() {
+			first = start
+		}
+		p, ok := periods[start]
+		if !ok {
+			p = &period{point: HistoryPoint{Start: start}, latency: NewSketch(), instances: map[string]bool{}}
+			periods[start] = p
+		}
+		p.point.Count++
+		p.point.QueryTime += queryTime
+		p.point.MaxQueryTime = math.Max(p.point.MaxQueryTime, queryTime)
+		p.point.RowsExamined += rowsExamined
+		p.latency.Add(queryTime)
+		p.instances[instance] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// エントリのない期間も0件として並べる
+	if first.IsZero() {
+		return h, nil
+	}
+	for start := first; !start.After(last); start = nextPeriod(start, opts.Period, 1) {
+		p, ok := periods[start]
+		if !ok {
+			h.Points = append(h.Points, HistoryPoint{Start: start})
+			continue
+		}
+		p.point.AvgQueryTime = p.point.QueryTime / float64(p.point.Count)
+		p.point.P95QueryTime = p.latency.Quantile(0.95)
+		p.point.Instances = len(p.instances)
+		h.Points = append(h.Points, p.point)
+	}
+	return h, nil
+}
+
+// historyDateFormat は期間の開始日の形式です
+func historyDateFormat(period string) string {
+	if period == "month" {
+		return "2006-01"
+	}
+	return "2006-01-02"
+}
+
+// WriteHistory はクエリの推移を形式に応じて書き出します
+func WriteHistory(w io.Writer, h *History, format string) error {
+	switch format {
+	case "csv":
+		return WriteHistoryCSV(w, h)
+	case "json":
+		return WriteHistoryJSON(w, h)
+	case "", "text":
+		return WriteHistoryText(w, h)
+	default:
+		return fmt.Errorf("Unsupported format: %s. Use 'text', 'csv' or 'json'", format)
+	}
+}
+
+// WriteHistoryText はクエリの推移を期間ごとの表とスパークラインで書き出します
+func WriteHistoryText(w io.Writer, h *History) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Query ID %s\n", h.QueryID)
+	fmt.Fprintf(&b, "# Fingerprint: %s\n", h.Fingerprint)
+	if len(h.Points) == 0 {
+		b.WriteString("# No entries with timestamp\n")
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	var peak float64
+	for _, p := range h.Points {
+		peak = math.Max(peak, p.QueryTime)
+	}
+	line := make([]rune, len(h.Points))
+	for i, p := range h.Points {
+		line[i] = sparkRune(p.QueryTime, peak)
+	}
+	dateFormat := historyDateFormat(h.Period)
+	fmt.Fprintf(&b, "# %s to %s by %s, total query time %s\n\n",
+		h.Points[0].Start.Format(dateFormat), h.Points[len(h.Points)-1].Start.Format(dateFormat), h.Period, string(line))
+
+	fmt.Fprintf(&b, "%-10s %7s %12s %10s %10s %10s %14s %9s\n",
+		h.Period, "Calls", "Total", "Avg", "p95", "Max", "Rows_examined", "Instances")
+	for _, p := range h.Points {
+		fmt.Fprintf(&b, "%-10s %7d %12s %10s %10s %10s %14d %9d\n",
+			p.Start.Format(dateFormat), p.Count, formatSeconds(p.QueryTime), formatSeconds(p.AvgQueryTime),
+			formatSeconds(p.P95QueryTime), formatSeconds(p.MaxQueryTime), p.RowsExamined, p.Instances)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteHistoryCSV はクエリの推移を期間ごとに1行のCSVで書き出します
+func WriteHistoryCSV(w io.Writer, h *History) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"start", "query_id", "count", "query_time", "avg_query_time", "p95_query_time", "max_query_time", "rows_examined", "instances"}); err != nil {
+		return err
+	}
+	for _, p := range h.Points {
+		if err := cw.Write([]string{
+			p.Start.Format(historyDateFormat(h.Period)),
+			h.QueryID,
+			strconv.FormatInt(p.Count, 10),
+			strconv.FormatFloat(p.QueryTime, 'f', -1, 64),
+			strconv.FormatFloat(p.AvgQueryTime, 'f', -1, 64),
+			strconv.FormatFloat(p.P95QueryTime, 'f', -1, 64),
+			strconv.FormatFloat(p.MaxQueryTime, 'f', -1, 64),
+			strconv.FormatInt(p.RowsExamined, 10),
+			strconv.Itoa(p.Instances),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteHistoryJSON はクエリの推移をJSON形式で書き出します
+func WriteHistoryJSON(w io.Writer, h *History) error {
+	if h.Points == nil {
+		h.Points = []HistoryPoint{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(h)
+}
@@ -0,0 +1,335 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestWarehouse はテスト用のウェアハウスにレコードを取り込みます
+func openTestWarehouse(t *testing.T, records ...Record) (*Warehouse, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "warehouse.db")
+	w, err := OpenWarehouse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+
+	imp, err := w.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range records {
+		if err := imp.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := imp.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return w, path
+}
+
+// queryCount は SQL の結果の1つ目の列を数値で返します
+func queryCount(t *testing.T, w *Warehouse, query string) int {
+	t.Helper()
+	var n int
+	if err := w.db.QueryRow(query).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestWarehouseImport(t *testing.T) {
+	rotated := newTestRecord("db-1", "SELECT * FROM users WHERE id = 1", 1.0, 1, 100, 1683721815)
+	rotated.Source = "slow.log.1"
+	w, _ := openTestWarehouse(t,
+		newTestRecord("db-1", "SELECT * FROM users WHERE id = 1", 1.0, 1, 100, 1683721815),
+		newTestRecord("db-1", "SELECT * FROM users WHERE id = 2", 3.0, 1, 300, 1684326615),
+		newTestRecord("db-2", "DELETE FROM sessions", 2.0, 0, 50, 1683721900),
+	)
+
+	// ローテーションで別のファイルになった同じエントリは重複させない
+	imp, err := w.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []Record{rotated, newTestRecord("db-1", "SELECT * FROM users WHERE id = 3", 2.0, 1, 200, 1684326700)} {
+		if err := imp.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := imp.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if imp.Inserted != 1 || imp.Duplicates != 1 {
+		t.Errorf("Inserted = %d, Duplicates = %d, want 1, 1", imp.Inserted, imp.Duplicates)
+	}
+
+	testCases := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{name: "エントリ", query: "SELECT count(*) FROM entries", want: 4},
+		{name: "インスタンス", query: "SELECT count(*) FROM instances", want: 2},
+		{name: "ファイル", query: "SELECT count(*) FROM source_files", want: 3},
+		{name: "フィンガープリント", query: "SELECT count(*) FROM fingerprints", want: 2},
+		{name: "フィンガープリントの期間", query: "SELECT count(*) FROM fingerprints WHERE first_seen = '2023-05-10 12:30:15.000000' AND last_seen = '2023-05-17 12:31:40.000000'", want: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := queryCount(t, w, tc.query); got != tc.want {
+				t.Errorf("%s = %d, want %d", tc.query, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWarehouseQuery(t *testing.T) {
+	_, path := openTestWarehouse(t,
+		newTestRecord("db-1", "SELECT * FROM users WHERE id = 1", 1.5, 1, 100, 1683721815),
+		newTestRecord("db-2", "DELETE FROM sessions", 2.0, 0, 50, 1683721900),
+	)
+	w, err := OpenWarehouseReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	query := "SELECT i.name, e.query_time, e.db FROM entries e JOIN instances i ON i.id = e.instance_id ORDER BY i.name"
+	testCases := []struct {
+		name    string
+		query   string
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "テキスト",
+			query:  query,
+			format: "text",
+			want:   "name  query_time  db\ndb-1  1.5         production\ndb-2  2           production\n(2 rows)\n",
+		},
+		{
+			name:   "CSV",
+			query:  query,
+			format: "csv",
+			want:   "name,query_time,db\ndb-1,1.5,production\ndb-2,2,production\n",
+		},
+		{
+			name:   "NULL",
+			query:  "SELECT NULL AS empty, 1 AS one",
+			format: "csv",
+			want:   "empty,one\n,1\n",
+		},
+		{name: "書き込みはできない", query: "DELETE FROM entries", format: "text", wantErr: true},
+		{name: "不正な SQL", query: "SELECT FROM", format: "text", wantErr: true},
+		{name: "不正な形式", query: query, format: "html", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := w.Query(context.Background(), &buf, tc.query, tc.format)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Query() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && buf.String() != tc.want {
+				t.Errorf("Query() = %q, want %q", buf.String(), tc.want)
+			}
+		})
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := w.Query(context.Background(), &buf, query, "json"); err != nil {
+			t.Fatal(err)
+		}
+		var rows []map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 2 || rows[0]["name"] != "db-1" || rows[1]["query_time"] != 2.0 {
+			t.Errorf("Query() = %s", buf.String())
+		}
+	})
+}
+
+func TestOpenWarehouseReadOnly(t *testing.T) {
+	if _, err := OpenWarehouseReadOnly(filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Error("OpenWarehouseReadOnly() should return error for a missing file")
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	// 2024-05-01 は水曜日
+	at := time.Date(2024, 5, 1, 15, 4, 5, 0, time.UTC)
+	testCases := []struct {
+		period string
+		want   time.Time
+	}{
+		{period: "day", want: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{period: "week", want: time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC)},
+		{period: "month", want: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.period, func(t *testing.T) {
+			if got := periodStart(at, tc.period); !got.Equal(tc.want) {
+				t.Errorf("periodStart() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	// 日曜日はその週の月曜日から始まる
+	if got := periodStart(time.Date(2024, 5, 5, 23, 0, 0, 0, time.UTC), "week"); !got.Equal(time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("periodStart() = %v, want 2024-04-29", got)
+	}
+}
+
+func TestWarehouseHistory(t *testing.T) {
+	week := int64(7 * 24 * 60 * 60)
+	start := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC).Unix() // 月曜日
+	w, _ := openTestWarehouse(t,
+		newTestRecord("db-1", "SELECT * FROM users WHERE id = 1", 1.0, 1, 100, start),
+		newTestRecord("db-2", "SELECT * FROM users WHERE id = 2", 3.0, 1, 300, start+60),
+		newTestRecord("db-1", "SELECT * FROM users WHERE id = 3", 2.0, 1, 200, start+2*week),
+		newTestRecord("db-1", "DELETE FROM sessions", 5.0, 0, 50, start),
+	)
+	id := FingerprintID(Fingerprint("SELECT * FROM users WHERE id = 1"))
+	now := time.Unix(start+3*week, 0)
+
+	testCases := []struct {
+		name    string
+		queryID string
+		opts    HistoryOptions
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "週ごと",
+			queryID: id,
+			opts:    HistoryOptions{Period: "week", Now: now},
+			want:    []string{"2024-04-01 2 4 3 db=2", "2024-04-08 0 0 0 db=0", "2024-04-15 1 2 2 db=1", "2024-04-22 0 0 0 db=0"},
+		},
+		{
+			name:    "前方一致と期間の数",
+			queryID: strings.ToLower(id[:6]),
+			opts:    HistoryOptions{Period: "week", Periods: 2, Now: now},
+			want:    []string{"2024-04-15 1 2 2 db=1", "2024-04-22 0 0 0 db=0"},
+		},
+		{
+			name:    "インスタンス",
+			queryID: id,
+			opts:    HistoryOptions{Period: "month", Instance: "db-2", Now: now},
+			want:    []string{"2024-04-01 1 3 3 db=1"},
+		},
+		{name: "存在しないクエリ ID", queryID: "FFFFFFFFFFFFFFFF", opts: HistoryOptions{Now: now}, wantErr: true},
+		{name: "不正な期間", queryID: id, opts: HistoryOptions{Period: "year", Now: now}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := w.History(context.Background(), tc.queryID, tc.opts)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("History() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if h.QueryID != id || h.Fingerprint != "select * from users where id = ?" {
+				t.Errorf("History() = %s %s", h.QueryID, h.Fingerprint)
+			}
+
+			var got []string
+			for _, p := range h.Points {
+				got = append(got, p.Start.Format("2006-01-02")+" "+
+					strings.Join([]string{formatQueryValue(float64(p.Count)), formatQueryValue(p.QueryTime), formatQueryValue(p.MaxQueryTime)}, " ")+
+					" db="+formatQueryValue(float64(p.Instances)))
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("History() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteHistory(t *testing.T) {
+	h := &History{
+		QueryID:     "7DA3D56C6C7BA0E5",
+		Fingerprint: "select * from users where id = ?",
+		Period:      "week",
+		Points: []HistoryPoint{
+			{Start: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), Count: 2, QueryTime: 4, AvgQueryTime: 2, P95QueryTime: 3, MaxQueryTime: 3, RowsExamined: 400, Instances: 2},
+			{Start: time.Date(2024, 4, 8, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	testCases := []struct {
+		format  string
+		want    []string
+		wantErr bool
+	}{
+		{format: "text", want: []string{"# Query ID 7DA3D56C6C7BA0E5\n", "2024-04-01 to 2024-04-08 by week, total query time █ \n", "2024-04-01       2       4.000s     2.000s     3.000s     3.000s            400         2\n"}},
+		{format: "csv", want: []string{"start,query_id,count,", "2024-04-01,7DA3D56C6C7BA0E5,2,4,2,3,3,400,2\n2024-04-08,7DA3D56C6C7BA0E5,0,0,0,0,0,0,0\n"}},
+		{format: "json", want: []string{`"query_id": "7DA3D56C6C7BA0E5"`, `"start": "2024-04-08T00:00:00Z"`}},
+		{format: "html", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := WriteHistory(&buf, h, tc.format)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("WriteHistory() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("WriteHistory() = %s, want to contain %q", buf.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadWarehouse(t *testing.T) {
+	logDir := t.TempDir()
+	if err := GenerateTestLogs(logDir); err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+	path := filepath.Join(outDir, "warehouse.db")
+	target := Target{
+		Name:      "local",
+		Provider:  "local",
+		Path:      filepath.Join(logDir, "*"),
+		Output:    filepath.Join(outDir, "{{.Instance}}.log"),
+		Format:    "slowlog",
+		Warehouse: path,
+	}
+
+	// 同じログを2回ダウンロードしてもエントリは増えない
+	for i := 0; i < 2; i++ {
+		if err := Download(context.Background(), NewLogger("error"), target, nil); err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+	}
+
+	w, err := OpenWarehouseReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if got := queryCount(t, w, "SELECT count(*) FROM entries"); got != 24 {
+		t.Errorf("entries = %d, want 24", got)
+	}
+	if got := queryCount(t, w, "SELECT count(*) FROM fingerprints"); got != 8 {
+		t.Errorf("fingerprints = %d, want 8", got)
+	}
+}
@@ -0,0 +1,121 @@
+// Package parser はMySQLのスロークエリログを構造化されたエントリに変換します
+package parser
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry はスロークエリログの1エントリです
+type Entry struct {
+	Time         time.Time
+	User         string
+	Host         string
+	IP           string
+	ThreadID     int64
+	QueryTime    float64
+	LockTime     float64
+	RowsSent     int64
+	RowsExamined int64
+	DB           string
+	Timestamp    int64
+	Statement    string
+
+	// Extra は Query_time 行などに含まれる上記以外のフィールドです
+	// MySQL 8.0 の log_slow_extra や Percona Server の拡張フィールドが入ります
+	Extra map[string]string
+
+	// Comments はエントリの # で始まる行をそのまま保持します
+	Comments []string
+}
+
+// StartTime はクエリの実行開始時刻を返します
+// SET timestamp があればその値を、なければ # Time: の値を使います
+func (e *Entry) StartTime() time.Time {
+	if e.Timestamp != 0 {
+		return time.Unix(e.Timestamp, 0).UTC()
+	}
+	return e.Time
+}
+
+// WriteTo はエントリをスロークエリログの形式で書き出します
+func (e *Entry) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	if len(e.Comments) > 0 {
+		for _, line := range e.Comments {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	} else {
+		b.WriteString(e.header())
+	}
+
+	if e.DB != "" {
+		fmt.Fprintf(&b, "use %s;\n", e.DB)
+	}
+	if e.Timestamp != 0 {
+		fmt.Fprintf(&b, "SET timestamp=%d;\n", e.Timestamp)
+	}
+	b.WriteString(e.Statement)
+	if !strings.HasSuffix(e.Statement, ";") {
+		b.WriteByte(';')
+	}
+	b.WriteString("\n\n")
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// String はエントリをスロークエリログの形式で返します
+func (e *Entry) String() string {
+	var b strings.Builder
+	e.WriteTo(&b)
+	return b.String()
+}
+
+// header はフィールドの値から # で始まるヘッダー行を組み立てます
+func (e *Entry) header() string {
+	var b strings.Builder
+
+	if !e.Time.IsZero() {
+		fmt.Fprintf(&b, "# Time: %s\n", e.Time.UTC().Format("2006-01-02T15:04:05.000000Z"))
+	}
+	if e.User != "" || e.Host != "" || e.IP != "" {
+		fmt.Fprintf(&b, "# User@Host: %s[%s] @ %s [%s]", e.User, e.User, e.Host, e.IP)
+		if e.ThreadID != 0 {
+			fmt.Fprintf(&b, "  Id: %d", e.ThreadID)
+		}
+		b.WriteByte('\n')
+	}
+	fmt.Fprintf(&b, "# Query_time: %.6f  Lock_time: %.6f Rows_sent: %d  Rows_examined: %d",
+		e.QueryTime, e.LockTime, e.RowsSent, e.RowsExamined)
+
+	keys := make([]string, 0, len(e.Extra))
+	for k := range e.Extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s: %s", k, e.Extra[k])
+	}
+	b.WriteByte('\n')
+
+	return b.String()
+}
+
+// parseInt は数値に変換できない場合に0を返します
+func parseInt(s string) int64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// parseFloat は数値に変換できない場合に0を返します
+func parseFloat(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
@@ -0,0 +1,244 @@
+package parser
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// MySQL 5.7/8.0 とRDSの形式: # User@Host: app[app] @ localhost [127.0.0.1]  Id:    12
+	userHostPattern = regexp.MustCompile(`^# User@Host: (\S*?)\[([^\]]*)\]\s*@\s*([^\s\[]*)\s*\[([^\]]*)\](?:\s+Id:\s*(\d+))?`)
+	useDBPattern    = regexp.MustCompile(`(?i)^use\s+` + "`?" + `([^;` + "`" + `]+)` + "`?" + `;\s*$`)
+	timestampRegexp = regexp.MustCompile(`(?i)^SET\s+(?:.*,)?timestamp=(\d+)(?:,.*)?;\s*$`)
+
+	// サーバー起動時にファイルの先頭へ書き込まれる行
+	serverHeaderPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`^\S.*, Version: .*started with:$`),
+		regexp.MustCompile(`^Tcp port: \d+`),
+		regexp.MustCompile(`^Time\s+Id\s+Command\s+Argument$`),
+	}
+
+	timeLayouts = []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05.999999",
+		"2006-01-02 15:04:05",
+		"060102 15:04:05",
+	}
+)
+
+// Scanner はスロークエリログをエントリごとに読み込みます
+// ログ全体をメモリに読み込まずに処理できます
+type Scanner struct {
+	r     *bufio.Reader
+	cur   *Entry
+	stmt  []string
+	entry *Entry
+	err   error
+	done  bool
+}
+
+// NewScanner は r から読み込むScannerを生成します
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Scan は次のエントリを読み込みます。エントリがなくなるかエラーが発生するとfalseを返します
+func (s *Scanner) Scan() bool {
+	s.entry = nil
+	if s.done {
+		return false
+	}
+
+	for {
+		line, err := s.r.ReadString('\n')
+		if line != "" {
+			if e := s.feed(strings.TrimRight(line, "\r\n")); e != nil {
+				s.entry = e
+				return true
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+			s.done = true
+			s.entry = s.flush()
+			return s.entry != nil
+		}
+	}
+}
+
+// Entry は直前のScanで読み込んだエントリを返します
+func (s *Scanner) Entry() *Entry {
+	return s.entry
+}
+
+// Err は読み込み中に発生したエラーを返します
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Parse は r から全てのエントリを読み込みます
+func Parse(r io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+
+	scanner := NewScanner(r)
+	for scanner.Scan() {
+		entries = append(entries, scanner.Entry())
+	}
+	return entries, scanner.Err()
+}
+
+// ParseString は文字列から全てのエントリを読み込みます
+func ParseString(s string) ([]*Entry, error) {
+	return Parse(strings.NewReader(s))
+}
+
+// feed は1行を処理し、その行で完了したエントリがあれば返します
+func (s *Scanner) feed(line string) *Entry {
+	if isServerHeader(line) {
+		return s.flush()
+	}
+
+	if strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "# administrator command:") {
+		var done *Entry
+		if len(s.stmt) > 0 {
+			done = s.flush()
+		}
+		if s.cur == nil {
+			s.cur = &Entry{}
+		}
+		s.cur.parseComment(line)
+		return done
+	}
+
+	if s.cur == nil {
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
+		s.cur = &Entry{}
+	}
+
+	// ステートメントの前に書かれる use と SET timestamp を読み取る
+	if len(s.stmt) == 0 {
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
+		if m := useDBPattern.FindStringSubmatch(line); m != nil {
+			s.cur.DB = m[1]
+			return nil
+		}
+		if m := timestampRegexp.FindStringSubmatch(line); m != nil {
+			s.cur.Timestamp = parseInt(m[1])
+			return nil
+		}
+	}
+
+	s.stmt = append(s.stmt, line)
+	return nil
+}
+
+// flush は読み込み中のエントリを完了させて返します
+// ステートメントを持たないエントリは捨てます
+func (s *Scanner) flush() *Entry {
+	e := s.cur
+	stmt := strings.TrimRight(strings.Join(s.stmt, "\n"), " \t\n")
+	s.cur = nil
+	s.stmt = nil
+
+	if e == nil || stmt == "" {
+		return nil
+	}
+
+	e.Statement = strings.TrimSuffix(stmt, ";")
+	return e
+}
+
+func isServerHeader(line string) bool {
+	for _, p := range serverHeaderPatterns {
+		if p.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseComment は # で始まるヘッダー行をエントリに反映します
+func (e *Entry) parseComment(line string) {
+	e.Comments = append(e.Comments, line)
+
+	switch {
+	case strings.HasPrefix(line, "# Time:"):
+		e.Time = parseTime(strings.TrimSpace(strings.TrimPrefix(line, "# Time:")))
+		return
+	case strings.HasPrefix(line, "# User@Host:"):
+		if m := userHostPattern.FindStringSubmatch(line); m != nil {
+			e.User = m[1]
+			if e.User == "" {
+				e.User = m[2]
+			}
+			e.Host = m[3]
+			e.IP = m[4]
+			if m[5] != "" {
+				e.ThreadID = parseInt(m[5])
+			}
+		}
+		return
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(line, "#"))
+	for i := 0; i < len(fields); i++ {
+		if !strings.HasSuffix(fields[i], ":") {
+			continue
+		}
+		key := strings.TrimSuffix(fields[i], ":")
+		value := ""
+		if i+1 < len(fields) && !strings.HasSuffix(fields[i+1], ":") {
+			value = fields[i+1]
+			i++
+		}
+		e.setField(key, value)
+	}
+}
+
+// setField はヘッダーのキーと値をエントリに設定します
+func (e *Entry) setField(key, value string) {
+	switch key {
+	case "Query_time":
+		e.QueryTime = parseFloat(value)
+	case "Lock_time":
+		e.LockTime = parseFloat(value)
+	case "Rows_sent":
+		e.RowsSent = parseInt(value)
+	case "Rows_examined":
+		e.RowsExamined = parseInt(value)
+	case "Thread_id", "Thd_id", "Id":
+		if e.ThreadID == 0 {
+			e.ThreadID = parseInt(value)
+		}
+	case "Schema":
+		if e.DB == "" {
+			e.DB = value
+		}
+	default:
+		if e.Extra == nil {
+			e.Extra = map[string]string{}
+		}
+		e.Extra[key] = value
+	}
+}
+
+// parseTime は # Time: の値を解析します。解析できない場合はゼロ値を返します
+func parseTime(value string) time.Time {
+	value = strings.Join(strings.Fields(value), " ")
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
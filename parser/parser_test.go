@@ -0,0 +1,307 @@
+package parser
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mysql57Log = `/usr/sbin/mysqld, Version: 5.7.42-log (MySQL Community Server (GPL)). started with:
+Tcp port: 3306  Unix socket: /var/run/mysqld/mysqld.sock
+Time                 Id Command    Argument
+# Time: 2023-05-10T12:30:15.123456Z
+# User@Host: app[app] @ app-1.example.com [10.0.1.10]  Id:    42
+# Query_time: 2.500000  Lock_time: 0.000100 Rows_sent: 1  Rows_examined: 100000
+use production;
+SET timestamp=1683721815;
+SELECT *
+FROM users
+WHERE email = 'a@example.com';
+# Time: 2023-05-10T12:30:16.000000Z
+# User@Host: root[root] @ localhost []  Id:    43
+# Query_time: 0.000020  Lock_time: 0.000000 Rows_sent: 0  Rows_examined: 0
+SET timestamp=1683721816;
+# administrator command: Quit;
+`
+
+const mysql80ExtraLog = `# Time: 2023-05-10T12:30:15.123456+09:00
+# User@Host: web[web] @  [10.0.1.11]  Id:     8
+# Query_time: 1.250000  Lock_time: 0.000002 Rows_sent: 1  Rows_examined: 1 Thread_id: 8 Errno: 0 Killed: 0 Bytes_received: 0 Bytes_sent: 56 Read_first: 0 Start: 2023-05-10T12:30:13.873456+09:00 End: 2023-05-10T12:30:15.123456+09:00
+SET timestamp=1683689413;
+SELECT COUNT(*) FROM orders;
+`
+
+const rdsMySQL56Log = `/rdsdbbin/mysql/bin/mysqld, Version: 5.6.51-log (Source distribution). started with:
+Tcp port: 3306  Unix socket: /tmp/mysql.sock
+Time                 Id Command    Argument
+# Time: 230510  2:30:15
+# User@Host: rdsadmin[rdsadmin] @ localhost [127.0.0.1]  Id:     1
+# Query_time: 3.000000  Lock_time: 0.000000 Rows_sent: 1  Rows_examined: 0
+SET timestamp=1683685815;
+SELECT 1;
+# User@Host: batch[batch] @  [10.0.1.12]  Id:     2
+# Query_time: 4.000000  Lock_time: 1.000000 Rows_sent: 0  Rows_examined: 500
+SET timestamp=1683685816;
+UPDATE jobs SET state = 'done' WHERE id = 7;
+`
+
+const perconaLog = `# Time: 2023-05-10T12:30:15.000000Z
+# User@Host: app[app] @ localhost []  Id: 12
+# Schema: inventory  Last_errno: 0  Killed: 0
+# Query_time: 0.912345  Lock_time: 0.000123  Rows_sent: 120  Rows_examined: 250000  Rows_affected: 0  Bytes_sent: 4096
+# QC_Hit: No  Full_scan: Yes  Full_join: No  Tmp_table: No  Tmp_table_on_disk: No
+SET timestamp=1683721815;
+SELECT * FROM products WHERE stock < 10;
+`
+
+func TestParseGeneratedLog(t *testing.T) {
+	file, err := os.Open("../testdata/aws-slowquery.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	entries, err := Parse(file)
+	if err != nil {
+		t.Fatalf("Parse() returned error: %v", err)
+	}
+	if len(entries) != 8 {
+		t.Fatalf("Parse() returned %d entries, want 8", len(entries))
+	}
+
+	e := entries[0]
+	expected := &Entry{
+		Time:         time.Date(2023, 5, 10, 12, 30, 15, 0, time.UTC),
+		User:         "app",
+		IP:           "10.0.1.10",
+		QueryTime:    2.5,
+		LockTime:     0.01,
+		RowsSent:     100,
+		RowsExamined: 1000000,
+		DB:           "production",
+		Timestamp:    1683721815,
+		Statement:    "SELECT * FROM users WHERE id > 1000 AND last_login > '2023-01-01' ORDER BY created_at DESC LIMIT 100",
+		Comments:     e.Comments,
+	}
+	if !reflect.DeepEqual(e, expected) {
+		t.Errorf("Parse()[0] = %+v, want %+v", e, expected)
+	}
+	if len(e.Comments) != 3 {
+		t.Errorf("Parse()[0].Comments = %v, want 3 lines", e.Comments)
+	}
+
+	if entries[7].DB != "audit" || !strings.HasPrefix(entries[7].Statement, "INSERT INTO audit_logs") {
+		t.Errorf("Parse()[7] = %+v", entries[7])
+	}
+}
+
+func TestParseVariants(t *testing.T) {
+	testCases := []struct {
+		name     string
+		log      string
+		expected []Entry
+	}{
+		{
+			name: "MySQL 5.7",
+			log:  mysql57Log,
+			expected: []Entry{
+				{
+					Time:         time.Date(2023, 5, 10, 12, 30, 15, 123456000, time.UTC),
+					User:         "app",
+					Host:         "app-1.example.com",
+					IP:           "10.0.1.10",
+					ThreadID:     42,
+					QueryTime:    2.5,
+					LockTime:     0.0001,
+					RowsSent:     1,
+					RowsExamined: 100000,
+					DB:           "production",
+					Timestamp:    1683721815,
+					Statement:    "SELECT *\nFROM users\nWHERE email = 'a@example.com'",
+				},
+				{
+					Time:      time.Date(2023, 5, 10, 12, 30, 16, 0, time.UTC),
+					User:      "root",
+					Host:      "localhost",
+					ThreadID:  43,
+					QueryTime: 0.00002,
+					Timestamp: 1683721816,
+					Statement: "# administrator command: Quit",
+				},
+			},
+		},
+		{
+			name: "MySQL 8.0 log_slow_extra",
+			log:  mysql80ExtraLog,
+			expected: []Entry{
+				{
+					Time:         time.Date(2023, 5, 10, 12, 30, 15, 123456000, time.FixedZone("", 9*60*60)),
+					User:         "web",
+					IP:           "10.0.1.11",
+					ThreadID:     8,
+					QueryTime:    1.25,
+					LockTime:     0.000002,
+					RowsSent:     1,
+					RowsExamined: 1,
+					Timestamp:    1683689413,
+					Statement:    "SELECT COUNT(*) FROM orders",
+					Extra: map[string]string{
+						"Errno":          "0",
+						"Killed":         "0",
+						"Bytes_received": "0",
+						"Bytes_sent":     "56",
+						"Read_first":     "0",
+						"Start":          "2023-05-10T12:30:13.873456+09:00",
+						"End":            "2023-05-10T12:30:15.123456+09:00",
+					},
+				},
+			},
+		},
+		{
+			name: "RDS for MySQL 5.6",
+			log:  rdsMySQL56Log,
+			expected: []Entry{
+				{
+					Time:      time.Date(2023, 5, 10, 2, 30, 15, 0, time.UTC),
+					User:      "rdsadmin",
+					Host:      "localhost",
+					IP:        "127.0.0.1",
+					ThreadID:  1,
+					QueryTime: 3,
+					RowsSent:  1,
+					Timestamp: 1683685815,
+					Statement: "SELECT 1",
+				},
+				{
+					User:         "batch",
+					IP:           "10.0.1.12",
+					ThreadID:     2,
+					QueryTime:    4,
+					LockTime:     1,
+					RowsExamined: 500,
+					Timestamp:    1683685816,
+					Statement:    "UPDATE jobs SET state = 'done' WHERE id = 7",
+				},
+			},
+		},
+		{
+			name: "Percona Server",
+			log:  perconaLog,
+			expected: []Entry{
+				{
+					Time:         time.Date(2023, 5, 10, 12, 30, 15, 0, time.UTC),
+					User:         "app",
+					Host:         "localhost",
+					ThreadID:     12,
+					QueryTime:    0.912345,
+					LockTime:     0.000123,
+					RowsSent:     120,
+					RowsExamined: 250000,
+					DB:           "inventory",
+					Timestamp:    1683721815,
+					Statement:    "SELECT * FROM products WHERE stock < 10",
+					Extra: map[string]string{
+						"Last_errno":        "0",
+						"Killed":            "0",
+						"Rows_affected":     "0",
+						"Bytes_sent":        "4096",
+						"QC_Hit":            "No",
+						"Full_scan":         "Yes",
+						"Full_join":         "No",
+						"Tmp_table":         "No",
+						"Tmp_table_on_disk": "No",
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := ParseString(tc.log)
+			if err != nil {
+				t.Fatalf("ParseString() returned error: %v", err)
+			}
+			if len(entries) != len(tc.expected) {
+				t.Fatalf("ParseString() returned %d entries, want %d", len(entries), len(tc.expected))
+			}
+
+			for i, e := range entries {
+				want := tc.expected[i]
+				want.Comments = e.Comments
+				if !e.Time.Equal(want.Time) {
+					t.Errorf("entry[%d].Time = %v, want %v", i, e.Time, want.Time)
+				}
+				want.Time = e.Time
+				if !reflect.DeepEqual(*e, want) {
+					t.Errorf("entry[%d] = %+v, want %+v", i, *e, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEntryRoundTrip(t *testing.T) {
+	for _, log := range []string{mysql57Log, mysql80ExtraLog, rdsMySQL56Log, perconaLog} {
+		entries, err := ParseString(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b strings.Builder
+		for _, e := range entries {
+			if _, err := e.WriteTo(&b); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		again, err := ParseString(b.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(again) != len(entries) {
+			t.Fatalf("round trip returned %d entries, want %d", len(again), len(entries))
+		}
+		for i := range entries {
+			if entries[i].DB == "" {
+				again[i].DB = ""
+			}
+			if !reflect.DeepEqual(entries[i], again[i]) {
+				t.Errorf("round trip entry[%d] = %+v, want %+v", i, again[i], entries[i])
+			}
+		}
+	}
+}
+
+func TestEntryStringWithoutComments(t *testing.T) {
+	e := &Entry{
+		Time:         time.Date(2023, 5, 10, 12, 30, 15, 0, time.UTC),
+		User:         "app",
+		IP:           "10.0.1.10",
+		QueryTime:    2.5,
+		LockTime:     0.01,
+		RowsSent:     100,
+		RowsExamined: 1000000,
+		DB:           "production",
+		Timestamp:    1683721815,
+		Statement:    "SELECT 1",
+	}
+
+	expected := `# Time: 2023-05-10T12:30:15.000000Z
+# User@Host: app[app] @  [10.0.1.10]
+# Query_time: 2.500000  Lock_time: 0.010000 Rows_sent: 100  Rows_examined: 1000000
+use production;
+SET timestamp=1683721815;
+SELECT 1;
+
+`
+	if got := e.String(); got != expected {
+		t.Errorf("String() = %q, want %q", got, expected)
+	}
+
+	if got := e.StartTime(); !got.Equal(time.Unix(1683721815, 0)) {
+		t.Errorf("StartTime() = %v", got)
+	}
+}